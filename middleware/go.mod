@@ -1,3 +1,5 @@
 module cliproxy-middleware
 
 go 1.25.5
+
+require golang.org/x/image v0.25.0
@@ -0,0 +1,190 @@
+package apierror
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Protocol identifies the API dialect a client is speaking
+type Protocol int
+
+const (
+	Anthropic Protocol = iota
+	OpenAI
+)
+
+// ProtocolFor picks the error dialect from the endpoint that was called
+func ProtocolFor(r *http.Request) Protocol {
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/v1/chat/") ||
+		strings.HasPrefix(path, "/v1/completions") ||
+		strings.HasPrefix(path, "/v1/embeddings") {
+		return OpenAI
+	}
+	return Anthropic
+}
+
+// Error types, named after the Anthropic error types
+const (
+	TypeInvalidRequest  = "invalid_request_error"
+	TypeAuthentication  = "authentication_error"
+	TypePermission      = "permission_error"
+	TypeNotFound        = "not_found_error"
+	TypeRequestTooLarge = "request_too_large"
+	TypeRateLimit       = "rate_limit_error"
+	TypeAPI             = "api_error"
+	TypeOverloaded      = "overloaded_error"
+)
+
+// openAIKinds maps an error type to the OpenAI type and code fields
+var openAIKinds = map[string]struct{ typ, code string }{
+	TypeInvalidRequest:  {"invalid_request_error", ""},
+	TypeAuthentication:  {"invalid_request_error", "invalid_api_key"},
+	TypePermission:      {"invalid_request_error", "permission_denied"},
+	TypeNotFound:        {"invalid_request_error", "not_found"},
+	TypeRequestTooLarge: {"invalid_request_error", "request_too_large"},
+	TypeRateLimit:       {"rate_limit_error", "rate_limit_exceeded"},
+	TypeAPI:             {"server_error", ""},
+	TypeOverloaded:      {"overloaded_error", "overloaded"},
+}
+
+// Error is an API error that can be rendered for either protocol
+type Error struct {
+	Status     int
+	Type       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// New creates an error with an explicit status and type
+func New(status int, typ, message string) *Error {
+	return &Error{Status: status, Type: typ, Message: message}
+}
+
+// InvalidRequest is a 400 invalid_request_error
+func InvalidRequest(message string) *Error {
+	return New(http.StatusBadRequest, TypeInvalidRequest, message)
+}
+
+// Authentication is a 401 authentication_error
+func Authentication(message string) *Error {
+	return New(http.StatusUnauthorized, TypeAuthentication, message)
+}
+
+// Permission is a 403 permission_error
+func Permission(message string) *Error {
+	return New(http.StatusForbidden, TypePermission, message)
+}
+
+// NotFound is a 404 not_found_error
+func NotFound(message string) *Error {
+	return New(http.StatusNotFound, TypeNotFound, message)
+}
+
+// MethodNotAllowed is a 405 invalid_request_error
+func MethodNotAllowed() *Error {
+	return New(http.StatusMethodNotAllowed, TypeInvalidRequest, "Method not allowed")
+}
+
+// RateLimit is a 429 rate_limit_error with a retry hint
+func RateLimit(message string, retryAfter time.Duration) *Error {
+	e := New(http.StatusTooManyRequests, TypeRateLimit, message)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+// Overloaded is an overloaded_error with a retry hint.
+// The status is 529 for Anthropic clients and 503 for OpenAI clients.
+func Overloaded(message string, retryAfter time.Duration) *Error {
+	e := New(529, TypeOverloaded, message)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+// Upstream is an api_error for failures talking to upstream (502, 504, ...)
+func Upstream(status int, message string) *Error {
+	return New(status, TypeAPI, message)
+}
+
+// StatusFor returns the HTTP status to send for the given protocol
+func (e *Error) StatusFor(p Protocol) int {
+	if p == OpenAI && e.Status == 529 {
+		return http.StatusServiceUnavailable
+	}
+	return e.Status
+}
+
+type anthropicBody struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type openAIBody struct {
+	Error struct {
+		Message string  `json:"message"`
+		Type    string  `json:"type"`
+		Param   *string `json:"param"`
+		Code    *string `json:"code"`
+	} `json:"error"`
+}
+
+// Body renders the JSON error envelope for the given protocol
+func (e *Error) Body(p Protocol) []byte {
+	var body []byte
+	if p == OpenAI {
+		kind, ok := openAIKinds[e.Type]
+		if !ok {
+			kind.typ = e.Type
+		}
+		var v openAIBody
+		v.Error.Message = e.Message
+		v.Error.Type = kind.typ
+		if kind.code != "" {
+			v.Error.Code = &kind.code
+		}
+		body, _ = json.Marshal(v)
+	} else {
+		var v anthropicBody
+		v.Type = "error"
+		v.Error.Type = e.Type
+		v.Error.Message = e.Message
+		body, _ = json.Marshal(v)
+	}
+	return body
+}
+
+// SSE renders the error as the last event of a failed stream: an
+// "event: error" frame for Anthropic clients and a data chunk holding the
+// error object for OpenAI clients, which ignore event names
+func (e *Error) SSE(p Protocol) []byte {
+	if p == OpenAI {
+		return []byte("data: " + string(e.Body(p)) + "\n\n")
+	}
+	return []byte("event: error\ndata: " + string(e.Body(p)) + "\n\n")
+}
+
+// Write sends the error as a JSON response in the dialect of the called endpoint
+func Write(w http.ResponseWriter, r *http.Request, e *Error) {
+	WriteProtocol(w, ProtocolFor(r), e)
+}
+
+// WriteProtocol sends the error as a JSON response for an explicit protocol
+func WriteProtocol(w http.ResponseWriter, p Protocol, e *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+	w.WriteHeader(e.StatusFor(p))
+	w.Write(e.Body(p))
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes a key can be granted
+const (
+	ScopeMessages    = "messages"     // /v1/messages
+	ScopeChat        = "chat"         // /v1/chat/completions
+	ScopeCountTokens = "count_tokens" // /v1/messages/count_tokens
+	ScopeProxy       = "proxy"        // other routes passed through to upstream
+	ScopeAdmin       = "admin"        // /usage and other management endpoints
+	ScopeAll         = "*"
+)
+
+// Key is a client API key accepted by the middleware
+type Key struct {
+	Name      string    `json:"name"`
+	Key       string    `json:"key,omitempty"`
+	KeySHA256 string    `json:"key_sha256,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	Expires   time.Time `json:"expires,omitempty"`
+}
+
+// keysFile is the on-disk format of the keys file
+type keysFile struct {
+	Keys []Key `json:"keys"`
+}
+
+// Allows reports whether the key grants scope. A key without scopes may use
+// the API endpoints but not admin ones.
+func (k *Key) Allows(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return scope != ScopeAdmin
+	}
+	for _, s := range k.Scopes {
+		if s == ScopeAll || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the key is past its expiry
+func (k *Key) Expired() bool {
+	return !k.Expires.IsZero() && time.Now().After(k.Expires)
+}
+
+// Store holds the accepted keys, indexed by SHA-256 so presented keys are
+// never compared as plain strings. The keys file is reloaded when it changes,
+// so keys can be added or revoked without a restart.
+type Store struct {
+	path string
+
+	mu       sync.RWMutex
+	keys     map[string]*Key
+	modTime  time.Time
+	checked  time.Time
+	interval time.Duration
+}
+
+// Load reads the keys file at path. An empty path returns a nil store,
+// which disables authentication.
+func Load(path string) (*Store, error) {
+	if path == "" {
+		return nil, nil
+	}
+	s := &Store{path: path, interval: 5 * time.Second}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Enabled reports whether incoming keys are checked
+func (s *Store) Enabled() bool {
+	return s != nil
+}
+
+func (s *Store) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var file keysFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse %s: %w", s.path, err)
+	}
+
+	keys := make(map[string]*Key, len(file.Keys))
+	for i := range file.Keys {
+		k := &file.Keys[i]
+		digest := strings.ToLower(k.KeySHA256)
+		if k.Key != "" {
+			digest = hashKey(k.Key)
+		}
+		if k.Name == "" || digest == "" {
+			return fmt.Errorf("parse %s: key %d needs a name and a key or key_sha256", s.path, i)
+		}
+		k.Key = ""
+		keys[digest] = k
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.modTime = info.ModTime()
+	s.checked = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// refresh reloads the keys file if it changed since the last check
+func (s *Store) refresh() {
+	s.mu.RLock()
+	due := time.Since(s.checked) >= s.interval
+	modTime := s.modTime
+	s.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	info, err := os.Stat(s.path)
+	if err == nil && !info.ModTime().Equal(modTime) {
+		if err := s.reload(); err != nil {
+			log.Printf("⚠️  Failed to reload keys file, keeping previous keys: %v", err)
+		} else {
+			log.Printf("🔑 Reloaded keys file %s", s.path)
+		}
+	}
+	s.mu.Lock()
+	s.checked = time.Now()
+	s.mu.Unlock()
+}
+
+// Lookup returns the key matching the presented secret, or nil
+func (s *Store) Lookup(secret string) *Key {
+	if secret == "" {
+		return nil
+	}
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys[hashKey(secret)]
+}
+
+// Len returns the number of configured keys
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys)
+}
+
+// PresentedKey extracts the client key from x-api-key or a Bearer Authorization header
+func PresentedKey(r *http.Request) string {
+	if key := r.Header.Get("x-api-key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// Authenticate checks the request's key for scope. On success it returns the
+// key; otherwise it returns an error message and whether the failure is a
+// missing permission (as opposed to a missing or invalid key).
+func (s *Store) Authenticate(r *http.Request, scope string) (*Key, string, bool) {
+	secret := PresentedKey(r)
+	if secret == "" {
+		return nil, "Missing API key: send it in the x-api-key header or as a Bearer token", false
+	}
+	key := s.Lookup(secret)
+	if key == nil {
+		return nil, "Invalid API key", false
+	}
+	if key.Expired() {
+		return nil, fmt.Sprintf("API key %q expired on %s", key.Name, key.Expires.Format(time.RFC3339)), false
+	}
+	if !key.Allows(scope) {
+		return nil, fmt.Sprintf("API key %q does not have the %q scope", key.Name, scope), true
+	}
+	return key, "", false
+}
+
+// SetUpstreamKey replaces the client's credentials with the upstream key
+func SetUpstreamKey(r *http.Request, upstreamKey string) {
+	r.Header.Del("x-api-key")
+	r.Header.Del("Authorization")
+	if upstreamKey != "" {
+		r.Header.Set("Authorization", "Bearer "+upstreamKey)
+	}
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKeys(t *testing.T, path, keys string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeKeys(t, path, `{"keys":[
+		{"name":"default","key":"sk-default"},
+		{"name":"chat","key":"sk-chat","scopes":["chat"]},
+		{"name":"admin","key_sha256":"`+strings.ToUpper(hashKey("sk-admin"))+`","scopes":["*"]},
+		{"name":"expired","key":"sk-expired","expires":"2020-01-01T00:00:00Z"},
+		{"name":"current","key":"sk-current","expires":"2999-01-01T00:00:00Z"}
+	]}`, time.Now())
+	store, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, header, value, scope string
+		wantKey                    string
+		wantForbidden              bool
+	}{
+		{"no key", "", "", ScopeMessages, "", false},
+		{"unknown key", "x-api-key", "sk-other", ScopeMessages, "", false},
+		{"x-api-key", "x-api-key", "sk-default", ScopeMessages, "default", false},
+		{"bearer token", "Authorization", "bearer sk-default", ScopeProxy, "default", false},
+		{"no scopes means no admin", "x-api-key", "sk-default", ScopeAdmin, "", true},
+		{"scope granted", "x-api-key", "sk-chat", ScopeChat, "chat", false},
+		{"scope missing", "x-api-key", "sk-chat", ScopeMessages, "", true},
+		{"hashed key with all scopes", "x-api-key", "sk-admin", ScopeAdmin, "admin", false},
+		{"expired", "x-api-key", "sk-expired", ScopeMessages, "", false},
+		{"not yet expired", "x-api-key", "sk-current", ScopeMessages, "current", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+			if tc.header != "" {
+				r.Header.Set(tc.header, tc.value)
+			}
+			key, message, forbidden := store.Authenticate(r, tc.scope)
+			name := ""
+			if key != nil {
+				name = key.Name
+			}
+			if name != tc.wantKey || forbidden != tc.wantForbidden {
+				t.Fatalf("Authenticate = %q, %q, %v; want %q, forbidden %v", name, message, forbidden, tc.wantKey, tc.wantForbidden)
+			}
+			if key == nil && message == "" {
+				t.Fatal("rejected without a message")
+			}
+			if key != nil && key.Key != "" {
+				t.Fatal("plain key kept in memory")
+			}
+		})
+	}
+}
+
+func TestLoadRejectsIncompleteKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	for _, keys := range []string{`{"keys":[{"key":"sk-1"}]}`, `{"keys":[{"name":"a"}]}`, `{"keys":`} {
+		writeKeys(t, path, keys, time.Now())
+		if _, err := Load(path); err == nil {
+			t.Errorf("Load(%s) succeeded", keys)
+		}
+	}
+	if store, err := Load(""); store.Enabled() || err != nil {
+		t.Fatalf("Load without a path = %v, %v; want authentication disabled", store, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	start := time.Now().Add(-time.Hour)
+	writeKeys(t, path, `{"keys":[{"name":"old","key":"sk-old"}]}`, start)
+	store, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes are picked up once the check interval has passed
+	writeKeys(t, path, `{"keys":[{"name":"new","key":"sk-new"}]}`, start.Add(time.Minute))
+	if store.Lookup("sk-old") == nil || store.Lookup("sk-new") != nil {
+		t.Fatal("keys file reloaded before the check interval")
+	}
+	store.mu.Lock()
+	store.checked = time.Now().Add(-store.interval)
+	store.mu.Unlock()
+	if store.Lookup("sk-new") == nil || store.Lookup("sk-old") != nil {
+		t.Fatal("revoked or added key not reloaded")
+	}
+
+	// A broken file keeps the previous keys
+	writeKeys(t, path, `{"keys":[`, start.Add(2*time.Minute))
+	store.mu.Lock()
+	store.checked = time.Now().Add(-store.interval)
+	store.mu.Unlock()
+	if store.Lookup("sk-new") == nil {
+		t.Fatal("keys dropped after a failed reload")
+	}
+}
+
+func TestSetUpstreamKey(t *testing.T) {
+	for _, upstreamKey := range []string{"sk-upstream", ""} {
+		r := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		r.Header.Set("x-api-key", "sk-client")
+		r.Header.Add("Authorization", "Bearer sk-client")
+		r.Header.Add("Authorization", "Bearer sk-client-2")
+		SetUpstreamKey(r, upstreamKey)
+
+		for name, values := range r.Header {
+			for _, value := range values {
+				if strings.Contains(value, "sk-client") {
+					t.Fatalf("client key sent upstream in %s", name)
+				}
+			}
+		}
+		want := ""
+		if upstreamKey != "" {
+			want = "Bearer " + upstreamKey
+		}
+		if got := r.Header.Get("Authorization"); got != want || r.Header.Get("x-api-key") != "" {
+			t.Fatalf("Authorization = %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned when the breaker rejects a request without contacting upstream
+var ErrOpen = errors.New("circuit breaker open: upstream is failing")
+
+// State is the current breaker state
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker trips after a run of consecutive upstream failures and fast-fails
+// requests until a health probe reports upstream is reachable again.
+// While half-open a single trial request is let through; its outcome decides
+// whether the breaker closes or re-opens.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu          sync.Mutex
+	state       State
+	failures    int
+	openedAt    time.Time
+	trialActive bool
+	trips       int64
+	rejected    int64
+}
+
+// New creates a breaker that opens after threshold consecutive failures.
+// cooldown is the minimum time the breaker stays open before a successful
+// probe may half-open it. A threshold <= 0 disables the breaker.
+func New(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Enabled reports whether the breaker can trip
+func (b *Breaker) Enabled() bool {
+	return b != nil && b.threshold > 0
+}
+
+// Allow reports whether a request may go upstream. In half-open state only
+// one trial request is admitted at a time.
+func (b *Breaker) Allow() bool {
+	if !b.Enabled() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		b.rejected++
+		return false
+	case HalfOpen:
+		if b.trialActive {
+			b.rejected++
+			return false
+		}
+		b.trialActive = true
+	}
+	return true
+}
+
+// IsOpen reports whether the breaker is currently rejecting requests.
+// Unlike Allow it does not consume the half-open trial slot.
+func (b *Breaker) IsOpen() bool {
+	if !b.Enabled() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == Open
+}
+
+// IsClosed reports whether the breaker is letting every request through.
+// A disabled breaker is always closed.
+func (b *Breaker) IsClosed() bool {
+	if !b.Enabled() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == Closed
+}
+
+// Success records a successful upstream call. Calls that started before the
+// breaker opened and finish while it is open don't close it; only the
+// half-open trial does.
+func (b *Breaker) Success() {
+	if !b.Enabled() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		return
+	case HalfOpen:
+		log.Printf("✅ Circuit breaker closed: trial request succeeded")
+		b.state = Closed
+		b.trialActive = false
+	}
+	b.failures = 0
+}
+
+// Failure records a failed or timed out upstream call
+func (b *Breaker) Failure() {
+	if !b.Enabled() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	switch b.state {
+	case HalfOpen:
+		b.trip("trial request failed")
+	case Closed:
+		if b.failures >= b.threshold {
+			b.trip("consecutive failures reached threshold")
+		}
+	}
+}
+
+// trip opens the breaker; callers must hold b.mu
+func (b *Breaker) trip(reason string) {
+	b.state = Open
+	b.openedAt = time.Now()
+	b.trialActive = false
+	b.trips++
+	log.Printf("⚠️  Circuit breaker opened: %s (%d failures)", reason, b.failures)
+}
+
+// Probe feeds the result of an out-of-band health check into the breaker.
+// A healthy probe moves an open breaker to half-open once the cooldown has passed.
+func (b *Breaker) Probe(healthy bool) {
+	if !b.Enabled() || !healthy {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && time.Since(b.openedAt) >= b.cooldown {
+		b.state = HalfOpen
+		b.trialActive = false
+		log.Printf("🔄 Circuit breaker half-open: upstream probe succeeded")
+	}
+}
+
+// RetryAfter estimates how long a rejected client should wait before retrying
+func (b *Breaker) RetryAfter() time.Duration {
+	if !b.Enabled() {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != Open {
+		return time.Second
+	}
+	remaining := b.cooldown - time.Since(b.openedAt)
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	return remaining
+}
+
+// Snapshot is a point-in-time view of the breaker for health and metrics output
+type Snapshot struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Trips               int64  `json:"trips"`
+	Rejected            int64  `json:"rejected"`
+	OpenedAt            string `json:"opened_at,omitempty"`
+}
+
+// Snapshot returns the current breaker state
+func (b *Breaker) Snapshot() Snapshot {
+	if !b.Enabled() {
+		return Snapshot{State: "disabled"}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snap := Snapshot{
+		State:               b.state.String(),
+		ConsecutiveFailures: b.failures,
+		Trips:               b.trips,
+		Rejected:            b.rejected,
+	}
+	if b.state != Closed {
+		snap.OpenedAt = b.openedAt.Format(time.RFC3339)
+	}
+	return snap
+}
+
+// Transport wraps an http.RoundTripper with the breaker.
+// Transport errors and 502/503/504 responses count as failures; requests
+// canceled by the client are not held against upstream.
+type Transport struct {
+	Breaker   *Breaker
+	Transport http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.Breaker.Allow() {
+		return nil, ErrOpen
+	}
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || req.Context().Err() == context.Canceled {
+			// Client went away; release a half-open trial without judging upstream
+			t.Breaker.release()
+			return resp, err
+		}
+		t.Breaker.Failure()
+		return resp, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		t.Breaker.Failure()
+	default:
+		t.Breaker.Success()
+	}
+	return resp, nil
+}
+
+// release frees a half-open trial slot without changing state
+func (b *Breaker) release() {
+	if !b.Enabled() {
+		return
+	}
+	b.mu.Lock()
+	b.trialActive = false
+	b.mu.Unlock()
+}
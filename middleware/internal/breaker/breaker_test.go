@@ -0,0 +1,100 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerTripsAfterThreshold(t *testing.T) {
+	b := New(3, time.Hour)
+	for i := 0; i < 2; i++ {
+		b.Failure()
+	}
+	if !b.Allow() {
+		t.Fatal("breaker rejected below the threshold")
+	}
+	b.Success()
+	b.Failure()
+	b.Failure()
+	if b.IsOpen() {
+		t.Fatal("a success must reset the failure count")
+	}
+	b.Failure()
+	if !b.IsOpen() || b.Allow() {
+		t.Fatal("breaker still admits requests after threshold failures")
+	}
+	if snap := b.Snapshot(); snap.State != "open" || snap.Trips != 1 || snap.Rejected != 1 {
+		t.Fatalf("snapshot = %+v", snap)
+	}
+}
+
+func TestBreakerStaysOpenForCooldown(t *testing.T) {
+	b := New(1, time.Hour)
+	b.Failure()
+	b.Probe(true)
+	if !b.IsOpen() {
+		t.Fatal("probe half-opened the breaker before the cooldown")
+	}
+	// A request that started before the trip must not close it
+	b.Success()
+	if !b.IsOpen() {
+		t.Fatal("late success closed an open breaker")
+	}
+}
+
+func TestBreakerHalfOpenTrial(t *testing.T) {
+	b := New(1, 0)
+	b.Failure()
+	b.Probe(false)
+	if !b.IsOpen() {
+		t.Fatal("failed probe moved the breaker out of open")
+	}
+	b.Probe(true)
+	if b.Snapshot().State != "half_open" {
+		t.Fatalf("state = %s, want half_open", b.Snapshot().State)
+	}
+	if !b.Allow() {
+		t.Fatal("half-open breaker rejected the trial request")
+	}
+	if b.Allow() {
+		t.Fatal("half-open breaker admitted a second concurrent request")
+	}
+
+	// A failed trial reopens
+	b.Failure()
+	if !b.IsOpen() {
+		t.Fatal("failed trial did not reopen the breaker")
+	}
+
+	// A successful trial closes
+	b.Probe(true)
+	b.Allow()
+	b.Success()
+	if snap := b.Snapshot(); snap.State != "closed" || snap.ConsecutiveFailures != 0 {
+		t.Fatalf("snapshot after successful trial = %+v", snap)
+	}
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("closed breaker rejected requests")
+	}
+}
+
+func TestBreakerReleaseFreesTrial(t *testing.T) {
+	b := New(1, 0)
+	b.Failure()
+	b.Probe(true)
+	b.Allow()
+	b.release()
+	if !b.Allow() {
+		t.Fatal("released trial slot was not reusable")
+	}
+}
+
+func TestDisabledBreaker(t *testing.T) {
+	b := New(0, time.Hour)
+	for i := 0; i < 10; i++ {
+		b.Failure()
+	}
+	if !b.Allow() || b.IsOpen() {
+		t.Fatal("disabled breaker rejected a request")
+	}
+}
@@ -0,0 +1,296 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"cliproxy-middleware/internal/sse"
+)
+
+// Assemble rebuilds the final message from a streamed response, the way a
+// client would see it once the stream is complete. Anthropic streams yield a
+// message object, OpenAI streams a chat.completion object. It returns nil if
+// the stream holds neither.
+func Assemble(stream []byte) json.RawMessage {
+	var anthropic anthropicAssembler
+	var openai openAIAssembler
+
+	reader := sse.NewReader(bytes.NewReader(stream))
+	for {
+		ev, err := reader.Next()
+		if err != nil {
+			break
+		}
+		if len(ev.Data) == 0 || string(ev.Data) == "[DONE]" {
+			continue
+		}
+		var event map[string]json.RawMessage
+		if json.Unmarshal(ev.Data, &event) != nil {
+			continue
+		}
+		if _, ok := event["choices"]; ok {
+			openai.add(event)
+		} else {
+			anthropic.add(event)
+		}
+	}
+
+	var result any
+	switch {
+	case anthropic.message != nil:
+		result = anthropic.result()
+	case openai.started:
+		result = openai.result()
+	default:
+		return nil
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+type anthropicAssembler struct {
+	message map[string]any
+	blocks  map[int]map[string]any
+	inputs  map[int]*strings.Builder // partial tool_use input JSON
+	errors  []any
+}
+
+func (a *anthropicAssembler) add(event map[string]json.RawMessage) {
+	var typ string
+	json.Unmarshal(event["type"], &typ)
+	var index int
+	json.Unmarshal(event["index"], &index)
+
+	switch typ {
+	case "message_start":
+		json.Unmarshal(event["message"], &a.message)
+		a.blocks = make(map[int]map[string]any)
+		a.inputs = make(map[int]*strings.Builder)
+	case "content_block_start":
+		if a.message == nil {
+			return
+		}
+		var block map[string]any
+		json.Unmarshal(event["content_block"], &block)
+		a.blocks[index] = block
+	case "content_block_delta":
+		block := a.blocks[index]
+		if block == nil {
+			return
+		}
+		var delta map[string]any
+		json.Unmarshal(event["delta"], &delta)
+		switch delta["type"] {
+		case "text_delta":
+			appendString(block, "text", delta["text"])
+		case "thinking_delta":
+			appendString(block, "thinking", delta["thinking"])
+		case "signature_delta":
+			block["signature"] = delta["signature"]
+		case "input_json_delta":
+			if a.inputs[index] == nil {
+				a.inputs[index] = &strings.Builder{}
+			}
+			partial, _ := delta["partial_json"].(string)
+			a.inputs[index].WriteString(partial)
+		}
+	case "message_delta":
+		if a.message == nil {
+			return
+		}
+		var delta map[string]any
+		json.Unmarshal(event["delta"], &delta)
+		for k, v := range delta {
+			a.message[k] = v
+		}
+		var usage map[string]any
+		if json.Unmarshal(event["usage"], &usage) == nil {
+			merged, _ := a.message["usage"].(map[string]any)
+			if merged == nil {
+				merged = make(map[string]any)
+			}
+			for k, v := range usage {
+				merged[k] = v
+			}
+			a.message["usage"] = merged
+		}
+	case "error":
+		var e any
+		json.Unmarshal(event["error"], &e)
+		a.errors = append(a.errors, e)
+	}
+}
+
+func (a *anthropicAssembler) result() map[string]any {
+	indexes := make([]int, 0, len(a.blocks))
+	for i := range a.blocks {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	content := make([]any, 0, len(indexes))
+	for _, i := range indexes {
+		block := a.blocks[i]
+		if input, ok := a.inputs[i]; ok {
+			var parsed any
+			if json.Unmarshal([]byte(input.String()), &parsed) == nil {
+				block["input"] = parsed
+			} else {
+				block["input"] = input.String()
+			}
+		}
+		content = append(content, block)
+	}
+	a.message["content"] = content
+	if len(a.errors) > 0 {
+		a.message["stream_errors"] = a.errors
+	}
+	return a.message
+}
+
+type openAIChoice struct {
+	Index        int
+	Role         string
+	Content      strings.Builder
+	ToolCalls    map[int]*openAICall
+	FinishReason any
+}
+
+type openAICall struct {
+	ID        string
+	Type      string
+	Name      string
+	Arguments strings.Builder
+}
+
+type openAIAssembler struct {
+	started bool
+	id      string
+	model   string
+	created any
+	usage   any
+	choices map[int]*openAIChoice
+}
+
+func (a *openAIAssembler) add(event map[string]json.RawMessage) {
+	if !a.started {
+		a.started = true
+		a.choices = make(map[int]*openAIChoice)
+		json.Unmarshal(event["id"], &a.id)
+		json.Unmarshal(event["model"], &a.model)
+		json.Unmarshal(event["created"], &a.created)
+	}
+	if u, ok := event["usage"]; ok && string(u) != "null" {
+		json.Unmarshal(u, &a.usage)
+	}
+
+	var chunks []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Role      string `json:"role"`
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Type     string `json:"type"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason any `json:"finish_reason"`
+	}
+	json.Unmarshal(event["choices"], &chunks)
+
+	for _, chunk := range chunks {
+		choice := a.choices[chunk.Index]
+		if choice == nil {
+			choice = &openAIChoice{Index: chunk.Index, ToolCalls: make(map[int]*openAICall)}
+			a.choices[chunk.Index] = choice
+		}
+		if chunk.Delta.Role != "" {
+			choice.Role = chunk.Delta.Role
+		}
+		choice.Content.WriteString(chunk.Delta.Content)
+		for _, tc := range chunk.Delta.ToolCalls {
+			call := choice.ToolCalls[tc.Index]
+			if call == nil {
+				call = &openAICall{}
+				choice.ToolCalls[tc.Index] = call
+			}
+			if tc.ID != "" {
+				call.ID = tc.ID
+			}
+			if tc.Type != "" {
+				call.Type = tc.Type
+			}
+			if tc.Function.Name != "" {
+				call.Name = tc.Function.Name
+			}
+			call.Arguments.WriteString(tc.Function.Arguments)
+		}
+		if chunk.FinishReason != nil {
+			choice.FinishReason = chunk.FinishReason
+		}
+	}
+}
+
+func (a *openAIAssembler) result() map[string]any {
+	indexes := make([]int, 0, len(a.choices))
+	for i := range a.choices {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	choices := make([]any, 0, len(indexes))
+	for _, i := range indexes {
+		choice := a.choices[i]
+		message := map[string]any{"role": choice.Role, "content": choice.Content.String()}
+		if len(choice.ToolCalls) > 0 {
+			callIndexes := make([]int, 0, len(choice.ToolCalls))
+			for j := range choice.ToolCalls {
+				callIndexes = append(callIndexes, j)
+			}
+			sort.Ints(callIndexes)
+			var calls []any
+			for _, j := range callIndexes {
+				call := choice.ToolCalls[j]
+				calls = append(calls, map[string]any{
+					"id":       call.ID,
+					"type":     call.Type,
+					"function": map[string]any{"name": call.Name, "arguments": call.Arguments.String()},
+				})
+			}
+			message["tool_calls"] = calls
+		}
+		choices = append(choices, map[string]any{
+			"index":         choice.Index,
+			"message":       message,
+			"finish_reason": choice.FinishReason,
+		})
+	}
+
+	result := map[string]any{
+		"id":      a.id,
+		"object":  "chat.completion",
+		"created": a.created,
+		"model":   a.model,
+		"choices": choices,
+	}
+	if a.usage != nil {
+		result["usage"] = a.usage
+	}
+	return result
+}
+
+func appendString(block map[string]any, key string, value any) {
+	s, _ := value.(string)
+	prev, _ := block[key].(string)
+	block[key] = prev + s
+}
@@ -0,0 +1,414 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+// Headers whose values are replaced before a capture is written
+var secretHeaders = []string{"Authorization", "X-Api-Key", "X-Goog-Api-Key", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+const redacted = "[REDACTED]"
+
+// Record is one captured call: what the client sent, what was sent upstream
+// and what the client got back
+type Record struct {
+	ID             string    `json:"id"`
+	Time           time.Time `json:"time"`
+	Client         string    `json:"client"`
+	RequestedModel string    `json:"requested_model,omitempty"`
+	MappedModel    string    `json:"mapped_model,omitempty"`
+	DurationMS     int64     `json:"duration_ms"`
+
+	Request         Message  `json:"request"`
+	UpstreamRequest *Message `json:"upstream_request,omitempty"`
+	Response        Message  `json:"response"`
+
+	w       *writer
+	maxBody int64
+}
+
+// Message is a captured request or response. JSON bodies are stored as-is,
+// anything else as a JSON string.
+type Message struct {
+	Method string          `json:"method,omitempty"`
+	URL    string          `json:"url,omitempty"`
+	Status int             `json:"status,omitempty"`
+	Header http.Header     `json:"header,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+
+	// Assembled is the final message rebuilt from a streamed response
+	Assembled json.RawMessage `json:"assembled,omitempty"`
+
+	// Truncated is set when only the start of the body was kept
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// BodyBytes returns the body as it was sent
+func (m *Message) BodyBytes() []byte {
+	if len(m.Body) > 0 && m.Body[0] == '"' {
+		var s string
+		if json.Unmarshal(m.Body, &s) == nil {
+			return []byte(s)
+		}
+	}
+	return m.Body
+}
+
+// Capturer writes records for matching requests to a directory, keeping at
+// most maxFiles of them
+type Capturer struct {
+	dir      string
+	maxFiles int
+	maxBody  int64
+	paths    []string
+	models   map[string]bool
+
+	mu sync.Mutex // serializes writes and rotation
+}
+
+// New creates a capturer writing to dir. An empty dir returns a nil
+// capturer, which captures nothing. Bodies longer than maxBody bytes are
+// captured only in part (0 keeps them whole). paths are URL path prefixes
+// and models requested or mapped model names; empty lists match everything.
+func New(dir string, maxFiles int, maxBody int64, paths, models []string) (*Capturer, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &Capturer{dir: dir, maxFiles: maxFiles, maxBody: maxBody, paths: paths}
+	if len(models) > 0 {
+		c.models = make(map[string]bool)
+		for _, model := range models {
+			c.models[model] = true
+		}
+	}
+	return c, nil
+}
+
+// Enabled reports whether requests are captured
+func (c *Capturer) Enabled() bool {
+	return c != nil
+}
+
+// Dir returns the capture directory
+func (c *Capturer) Dir() string {
+	return c.dir
+}
+
+func (c *Capturer) matchPath(path string) bool {
+	if len(c.paths) == 0 {
+		return true
+	}
+	for _, prefix := range c.paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Capturer) matchModel(info *reqinfo.Info) bool {
+	return c.models == nil || c.models[info.RequestedModel] || c.models[info.MappedModel]
+}
+
+// Begin starts capturing r if its path matches. Call it once the client is
+// authenticated. It buffers the client body, up to the body limit, and
+// returns the request and writer to use from then on, plus the record to
+// pass to Finish. The record is nil if the request is not captured.
+func (c *Capturer) Begin(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, *Record) {
+	if !c.Enabled() || !c.matchPath(r.URL.Path) {
+		return w, r, nil
+	}
+
+	var body []byte
+	truncated := false
+	if r.Body != nil {
+		var err error
+		body, truncated, err = readStart(&r.Body, c.maxBody)
+		if err != nil {
+			return w, r, nil
+		}
+	}
+
+	rec := &Record{
+		Time: time.Now(),
+		Request: Message{
+			Method:    r.Method,
+			URL:       r.URL.RequestURI(),
+			Header:    redactHeader(r.Header),
+			Body:      encodeBody(body),
+			Truncated: truncated,
+		},
+		maxBody: c.maxBody,
+	}
+	rec.w = &writer{ResponseWriter: w, rec: rec}
+	return rec.w, r.WithContext(WithRecord(r.Context(), rec)), rec
+}
+
+// Finish writes rec to disk if the request's model matches the filter
+func (c *Capturer) Finish(rec *Record, info *reqinfo.Info) {
+	if rec == nil || !c.matchModel(info) {
+		return
+	}
+
+	rec.ID = info.ID
+	rec.Client = info.ClientID()
+	rec.RequestedModel = info.RequestedModel
+	rec.MappedModel = info.MappedModel
+	rec.DurationMS = time.Since(rec.Time).Milliseconds()
+	if rec.Response.Status == 0 {
+		rec.Response.Status = http.StatusOK
+	}
+	rec.Response.Header = redactHeader(rec.w.Header())
+	body := rec.w.body.Bytes()
+	rec.Response.Body = encodeBody(body)
+	rec.Response.Truncated = rec.w.truncated
+	if !rec.w.truncated && strings.Contains(rec.w.Header().Get("Content-Type"), "text/event-stream") {
+		rec.Response.Assembled = Assemble(body)
+	}
+
+	if err := c.write(rec); err != nil {
+		log.Printf("⚠️  Failed to write capture: %v", err)
+	}
+}
+
+// Find returns the path of the newest capture of the request with the given ID
+func (c *Capturer) Find(id string) (string, bool) {
+	if !c.Enabled() || id == "" {
+		return "", false
+	}
+	matches, _ := filepath.Glob(filepath.Join(c.dir, "*-"+safeName(id)+".json"))
+	if len(matches) == 0 {
+		return "", false
+	}
+	return matches[len(matches)-1], true
+}
+
+func (c *Capturer) write(rec *Record) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Timestamped names sort oldest first, which rotation relies on
+	name := fmt.Sprintf("%s-%s.json", rec.Time.UTC().Format("20060102T150405.000000000"), safeName(rec.ID))
+	if err := os.WriteFile(filepath.Join(c.dir, name), data, 0o600); err != nil {
+		return err
+	}
+	return c.rotate()
+}
+
+// rotate removes the oldest captures beyond maxFiles; callers must hold c.mu
+func (c *Capturer) rotate() error {
+	if c.maxFiles <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > c.maxFiles {
+		os.Remove(filepath.Join(c.dir, names[0]))
+		names = names[1:]
+	}
+	return nil
+}
+
+// Load reads a capture file
+func Load(path string) (*Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &rec, nil
+}
+
+type contextKey struct{}
+
+// WithRecord returns a context whose upstream request is captured into rec.
+// A nil rec leaves side requests, such as compaction summaries, uncaptured.
+func WithRecord(ctx context.Context, rec *Record) context.Context {
+	return context.WithValue(ctx, contextKey{}, rec)
+}
+
+// RecordUpstream captures the request about to be sent upstream, if the
+// originating client request is being captured
+func RecordUpstream(req *http.Request) {
+	rec, ok := req.Context().Value(contextKey{}).(*Record)
+	if !ok || rec == nil || rec.UpstreamRequest != nil {
+		return
+	}
+	var body []byte
+	truncated := false
+	if req.Body != nil && req.GetBody != nil {
+		if rc, err := req.GetBody(); err == nil {
+			body, truncated, _ = readStart(&rc, rec.maxBody)
+			rc.Close()
+		}
+	} else if req.Body != nil {
+		body, truncated, _ = readStart(&req.Body, rec.maxBody)
+	}
+	rec.UpstreamRequest = &Message{
+		Method:    req.Method,
+		URL:       redactURL(req.URL),
+		Header:    redactHeader(req.Header),
+		Body:      encodeBody(body),
+		Truncated: truncated,
+	}
+}
+
+// Transport records the upstream request of captured calls
+type Transport struct {
+	Transport http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	RecordUpstream(req)
+	return t.Transport.RoundTrip(req)
+}
+
+// readStart reads up to limit bytes of *body (everything if limit <= 0) and
+// replaces *body with a reader that still yields all of it. It reports
+// whether the body was longer than what it returns.
+func readStart(body *io.ReadCloser, limit int64) ([]byte, bool, error) {
+	rc := *body
+	var data []byte
+	var err error
+	if limit > 0 {
+		data, err = io.ReadAll(io.LimitReader(rc, limit+1))
+	} else {
+		data, err = io.ReadAll(rc)
+	}
+	if err != nil {
+		rc.Close()
+		*body = io.NopCloser(errReader{err})
+		return nil, false, err
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		// Too long to keep: capture the start and stream the rest on
+		*body = readCloser{io.MultiReader(bytes.NewReader(data), rc), rc}
+		return data[:limit], true, nil
+	}
+	rc.Close()
+	*body = io.NopCloser(bytes.NewReader(data))
+	return data, false, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// writer tees the response sent to the client into the record, up to the
+// body limit
+type writer struct {
+	http.ResponseWriter
+	rec       *Record
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *writer) WriteHeader(status int) {
+	if w.rec.Response.Status == 0 {
+		w.rec.Response.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	keep := p
+	if limit := w.rec.maxBody; limit > 0 && int64(w.body.Len()+len(p)) > limit {
+		keep = p[:max(0, limit-int64(w.body.Len()))]
+		w.truncated = true
+	}
+	w.body.Write(keep)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *writer) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func redactHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range secretHeaders {
+		if len(out.Values(name)) > 0 {
+			out.Set(name, redacted)
+		}
+	}
+	return out
+}
+
+// redactURL hides API keys passed as query parameters
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	if q.Has("key") {
+		q.Set("key", redacted)
+		copied := *u
+		copied.RawQuery = q.Encode()
+		return copied.String()
+	}
+	return u.String()
+}
+
+func encodeBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		var buf bytes.Buffer
+		if json.Compact(&buf, body) == nil {
+			return buf.Bytes()
+		}
+	}
+	encoded, _ := json.Marshal(string(body))
+	return encoded
+}
+
+// safeName keeps only characters that are safe in a file name
+func safeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
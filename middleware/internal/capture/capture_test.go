@@ -0,0 +1,79 @@
+package capture
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+func TestBeginLimitsBufferedBodies(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		maxBody       int64
+		body          string
+		wantCaptured  string
+		wantTruncated bool
+	}{
+		{"within limit", 16, "short body", "short body", false},
+		{"at limit", 10, "0123456789", "0123456789", false},
+		{"over limit", 10, "0123456789abcdef", "0123456789", true},
+		{"no limit", 0, "0123456789abcdef", "0123456789abcdef", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := New(t.TempDir(), 0, tc.maxBody, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(tc.body))
+			cw, cr, rec := c.Begin(w, r)
+
+			// The handler still gets the whole body
+			got, err := io.ReadAll(cr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.body {
+				t.Fatalf("handler read %q, want %q", got, tc.body)
+			}
+			if body := string(rec.Request.BodyBytes()); body != tc.wantCaptured || rec.Request.Truncated != tc.wantTruncated {
+				t.Fatalf("captured request %q (truncated %v), want %q (truncated %v)", body, rec.Request.Truncated, tc.wantCaptured, tc.wantTruncated)
+			}
+
+			// Responses are cut the same way, but sent in full
+			cw.Write([]byte(tc.body[:len(tc.body)/2]))
+			cw.Write([]byte(tc.body[len(tc.body)/2:]))
+			if w.Body.String() != tc.body {
+				t.Fatalf("client got %q, want %q", w.Body.String(), tc.body)
+			}
+			c.Finish(rec, &reqinfo.Info{ID: "req_1"})
+			if body := string(rec.Response.BodyBytes()); body != tc.wantCaptured || rec.Response.Truncated != tc.wantTruncated {
+				t.Fatalf("captured response %q (truncated %v), want %q (truncated %v)", body, rec.Response.Truncated, tc.wantCaptured, tc.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestRecordUpstreamLimitsBody(t *testing.T) {
+	rec := &Record{maxBody: 8}
+	body := `{"model":"gemini-3-flash"}`
+	req := httptest.NewRequest(http.MethodPost, "http://upstream/v1/messages", strings.NewReader(body))
+	req = req.WithContext(WithRecord(req.Context(), rec))
+	req.GetBody = nil
+	RecordUpstream(req)
+
+	sent, _ := io.ReadAll(req.Body)
+	if string(sent) != body {
+		t.Fatalf("upstream gets %q, want %q", sent, body)
+	}
+	var captured string
+	json.Unmarshal(rec.UpstreamRequest.Body, &captured)
+	if captured != body[:8] || !rec.UpstreamRequest.Truncated {
+		t.Fatalf("captured %q (truncated %v), want %q", captured, rec.UpstreamRequest.Truncated, body[:8])
+	}
+}
@@ -0,0 +1,240 @@
+package compaction
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"cliproxy-middleware/internal/models"
+)
+
+// Summarizer condenses a conversation transcript into a short summary
+type Summarizer func(ctx context.Context, transcript string) (string, error)
+
+// Result describes one compaction
+type Result struct {
+	TrimmedToolResults int
+	SummarizedMessages int
+	TokensBefore       int
+	TokensAfter        int
+}
+
+// Header formats the result for the X-Context-Compaction response header
+func (r *Result) Header() string {
+	return fmt.Sprintf("tool_results_trimmed=%d, messages_summarized=%d, tokens_before=%d, tokens_after=%d",
+		r.TrimmedToolResults, r.SummarizedMessages, r.TokensBefore, r.TokensAfter)
+}
+
+// Fits reports whether compaction brought the prompt under the target
+func (r *Result) Fits(target int) bool {
+	return r.TokensAfter <= target
+}
+
+// maxTranscriptChars bounds what is sent to the summarizer
+const maxTranscriptChars = 2 << 20
+
+// message is a Messages API turn; content is a string or a list of blocks
+type message struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// Compact shrinks the messages of a Messages request until its estimated
+// size is at most target tokens. The oldest tool_result contents are
+// replaced with a placeholder first; if that isn't enough, the oldest turns
+// after the opening user request are replaced with a summary from summarize
+// (skipped when nil). The opening request and the latest turn are kept. It
+// returns nil if the request already fits.
+func Compact(ctx context.Context, request map[string]json.RawMessage, target int, tokenMultiplier float64, summarize Summarizer) (*Result, error) {
+	estimate := func() int {
+		return models.EstimateTokens(request, tokenMultiplier)
+	}
+	before := estimate()
+	if before <= target {
+		return nil, nil
+	}
+
+	var messages []message
+	if err := json.Unmarshal(request["messages"], &messages); err != nil {
+		return nil, err
+	}
+	result := &Result{TokensBefore: before, TokensAfter: before}
+	excess := int(float64(before-target) * tokenMultiplier)
+
+	// Oldest tool output first: it is the bulkiest and least relevant
+	for i := 0; i < len(messages)-1 && excess > 0; i++ {
+		saved, trimmed := trimToolResults(&messages[i], excess)
+		excess -= saved
+		result.TrimmedToolResults += trimmed
+	}
+	if result.TrimmedToolResults > 0 {
+		request["messages"], _ = json.Marshal(messages)
+		result.TokensAfter = estimate()
+	}
+	if result.TokensAfter <= target || summarize == nil {
+		return result, nil
+	}
+
+	// Summarize the shortest run of turns after the opening request that
+	// makes the request fit. The run ends before a user turn that isn't a
+	// tool result, so no tool call is separated from its result.
+	total := len(request["messages"])
+	room := target - min(summaryReserve, target/4)
+	head, headChars := openingTurns(messages)
+	if int(float64(headChars)/tokenMultiplier) > room/2 {
+		// An opening request this large can't stay verbatim
+		head, headChars = 0, 0
+	}
+	cut, removed := -1, 0
+	for i := head + 1; i < len(messages); i++ {
+		raw, _ := json.Marshal(messages[i-1])
+		removed += len(raw) + 1
+		if messages[i].Role != "user" || hasToolResult(messages[i]) {
+			continue
+		}
+		cut = i
+		if int(float64(total-removed)/tokenMultiplier) <= room {
+			break
+		}
+	}
+	if cut <= head {
+		return result, nil
+	}
+
+	summary, err := summarize(ctx, transcript(messages[head:cut]))
+	if err != nil {
+		return result, fmt.Errorf("summarize: %w", err)
+	}
+	summary = "<conversation-summary>\nThe earlier part of this conversation was summarized to fit the context window:\n\n" + summary + "\n</conversation-summary>"
+	kept := append([]message(nil), messages[:head]...)
+	if head == 0 {
+		messages[cut].Content = prependText(messages[cut].Content, summary)
+	} else {
+		// The summary takes the place of the assistant turn that answered the
+		// opening request, so roles keep alternating
+		content, _ := json.Marshal([]map[string]string{{"type": "text", "text": summary}})
+		kept = append(kept, message{Role: "assistant", Content: content})
+	}
+	kept = append(kept, messages[cut:]...)
+	request["messages"], _ = json.Marshal(kept)
+	result.SummarizedMessages = cut - head
+	result.TokensAfter = estimate()
+	return result, nil
+}
+
+// openingTurns counts the user turns that open the conversation, which hold
+// the original task and are kept verbatim, and measures their JSON size
+func openingTurns(messages []message) (n, chars int) {
+	// The latest turn is never summarized, so it can't be part of the head
+	for n < len(messages)-1 && messages[n].Role == "user" && !hasToolResult(messages[n]) {
+		raw, _ := json.Marshal(messages[n])
+		chars += len(raw) + 1
+		n++
+	}
+	return n, chars
+}
+
+// summaryReserve is room left for the summary when choosing what to summarize
+const summaryReserve = 2048
+
+// trimToolResults replaces the content of a message's tool_result blocks
+// until about need characters are saved. It returns the characters saved
+// and the number of blocks trimmed.
+func trimToolResults(m *message, need int) (saved, trimmed int) {
+	if m.Role != "user" || len(m.Content) == 0 || m.Content[0] != '[' {
+		return 0, 0
+	}
+	var blocks []map[string]json.RawMessage
+	if json.Unmarshal(m.Content, &blocks) != nil {
+		return 0, 0
+	}
+	for _, block := range blocks {
+		if saved >= need {
+			break
+		}
+		var typ string
+		json.Unmarshal(block["type"], &typ)
+		content := block["content"]
+		if typ != "tool_result" || len(content) < 256 {
+			continue
+		}
+		placeholder, _ := json.Marshal(fmt.Sprintf("[Tool output removed to fit the context window: %d characters]", len(content)))
+		block["content"] = placeholder
+		saved += len(content) - len(placeholder)
+		trimmed++
+	}
+	if trimmed > 0 {
+		m.Content, _ = json.Marshal(blocks)
+	}
+	return saved, trimmed
+}
+
+func hasToolResult(m message) bool {
+	return strings.Contains(string(m.Content), `"tool_result"`)
+}
+
+// prependText adds a text block before a message's content
+func prependText(content json.RawMessage, text string) json.RawMessage {
+	block := map[string]any{"type": "text", "text": text}
+	var blocks []any
+	if len(content) > 0 && content[0] == '[' {
+		json.Unmarshal(content, &blocks)
+	} else {
+		var s string
+		json.Unmarshal(content, &s)
+		blocks = []any{map[string]any{"type": "text", "text": s}}
+	}
+	out, _ := json.Marshal(append([]any{block}, blocks...))
+	return out
+}
+
+// transcript renders turns as plain text for the summarizer, abbreviating
+// tool input and output
+func transcript(messages []message) string {
+	var b strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&b, "## %s\n", m.Role)
+		if len(m.Content) > 0 && m.Content[0] == '"' {
+			var s string
+			json.Unmarshal(m.Content, &s)
+			b.WriteString(s + "\n\n")
+			continue
+		}
+		var blocks []struct {
+			Type    string          `json:"type"`
+			Text    string          `json:"text"`
+			Name    string          `json:"name"`
+			Input   json.RawMessage `json:"input"`
+			Content json.RawMessage `json:"content"`
+		}
+		json.Unmarshal(m.Content, &blocks)
+		for _, block := range blocks {
+			switch block.Type {
+			case "text":
+				b.WriteString(block.Text + "\n")
+			case "tool_use":
+				fmt.Fprintf(&b, "[called %s %s]\n", block.Name, abbreviate(string(block.Input), 500))
+			case "tool_result":
+				fmt.Fprintf(&b, "[result %s]\n", abbreviate(string(block.Content), 1000))
+			case "image", "document":
+				fmt.Fprintf(&b, "[%s]\n", block.Type)
+			}
+		}
+		b.WriteString("\n")
+	}
+	text := b.String()
+	if len(text) > maxTranscriptChars {
+		// Keep both ends: the earliest and the latest progress
+		half := maxTranscriptChars / 2
+		text = text[:half] + "\n[...]\n" + text[len(text)-half:]
+	}
+	return text
+}
+
+func abbreviate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,191 @@
+package compaction
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// turn is a message with text content of n characters
+func turn(role string, n int) message {
+	content, _ := json.Marshal(strings.Repeat(role[:1], n))
+	return message{Role: role, Content: content}
+}
+
+func toolUse(id string) message {
+	content, _ := json.Marshal([]map[string]any{{"type": "tool_use", "id": id, "name": "read_file", "input": map[string]any{}}})
+	return message{Role: "assistant", Content: content}
+}
+
+func toolResult(id string, n int) message {
+	content, _ := json.Marshal([]map[string]any{{"type": "tool_result", "tool_use_id": id, "content": strings.Repeat("r", n)}})
+	return message{Role: "user", Content: content}
+}
+
+func build(t *testing.T, messages ...message) map[string]json.RawMessage {
+	t.Helper()
+	raw, err := json.Marshal(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]json.RawMessage{"messages": raw}
+}
+
+func parse(t *testing.T, request map[string]json.RawMessage) []message {
+	t.Helper()
+	var messages []message
+	if err := json.Unmarshal(request["messages"], &messages); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func checkAlternation(t *testing.T, messages []message) {
+	t.Helper()
+	for i, m := range messages {
+		want := "user"
+		if i%2 == 1 {
+			want = "assistant"
+		}
+		if m.Role != want {
+			t.Fatalf("message %d is %s, want %s", i, m.Role, want)
+		}
+	}
+}
+
+func summarizer(calls *[]string) Summarizer {
+	return func(ctx context.Context, transcript string) (string, error) {
+		*calls = append(*calls, transcript)
+		return "SUMMARY", nil
+	}
+}
+
+func TestCompactFits(t *testing.T) {
+	request := build(t, turn("user", 100))
+	result, err := Compact(context.Background(), request, 1000, 1, nil)
+	if result != nil || err != nil {
+		t.Fatalf("Compact = %+v, %v; want nothing done", result, err)
+	}
+}
+
+func TestCompactTrimsOldestToolResults(t *testing.T) {
+	request := build(t,
+		turn("user", 10),
+		toolUse("a"), toolResult("a", 5000),
+		toolUse("b"), toolResult("b", 5000),
+		toolUse("c"), toolResult("c", 5000),
+	)
+	before := len(request["messages"])
+	result, err := Compact(context.Background(), request, before-4000, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TrimmedToolResults != 1 || result.SummarizedMessages != 0 || !result.Fits(before-4000) {
+		t.Fatalf("result = %+v, want the oldest tool result trimmed", result)
+	}
+	messages := parse(t, request)
+	if !strings.Contains(string(messages[2].Content), "Tool output removed") {
+		t.Fatalf("oldest result kept: %.80s", messages[2].Content)
+	}
+	for _, i := range []int{4, 6} {
+		if strings.Contains(string(messages[i].Content), "Tool output removed") {
+			t.Fatalf("message %d trimmed before it was needed", i)
+		}
+	}
+
+	// The latest turn is never trimmed, even when nothing else helps
+	request = build(t, turn("user", 10), toolUse("a"), toolResult("a", 5000))
+	result, _ = Compact(context.Background(), request, 100, 1, nil)
+	if result.TrimmedToolResults != 0 || result.Fits(100) {
+		t.Fatalf("result = %+v, want the latest tool result kept", result)
+	}
+}
+
+func TestCompactSummarizesAfterOpeningRequest(t *testing.T) {
+	request := build(t,
+		turn("user", 100), // the opening task
+		turn("assistant", 3000),
+		turn("user", 3000),
+		toolUse("a"), toolResult("a", 100),
+		turn("assistant", 3000),
+		turn("user", 3000),
+		turn("assistant", 100),
+		turn("user", 100),
+	)
+	var calls []string
+	result, err := Compact(context.Background(), request, 6000, 1, summarizer(&calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := parse(t, request)
+	checkAlternation(t, messages)
+
+	if string(messages[0].Content) != string(turn("user", 100).Content) {
+		t.Fatal("opening request not kept verbatim")
+	}
+	if m := messages[1]; m.Role != "assistant" || !strings.Contains(string(m.Content), "SUMMARY") {
+		t.Fatalf("summary turn = %s %.80s", m.Role, m.Content)
+	}
+	// The run ends before a plain user turn, not at the tool result
+	if len(messages) != 5 || result.SummarizedMessages != 5 || string(messages[2].Content) != string(turn("user", 3000).Content) {
+		t.Fatalf("result = %+v, kept turns start with %.80s", result, messages[2].Content)
+	}
+	if last := messages[len(messages)-1]; string(last.Content) != string(turn("user", 100).Content) {
+		t.Fatal("latest turn not kept")
+	}
+	if len(calls) != 1 || !strings.HasPrefix(calls[0], "## assistant\n") {
+		t.Fatalf("transcript = %.40q, want it to start after the opening request", calls)
+	}
+	if !result.Fits(6000) {
+		t.Fatalf("result = %+v, want it under the target", result)
+	}
+}
+
+func TestCompactSummarizesLargeOpeningRequest(t *testing.T) {
+	request := build(t,
+		turn("user", 8000), // too large to keep verbatim
+		turn("assistant", 3000),
+		turn("user", 100),
+		turn("assistant", 100),
+		turn("user", 100),
+	)
+	var calls []string
+	result, err := Compact(context.Background(), request, 4000, 1, summarizer(&calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := parse(t, request)
+	checkAlternation(t, messages)
+	if !strings.HasPrefix(calls[0], "## user\nuuu") {
+		t.Fatalf("transcript = %.40q, want the opening request summarized", calls[0])
+	}
+	// The summary is prepended to the first kept user turn
+	var blocks []map[string]string
+	if err := json.Unmarshal(messages[0].Content, &blocks); err != nil || len(blocks) != 2 ||
+		!strings.Contains(blocks[0]["text"], "SUMMARY") || blocks[1]["text"] != strings.Repeat("u", 100) {
+		t.Fatalf("first turn = %s", messages[0].Content)
+	}
+	if result.SummarizedMessages != 2 || len(messages) != 3 || !result.Fits(4000) {
+		t.Fatalf("result = %+v with %d messages left", result, len(messages))
+	}
+}
+
+func TestCompactKeepsToolCallsWithResults(t *testing.T) {
+	// The only user turns after the opening request carry tool results, so
+	// there is nowhere to cut without orphaning one
+	request := build(t,
+		turn("user", 100),
+		toolUse("a"), toolResult("a", 200),
+		toolUse("b"), toolResult("b", 200),
+	)
+	before := string(request["messages"])
+	var calls []string
+	result, err := Compact(context.Background(), request, 100, 1, summarizer(&calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 || result.SummarizedMessages != 0 || string(request["messages"]) != before {
+		t.Fatalf("result = %+v after %d summaries, want the turns kept", result, len(calls))
+	}
+}
@@ -2,30 +2,196 @@ package config
 
 import (
 	"flag"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds the middleware configuration
 type Config struct {
+	Host            string
 	Port            int
 	UpstreamURL     string
 	APIKey          string
 	Debug           bool
 	LogRequests     bool
+	LogFormat       string
 	TokenMultiplier float64
+
+	// Circuit breaker around upstream
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Resuming broken /v1/messages streams
+	StreamResumeAttempts int
+	StreamResumeModel    string
+
+	// Idle stream keepalive and stall detection
+	PingInterval       time.Duration
+	StallTimeout       time.Duration
+	ModelStallTimeouts map[string]time.Duration
+
+	// Hedging for small non-streaming requests
+	HedgeDelay    time.Duration
+	HedgeMaxBytes int64
+	HedgeModels   []string
+
+	// Concurrency limiting
+	MaxConcurrency      int
+	ModelMaxConcurrency map[string]int
+	QueueTimeout        time.Duration
+
+	// Per-client quotas
+	RateLimitRPM       int
+	RateLimitTokensDay int64
+
+	// Client authentication
+	KeysFile string
+
+	// Listeners
+	TLSCert        string
+	TLSKey         string
+	TLSSelfSigned  bool
+	TLSDir         string
+	UnixSocket     string
+	UnixSocketMode os.FileMode
+
+	// Request/response capture for debugging and replay
+	CaptureDir      string
+	CaptureMaxFiles int
+	CaptureMaxBody  int64
+	CapturePaths    []string
+	CaptureModels   []string
+
+	// Response cache for deterministic requests
+	ResponseCache              string
+	ResponseCacheDir           string
+	ResponseCacheTTL           time.Duration
+	ResponseCacheMaxBytes      int64
+	ResponseCacheMaxEntryBytes int64
+
+	// JSON file of upstream model capabilities added to the built-in registry
+	ModelsFile string
+
+	// Describe schema constraints dropped for Gemini in descriptions
+	SchemaHints bool
+
+	// Tool names and descriptions for Gemini function declarations
+	SanitizeToolNames  bool
+	ToolDescriptionMax int
+
+	// Tool count limits for /v1/messages, pruned by relevance
+	MaxTools      int
+	ModelMaxTools map[string]int
+
+	// Image and document handling per target model
+	MediaNormalization bool
+	FetchMediaURLs     bool
+	PDFFallback        string
+
+	// Context compaction for prompts beyond the model's window
+	Compaction      bool
+	CompactionModel string
+
+	// Budget for thinking added to requests routed to -thinking models
+	ThinkingBudget int
+	// Handling of prior thinking blocks the target model can't validate
+	ThinkingHistory string
+	// File that keeps the model each thinking signature came from
+	ThinkingSignaturesFile string
+
+	// Prompt caching emulation and cache_control handling
+	PromptCacheEmulation bool
+	CacheControl         string
+	ModelCacheControl    map[string]string
+
+	// OpenTelemetry tracing
+	TraceExporter string
+	TraceEndpoint string
+	TraceService  string
+}
+
+// DefaultModelStallTimeouts gives thinking models more time before a silent
+// stream is considered stalled
+var DefaultModelStallTimeouts = map[string]time.Duration{
+	"gemini-claude-opus-4-5-thinking":   5 * time.Minute,
+	"gemini-claude-sonnet-4-5-thinking": 4 * time.Minute,
 }
 
 // Load parses flags and environment variables to build config
 func Load() *Config {
+	return LoadArgs(os.Args[1:])
+}
+
+// LoadArgs is Load for an explicit argument list, used by subcommands.
+// Flags registered on flag.CommandLine beforehand are parsed as well.
+func LoadArgs(args []string) *Config {
 	cfg := &Config{}
 
-	flag.IntVar(&cfg.Port, "port", 8318, "Port to listen on")
+	flag.StringVar(&cfg.Host, "host", "127.0.0.1", "Address to bind (use 0.0.0.0 for all interfaces)")
+	flag.IntVar(&cfg.Port, "port", 8318, "Port to listen on (0 disables TCP when -unix-socket is set)")
 	flag.StringVar(&cfg.UpstreamURL, "upstream", "http://127.0.0.1:8317", "CLIProxyAPI upstream URL")
-	flag.StringVar(&cfg.APIKey, "api-key", "", "API key for authentication (optional)")
+	flag.StringVar(&cfg.APIKey, "api-key", "", "API key sent to upstream CLIProxyAPI (optional)")
 	flag.BoolVar(&cfg.Debug, "debug", false, "Enable debug logging")
 	flag.BoolVar(&cfg.LogRequests, "log-requests", false, "Log all requests")
+	flag.StringVar(&cfg.LogFormat, "log-format", "text", "Log output format: text or json")
 	flag.Float64Var(&cfg.TokenMultiplier, "token-multiplier", 4.0, "Character to token ratio")
-	flag.Parse()
+	flag.IntVar(&cfg.BreakerThreshold, "breaker-threshold", 5, "Consecutive upstream failures before the circuit breaker opens (0 disables)")
+	flag.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", 30*time.Second, "Minimum time the circuit breaker stays open before probing upstream")
+	flag.IntVar(&cfg.StreamResumeAttempts, "stream-resume-attempts", 1, "Times to resume a broken /v1/messages stream with a continuation request (0 disables)")
+	flag.StringVar(&cfg.StreamResumeModel, "stream-resume-model", "", "Upstream model for stream continuations (default: same model)")
+	flag.DurationVar(&cfg.PingInterval, "ping-interval", 15*time.Second, "Send SSE ping events to the client after this much upstream silence (0 disables)")
+	flag.DurationVar(&cfg.StallTimeout, "stall-timeout", 2*time.Minute, "Abort a stream after this much upstream silence (0 disables)")
+	stallModels := flag.String("stall-timeout-models", "", "Per-model stall timeouts, e.g. gemini-3-pro-high=3m,gemini-3-flash=1m")
+	flag.DurationVar(&cfg.HedgeDelay, "hedge-delay", 0, "Send a second copy of small non-streaming requests after this delay without response headers (0 disables)")
+	flag.Int64Var(&cfg.HedgeMaxBytes, "hedge-max-bytes", 32*1024, "Largest request body eligible for hedging")
+	hedgeModels := flag.String("hedge-models", "gemini-3-flash", "Comma-separated upstream models eligible for hedging")
+	flag.IntVar(&cfg.MaxConcurrency, "max-concurrency", 0, "Maximum concurrent upstream requests (0 = unlimited)")
+	modelConcurrency := flag.String("max-concurrency-models", "", "Per-model concurrency caps, e.g. gemini-claude-opus-4-5-thinking=2,gemini-3-flash=8")
+	flag.DurationVar(&cfg.QueueTimeout, "queue-timeout", 60*time.Second, "Maximum time a request waits for a free upstream slot")
+	flag.IntVar(&cfg.RateLimitRPM, "rate-limit-rpm", 0, "Requests per minute allowed per client API key (0 = unlimited)")
+	flag.Int64Var(&cfg.RateLimitTokensDay, "rate-limit-tokens-per-day", 0, "Tokens per day allowed per client API key (0 = unlimited)")
+	flag.StringVar(&cfg.KeysFile, "keys-file", "", "JSON file of client keys accepted by the middleware (enables authentication)")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file (PEM)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file (PEM)")
+	flag.BoolVar(&cfg.TLSSelfSigned, "tls-self-signed", false, "Serve TLS with a certificate from an auto-generated local CA")
+	flag.StringVar(&cfg.TLSDir, "tls-dir", defaultTLSDir(), "Directory for the auto-generated local CA and certificate")
+	flag.StringVar(&cfg.UnixSocket, "unix-socket", "", "Also listen on this Unix domain socket path")
+	socketMode := flag.String("unix-socket-mode", "0660", "File permissions for the Unix domain socket")
+	flag.StringVar(&cfg.CaptureDir, "capture-dir", "", "Write full request/response captures to this directory (empty disables)")
+	flag.IntVar(&cfg.CaptureMaxFiles, "capture-max-files", 500, "Captures to keep before the oldest are deleted (0 = unlimited)")
+	flag.Int64Var(&cfg.CaptureMaxBody, "capture-max-body-bytes", 10<<20, "Longest request or response body captured in full; longer ones are cut (0 = no limit)")
+	capturePaths := flag.String("capture-paths", "", "Comma-separated path prefixes to capture (default: all)")
+	captureModels := flag.String("capture-models", "", "Comma-separated requested or upstream models to capture (default: all)")
+	flag.StringVar(&cfg.ResponseCache, "response-cache", "none", "Cache count_tokens and temperature 0 responses: memory, disk or none")
+	flag.StringVar(&cfg.ResponseCacheDir, "response-cache-dir", defaultResponseCacheDir(), "Directory for -response-cache disk")
+	flag.DurationVar(&cfg.ResponseCacheTTL, "response-cache-ttl", time.Hour, "How long cached responses are served")
+	flag.Int64Var(&cfg.ResponseCacheMaxBytes, "response-cache-max-bytes", 64<<20, "Total size of cached responses before the oldest are evicted")
+	flag.Int64Var(&cfg.ResponseCacheMaxEntryBytes, "response-cache-max-entry-bytes", 1<<20, "Largest response body that is cached")
+	flag.StringVar(&cfg.ModelsFile, "models-file", "", "JSON file of upstream model capabilities (context_window, max_output, images, documents, thinking) extending the built-in list")
+	flag.BoolVar(&cfg.SchemaHints, "schema-hints", false, "Append notes on dropped schema constraints (if/then/else, not, unions, ...) to tool parameter descriptions")
+	flag.BoolVar(&cfg.SanitizeToolNames, "sanitize-tool-names", true, "Rename tools whose names Gemini rejects and restore the names in responses")
+	flag.IntVar(&cfg.ToolDescriptionMax, "tool-description-max", 0, "Truncate tool descriptions longer than this many characters (0 = keep)")
+	flag.IntVar(&cfg.MaxTools, "max-tools", 0, "Most tools sent upstream per /v1/messages request; extra tools are pruned by relevance (0 = no limit)")
+	maxToolsModels := flag.String("max-tools-models", "", "Per-model tool limits, e.g. gemini-3-flash=64,gemini-3-pro-high=128")
+	flag.BoolVar(&cfg.MediaNormalization, "media-normalization", true, "Convert, downscale and recompress images and handle PDFs for what the target model accepts (HEIC is passed through or rejected, never converted)")
+	flag.BoolVar(&cfg.FetchMediaURLs, "fetch-media-urls", false, "Download url image and document sources for models that can't fetch them, and send them inline (public addresses only)")
+	flag.StringVar(&cfg.PDFFallback, "pdf-fallback", "text", "PDFs for models without document support: text (extract it) or reject")
+	flag.BoolVar(&cfg.Compaction, "compaction", false, "Trim old tool results and summarize old turns of /v1/messages requests that exceed the model's context window")
+	flag.StringVar(&cfg.CompactionModel, "compaction-model", "gemini-3-flash", "Upstream model that summarizes old turns for -compaction (empty = only trim tool results)")
+	flag.IntVar(&cfg.ThinkingBudget, "thinking-budget", 8192, "budget_tokens for thinking added to requests mapped to a -thinking model without it (0 = don't add)")
+	flag.StringVar(&cfg.ThinkingHistory, "thinking-history", "strip", "Prior thinking blocks signed by another model: strip, or text to keep the reasoning as text")
+	flag.StringVar(&cfg.ThinkingSignaturesFile, "thinking-signatures-file", defaultSignaturesFile(), "File that keeps which model signed each thinking block across restarts (empty = memory only)")
+	flag.BoolVar(&cfg.PromptCacheEmulation, "prompt-cache-emulation", false, "Report estimated cache_creation/cache_read_input_tokens from local prefix tracking when upstream omits them")
+	flag.StringVar(&cfg.CacheControl, "cache-control", "keep", "How cache_control blocks are forwarded upstream: keep, normalize or strip")
+	cacheControlModels := flag.String("cache-control-models", "", "Per-model cache_control handling, e.g. gemini-3-pro-high=strip")
+	flag.StringVar(&cfg.TraceExporter, "trace-exporter", "none", "Export OpenTelemetry traces: otlp, stdout or none")
+	flag.StringVar(&cfg.TraceEndpoint, "trace-endpoint", "http://127.0.0.1:4318", "OTLP/HTTP collector URL for -trace-exporter otlp")
+	flag.StringVar(&cfg.TraceService, "trace-service-name", "cliproxy-middleware", "service.name reported on exported traces")
+	flag.CommandLine.Parse(args)
 
 	// Environment variable overrides
 	if cfg.UpstreamURL == "http://127.0.0.1:8317" {
@@ -36,6 +202,166 @@ func Load() *Config {
 	if cfg.APIKey == "" {
 		cfg.APIKey = os.Getenv("CLIPROXY_API_KEY")
 	}
+	if cfg.KeysFile == "" {
+		cfg.KeysFile = os.Getenv("CLIPROXY_MIDDLEWARE_KEYS_FILE")
+	}
+
+	if cfg.TraceEndpoint == "http://127.0.0.1:4318" {
+		if envURL := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); envURL != "" {
+			cfg.TraceEndpoint = envURL
+		}
+	}
+
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		log.Fatalf("Invalid -log-format %q: expected text or json", cfg.LogFormat)
+	}
+	switch cfg.ResponseCache {
+	case "none", "memory", "disk":
+	default:
+		log.Fatalf("Invalid -response-cache %q: expected memory, disk or none", cfg.ResponseCache)
+	}
+	cfg.ModelCacheControl = parseModelList(*cacheControlModels)
+	cacheControlModes := []string{cfg.CacheControl}
+	for _, mode := range cfg.ModelCacheControl {
+		cacheControlModes = append(cacheControlModes, mode)
+	}
+	for _, mode := range cacheControlModes {
+		switch mode {
+		case "keep", "normalize", "strip":
+		default:
+			log.Fatalf("Invalid cache_control mode %q: expected keep, normalize or strip", mode)
+		}
+	}
+	if cfg.PDFFallback != "text" && cfg.PDFFallback != "reject" {
+		log.Fatalf("Invalid -pdf-fallback %q: expected text or reject", cfg.PDFFallback)
+	}
+	if cfg.ThinkingHistory != "strip" && cfg.ThinkingHistory != "text" {
+		log.Fatalf("Invalid -thinking-history %q: expected strip or text", cfg.ThinkingHistory)
+	}
+	switch cfg.TraceExporter {
+	case "none", "otlp", "stdout":
+	default:
+		log.Fatalf("Invalid -trace-exporter %q: expected otlp, stdout or none", cfg.TraceExporter)
+	}
+
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		log.Fatalf("Invalid -unix-socket-mode %q: %v", *socketMode, err)
+	}
+	cfg.UnixSocketMode = os.FileMode(mode)
+
+	cfg.HedgeModels = splitList(*hedgeModels)
+	cfg.CapturePaths = splitList(*capturePaths)
+	cfg.CaptureModels = splitList(*captureModels)
+
+	cfg.ModelMaxConcurrency = make(map[string]int)
+	for model, value := range parseModelList(*modelConcurrency) {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid concurrency limit for %s: %v", model, err)
+		}
+		cfg.ModelMaxConcurrency[model] = limit
+	}
+
+	cfg.ModelMaxTools = make(map[string]int)
+	for model, value := range parseModelList(*maxToolsModels) {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid tool limit for %s: %v", model, err)
+		}
+		cfg.ModelMaxTools[model] = limit
+	}
+
+	cfg.ModelStallTimeouts = make(map[string]time.Duration)
+	for model, timeout := range DefaultModelStallTimeouts {
+		cfg.ModelStallTimeouts[model] = timeout
+	}
+	for model, value := range parseModelList(*stallModels) {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid stall timeout for %s: %v", model, err)
+		}
+		cfg.ModelStallTimeouts[model] = timeout
+	}
 
 	return cfg
 }
+
+// defaultTLSDir is where the self-signed local CA is kept
+func defaultTLSDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".cliproxy-middleware-tls"
+	}
+	return filepath.Join(home, ".cliproxy-middleware", "tls")
+}
+
+// defaultSignaturesFile is where thinking signature origins are kept
+func defaultSignaturesFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".cliproxy-middleware-signatures.json"
+	}
+	return filepath.Join(home, ".cliproxy-middleware", "signatures.json")
+}
+
+// defaultResponseCacheDir is where the disk response cache is kept
+func defaultResponseCacheDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".cliproxy-middleware-cache"
+	}
+	return filepath.Join(home, ".cliproxy-middleware", "cache")
+}
+
+// CacheControlFor returns how cache_control is forwarded to an upstream model
+func (c *Config) CacheControlFor(model string) string {
+	if mode, ok := c.ModelCacheControl[model]; ok {
+		return mode
+	}
+	return c.CacheControl
+}
+
+// MaxToolsFor returns the tool limit for an upstream model, 0 for none
+func (c *Config) MaxToolsFor(model string) int {
+	if limit, ok := c.ModelMaxTools[model]; ok {
+		return limit
+	}
+	return c.MaxTools
+}
+
+// StallTimeoutFor returns the stall timeout for an upstream model
+func (c *Config) StallTimeoutFor(model string) time.Duration {
+	if timeout, ok := c.ModelStallTimeouts[model]; ok {
+		return timeout
+	}
+	return c.StallTimeout
+}
+
+// splitList parses a comma-separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseModelList parses "model=value,model=value" into a map
+func parseModelList(s string) map[string]string {
+	result := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		model, value, ok := strings.Cut(item, "=")
+		if !ok {
+			log.Fatalf("Invalid model setting %q, expected model=value", item)
+		}
+		result[strings.TrimSpace(model)] = strings.TrimSpace(value)
+	}
+	return result
+}
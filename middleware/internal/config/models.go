@@ -1,6 +1,9 @@
 package config
 
-import "strings"
+import (
+	"sort"
+	"strings"
+)
 
 // DefaultModelMappings maps standard Claude model names to Antigravity equivalents
 // Roo Code uses these exact model names:
@@ -52,3 +55,49 @@ func MapModel(model string) string {
 
 	return model
 }
+
+// Recognize returns the name of the mapping rule that matches model: the
+// model itself for exact mappings and mapping targets, the prefix followed by
+// "*" for prefix rules, or "" if no rule knows it
+func Recognize(model string) string {
+	if _, ok := DefaultModelMappings[model]; ok {
+		return model
+	}
+	for _, target := range DefaultModelMappings {
+		if model == target {
+			return model
+		}
+	}
+	for _, pm := range prefixMappings {
+		if model == pm.target {
+			return model
+		}
+	}
+	for _, pm := range prefixMappings {
+		if strings.HasPrefix(model, pm.prefix) {
+			return pm.prefix + "*"
+		}
+	}
+	return ""
+}
+
+// Mapping is one model mapping rule. Prefix rules apply to any model name
+// starting with From that has no exact mapping.
+type Mapping struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Prefix bool   `json:"prefix,omitempty"`
+}
+
+// Mappings lists the mapping rules in the order MapModel applies them
+func Mappings() []Mapping {
+	var mappings []Mapping
+	for from, to := range DefaultModelMappings {
+		mappings = append(mappings, Mapping{From: from, To: to})
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].From < mappings[j].From })
+	for _, pm := range prefixMappings {
+		mappings = append(mappings, Mapping{From: pm.prefix, To: pm.target, Prefix: true})
+	}
+	return mappings
+}
@@ -0,0 +1,224 @@
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"sync"
+	"time"
+
+	"cliproxy-middleware/internal/capture"
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// Limits on what is kept in memory for the dashboard
+const (
+	maxRecent   = 200
+	maxErrors   = 50
+	maxHealth   = 360 // one hour of checks at the 10s health interval
+	seriesSlots = 60  // minutes of token history
+)
+
+// Event describes a request starting or finishing
+type Event struct {
+	Type           string    `json:"type"` // "start" or "finish"
+	ID             string    `json:"id"`
+	Time           time.Time `json:"time"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Client         string    `json:"client"`
+	RequestedModel string    `json:"requested_model,omitempty"`
+	MappedModel    string    `json:"mapped_model,omitempty"`
+	Stream         bool      `json:"stream,omitempty"`
+	Status         int       `json:"status,omitempty"`
+	LatencyMS      int64     `json:"latency_ms,omitempty"`
+	TTFTMS         int64     `json:"ttft_ms,omitempty"`
+	InputTokens    int       `json:"input_tokens,omitempty"`
+	OutputTokens   int       `json:"output_tokens,omitempty"`
+	Captured       bool      `json:"captured,omitempty"`
+}
+
+// ErrorEntry is a failed request with the error body sent to the client
+type ErrorEntry struct {
+	Event
+	Body string `json:"body"`
+}
+
+// HealthSample is one upstream health check
+type HealthSample struct {
+	Time      time.Time `json:"time"`
+	Up        bool      `json:"up"`
+	LatencyMS int64     `json:"latency_ms"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// Tokens totals token usage
+type Tokens struct {
+	Requests      int64 `json:"requests"`
+	Input         int64 `json:"input"`
+	Output        int64 `json:"output"`
+	CacheCreation int64 `json:"cache_creation"`
+	CacheRead     int64 `json:"cache_read"`
+}
+
+func (t *Tokens) add(info *reqinfo.Info) {
+	t.Requests++
+	t.Input += int64(info.InputTokens)
+	t.Output += int64(info.OutputTokens)
+	t.CacheCreation += int64(info.CacheCreationInputTokens)
+	t.CacheRead += int64(info.CacheReadInputTokens)
+}
+
+// minute is one slot of the per-minute token series
+type minute struct {
+	Start  time.Time        `json:"start"`
+	Models map[string]int64 `json:"models"` // input+output tokens per mapped model
+}
+
+// Dashboard collects recent activity for the /ui pages
+type Dashboard struct {
+	capturer *capture.Capturer
+
+	mu       sync.Mutex
+	inFlight map[string]Event
+	recent   []Event
+	errors   []ErrorEntry
+	health   []HealthSample
+	byModel  map[string]*Tokens
+	byClient map[string]*Tokens
+	series   []minute
+	subs     map[chan Event]struct{}
+}
+
+// New creates a dashboard. capturer may be nil; when it is enabled, errors
+// link to their capture files.
+func New(capturer *capture.Capturer) *Dashboard {
+	return &Dashboard{
+		capturer: capturer,
+		inFlight: make(map[string]Event),
+		byModel:  make(map[string]*Tokens),
+		byClient: make(map[string]*Tokens),
+		subs:     make(map[chan Event]struct{}),
+	}
+}
+
+// static returns the embedded assets rooted at the static directory
+func static() fs.FS {
+	sub, _ := fs.Sub(staticFiles, "static")
+	return sub
+}
+
+// Begin records a request that has started
+func (d *Dashboard) Begin(info *reqinfo.Info, method, path string) {
+	ev := Event{Type: "start", ID: info.ID, Time: info.Start, Method: method, Path: path, Client: info.ClientID()}
+	d.mu.Lock()
+	d.inFlight[info.ID] = ev
+	d.mu.Unlock()
+	d.publish(ev)
+}
+
+// Finish records a finished request. errorBody is the (truncated) response
+// body of failed requests.
+func (d *Dashboard) Finish(info *reqinfo.Info, method, path string, status int, errorBody []byte) {
+	ev := Event{
+		Type:           "finish",
+		ID:             info.ID,
+		Time:           info.Start,
+		Method:         method,
+		Path:           path,
+		Client:         info.ClientID(),
+		RequestedModel: info.RequestedModel,
+		MappedModel:    info.MappedModel,
+		Stream:         info.Stream,
+		Status:         status,
+		LatencyMS:      time.Since(info.Start).Milliseconds(),
+		InputTokens:    info.InputTokens,
+		OutputTokens:   info.OutputTokens,
+	}
+	if !info.FirstToken.IsZero() {
+		ev.TTFTMS = info.FirstToken.Sub(info.Start).Milliseconds()
+	}
+	if status >= 400 && d.capturer.Enabled() {
+		_, ev.Captured = d.capturer.Find(info.ID)
+	}
+
+	d.mu.Lock()
+	delete(d.inFlight, info.ID)
+	d.recent = appendCapped(d.recent, ev, maxRecent)
+	if status >= 400 {
+		d.errors = appendCapped(d.errors, ErrorEntry{Event: ev, Body: string(errorBody)}, maxErrors)
+	}
+	if info.InputTokens > 0 || info.OutputTokens > 0 {
+		tokensFor(d.byModel, info.MappedModel).add(info)
+		tokensFor(d.byClient, info.ClientID()).add(info)
+		d.addToSeries(info.MappedModel, int64(info.InputTokens+info.OutputTokens))
+	}
+	d.mu.Unlock()
+	d.publish(ev)
+}
+
+// RecordHealth records the result of an upstream health check
+func (d *Dashboard) RecordHealth(up bool, latency time.Duration, detail string) {
+	d.mu.Lock()
+	d.health = appendCapped(d.health, HealthSample{Time: time.Now(), Up: up, LatencyMS: latency.Milliseconds(), Detail: detail}, maxHealth)
+	d.mu.Unlock()
+}
+
+func tokensFor(m map[string]*Tokens, key string) *Tokens {
+	if key == "" {
+		key = "unknown"
+	}
+	t, ok := m[key]
+	if !ok {
+		t = &Tokens{}
+		m[key] = t
+	}
+	return t
+}
+
+// addToSeries adds tokens to the current minute; callers must hold d.mu
+func (d *Dashboard) addToSeries(model string, tokens int64) {
+	if model == "" {
+		model = "unknown"
+	}
+	now := time.Now().Truncate(time.Minute)
+	if n := len(d.series); n == 0 || !d.series[n-1].Start.Equal(now) {
+		d.series = appendCapped(d.series, minute{Start: now, Models: make(map[string]int64)}, seriesSlots)
+	}
+	d.series[len(d.series)-1].Models[model] += tokens
+}
+
+func appendCapped[T any](list []T, item T, limit int) []T {
+	list = append(list, item)
+	if len(list) > limit {
+		list = append(list[:0], list[len(list)-limit:]...)
+	}
+	return list
+}
+
+// subscribe registers a channel for live events; the returned func removes it
+func (d *Dashboard) subscribe() (chan Event, func()) {
+	ch := make(chan Event, 64)
+	d.mu.Lock()
+	d.subs[ch] = struct{}{}
+	d.mu.Unlock()
+	return ch, func() {
+		d.mu.Lock()
+		delete(d.subs, ch)
+		d.mu.Unlock()
+	}
+}
+
+// publish sends ev to live subscribers, dropping it for any that are behind
+func (d *Dashboard) publish(ev Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ch := range d.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"cliproxy-middleware/internal/apierror"
+	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/sse"
+)
+
+// pingInterval keeps idle event streams open through proxies
+const pingInterval = 15 * time.Second
+
+// Handler serves the dashboard page under /ui/ and its data under /ui/api/.
+// authorize guards the data endpoints: it writes an error response and
+// returns false to deny the request. status supplies server-wide values
+// (uptime, upstream health, breaker state) for the header.
+func (d *Dashboard) Handler(authorize func(http.ResponseWriter, *http.Request) bool, status func() map[string]any) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /ui/", http.StripPrefix("/ui/", http.FileServerFS(static())))
+	mux.Handle("GET /ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+
+	guard := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if authorize(w, r) {
+				h(w, r)
+			}
+		}
+	}
+	mux.HandleFunc("GET /ui/api/state", guard(func(w http.ResponseWriter, r *http.Request) {
+		state := d.snapshot()
+		state["server"] = status()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	}))
+	mux.HandleFunc("GET /ui/api/events", guard(d.serveEvents))
+	mux.HandleFunc("GET /ui/api/captures/{id}", guard(d.serveCapture))
+	return mux
+}
+
+// snapshot returns everything the page renders on load
+func (d *Dashboard) snapshot() map[string]any {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	inFlight := make([]Event, 0, len(d.inFlight))
+	for _, ev := range d.inFlight {
+		inFlight = append(inFlight, ev)
+	}
+	sort.Slice(inFlight, func(i, j int) bool { return inFlight[i].Time.Before(inFlight[j].Time) })
+
+	byModel := make(map[string]Tokens, len(d.byModel))
+	for k, t := range d.byModel {
+		byModel[k] = *t
+	}
+	byClient := make(map[string]Tokens, len(d.byClient))
+	for k, t := range d.byClient {
+		byClient[k] = *t
+	}
+	series := make([]minute, len(d.series))
+	for i, m := range d.series {
+		models := make(map[string]int64, len(m.Models))
+		for k, v := range m.Models {
+			models[k] = v
+		}
+		series[i] = minute{Start: m.Start, Models: models}
+	}
+
+	return map[string]any{
+		"in_flight": inFlight,
+		"recent":    append([]Event{}, d.recent...),
+		"errors":    append([]ErrorEntry{}, d.errors...),
+		"health":    append([]HealthSample{}, d.health...),
+		"tokens": map[string]any{
+			"by_model":  byModel,
+			"by_client": byClient,
+			"series":    series,
+		},
+		"mappings":        config.Mappings(),
+		"capture_enabled": d.capturer.Enabled(),
+	}
+}
+
+// serveEvents streams request start and finish events as SSE
+func (d *Dashboard) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apierror.Write(w, r, apierror.Upstream(http.StatusInternalServerError, "Streaming is not supported"))
+		return
+	}
+	events, unsubscribe := d.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(": connected\n\n"))
+	flusher.Flush()
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			w.Write([]byte(": ping\n\n"))
+		case ev := <-events:
+			data, _ := json.Marshal(ev)
+			w.Write(sse.Encode("request", data))
+		}
+		flusher.Flush()
+	}
+}
+
+// serveCapture returns the capture file of a request
+func (d *Dashboard) serveCapture(w http.ResponseWriter, r *http.Request) {
+	path, ok := d.capturer.Find(r.PathValue("id"))
+	if !ok {
+		apierror.Write(w, r, apierror.NotFound("No capture for this request"))
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		apierror.Write(w, r, apierror.NotFound("Capture is no longer available"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,301 @@
+"use strict";
+
+// Data endpoints need the admin key when the middleware has a keys file.
+// It is kept for the browser session only.
+let apiKey = sessionStorage.getItem("cliproxy-key") || "";
+const rows = new Map(); // request ID -> table row
+const maxRows = 200;
+const colors = ["#58a6ff", "#3fb950", "#d29922", "#bc8cff", "#f85149", "#39c5cf", "#ff9bce", "#a5d6ff"];
+
+const $ = (sel) => document.querySelector(sel);
+
+function headers() {
+  return apiKey ? { "x-api-key": apiKey } : {};
+}
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === "class") node.className = v;
+    else if (k.startsWith("on")) node.addEventListener(k.slice(2), v);
+    else node.setAttribute(k, v);
+  }
+  for (const child of children) {
+    node.append(child instanceof Node ? child : document.createTextNode(child ?? ""));
+  }
+  return node;
+}
+
+function fmt(n) {
+  if (n >= 1e6) return (n / 1e6).toFixed(1) + "M";
+  if (n >= 1e3) return (n / 1e3).toFixed(1) + "k";
+  return String(n);
+}
+
+function ms(v) {
+  if (!v) return "";
+  return v >= 1000 ? (v / 1000).toFixed(1) + "s" : v + "ms";
+}
+
+function clock(t) {
+  return new Date(t).toLocaleTimeString();
+}
+
+function statusClass(status) {
+  return status ? "s" + String(status)[0] : "";
+}
+
+async function api(path) {
+  const resp = await fetch(path, { headers: headers() });
+  if (resp.status === 401 || resp.status === 403) {
+    const body = await resp.json().catch(() => ({}));
+    showLogin(body.error ? body.error.message : "Admin key required");
+    throw new Error("unauthorized");
+  }
+  if (!resp.ok) throw new Error(path + ": " + resp.status);
+  return resp.json();
+}
+
+function showLogin(message) {
+  $("#login").hidden = false;
+  $("#login-error").textContent = message;
+}
+
+$("#login-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  apiKey = $("#login-key").value.trim();
+  sessionStorage.setItem("cliproxy-key", apiKey);
+  $("#login").hidden = true;
+  start();
+});
+
+// Requests table
+
+function requestRow(ev) {
+  const model = ev.requested_model
+    ? (ev.requested_model === ev.mapped_model ? ev.mapped_model : ev.requested_model + " → " + ev.mapped_model)
+    : "";
+  const tokens = ev.input_tokens || ev.output_tokens ? fmt(ev.input_tokens || 0) + " / " + fmt(ev.output_tokens || 0) : "";
+  const tr = el("tr", { class: ev.type === "start" ? "pending" : "", title: ev.id },
+    el("td", {}, clock(ev.time)),
+    el("td", {}, ev.method + " " + ev.path + (ev.stream ? " (stream)" : "")),
+    el("td", {}, ev.client),
+    el("td", {}, model),
+    el("td", { class: statusClass(ev.status) }, ev.type === "start" ? "…" : String(ev.status)),
+    el("td", {}, ms(ev.latency_ms)),
+    el("td", {}, ms(ev.ttft_ms)),
+    el("td", {}, tokens));
+  return tr;
+}
+
+function showRequest(ev) {
+  const tbody = $("#requests tbody");
+  const tr = requestRow(ev);
+  const old = rows.get(ev.id);
+  if (old) {
+    old.replaceWith(tr);
+  } else {
+    tbody.prepend(tr);
+  }
+  rows.set(ev.id, tr);
+  while (tbody.children.length > maxRows) {
+    const last = tbody.lastElementChild;
+    rows.delete(last.title);
+    last.remove();
+  }
+}
+
+// Charts
+
+function renderBars(target, byKey) {
+  const entries = Object.entries(byKey || {}).sort((a, b) => (b[1].input + b[1].output) - (a[1].input + a[1].output));
+  const max = Math.max(1, ...entries.map(([, t]) => t.input + t.output));
+  target.replaceChildren(...entries.map(([name, t]) => {
+    const bar = el("div", { class: "bar" },
+      el("div", { class: "in", style: `width:${100 * t.input / max}%`, title: "input " + t.input }),
+      el("div", { class: "out", style: `width:${100 * t.output / max}%`, title: "output " + t.output }));
+    return el("div", { class: "row" },
+      el("span", { class: "name", title: name }, name),
+      bar,
+      el("span", { class: "num" }, fmt(t.input) + " / " + fmt(t.output)));
+  }));
+  if (!entries.length) target.replaceChildren(el("span", { class: "muted" }, "No usage yet"));
+}
+
+function renderSeries(series) {
+  const svg = $("#series");
+  const legend = $("#series-legend");
+  const ns = "http://www.w3.org/2000/svg";
+  svg.replaceChildren();
+  legend.replaceChildren();
+  if (!series || !series.length) {
+    legend.append(el("span", { class: "muted" }, "No usage yet"));
+    return;
+  }
+
+  // One slot per minute over the last hour, stacked by model
+  const now = Math.floor(Date.now() / 60000);
+  const slots = 60;
+  const models = [...new Set(series.flatMap((m) => Object.keys(m.models)))].sort();
+  const totals = new Array(slots).fill(0);
+  const bySlot = new Array(slots).fill(null).map(() => ({}));
+  for (const m of series) {
+    const slot = slots - 1 - (now - Math.floor(new Date(m.start).getTime() / 60000));
+    if (slot < 0 || slot >= slots) continue;
+    bySlot[slot] = m.models;
+    totals[slot] = Object.values(m.models).reduce((a, b) => a + b, 0);
+  }
+  const max = Math.max(1, ...totals);
+  const width = 600 / slots;
+  bySlot.forEach((counts, i) => {
+    let y = 120;
+    models.forEach((model, j) => {
+      const h = 118 * (counts[model] || 0) / max;
+      if (!h) return;
+      y -= h;
+      const rect = document.createElementNS(ns, "rect");
+      rect.setAttribute("x", i * width + 1);
+      rect.setAttribute("y", y);
+      rect.setAttribute("width", width - 2);
+      rect.setAttribute("height", h);
+      rect.setAttribute("fill", colors[j % colors.length]);
+      const title = document.createElementNS(ns, "title");
+      title.textContent = `${model}: ${counts[model]} tokens`;
+      rect.append(title);
+      svg.append(rect);
+    });
+  });
+  models.forEach((model, j) => {
+    legend.append(el("span", {}, el("i", { style: `background:${colors[j % colors.length]}` }), model));
+  });
+  legend.append(el("span", { class: "muted" }, "peak " + fmt(max) + "/min"));
+}
+
+function renderHealth(health) {
+  const strip = $("#health");
+  strip.replaceChildren(...(health || []).map((h) =>
+    el("div", { class: h.up ? "" : "down", title: `${clock(h.time)} ${h.up ? "up" : "down"} ${h.latency_ms}ms ${h.detail || ""}` })));
+  const last = (health || []).at(-1);
+  const down = (health || []).filter((h) => !h.up).length;
+  $("#health-detail").textContent = last
+    ? `Last check ${clock(last.time)}: ${last.up ? "up" : "down"} in ${last.latency_ms}ms${last.detail ? " (" + last.detail + ")" : ""}. ${down} of ${health.length} checks failed.`
+    : "No checks yet";
+}
+
+function renderMappings(mappings) {
+  $("#mappings tbody").replaceChildren(...(mappings || []).map((m) =>
+    el("tr", {}, el("td", {}, m.prefix ? m.from + "*" : m.from), el("td", {}, m.to))));
+}
+
+function renderErrors(errors, captureEnabled) {
+  const list = $("#errors");
+  list.replaceChildren(...(errors || []).slice().reverse().map((e) =>
+    el("li", { onclick: () => showError(e) },
+      el("span", { class: statusClass(e.status) }, String(e.status)), " ",
+      clock(e.time), " ", e.method, " ", e.path, " ", e.mapped_model || "",
+      e.captured ? " [capture]" : "")));
+  if (!list.children.length) {
+    list.append(el("li", { class: "muted" }, captureEnabled ? "No errors" : "No errors (start with -capture-dir to keep full payloads)"));
+  }
+}
+
+async function showError(entry) {
+  $("#payload-title").textContent = `${entry.status} ${entry.method} ${entry.path} (${entry.id})`;
+  let body = entry.body;
+  try { body = JSON.stringify(JSON.parse(body), null, 2); } catch (_) { /* not JSON */ }
+  $("#payload-body").textContent = body;
+  $("#payload").showModal();
+  if (entry.captured) {
+    try {
+      const capture = await api("/ui/api/captures/" + encodeURIComponent(entry.id));
+      $("#payload-body").textContent = "Response:\n" + body + "\n\nCapture:\n" + JSON.stringify(capture, null, 2);
+    } catch (_) { /* capture rotated away */ }
+  }
+}
+
+function renderStatus(server) {
+  const up = server.upstream_healthy;
+  $("#status").replaceChildren(
+    el("span", {}, "uptime " + server.uptime),
+    el("span", {}, "requests " + server.requests),
+    el("span", { class: up ? "s2" : "s5" }, "upstream " + (up ? "up" : "down")),
+    el("span", {}, "breaker " + server.circuit_breaker));
+}
+
+// Loading
+
+let refreshTimer = null;
+
+async function refresh() {
+  const state = await api("/ui/api/state");
+  renderStatus(state.server);
+  renderBars($("#tokens-model"), state.tokens.by_model);
+  renderBars($("#tokens-client"), state.tokens.by_client);
+  renderSeries(state.tokens.series);
+  renderHealth(state.health);
+  renderMappings(state.mappings);
+  renderErrors(state.errors, state.capture_enabled);
+  return state;
+}
+
+// scheduleRefresh coalesces chart updates while requests stream in
+function scheduleRefresh() {
+  if (refreshTimer) return;
+  refreshTimer = setTimeout(() => {
+    refreshTimer = null;
+    refresh().catch(() => {});
+  }, 2000);
+}
+
+async function streamEvents() {
+  const live = $("#live");
+  for (;;) {
+    try {
+      const resp = await fetch("/ui/api/events", { headers: headers() });
+      if (!resp.ok) throw new Error("events: " + resp.status);
+      live.classList.add("on");
+      const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+      let buffer = "";
+      for (;;) {
+        const { value, done } = await reader.read();
+        if (done) break;
+        buffer += value;
+        let end;
+        while ((end = buffer.indexOf("\n\n")) >= 0) {
+          const block = buffer.slice(0, end);
+          buffer = buffer.slice(end + 2);
+          const data = block.split("\n").filter((l) => l.startsWith("data: ")).map((l) => l.slice(6)).join("\n");
+          if (!data) continue;
+          const ev = JSON.parse(data);
+          showRequest(ev);
+          if (ev.type === "finish") scheduleRefresh();
+        }
+      }
+    } catch (_) {
+      // reconnect below
+    }
+    live.classList.remove("on");
+    await new Promise((r) => setTimeout(r, 3000));
+  }
+}
+
+let started = false;
+
+async function start() {
+  let state;
+  try {
+    state = await refresh();
+  } catch (_) {
+    return;
+  }
+  rows.clear();
+  $("#requests tbody").replaceChildren();
+  for (const ev of state.recent) showRequest(ev);
+  for (const ev of state.in_flight) showRequest(ev);
+  if (started) return;
+  started = true;
+  setInterval(() => refresh().catch(() => {}), 10000);
+  streamEvents();
+}
+
+start();
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"cliproxy-middleware/internal/apierror"
+	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/media"
+	"cliproxy-middleware/internal/models"
+	"cliproxy-middleware/internal/reqinfo"
+	"cliproxy-middleware/internal/tracing"
+)
+
+// fitModel clamps the request's output limit to what the upstream model
+// allows. If the prompt can't fit the model's context window it writes an
+// invalid_request_error and returns ok false. changed reports whether the
+// request was rewritten.
+func fitModel(w http.ResponseWriter, r *http.Request, cfg *config.Config, request map[string]json.RawMessage, field string, logger *slog.Logger) (changed, ok bool) {
+	model := reqinfo.From(r.Context()).MappedModel
+	caps, known := models.Lookup(model)
+	if !known {
+		return false, true
+	}
+
+	input := models.EstimateTokens(request, cfg.TokenMultiplier)
+	requested, err := models.Fit(request, caps, field, input)
+	var tooLong *models.TooLongError
+	if errors.As(err, &tooLong) {
+		logger.Warn("prompt exceeds context window", "model", model, "tokens", tooLong.Tokens, "maximum", tooLong.Maximum)
+		apierror.Write(w, r, apierror.InvalidRequest(err.Error()))
+		return false, false
+	}
+	if requested > 0 {
+		var limit int
+		json.Unmarshal(request[field], &limit)
+		logger.Debug("output limit clamped", "model", model, "field", field, "requested", requested, "limit", limit, "input_estimate", input)
+		return true, true
+	}
+	return false, true
+}
+
+// normalizeMedia fits image and document blocks to what the upstream model
+// accepts. If they can't be, it writes an invalid_request_error and returns
+// ok false.
+func normalizeMedia(w http.ResponseWriter, r *http.Request, cfg *config.Config, request map[string]json.RawMessage, logger *slog.Logger) (changed, ok bool) {
+	model := reqinfo.From(r.Context()).MappedModel
+	caps, known := models.Lookup(model)
+	if !known || !bytes.Contains(request["messages"], []byte(`"source"`)) {
+		return false, true
+	}
+
+	ctx, span := tracing.Start(r.Context(), "normalize media", tracing.KindInternal)
+	defer span.End()
+	result, err := media.Normalize(ctx, request, model, caps, media.Options{FetchURLs: cfg.FetchMediaURLs, PDFFallback: cfg.PDFFallback})
+	span.SetAttributes(
+		tracing.Int("cliproxy.media.fetched", result.Fetched),
+		tracing.Int("cliproxy.media.converted", result.Converted),
+		tracing.Int("cliproxy.media.extracted", result.Extracted),
+	)
+	var reject *media.RejectError
+	if errors.As(err, &reject) {
+		span.SetError(err.Error())
+		logger.Warn("media rejected", "model", model, "error", err)
+		apierror.Write(w, r, apierror.InvalidRequest(err.Error()))
+		return false, false
+	}
+	if err != nil {
+		logger.Warn("media normalization failed", "model", model, "error", err)
+		return false, true
+	}
+	if result.Changed() {
+		logger.Debug("media normalized", "model", model, "fetched", result.Fetched, "converted", result.Converted, "extracted", result.Extracted)
+	}
+	return result.Changed(), true
+}
@@ -4,33 +4,34 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httputil"
 
+	"cliproxy-middleware/internal/apierror"
 	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/reqinfo"
 	"cliproxy-middleware/internal/schema"
+	"cliproxy-middleware/internal/toolnames"
+	"cliproxy-middleware/internal/tracing"
 )
 
 // ChatCompletions intercepts /v1/chat/completions to normalize tool schemas and map model names
 // OpenAI format uses tools[].function.parameters instead of tools[].input_schema
 func ChatCompletions(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if cfg.Debug {
-			log.Printf("[chat] received %s %s", r.Method, r.URL.Path)
-		}
+		logger := reqinfo.Logger(r.Context()).With("handler", "chat")
+		logger.Debug("received", "method", r.Method, "path", r.URL.Path)
 
 		if r.Method != http.MethodPost {
 			serveProxy(w, r, proxy)
 			return
 		}
 
-		body, err := io.ReadAll(r.Body)
+		body, err := readBody(r)
 		if err != nil {
-			http.Error(w, `{"error":{"message":"Failed to read request body","type":"invalid_request_error"}}`, http.StatusBadRequest)
+			apierror.Write(w, r, apierror.InvalidRequest("Failed to read request body"))
 			return
 		}
-		r.Body.Close()
 
 		// Parse request
 		var rawRequest map[string]json.RawMessage
@@ -42,16 +43,20 @@ func ChatCompletions(cfg *config.Config, proxy *httputil.ReverseProxy) http.Hand
 		}
 
 		modified := false
+		info := reqinfo.From(r.Context())
 
 		// Map model name to Antigravity equivalent
 		if modelRaw, hasModel := rawRequest["model"]; hasModel {
 			var model string
 			if err := json.Unmarshal(modelRaw, &model); err == nil {
+				_, span := tracing.Start(r.Context(), "map model", tracing.KindInternal)
 				mappedModel := config.MapModel(model)
+				span.SetAttributes(tracing.String("cliproxy.requested_model", model), tracing.String("cliproxy.mapped_model", mappedModel))
+				span.End()
+				info.RequestedModel = model
+				info.MappedModel = mappedModel
 				if mappedModel != model {
-					if cfg.Debug {
-						log.Printf("[chat] model mapped: %s -> %s", model, mappedModel)
-					}
+					logger.Debug("model mapped", "from", model, "to", mappedModel)
 					newModelJSON, _ := json.Marshal(mappedModel)
 					rawRequest["model"] = newModelJSON
 					modified = true
@@ -66,16 +71,14 @@ func ChatCompletions(cfg *config.Config, proxy *httputil.ReverseProxy) http.Hand
 			for k := range rawRequest {
 				keys = append(keys, k)
 			}
-			log.Printf("[chat] request keys: %v, hasTools: %v", keys, hasTools)
-			if hasTools {
-				log.Printf("[chat] tools length: %d bytes", len(toolsRaw))
-			}
+			logger.Debug("request parsed", "keys", keys, "has_tools", hasTools, "tools_bytes", len(toolsRaw))
 		}
 
 		// Normalize tools if present (OpenAI format)
 		if hasTools && len(toolsRaw) > 0 && string(toolsRaw) != "null" {
 			var tools []map[string]interface{}
 			if err := json.Unmarshal(toolsRaw, &tools); err == nil {
+				_, span := tracing.Start(r.Context(), "normalize schemas", tracing.KindInternal)
 				for i, tool := range tools {
 					// OpenAI format: tools[].function.parameters
 					if function, exists := tool["function"]; exists {
@@ -83,16 +86,20 @@ func ChatCompletions(cfg *config.Config, proxy *httputil.ReverseProxy) http.Hand
 							if parameters, hasParams := funcMap["parameters"]; hasParams {
 								if schemaMap, ok := parameters.(map[string]interface{}); ok {
 									originalJSON, _ := json.Marshal(schemaMap)
+									if cfg.SchemaHints {
+										schema.Hoist(schemaMap)
+									}
 									normalized := schema.Normalize(schemaMap, cfg.Debug)
 									normalizedJSON, _ := json.Marshal(normalized)
 
 									if string(originalJSON) != string(normalizedJSON) {
 										modified = true
+										info.SchemasNormalized++
 										funcMap["parameters"] = normalized
 										tools[i]["function"] = funcMap
 										if cfg.Debug {
 											if name, ok := funcMap["name"].(string); ok {
-												log.Printf("[chat] normalized tool: %s", name)
+												logger.Debug("normalized tool", "tool", name)
 											}
 										}
 									}
@@ -105,21 +112,43 @@ func ChatCompletions(cfg *config.Config, proxy *httputil.ReverseProxy) http.Hand
 					normalizedTools, _ := json.Marshal(tools)
 					rawRequest["tools"] = normalizedTools
 				}
+				span.SetAttributes(tracing.Int("cliproxy.tools", len(tools)), tracing.Int("cliproxy.schemas_normalized", info.SchemasNormalized))
+				span.End()
 			}
 		}
 
+		// Give tools names Gemini accepts; the response gets the originals back
+		rename := cfg.SanitizeToolNames && toolnames.Applies(info.MappedModel)
+		if mapping, truncated := toolnames.Sanitize(rawRequest, toolnames.OpenAI, rename, cfg.ToolDescriptionMax); mapping != nil || truncated > 0 {
+			if mapping != nil {
+				r = r.WithContext(toolnames.With(r.Context(), mapping))
+			}
+			logger.Debug("tools sanitized", "renamed", mapping.Len(), "descriptions_truncated", truncated)
+			modified = true
+		}
+
+		// Keep the output limit within the upstream model's limits
+		field := "max_tokens"
+		if _, ok := rawRequest["max_completion_tokens"]; ok {
+			field = "max_completion_tokens"
+		}
+		if changed, ok := fitModel(w, r, cfg, rawRequest, field, logger); !ok {
+			return
+		} else if changed {
+			modified = true
+		}
+
 		// Apply modifications if any
 		if modified {
 			newBody, _ := json.Marshal(rawRequest)
-			if cfg.Debug {
-				log.Printf("[chat] request modified, %d -> %d bytes", len(body), len(newBody))
-			}
+			logger.Debug("request modified", "bytes_before", len(body), "bytes_after", len(newBody))
 			r.Body = io.NopCloser(bytes.NewReader(newBody))
 			r.ContentLength = int64(len(newBody))
 		} else {
 			r.Body = io.NopCloser(bytes.NewReader(body))
 			r.ContentLength = int64(len(body))
 		}
+		json.Unmarshal(rawRequest["stream"], &info.Stream)
 
 		serveProxy(w, r, proxy)
 	}
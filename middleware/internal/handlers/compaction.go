@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cliproxy-middleware/internal/capture"
+	"cliproxy-middleware/internal/compaction"
+	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/models"
+	"cliproxy-middleware/internal/reqinfo"
+	"cliproxy-middleware/internal/tracing"
+)
+
+// summaryTimeout bounds one summarization request
+const summaryTimeout = 2 * time.Minute
+
+const summaryPrompt = `Summarize the conversation transcript below so an assistant can continue the work without it. Keep the user's goals and instructions, decisions made, files and identifiers involved, results of tool calls that still matter, and what remains to be done. Be concise; write plain text only.
+
+<transcript>
+%s
+</transcript>`
+
+// compact shrinks a Messages request that doesn't fit the upstream model's
+// context window, reporting what was done in the X-Context-Compaction header
+func compact(w http.ResponseWriter, r *http.Request, cfg *config.Config, transport http.RoundTripper, request map[string]json.RawMessage, logger *slog.Logger) bool {
+	model := reqinfo.From(r.Context()).MappedModel
+	caps, known := models.Lookup(model)
+	if !known {
+		return false
+	}
+	var maxTokens int
+	json.Unmarshal(request["max_tokens"], &maxTokens)
+	target := caps.ContextWindow - min(maxTokens, caps.MaxOutput)
+
+	ctx, span := tracing.Start(r.Context(), "compact context", tracing.KindInternal)
+	defer span.End()
+	result, err := compaction.Compact(ctx, request, target, cfg.TokenMultiplier, summarizer(r, cfg, transport))
+	if err != nil {
+		span.SetError(err.Error())
+		logger.Warn("context compaction failed", "model", model, "error", err)
+	}
+	if result == nil {
+		return false
+	}
+
+	span.SetAttributes(
+		tracing.Int("cliproxy.compaction.tool_results_trimmed", result.TrimmedToolResults),
+		tracing.Int("cliproxy.compaction.messages_summarized", result.SummarizedMessages),
+		tracing.Int("cliproxy.compaction.tokens_before", result.TokensBefore),
+		tracing.Int("cliproxy.compaction.tokens_after", result.TokensAfter),
+	)
+	w.Header().Set("X-Context-Compaction", result.Header())
+	logger.Info("context compacted", "model", model,
+		"tool_results_trimmed", result.TrimmedToolResults, "messages_summarized", result.SummarizedMessages,
+		"tokens_before", result.TokensBefore, "tokens_after", result.TokensAfter, "target", target, "fits", result.Fits(target))
+	return true
+}
+
+// summarizer asks -compaction-model for a summary, authenticating like the
+// client request. It goes through the proxy's transport, so the breaker and
+// concurrency limits apply, and its usage counts toward the client's quota.
+func summarizer(r *http.Request, cfg *config.Config, transport http.RoundTripper) compaction.Summarizer {
+	if cfg.CompactionModel == "" {
+		return nil
+	}
+	client := &http.Client{Timeout: summaryTimeout, Transport: transport}
+	return func(ctx context.Context, transcript string) (string, error) {
+		// The summary is a request of its own for the limiter and tracing,
+		// and is left out of the client request's capture
+		parent := reqinfo.From(r.Context())
+		info := &reqinfo.Info{ID: parent.ID, Start: time.Now(), Client: parent.Client,
+			RequestedModel: cfg.CompactionModel, MappedModel: cfg.CompactionModel}
+		ctx = capture.WithRecord(reqinfo.With(ctx, info), nil)
+
+		body, _ := json.Marshal(map[string]any{
+			"model":      cfg.CompactionModel,
+			"max_tokens": 4096,
+			"messages": []map[string]any{
+				{"role": "user", "content": fmt.Sprintf(summaryPrompt, transcript)},
+			},
+		})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.UpstreamURL+"/v1/messages", bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("anthropic-version", "2023-06-01")
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+		} else if r.Header.Get("x-api-key") != "" {
+			req.Header.Set("x-api-key", r.Header.Get("x-api-key"))
+		} else if cfg.APIKey != "" {
+			req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+		}
+		if info.ID != "" {
+			req.Header.Set("X-Request-ID", info.ID)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%s returned %d", cfg.CompactionModel, resp.StatusCode)
+		}
+
+		var message struct {
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+			Usage *AnthropicUsage `json:"usage"`
+		}
+		if err := json.Unmarshal(respBody, &message); err != nil {
+			return "", err
+		}
+		if message.Usage != nil {
+			addUsage(info.ClientID(), message.Usage, cfg.Debug)
+		}
+		var summary string
+		for _, block := range message.Content {
+			if block.Type == "text" {
+				summary += block.Text
+			}
+		}
+		if summary == "" {
+			return "", fmt.Errorf("%s returned no text", cfg.CompactionModel)
+		}
+		return summary, nil
+	}
+}
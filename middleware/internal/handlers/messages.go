@@ -5,33 +5,37 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"strings"
 
+	"cliproxy-middleware/internal/apierror"
 	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/promptcache"
+	"cliproxy-middleware/internal/reqinfo"
 	"cliproxy-middleware/internal/schema"
+	"cliproxy-middleware/internal/thinking"
+	"cliproxy-middleware/internal/toolnames"
+	"cliproxy-middleware/internal/toolprune"
+	"cliproxy-middleware/internal/tracing"
 )
 
 // Messages intercepts /v1/messages to normalize tool schemas and map model names
 func Messages(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if cfg.Debug {
-			log.Printf("[messages] received %s %s", r.Method, r.URL.Path)
-		}
+		logger := reqinfo.Logger(r.Context()).With("handler", "messages")
+		logger.Debug("received", "method", r.Method, "path", r.URL.Path)
 
 		if r.Method != http.MethodPost {
 			serveProxy(w, r, proxy)
 			return
 		}
 
-		body, err := io.ReadAll(r.Body)
+		body, err := readBody(r)
 		if err != nil {
-			http.Error(w, `{"error":{"message":"Failed to read request body","type":"invalid_request_error"}}`, http.StatusBadRequest)
+			apierror.Write(w, r, apierror.InvalidRequest("Failed to read request body"))
 			return
 		}
-		r.Body.Close()
 
 		// Parse request
 		var rawRequest map[string]json.RawMessage
@@ -43,16 +47,20 @@ func Messages(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFunc
 		}
 
 		modified := false
+		info := reqinfo.From(r.Context())
 
 		// Map model name to Antigravity equivalent
 		if modelRaw, hasModel := rawRequest["model"]; hasModel {
 			var model string
 			if err := json.Unmarshal(modelRaw, &model); err == nil {
+				_, span := tracing.Start(r.Context(), "map model", tracing.KindInternal)
 				mappedModel := config.MapModel(model)
+				span.SetAttributes(tracing.String("cliproxy.requested_model", model), tracing.String("cliproxy.mapped_model", mappedModel))
+				span.End()
+				info.RequestedModel = model
+				info.MappedModel = mappedModel
 				if mappedModel != model {
-					if cfg.Debug {
-						log.Printf("[messages] model mapped: %s -> %s", model, mappedModel)
-					}
+					logger.Debug("model mapped", "from", model, "to", mappedModel)
 					newModelJSON, _ := json.Marshal(mappedModel)
 					rawRequest["model"] = newModelJSON
 					modified = true
@@ -60,6 +68,28 @@ func Messages(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFunc
 			}
 		}
 
+		// Fit the thinking configuration to what the upstream model accepts
+		if action := thinking.Translate(rawRequest, info.MappedModel, cfg.ThinkingBudget); action != "" {
+			logger.Debug("thinking translated", "model", info.MappedModel, "action", action)
+			modified = true
+		}
+		if n := thinking.SanitizeHistory(rawRequest, info.MappedModel, cfg.ThinkingHistory); n > 0 {
+			_, hasThinking := rawRequest["thinking"]
+			logger.Debug("thinking history sanitized", "model", info.MappedModel, "blocks", n, "thinking", hasThinking)
+			modified = true
+		}
+
+		// Keep the tool list within the upstream model's limit
+		maxTools := cfg.MaxToolsFor(info.MappedModel)
+		if pruned := toolprune.Prune(rawRequest, maxTools); pruned != nil {
+			r = r.WithContext(toolprune.With(r.Context(), pruned))
+			logger.Info("tools pruned", "model", info.MappedModel, "tools", pruned.Total, "kept", pruned.Kept)
+			if pruned.Kept > maxTools {
+				logger.Warn("tools called earlier or forced by tool_choice exceed the tool limit", "model", info.MappedModel, "kept", pruned.Kept, "limit", maxTools)
+			}
+			modified = true
+		}
+
 		// Check if there are tools to normalize
 		toolsRaw, hasTools := rawRequest["tools"]
 		if cfg.Debug {
@@ -67,29 +97,31 @@ func Messages(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFunc
 			for k := range rawRequest {
 				keys = append(keys, k)
 			}
-			log.Printf("[messages] request keys: %v, hasTools: %v", keys, hasTools)
-			if hasTools {
-				log.Printf("[messages] tools length: %d bytes", len(toolsRaw))
-			}
+			logger.Debug("request parsed", "keys", keys, "has_tools", hasTools, "tools_bytes", len(toolsRaw))
 		}
 
 		// Normalize tools if present
 		if hasTools && len(toolsRaw) > 0 && string(toolsRaw) != "null" {
 			var tools []map[string]interface{}
 			if err := json.Unmarshal(toolsRaw, &tools); err == nil {
+				_, span := tracing.Start(r.Context(), "normalize schemas", tracing.KindInternal)
 				for i, tool := range tools {
 					if inputSchema, exists := tool["input_schema"]; exists {
 						if schemaMap, ok := inputSchema.(map[string]interface{}); ok {
 							originalJSON, _ := json.Marshal(schemaMap)
+							if cfg.SchemaHints {
+								schema.Hoist(schemaMap)
+							}
 							normalized := schema.Normalize(schemaMap, cfg.Debug)
 							normalizedJSON, _ := json.Marshal(normalized)
 
 							if string(originalJSON) != string(normalizedJSON) {
 								modified = true
+								info.SchemasNormalized++
 								tools[i]["input_schema"] = normalized
 								if cfg.Debug {
 									if name, ok := tool["name"].(string); ok {
-										log.Printf("[messages] normalized tool: %s", name)
+										logger.Debug("normalized tool", "tool", name)
 									}
 								}
 							}
@@ -100,40 +132,107 @@ func Messages(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFunc
 					normalizedTools, _ := json.Marshal(tools)
 					rawRequest["tools"] = normalizedTools
 				}
+				span.SetAttributes(tracing.Int("cliproxy.tools", len(tools)), tracing.Int("cliproxy.schemas_normalized", info.SchemasNormalized))
+				span.End()
+			}
+		}
+
+		// Give tools names Gemini accepts; the response gets the originals back
+		rename := cfg.SanitizeToolNames && toolnames.Applies(info.MappedModel)
+		if mapping, truncated := toolnames.Sanitize(rawRequest, toolnames.Anthropic, rename, cfg.ToolDescriptionMax); mapping != nil || truncated > 0 {
+			if mapping != nil {
+				r = r.WithContext(toolnames.With(r.Context(), mapping))
+			}
+			logger.Debug("tools sanitized", "renamed", mapping.Len(), "descriptions_truncated", truncated)
+			modified = true
+		}
+
+		// Fit images and documents to what the upstream model accepts
+		if cfg.MediaNormalization {
+			if changed, ok := normalizeMedia(w, r, cfg, rawRequest, logger); !ok {
+				return
+			} else if changed {
+				modified = true
+			}
+		}
+
+		// Shrink conversations that outgrew the upstream model's context window
+		if cfg.Compaction && compact(w, r, cfg, proxy.Transport, rawRequest, logger) {
+			modified = true
+		}
+
+		// Keep max_tokens within the upstream model's limits
+		if changed, ok := fitModel(w, r, cfg, rawRequest, "max_tokens", logger); !ok {
+			return
+		} else if changed {
+			modified = true
+		}
+
+		// Track cache_control prefixes, then forward them as the upstream model accepts
+		if cfg.PromptCacheEmulation {
+			if plan := promptcache.Analyze(rawRequest, info.ClientID(), info.MappedModel, cfg.TokenMultiplier); plan != nil {
+				r = r.WithContext(promptcache.With(r.Context(), plan))
 			}
 		}
+		if mode := cfg.CacheControlFor(info.MappedModel); promptcache.ApplyMode(rawRequest, mode) {
+			logger.Debug("cache_control rewritten", "mode", mode)
+			modified = true
+		}
 
 		// Apply modifications if any
 		if modified {
 			newBody, _ := json.Marshal(rawRequest)
-			if cfg.Debug {
-				log.Printf("[messages] request modified, %d -> %d bytes", len(body), len(newBody))
-			}
-			r.Body = io.NopCloser(bytes.NewReader(newBody))
-			r.ContentLength = int64(len(newBody))
-		} else {
-			r.Body = io.NopCloser(bytes.NewReader(body))
-			r.ContentLength = int64(len(body))
+			logger.Debug("request modified", "bytes_before", len(body), "bytes_after", len(newBody))
+			body = newBody
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+
+		// Keep the upstream body so a broken stream can be resumed
+		json.Unmarshal(rawRequest["stream"], &info.Stream)
+		if info.Stream {
+			info.UpstreamBody = body
 		}
 
 		serveProxyWithUsage(w, r, proxy, cfg.Debug)
 	}
 }
 
+// readBody reads and closes the client request body
+func readBody(r *http.Request) ([]byte, error) {
+	_, span := tracing.Start(r.Context(), "read body", tracing.KindInternal)
+	defer span.End()
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	span.SetAttributes(tracing.Int("http.request.body.size", len(body)))
+	return body, err
+}
+
 func serveProxy(w http.ResponseWriter, r *http.Request, proxy *httputil.ReverseProxy) {
 	serveProxyWithUsage(w, r, proxy, false)
 }
 
 func serveProxyWithUsage(w http.ResponseWriter, r *http.Request, proxy *httputil.ReverseProxy, debug bool) {
 	// Wrap writer to capture usage from responses
+	info := reqinfo.From(r.Context())
 	uw := &usageTrackingWriter{
 		ResponseWriter: w,
+		info:           info,
+		client:         info.ClientID(),
 		debug:          debug,
 	}
 	if flusher, ok := w.(http.Flusher); ok {
 		uw.flusher = flusher
 	}
 	proxy.ServeHTTP(uw, r)
+
+	// A stream's usage is spread over several events; record it once, complete
+	if uw.isStreaming && uw.streamUsage.Total() > 0 {
+		addUsage(uw.client, &uw.streamUsage, debug)
+	}
 }
 
 type flushWriter struct {
@@ -151,13 +250,18 @@ func (fw *flushWriter) Write(p []byte) (int, error) {
 type usageTrackingWriter struct {
 	http.ResponseWriter
 	flusher     http.Flusher
+	info        *reqinfo.Info
+	client      string
 	debug       bool
 	isStreaming bool
 	headersSent bool
+	status      int
+	streamUsage AnthropicUsage // largest counts seen in the stream's events
 }
 
 func (uw *usageTrackingWriter) WriteHeader(statusCode int) {
 	uw.headersSent = true
+	uw.status = statusCode
 	contentType := uw.Header().Get("Content-Type")
 	uw.isStreaming = strings.Contains(contentType, "text/event-stream")
 	uw.ResponseWriter.WriteHeader(statusCode)
@@ -170,7 +274,13 @@ func (uw *usageTrackingWriter) Write(p []byte) (int, error) {
 		uw.parseStreamingUsage(p)
 	} else {
 		// For non-streaming, check if this looks like a complete response
-		TrackUsageFromResponse(p, false, uw.debug)
+		if uw.status < http.StatusBadRequest {
+			uw.info.MarkFirstToken()
+		}
+		if usage := trackNonStreamingUsage(uw.client, p, uw.debug); usage != nil {
+			uw.info.RecordUsage(usage.InputTokens, usage.OutputTokens, usage.CacheCreationInputTokens, usage.CacheReadInputTokens)
+			uw.info.RecordResponse(responseIdentity(p))
+		}
 	}
 
 	n, err := uw.ResponseWriter.Write(p)
@@ -190,16 +300,18 @@ func (uw *usageTrackingWriter) parseStreamingUsage(data []byte) {
 			if jsonData == "[DONE]" {
 				continue
 			}
-			// Look for message_delta with usage info
-			var event struct {
-				Type  string         `json:"type"`
-				Usage *AnthropicUsage `json:"usage,omitempty"`
+			// Usage arrives on message_start, message_delta and OpenAI's final chunk
+			delta := parseStreamEvent([]byte(jsonData))
+			if delta == nil {
+				continue
 			}
-			if err := json.Unmarshal([]byte(jsonData), &event); err == nil {
-				if event.Usage != nil {
-					addUsage(event.Usage, uw.debug)
-				}
+			if delta.Type == "content_block_delta" || len(delta.Choices) > 0 {
+				uw.info.MarkFirstToken()
 			}
+			uw.info.RecordResponse(delta.identity())
+			delta.mergeUsage(&uw.streamUsage)
+			usage := uw.streamUsage
+			uw.info.RecordUsage(usage.InputTokens, usage.OutputTokens, usage.CacheCreationInputTokens, usage.CacheReadInputTokens)
 		}
 	}
 }
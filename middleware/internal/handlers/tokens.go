@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"time"
 
+	"cliproxy-middleware/internal/apierror"
+	"cliproxy-middleware/internal/breaker"
+	"cliproxy-middleware/internal/capture"
 	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/reqinfo"
+	"cliproxy-middleware/internal/tracing"
 )
 
 // TokenCountRequest represents the Anthropic token count request
@@ -29,33 +33,33 @@ type TokenCountResponse struct {
 // httpClient is a shared client with connection pooling for token counting
 var tokenCountClient = &http.Client{
 	Timeout: 30 * time.Second,
-	Transport: &http.Transport{
+	Transport: &tracing.Transport{Transport: &http.Transport{
 		MaxIdleConns:        10,
 		MaxIdleConnsPerHost: 5,
 		IdleConnTimeout:     90 * time.Second,
-	},
+	}},
 }
 
 // TokenCount handles /v1/messages/count_tokens by forwarding to upstream
-// Falls back to local estimation if upstream fails
-func TokenCount(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFunc {
+// Falls back to local estimation if upstream fails or the circuit breaker is open
+func TokenCount(cfg *config.Config, proxy *httputil.ReverseProxy, brk *breaker.Breaker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		logger := reqinfo.Logger(r.Context()).With("handler", "token_count")
 		if r.Method != http.MethodPost {
-			http.Error(w, `{"error":{"message":"Method not allowed","type":"invalid_request_error"}}`, http.StatusMethodNotAllowed)
+			apierror.Write(w, r, apierror.MethodNotAllowed())
 			return
 		}
 
-		body, err := io.ReadAll(r.Body)
+		body, err := readBody(r)
 		if err != nil {
-			http.Error(w, `{"error":{"message":"Failed to read request body","type":"invalid_request_error"}}`, http.StatusBadRequest)
+			apierror.Write(w, r, apierror.InvalidRequest("Failed to read request body"))
 			return
 		}
-		r.Body.Close()
 
 		// Parse request for model mapping
 		var rawRequest map[string]json.RawMessage
 		if err := json.Unmarshal(body, &rawRequest); err != nil {
-			http.Error(w, `{"error":{"message":"Invalid JSON","type":"invalid_request_error"}}`, http.StatusBadRequest)
+			apierror.Write(w, r, apierror.InvalidRequest("Invalid JSON"))
 			return
 		}
 
@@ -63,11 +67,15 @@ func TokenCount(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFu
 		if modelRaw, hasModel := rawRequest["model"]; hasModel {
 			var model string
 			if err := json.Unmarshal(modelRaw, &model); err == nil {
+				_, span := tracing.Start(r.Context(), "map model", tracing.KindInternal)
 				mappedModel := config.MapModel(model)
+				span.SetAttributes(tracing.String("cliproxy.requested_model", model), tracing.String("cliproxy.mapped_model", mappedModel))
+				span.End()
+				info := reqinfo.From(r.Context())
+				info.RequestedModel = model
+				info.MappedModel = mappedModel
 				if mappedModel != model {
-					if cfg.Debug {
-						log.Printf("[token_count] model mapped: %s -> %s", model, mappedModel)
-					}
+					logger.Debug("model mapped", "from", model, "to", mappedModel)
 					newModelJSON, _ := json.Marshal(mappedModel)
 					rawRequest["model"] = newModelJSON
 					body, _ = json.Marshal(rawRequest)
@@ -75,15 +83,20 @@ func TokenCount(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFu
 			}
 		}
 
+		// Don't wait on an upstream that is known to be failing
+		if brk.IsOpen() {
+			logger.Debug("circuit breaker open, using fallback")
+			sendFallbackTokenCount(w, r, body, cfg)
+			return
+		}
+
 		// Try to forward to upstream for accurate token counting
 		upstreamURL := fmt.Sprintf("%s/v1/messages/count_tokens", cfg.UpstreamURL)
 
-		req, err := http.NewRequest("POST", upstreamURL, bytes.NewReader(body))
+		req, err := http.NewRequestWithContext(r.Context(), "POST", upstreamURL, bytes.NewReader(body))
 		if err != nil {
-			if cfg.Debug {
-				log.Printf("[token_count] failed to create request: %v, using fallback", err)
-			}
-			sendFallbackTokenCount(w, body, cfg)
+			logger.Debug("failed to create request, using fallback", "error", err)
+			sendFallbackTokenCount(w, r, body, cfg)
 			return
 		}
 
@@ -97,17 +110,20 @@ func TokenCount(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFu
 			req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
 		}
 
+		if id := reqinfo.From(r.Context()).ID; id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+
 		// Forward anthropic-version header if present
 		if ver := r.Header.Get("anthropic-version"); ver != "" {
 			req.Header.Set("anthropic-version", ver)
 		}
 
+		capture.RecordUpstream(req)
 		resp, err := tokenCountClient.Do(req)
 		if err != nil {
-			if cfg.Debug {
-				log.Printf("[token_count] upstream request failed: %v, using fallback", err)
-			}
-			sendFallbackTokenCount(w, body, cfg)
+			logger.Debug("upstream request failed, using fallback", "error", err)
+			sendFallbackTokenCount(w, r, body, cfg)
 			return
 		}
 		defer resp.Body.Close()
@@ -115,26 +131,20 @@ func TokenCount(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFu
 		// If upstream returns non-2xx, use fallback
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 			respBody, _ := io.ReadAll(resp.Body)
-			if cfg.Debug {
-				log.Printf("[token_count] upstream returned %d: %s, using fallback", resp.StatusCode, string(respBody))
-			}
-			sendFallbackTokenCount(w, body, cfg)
+			logger.Debug("upstream error, using fallback", "status", resp.StatusCode, "body", string(respBody))
+			sendFallbackTokenCount(w, r, body, cfg)
 			return
 		}
 
 		// Forward upstream response
 		respBody, err := io.ReadAll(resp.Body)
 		if err != nil {
-			if cfg.Debug {
-				log.Printf("[token_count] failed to read upstream response: %v, using fallback", err)
-			}
-			sendFallbackTokenCount(w, body, cfg)
+			logger.Debug("failed to read upstream response, using fallback", "error", err)
+			sendFallbackTokenCount(w, r, body, cfg)
 			return
 		}
 
-		if cfg.Debug {
-			log.Printf("[token_count] upstream returned: %s", string(respBody))
-		}
+		logger.Debug("upstream returned", "body", string(respBody))
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(resp.StatusCode)
@@ -143,7 +153,8 @@ func TokenCount(cfg *config.Config, proxy *httputil.ReverseProxy) http.HandlerFu
 }
 
 // sendFallbackTokenCount sends an estimated token count when upstream is unavailable
-func sendFallbackTokenCount(w http.ResponseWriter, body []byte, cfg *config.Config) {
+func sendFallbackTokenCount(w http.ResponseWriter, r *http.Request, body []byte, cfg *config.Config) {
+	w.Header().Set("X-Token-Estimate", "true")
 	var req TokenCountRequest
 	if err := json.Unmarshal(body, &req); err != nil {
 		// If we can't parse, just estimate based on raw body size
@@ -163,9 +174,7 @@ func sendFallbackTokenCount(w http.ResponseWriter, body []byte, cfg *config.Conf
 		estimatedTokens = 1
 	}
 
-	if cfg.Debug {
-		log.Printf("[token_count] fallback estimate: %d chars -> %d tokens", totalChars, estimatedTokens)
-	}
+	reqinfo.Logger(r.Context()).Debug("fallback estimate", "handler", "token_count", "chars", totalChars, "tokens", estimatedTokens)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(TokenCountResponse{InputTokens: estimatedTokens})
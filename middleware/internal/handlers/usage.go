@@ -2,7 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,11 +18,36 @@ type UsageStats struct {
 	TotalRequests   atomic.Int64
 	SessionStart    time.Time
 	LastRequestTime time.Time
+	Clients         map[string]*ClientUsage
+}
+
+// ClientUsage tracks token usage for a single client
+type ClientUsage struct {
+	InputTokens   int64 `json:"input_tokens"`
+	OutputTokens  int64 `json:"output_tokens"`
+	CacheCreation int64 `json:"cache_creation_input_tokens"`
+	CacheRead     int64 `json:"cache_read_input_tokens"`
+	Requests      int64 `json:"requests"`
 }
 
 // Global usage tracker
 var globalUsage = &UsageStats{
 	SessionStart: time.Now(),
+	Clients:      make(map[string]*ClientUsage),
+}
+
+// usageObservers are notified of every usage record, e.g. to debit quotas
+var usageObservers []func(client string, usage *AnthropicUsage)
+
+// OnUsage registers fn to be called with every usage record and the client it belongs to.
+// Observers must be registered before the server starts handling requests.
+func OnUsage(fn func(client string, usage *AnthropicUsage)) {
+	usageObservers = append(usageObservers, fn)
+}
+
+// Total returns all tokens counted in the usage record
+func (u *AnthropicUsage) Total() int {
+	return u.InputTokens + u.OutputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
 }
 
 // AnthropicUsage represents the usage field in Anthropic API responses
@@ -33,59 +58,185 @@ type AnthropicUsage struct {
 	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
 }
 
+// openAIUsage represents the usage field in OpenAI chat completion responses
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// responseUsage holds a usage field in either format
+type responseUsage struct {
+	AnthropicUsage
+	openAIUsage
+}
+
+// toAnthropic folds OpenAI token counts into the Anthropic fields
+func (u *responseUsage) toAnthropic() *AnthropicUsage {
+	usage := u.AnthropicUsage
+	if usage.InputTokens == 0 {
+		usage.InputTokens = u.PromptTokens
+	}
+	if usage.OutputTokens == 0 {
+		usage.OutputTokens = u.CompletionTokens
+	}
+	return &usage
+}
+
 // StreamDelta represents a streaming event that may contain usage
 type StreamDelta struct {
-	Type  string          `json:"type"`
-	Usage *AnthropicUsage `json:"usage,omitempty"`
+	Type    string            `json:"type"`
+	ID      string            `json:"id,omitempty"`      // OpenAI chunks
+	Model   string            `json:"model,omitempty"`   // OpenAI chunks
+	Choices []json.RawMessage `json:"choices,omitempty"` // OpenAI chunks
+	Usage   *responseUsage    `json:"usage,omitempty"`
+
+	// message_start carries the input token count on the message
+	Message *struct {
+		ID    string         `json:"id"`
+		Model string         `json:"model"`
+		Usage *responseUsage `json:"usage,omitempty"`
+	} `json:"message,omitempty"`
+
+	// message_delta carries the stop reason
+	Delta *struct {
+		StopReason string `json:"stop_reason"`
+	} `json:"delta,omitempty"`
+}
+
+// messageUsage returns the usage of a message_start event, if any
+func (d *StreamDelta) messageUsage() *responseUsage {
+	if d.Message == nil {
+		return nil
+	}
+	return d.Message.Usage
+}
+
+// identity returns the response ID, model and finish reason carried by the
+// event, each empty if absent
+func (d *StreamDelta) identity() (id, model, finishReason string) {
+	id, model = d.ID, d.Model
+	if d.Message != nil {
+		id, model = d.Message.ID, d.Message.Model
+	}
+	if d.Delta != nil {
+		finishReason = d.Delta.StopReason
+	}
+	for _, raw := range d.Choices {
+		var choice struct {
+			FinishReason string `json:"finish_reason"`
+		}
+		if json.Unmarshal(raw, &choice) == nil && choice.FinishReason != "" {
+			finishReason = choice.FinishReason
+		}
+	}
+	return id, model, finishReason
+}
+
+// responseIdentity returns the ID, model and finish reason of a non-streaming
+// response in either format
+func responseIdentity(body []byte) (id, model, finishReason string) {
+	var response struct {
+		ID         string `json:"id"`
+		Model      string `json:"model"`
+		StopReason string `json:"stop_reason"`
+		Choices    []struct {
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(body, &response) != nil {
+		return "", "", ""
+	}
+	finishReason = response.StopReason
+	if len(response.Choices) > 0 && finishReason == "" {
+		finishReason = response.Choices[0].FinishReason
+	}
+	return response.ID, response.Model, finishReason
 }
 
 // TrackUsageFromResponse extracts and tracks usage from an API response body
-// Works for both streaming and non-streaming responses
-func TrackUsageFromResponse(body []byte, isStreaming bool, debug bool) {
+// Works for both streaming and non-streaming responses. It returns the usage
+// recorded, if any.
+func TrackUsageFromResponse(client string, body []byte, isStreaming bool, debug bool) *AnthropicUsage {
 	if isStreaming {
-		trackStreamingUsage(body, debug)
-	} else {
-		trackNonStreamingUsage(body, debug)
+		if delta := parseStreamEvent(body); delta != nil {
+			var usage AnthropicUsage
+			delta.mergeUsage(&usage)
+			if usage.Total() > 0 {
+				addUsage(client, &usage, debug)
+				return &usage
+			}
+		}
+		return nil
 	}
+	return trackNonStreamingUsage(client, body, debug)
 }
 
-// trackNonStreamingUsage handles regular JSON responses
-func trackNonStreamingUsage(body []byte, debug bool) {
+// trackNonStreamingUsage handles regular JSON responses and returns the
+// usage it recorded, if any
+func trackNonStreamingUsage(client string, body []byte, debug bool) *AnthropicUsage {
 	var response struct {
-		Usage *AnthropicUsage `json:"usage"`
+		Usage *responseUsage `json:"usage"`
 	}
 
 	if err := json.Unmarshal(body, &response); err != nil {
-		return
+		return nil
 	}
 
-	if response.Usage != nil {
-		addUsage(response.Usage, debug)
+	if response.Usage == nil {
+		return nil
 	}
+	usage := response.Usage.toAnthropic()
+	addUsage(client, usage, debug)
+	return usage
 }
 
-// trackStreamingUsage handles SSE streaming responses
-// The final message_delta event contains the usage
-func trackStreamingUsage(body []byte, debug bool) {
-	// Look for usage in the body (it appears in message_delta events)
-	// SSE format: data: {"type":"message_delta","usage":{...}}
-
+// parseStreamEvent parses the data of an SSE event, or returns nil if it is
+// not JSON
+func parseStreamEvent(body []byte) *StreamDelta {
 	var delta StreamDelta
 	if err := json.Unmarshal(body, &delta); err != nil {
-		return
+		return nil
 	}
+	return &delta
+}
 
-	if delta.Usage != nil {
-		addUsage(delta.Usage, debug)
+// mergeUsage folds the usage carried by a stream event into total. Anthropic
+// streams report input tokens on message_start and cumulative counts on
+// message_delta, which may repeat the input, so each field keeps its largest
+// value rather than being summed.
+func (d *StreamDelta) mergeUsage(total *AnthropicUsage) {
+	for _, u := range []*responseUsage{d.Usage, d.messageUsage()} {
+		if u == nil {
+			continue
+		}
+		usage := u.toAnthropic()
+		total.InputTokens = max(total.InputTokens, usage.InputTokens)
+		total.OutputTokens = max(total.OutputTokens, usage.OutputTokens)
+		total.CacheCreationInputTokens = max(total.CacheCreationInputTokens, usage.CacheCreationInputTokens)
+		total.CacheReadInputTokens = max(total.CacheReadInputTokens, usage.CacheReadInputTokens)
 	}
 }
 
-// addUsage adds the given usage to global stats
-func addUsage(usage *AnthropicUsage, debug bool) {
+// addUsage adds the given usage to global and per-client stats
+func addUsage(client string, usage *AnthropicUsage, debug bool) {
 	globalUsage.mu.Lock()
 	globalUsage.LastRequestTime = time.Now()
+	cu, ok := globalUsage.Clients[client]
+	if !ok {
+		cu = &ClientUsage{}
+		globalUsage.Clients[client] = cu
+	}
+	cu.Requests++
+	cu.InputTokens += int64(usage.InputTokens)
+	cu.OutputTokens += int64(usage.OutputTokens)
+	cu.CacheCreation += int64(usage.CacheCreationInputTokens)
+	cu.CacheRead += int64(usage.CacheReadInputTokens)
 	globalUsage.mu.Unlock()
 
+	for _, fn := range usageObservers {
+		fn(client, usage)
+	}
+
 	globalUsage.TotalRequests.Add(1)
 
 	if usage.InputTokens > 0 {
@@ -102,9 +253,9 @@ func addUsage(usage *AnthropicUsage, debug bool) {
 	}
 
 	if debug {
-		log.Printf("[usage] +%d input, +%d output (total: %d in / %d out)",
-			usage.InputTokens, usage.OutputTokens,
-			globalUsage.InputTokens.Load(), globalUsage.OutputTokens.Load())
+		slog.Debug("usage recorded", "client", client,
+			"input_tokens", usage.InputTokens, "output_tokens", usage.OutputTokens,
+			"total_input_tokens", globalUsage.InputTokens.Load(), "total_output_tokens", globalUsage.OutputTokens.Load())
 	}
 }
 
@@ -113,6 +264,10 @@ func GetUsageStats() map[string]interface{} {
 	globalUsage.mu.RLock()
 	lastRequest := globalUsage.LastRequestTime
 	sessionStart := globalUsage.SessionStart
+	clients := make(map[string]ClientUsage, len(globalUsage.Clients))
+	for id, cu := range globalUsage.Clients {
+		clients[id] = *cu
+	}
 	globalUsage.mu.RUnlock()
 
 	stats := map[string]interface{}{
@@ -123,6 +278,7 @@ func GetUsageStats() map[string]interface{} {
 		"total_requests":              globalUsage.TotalRequests.Load(),
 		"session_start":               sessionStart.Format(time.RFC3339),
 		"session_duration":            time.Since(sessionStart).Round(time.Second).String(),
+		"clients":                     clients,
 	}
 
 	if !lastRequest.IsZero() {
@@ -143,5 +299,6 @@ func ResetUsageStats() {
 	globalUsage.mu.Lock()
 	globalUsage.SessionStart = time.Now()
 	globalUsage.LastRequestTime = time.Time{}
+	globalUsage.Clients = make(map[string]*ClientUsage)
 	globalUsage.mu.Unlock()
 }
@@ -0,0 +1,245 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrQueueTimeout is returned when a request waited too long for a slot
+var ErrQueueTimeout = errors.New("timed out waiting for a free upstream slot")
+
+// Limiter caps concurrent upstream requests overall and per mapped model.
+// Requests over the cap wait in per-client queues that are served
+// round-robin, so one busy client cannot starve the others.
+type Limiter struct {
+	maxTotal  int
+	maxModels map[string]int
+	timeout   time.Duration
+
+	mu            sync.Mutex
+	inFlight      int
+	modelInFlight map[string]int
+	queues        map[string][]*waiter
+	clients       []string // clients with waiters, in round-robin order
+	next          int
+	queued        int
+}
+
+type waiter struct {
+	client  string
+	model   string
+	ready   chan struct{}
+	granted bool
+}
+
+// New creates a limiter. maxTotal <= 0 means no overall cap; models without
+// an entry in maxModels have no per-model cap.
+func New(maxTotal int, maxModels map[string]int, timeout time.Duration) *Limiter {
+	return &Limiter{
+		maxTotal:      maxTotal,
+		maxModels:     maxModels,
+		timeout:       timeout,
+		modelInFlight: make(map[string]int),
+		queues:        make(map[string][]*waiter),
+	}
+}
+
+// Enabled reports whether any cap is configured
+func (l *Limiter) Enabled() bool {
+	return l != nil && (l.maxTotal > 0 || len(l.maxModels) > 0)
+}
+
+// Acquire waits for a slot for client's request to model. The returned
+// release function must be called once the upstream call is finished.
+func (l *Limiter) Acquire(ctx context.Context, client, model string) (func(), error) {
+	if !l.Enabled() {
+		return func() {}, nil
+	}
+
+	w := &waiter{client: client, model: model, ready: make(chan struct{})}
+
+	l.mu.Lock()
+	l.enqueue(w)
+	l.dispatch()
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		t := time.NewTimer(l.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-w.ready:
+		return l.releaser(w), nil
+	case <-ctx.Done():
+		return nil, l.abandon(w, ctx.Err())
+	case <-timeout:
+		return nil, l.abandon(w, ErrQueueTimeout)
+	}
+}
+
+// TryAcquire takes a slot for client's request to model only if one is free
+// and nobody is waiting for it, without queueing. ok is false otherwise.
+func (l *Limiter) TryAcquire(client, model string) (release func(), ok bool) {
+	if !l.Enabled() {
+		return func() {}, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.queued > 0 || !l.hasCapacity(model) {
+		return nil, false
+	}
+	w := &waiter{client: client, model: model, granted: true}
+	l.inFlight++
+	l.modelInFlight[model]++
+	return l.releaser(w), true
+}
+
+// abandon removes a waiter that gave up, unless it was granted in the meantime
+func (l *Limiter) abandon(w *waiter, err error) error {
+	l.mu.Lock()
+	if w.granted {
+		l.mu.Unlock()
+		l.releaser(w)()
+		return err
+	}
+	queue := l.queues[w.client]
+	for i, q := range queue {
+		if q == w {
+			l.queues[w.client] = append(queue[:i], queue[i+1:]...)
+			l.queued--
+			break
+		}
+	}
+	l.dropIdleClient(w.client)
+	l.mu.Unlock()
+	return err
+}
+
+func (l *Limiter) releaser(w *waiter) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.inFlight--
+			l.modelInFlight[w.model]--
+			l.dispatch()
+			l.mu.Unlock()
+		})
+	}
+}
+
+// enqueue adds w to its client's queue; callers must hold l.mu
+func (l *Limiter) enqueue(w *waiter) {
+	if len(l.queues[w.client]) == 0 {
+		l.clients = append(l.clients, w.client)
+	}
+	l.queues[w.client] = append(l.queues[w.client], w)
+	l.queued++
+}
+
+// dropIdleClient removes a client with an empty queue from the rotation;
+// callers must hold l.mu
+func (l *Limiter) dropIdleClient(client string) {
+	if len(l.queues[client]) > 0 {
+		return
+	}
+	delete(l.queues, client)
+	for i, c := range l.clients {
+		if c == client {
+			l.clients = append(l.clients[:i], l.clients[i+1:]...)
+			if l.next > i {
+				l.next--
+			}
+			break
+		}
+	}
+}
+
+// hasCapacity reports whether a request for model may start; callers must hold l.mu
+func (l *Limiter) hasCapacity(model string) bool {
+	if l.maxTotal > 0 && l.inFlight >= l.maxTotal {
+		return false
+	}
+	if max, ok := l.maxModels[model]; ok && l.modelInFlight[model] >= max {
+		return false
+	}
+	return true
+}
+
+// dispatch grants slots to waiting requests, visiting clients round-robin
+// and taking each client's oldest request that fits; callers must hold l.mu
+func (l *Limiter) dispatch() {
+	for {
+		if len(l.clients) == 0 || (l.maxTotal > 0 && l.inFlight >= l.maxTotal) {
+			return
+		}
+		granted := false
+		for n := 0; n < len(l.clients); n++ {
+			idx := (l.next + n) % len(l.clients)
+			client := l.clients[idx]
+			queue := l.queues[client]
+			for i, w := range queue {
+				if !l.hasCapacity(w.model) {
+					continue
+				}
+				l.queues[client] = append(queue[:i], queue[i+1:]...)
+				l.queued--
+				l.inFlight++
+				l.modelInFlight[w.model]++
+				w.granted = true
+				close(w.ready)
+
+				l.next = idx + 1
+				l.dropIdleClient(client)
+				if len(l.clients) > 0 {
+					l.next %= len(l.clients)
+				} else {
+					l.next = 0
+				}
+				granted = true
+				break
+			}
+			if granted {
+				break
+			}
+		}
+		if !granted {
+			return
+		}
+	}
+}
+
+// Stats is a point-in-time view of the limiter
+type Stats struct {
+	InFlight      int            `json:"in_flight"`
+	Queued        int            `json:"queued"`
+	ModelInFlight map[string]int `json:"model_in_flight"`
+	ClientQueued  map[string]int `json:"client_queued"`
+}
+
+// Stats returns current in-flight and queue depth counts
+func (l *Limiter) Stats() Stats {
+	stats := Stats{ModelInFlight: map[string]int{}, ClientQueued: map[string]int{}}
+	if !l.Enabled() {
+		return stats
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats.InFlight = l.inFlight
+	stats.Queued = l.queued
+	for model, n := range l.modelInFlight {
+		if n > 0 {
+			stats.ModelInFlight[model] = n
+		}
+	}
+	for client, queue := range l.queues {
+		stats.ClientQueued[client] = len(queue)
+	}
+	return stats
+}
@@ -0,0 +1,150 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n requests are queued
+func waitQueued(t *testing.T, l *Limiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for l.Stats().Queued != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("queued = %d, want %d", l.Stats().Queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type grant struct {
+	name    string
+	release func()
+}
+
+func TestAcquireServesClientsRoundRobin(t *testing.T) {
+	l := New(1, nil, 0)
+	holder, err := l.Acquire(context.Background(), "a", "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grants := make(chan grant)
+	queue := func(name, client string) {
+		go func() {
+			release, err := l.Acquire(context.Background(), client, "m")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			grants <- grant{name, release}
+		}()
+	}
+	// Client a queues two requests before client b queues one
+	queue("a1", "a")
+	waitQueued(t, l, 1)
+	queue("a2", "a")
+	waitQueued(t, l, 2)
+	queue("b1", "b")
+	waitQueued(t, l, 3)
+
+	holder()
+	var order []string
+	for range 3 {
+		g := <-grants
+		order = append(order, g.name)
+		g.release()
+	}
+	if order[2] != "a2" {
+		t.Fatalf("grant order = %v, want b1 served before a2", order)
+	}
+	if stats := l.Stats(); stats.InFlight != 0 || stats.Queued != 0 {
+		t.Fatalf("stats after release = %+v", stats)
+	}
+}
+
+func TestAcquireCancelRemovesWaiter(t *testing.T) {
+	l := New(1, nil, 0)
+	holder, _ := l.Acquire(context.Background(), "a", "m")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := l.Acquire(ctx, "b", "m")
+		done <- err
+	}()
+	waitQueued(t, l, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if stats := l.Stats(); stats.Queued != 0 || len(stats.ClientQueued) != 0 {
+		t.Fatalf("canceled waiter still queued: %+v", stats)
+	}
+
+	holder()
+	if stats := l.Stats(); stats.InFlight != 0 {
+		t.Fatalf("in flight = %d after release, want 0", stats.InFlight)
+	}
+}
+
+func TestAcquireQueueTimeout(t *testing.T) {
+	l := New(1, nil, 20*time.Millisecond)
+	holder, _ := l.Acquire(context.Background(), "a", "m")
+	defer holder()
+
+	if _, err := l.Acquire(context.Background(), "b", "m"); !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("err = %v, want ErrQueueTimeout", err)
+	}
+	if stats := l.Stats(); stats.Queued != 0 {
+		t.Fatalf("timed out waiter still queued: %+v", stats)
+	}
+}
+
+func TestModelCapLeavesOtherModelsFree(t *testing.T) {
+	l := New(0, map[string]int{"slow": 1}, 20*time.Millisecond)
+	holder, _ := l.Acquire(context.Background(), "a", "slow")
+	defer holder()
+
+	release, err := l.Acquire(context.Background(), "a", "fast")
+	if err != nil {
+		t.Fatalf("other model blocked: %v", err)
+	}
+	release()
+	if _, err := l.Acquire(context.Background(), "b", "slow"); !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("err = %v, want ErrQueueTimeout for the capped model", err)
+	}
+}
+
+func TestTryAcquire(t *testing.T) {
+	l := New(1, nil, 0)
+	release, ok := l.TryAcquire("a", "m")
+	if !ok {
+		t.Fatal("TryAcquire failed with a free slot")
+	}
+	if _, ok := l.TryAcquire("a", "m"); ok {
+		t.Fatal("TryAcquire succeeded beyond the cap")
+	}
+	release()
+	release() // releasing twice must not free a second slot
+
+	// A free slot still goes to a queued request first
+	holder, _ := l.Acquire(context.Background(), "a", "m")
+	waiting := make(chan func())
+	go func() {
+		r, _ := l.Acquire(context.Background(), "b", "m")
+		waiting <- r
+	}()
+	waitQueued(t, l, 1)
+	holder()
+	r := <-waiting
+	if _, ok := l.TryAcquire("c", "m"); ok {
+		t.Fatal("TryAcquire took the slot granted to the queued request")
+	}
+	r()
+	if stats := l.Stats(); stats.InFlight != 0 {
+		t.Fatalf("in flight = %d, want 0", stats.InFlight)
+	}
+}
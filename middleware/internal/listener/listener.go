@@ -0,0 +1,156 @@
+package listener
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"cliproxy-middleware/internal/config"
+)
+
+// Listener is a bound socket together with the URL clients should use
+type Listener struct {
+	net.Listener
+	URL string
+}
+
+// Open binds every listener the config asks for: TCP on host:port (with TLS
+// if configured) and optionally a Unix domain socket.
+func Open(cfg *config.Config) ([]*Listener, error) {
+	var listeners []*Listener
+
+	if cfg.Port > 0 {
+		ln, err := openTCP(cfg)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if cfg.UnixSocket != "" {
+		ln, err := openUnix(cfg.UnixSocket, cfg.UnixSocketMode)
+		if err != nil {
+			closeAll(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listeners configured: set -port or -unix-socket")
+	}
+	return listeners, nil
+}
+
+func openTCP(cfg *config.Config) (*Listener, error) {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := tlsConfigFor(cfg)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return &Listener{Listener: ln, URL: "http://" + displayAddr(cfg.Host, cfg.Port)}, nil
+	}
+	return &Listener{
+		Listener: tls.NewListener(ln, tlsConfig),
+		URL:      "https://" + displayAddr(cfg.Host, cfg.Port),
+	}, nil
+}
+
+func openUnix(path string, mode os.FileMode) (*Listener, error) {
+	// Remove a stale socket left behind by an unclean shutdown
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+
+	// Bind inside a private directory and move the socket into place once it
+	// has its permissions, so it is never reachable with the umask's
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := ln.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chmod %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &Listener{Listener: &unixListener{UnixListener: ul, path: path}, URL: "unix:" + path}, nil
+}
+
+// unixListener removes its socket file on close
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+func tlsConfigFor(cfg *config.Config) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+
+	switch {
+	case cfg.TLSCert != "" || cfg.TLSKey != "":
+		if cfg.TLSCert == "" || cfg.TLSKey == "" {
+			return nil, fmt.Errorf("-tls-cert and -tls-key must be set together")
+		}
+		cert, err = tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	case cfg.TLSSelfSigned:
+		cert, err = selfSigned(cfg.TLSDir, cfg.Host)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, nil
+}
+
+func displayAddr(host string, port int) string {
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func closeAll(listeners []*Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
@@ -0,0 +1,106 @@
+package listener
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"cliproxy-middleware/internal/config"
+)
+
+func TestOpenTCPOnLoopback(t *testing.T) {
+	// Find a free port
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	listeners, err := Open(&config.Config{Host: "127.0.0.1", Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAll(listeners)
+	if len(listeners) != 1 {
+		t.Fatalf("%d listeners, want 1", len(listeners))
+	}
+	addr := listeners[0].Addr().(*net.TCPAddr)
+	if !addr.IP.IsLoopback() || addr.Port != port {
+		t.Fatalf("bound %s, want 127.0.0.1:%d", addr, port)
+	}
+	if want := "http://127.0.0.1:" + strconv.Itoa(port); listeners[0].URL != want {
+		t.Fatalf("URL = %s, want %s", listeners[0].URL, want)
+	}
+}
+
+func TestOpenNothing(t *testing.T) {
+	if _, err := Open(&config.Config{}); err == nil {
+		t.Fatal("opened without a port or socket")
+	}
+}
+
+func TestOpenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mw.sock")
+	ln, err := openUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode = %v, want 0600", info.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("directory holds %d entries, want only the socket", len(entries))
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// A socket in use is not taken over
+	if _, err := openUnix(path, 0600); err == nil {
+		t.Fatal("opened a socket that is in use")
+	}
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket left behind after close: %v", err)
+	}
+}
+
+func TestOpenUnixRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mw.sock")
+	// A socket file left behind by a process that died
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := openUnix(path, 0660)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	ln.Close()
+}
+
+func TestOpenUnixRefusesOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mw.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openUnix(path, 0660); err == nil {
+		t.Fatal("replaced a regular file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Fatal("regular file changed")
+	}
+}
@@ -0,0 +1,163 @@
+package listener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	caCertFile   = "ca.pem"
+	caKeyFile    = "ca-key.pem"
+	leafCertFile = "cert.pem"
+	leafKeyFile  = "key.pem"
+)
+
+// selfSigned returns a server certificate issued by a local CA kept in dir.
+// The CA is created once and reused, so clients only need to trust ca.pem a
+// single time; the server certificate is reissued when it nears expiry or
+// does not cover host.
+func selfSigned(dir, host string) (tls.Certificate, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	caCert, caKey, err := loadOrCreateCA(dir)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("local CA: %w", err)
+	}
+
+	certPath := filepath.Join(dir, leafCertFile)
+	keyPath := filepath.Join(dir, leafKeyFile)
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && leafUsable(cert, caCert, host) {
+		return cert, nil
+	}
+
+	log.Printf("🔐 Issuing self-signed certificate in %s (trust %s to avoid warnings)", dir, filepath.Join(dir, caCertFile))
+	if err := issueLeaf(caCert, caKey, host, certPath, keyPath); err != nil {
+		return tls.Certificate{}, fmt.Errorf("issue certificate: %w", err)
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err == nil && time.Now().Before(cert.NotAfter) {
+			if key, ok := pair.PrivateKey.(*ecdsa.PrivateKey); ok {
+				return cert, key, nil
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "cliproxy-middleware local CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := writeKey(keyPath, key); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func issueLeaf(caCert *x509.Certificate, caKey *ecdsa.PrivateKey, host, certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "cliproxy-middleware"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if host != "" && host != "0.0.0.0" && host != "::" {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	return writeKey(keyPath, key)
+}
+
+// leafUsable reports whether an existing certificate is still valid for host
+func leafUsable(pair tls.Certificate, caCert *x509.Certificate, host string) bool {
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil || time.Now().Add(7*24*time.Hour).After(cert.NotAfter) {
+		return false
+	}
+	if cert.CheckSignatureFrom(caCert) != nil {
+		return false
+	}
+	if host != "" && host != "0.0.0.0" && host != "::" && cert.VerifyHostname(host) != nil {
+		return false
+	}
+	return true
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+func writePEM(path, blockType string, der []byte, mode os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return os.WriteFile(path, data, mode)
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
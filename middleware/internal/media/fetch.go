@@ -0,0 +1,145 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// maxFetchBytes bounds a fetched URL source
+const maxFetchBytes = 20 << 20
+
+// maxRedirects bounds the redirects followed for one source
+const maxRedirects = 5
+
+// errBlockedAddress refuses sources that resolve to the proxy's own network
+var errBlockedAddress = errors.New("refusing to fetch from a loopback, private or link-local address")
+
+// blockedPrefixes are non-public ranges net.IP's predicates don't cover
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64 can embed any IPv4 address
+}
+
+// fetchClient downloads URL image and document sources. Every connection is
+// checked after DNS resolution, so redirects and rebinding can't reach
+// internal addresses either; environment proxies are not used since they
+// would hide the real destination.
+var fetchClient = &http.Client{
+	Timeout: 20 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: dialControl}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return checkURL(req.Context(), req.URL)
+	},
+}
+
+// publicAddress reports whether addr may be fetched from
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialControl refuses connections to non-public addresses, after resolution
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !publicAddress(addr) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+// checkURL rejects non-http(s) URLs and hosts that resolve to a non-public
+// address, for a clear error before connecting
+func checkURL(ctx context.Context, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("only http and https URLs are supported")
+	}
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !publicAddress(addr) {
+			return errBlockedAddress
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("could not resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if !publicAddress(addr) {
+			return errBlockedAddress
+		}
+	}
+	return nil
+}
+
+// fetch downloads a URL source, returning its data and media type
+func (n *normalizer) fetch(rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", errors.New("invalid URL")
+	}
+	if err := checkURL(n.ctx, u); err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errBlockedAddress) {
+			return nil, "", errBlockedAddress
+		}
+		return nil, "", errors.New("request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxFetchBytes {
+		return nil, "", fmt.Errorf("larger than %d bytes", maxFetchBytes)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		mediaType = http.DetectContentType(data)
+		mediaType, _, _ = mime.ParseMediaType(mediaType)
+	}
+	return data, mediaType, nil
+}
@@ -0,0 +1,139 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	// Decoders for the formats that can be converted
+	_ "image/gif"
+
+	_ "golang.org/x/image/webp"
+)
+
+// errUndecodable means the image is in a format without a decoder here
+// (such as HEIC), so it can only be passed through
+var errUndecodable = errors.New("no decoder for image format")
+
+// maxImagePixels bounds the images decoded for conversion, since a small
+// compressed file can claim dimensions that take gigabytes to decode
+const maxImagePixels = 40_000_000
+
+// errTooManyPixels means the image is too large to decode safely
+var errTooManyPixels = errors.New("image has too many pixels to convert")
+
+// imageLimits is what the target model accepts
+type imageLimits struct {
+	types        map[string]bool
+	maxBytes     int // base64 length
+	maxDimension int
+}
+
+// fitImage returns the image re-encoded to satisfy limits, or nil if it
+// already does. mediaType is the type of the returned image.
+func fitImage(data []byte, mediaType string, limits imageLimits) (out []byte, outType string, err error) {
+	accepted := limits.types[mediaType]
+	tooBig := limits.maxBytes > 0 && base64Len(len(data)) > limits.maxBytes
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		if accepted && !tooBig {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("%s: %w", mediaType, errUndecodable)
+	}
+	longest := max(config.Width, config.Height)
+	tooLarge := limits.maxDimension > 0 && longest > limits.maxDimension
+	if accepted && !tooBig && !tooLarge && "image/"+format == mediaType {
+		return nil, "", nil
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, "", fmt.Errorf("%dx%d: %w", config.Width, config.Height, errTooManyPixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if tooLarge {
+		img = downscale(img, limits.maxDimension)
+	}
+
+	// Keep transparency as PNG; photos compress far better as JPEG
+	opaque := isOpaque(img)
+	for attempt := 0; attempt < 4; attempt++ {
+		var buf bytes.Buffer
+		if !opaque && limits.types["image/png"] {
+			err, outType = png.Encode(&buf, img), "image/png"
+		} else {
+			quality := 85 - 15*attempt
+			err, outType = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}), "image/jpeg"
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if limits.maxBytes <= 0 || base64Len(buf.Len()) <= limits.maxBytes {
+			return buf.Bytes(), outType, nil
+		}
+		// Still too big: halve the size and try again, dropping transparency
+		bounds := img.Bounds()
+		img = downscale(img, max(bounds.Dx(), bounds.Dy())/2)
+		opaque = true
+	}
+	return nil, "", fmt.Errorf("image is still larger than %d bytes after recompression", limits.maxBytes)
+}
+
+func base64Len(n int) int {
+	return (n + 2) / 3 * 4
+}
+
+// isOpaque reports whether every pixel is fully opaque
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// downscale shrinks img so its longest edge is at most maxDimension,
+// averaging the source pixels behind each destination pixel
+func downscale(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	longest := max(sw, sh)
+	if longest <= maxDimension || maxDimension <= 0 {
+		return img
+	}
+	dw := max(1, sw*maxDimension/longest)
+	dh := max(1, sh*maxDimension/longest)
+
+	src := image.NewNRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,57 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+)
+
+// pngClaiming returns a tiny PNG whose header claims the given size
+func pngClaiming(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, color.NRGBA{255, 0, 0, 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// IHDR follows the 8-byte signature: length, type, width, height, ..., CRC
+	ihdr := data[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+	return data
+}
+
+func TestFitImageRejectsHugeDimensions(t *testing.T) {
+	limits := imageLimits{types: map[string]bool{"image/png": true}, maxDimension: 3072}
+	_, _, err := fitImage(pngClaiming(t, 60000, 60000), "image/png", limits)
+	if !errors.Is(err, errTooManyPixels) {
+		t.Fatalf("err = %v, want errTooManyPixels", err)
+	}
+}
+
+func TestFitImageConvertsWebP(t *testing.T) {
+	data, err := os.ReadFile("testdata/video-001.lossy.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := imageLimits{types: map[string]bool{"image/png": true, "image/jpeg": true}}
+	out, outType, err := fitImage(data, "image/webp", limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outType != "image/jpeg" {
+		t.Fatalf("converted to %s, want image/jpeg", outType)
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(out)); err != nil || format != "jpeg" {
+		t.Fatalf("output is %q (%v), want a JPEG", format, err)
+	}
+}
@@ -0,0 +1,257 @@
+package media
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"cliproxy-middleware/internal/models"
+)
+
+// PDF handling for models without document support
+const (
+	PDFText   = "text"   // replace the document with its extracted text
+	PDFReject = "reject" // fail the request
+)
+
+// Options controls Normalize
+type Options struct {
+	FetchURLs   bool   // inline url sources for models that can't take them
+	PDFFallback string // PDFText or PDFReject
+}
+
+// Result counts the blocks changed by Normalize
+type Result struct {
+	Fetched   int // url sources inlined
+	Converted int // images re-encoded, downscaled or recompressed
+	Extracted int // documents replaced with their text
+}
+
+// Changed reports whether any block was rewritten
+func (r Result) Changed() bool {
+	return r.Fetched+r.Converted+r.Extracted > 0
+}
+
+// RejectError is content the target model can't take
+type RejectError struct {
+	Message string
+}
+
+func (e *RejectError) Error() string {
+	return e.Message
+}
+
+// Normalize rewrites the image and document blocks of a Messages request,
+// including those inside tool results, into what the model with caps
+// accepts. Content that can't be made acceptable is reported as a
+// *RejectError.
+func Normalize(ctx context.Context, request map[string]json.RawMessage, model string, caps models.Capabilities, opts Options) (Result, error) {
+	n := &normalizer{ctx: ctx, model: model, caps: caps, opts: opts}
+	n.limits = imageLimits{types: make(map[string]bool), maxBytes: caps.MaxImageBytes, maxDimension: caps.MaxImageDimension}
+	for _, t := range caps.ImageTypes {
+		n.limits.types[t] = true
+	}
+
+	var messages []map[string]json.RawMessage
+	if json.Unmarshal(request["messages"], &messages) != nil {
+		return Result{}, nil
+	}
+	changed := false
+	for _, message := range messages {
+		content, ok, err := n.blocks(message["content"])
+		if err != nil {
+			return n.result, err
+		}
+		if ok {
+			message["content"] = content
+			changed = true
+		}
+	}
+	if changed {
+		request["messages"], _ = json.Marshal(messages)
+	}
+	return n.result, nil
+}
+
+type normalizer struct {
+	ctx    context.Context
+	model  string
+	caps   models.Capabilities
+	opts   Options
+	limits imageLimits
+	result Result
+}
+
+// blocks normalizes a content array, returning the new JSON if it changed
+func (n *normalizer) blocks(raw json.RawMessage) (json.RawMessage, bool, error) {
+	if len(raw) == 0 || raw[0] != '[' {
+		return raw, false, nil
+	}
+	var blocks []map[string]json.RawMessage
+	if json.Unmarshal(raw, &blocks) != nil {
+		return raw, false, nil
+	}
+
+	changed := false
+	for i, block := range blocks {
+		var typ string
+		json.Unmarshal(block["type"], &typ)
+		var replaced map[string]json.RawMessage
+		var err error
+		switch typ {
+		case "image":
+			replaced, err = n.image(block)
+		case "document":
+			replaced, err = n.document(block)
+		case "tool_result":
+			var content json.RawMessage
+			var ok bool
+			if content, ok, err = n.blocks(block["content"]); ok {
+				block["content"] = content
+				changed = true
+			}
+		}
+		if err != nil {
+			return raw, false, err
+		}
+		if replaced != nil {
+			blocks[i] = replaced
+			changed = true
+		}
+	}
+	if !changed {
+		return raw, false, nil
+	}
+	out, err := json.Marshal(blocks)
+	return out, err == nil, err
+}
+
+// source is an image or document source
+type source struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// image returns a replacement for an image block, or nil to keep it
+func (n *normalizer) image(block map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	if !n.caps.Images {
+		return nil, &RejectError{fmt.Sprintf("%s does not accept images", n.model)}
+	}
+	var src source
+	if json.Unmarshal(block["source"], &src) != nil {
+		return nil, nil
+	}
+
+	fetched := false
+	var data []byte
+	switch src.Type {
+	case "base64":
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(src.Data); err != nil {
+			return nil, &RejectError{"image source data is not valid base64"}
+		}
+	case "url":
+		if n.caps.URLSources || !n.opts.FetchURLs {
+			return nil, nil
+		}
+		var err error
+		if data, src.MediaType, err = n.fetch(src.URL); err != nil {
+			return nil, &RejectError{fmt.Sprintf("failed to fetch image %s: %v", src.URL, err)}
+		}
+		fetched = true
+	default:
+		return nil, nil
+	}
+
+	out, outType, err := fitImage(data, src.MediaType, n.limits)
+	if err != nil {
+		if errors.Is(err, errUndecodable) {
+			return nil, &RejectError{fmt.Sprintf("%s images can't be converted or resized for %s", src.MediaType, n.model)}
+		}
+		if errors.Is(err, errTooManyPixels) {
+			return nil, &RejectError{fmt.Sprintf("image is too large to resize for %s (%v)", n.model, err)}
+		}
+		return nil, &RejectError{fmt.Sprintf("image could not be processed: %v", err)}
+	}
+	if out != nil {
+		data, src.MediaType = out, outType
+		n.result.Converted++
+	} else if !fetched {
+		return nil, nil
+	}
+	if fetched {
+		n.result.Fetched++
+	}
+
+	replaced := copyBlock(block)
+	replaced["source"], _ = json.Marshal(source{Type: "base64", MediaType: src.MediaType, Data: base64.StdEncoding.EncodeToString(data)})
+	return replaced, nil
+}
+
+// document returns a replacement for a document block, or nil to keep it
+func (n *normalizer) document(block map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	var src source
+	if json.Unmarshal(block["source"], &src) != nil {
+		return nil, nil
+	}
+	if src.Type != "base64" && src.Type != "url" {
+		// Plain text and content sources need no document support
+		return nil, nil
+	}
+
+	var data []byte
+	switch src.Type {
+	case "base64":
+		if n.caps.Documents {
+			return nil, nil
+		}
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(src.Data); err != nil {
+			return nil, &RejectError{"document source data is not valid base64"}
+		}
+	case "url":
+		if n.caps.Documents && n.caps.URLSources || !n.opts.FetchURLs {
+			return nil, nil
+		}
+		var err error
+		if data, src.MediaType, err = n.fetch(src.URL); err != nil {
+			return nil, &RejectError{fmt.Sprintf("failed to fetch document %s: %v", src.URL, err)}
+		}
+		n.result.Fetched++
+		if n.caps.Documents {
+			replaced := copyBlock(block)
+			replaced["source"], _ = json.Marshal(source{Type: "base64", MediaType: src.MediaType, Data: base64.StdEncoding.EncodeToString(data)})
+			return replaced, nil
+		}
+	}
+
+	if n.opts.PDFFallback == PDFReject {
+		return nil, &RejectError{fmt.Sprintf("%s does not accept PDF documents", n.model)}
+	}
+	text, err := extractPDFText(data)
+	if err != nil {
+		return nil, &RejectError{fmt.Sprintf("%s does not accept PDF documents, and no text could be extracted: %v", n.model, err)}
+	}
+	var title string
+	json.Unmarshal(block["title"], &title)
+	n.result.Extracted++
+
+	replaced := map[string]json.RawMessage{"type": json.RawMessage(`"text"`)}
+	replaced["text"], _ = json.Marshal(fmt.Sprintf("<document title=%q>\n%s\n</document>", title, text))
+	if control, ok := block["cache_control"]; ok {
+		replaced["cache_control"] = control
+	}
+	return replaced, nil
+}
+
+func copyBlock(block map[string]json.RawMessage) map[string]json.RawMessage {
+	out := make(map[string]json.RawMessage, len(block))
+	for k, v := range block {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,174 @@
+package media
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxPDFText bounds the text extracted from one document
+const maxPDFText = 1 << 20
+
+var (
+	streamStart = regexp.MustCompile(`(?s)<<(.{0,1000}?)>>\s*stream\r?\n`)
+	// Text-showing operators: (string) Tj, (string) ', [array] TJ, and
+	// the line-breaking operators Td, TD, T* and '
+	textOperator  = regexp.MustCompile(`(?s)\((?:\\.|[^\\)])*\)\s*(?:Tj|'|")|\[(?:\\.|[^\]])*\]\s*TJ|<[0-9A-Fa-f\s]*>\s*Tj|T\*|-?[\d.]+\s+-?[\d.]+\s+T[dD]|ET`)
+	stringLiteral = regexp.MustCompile(`\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>|-?\d+(?:\.\d+)?`)
+)
+
+// extractPDFText pulls the text shown by a PDF's content streams. It is a
+// best-effort reader: text in fonts with custom encodings, or in images,
+// is not recovered.
+func extractPDFText(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return "", errors.New("not a PDF")
+	}
+
+	var text strings.Builder
+	for _, loc := range streamStart.FindAllSubmatchIndex(data, -1) {
+		dict := data[loc[2]:loc[3]]
+		start := loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := data[start : start+end]
+		if bytes.Contains(dict, []byte("/Subtype/Image")) || bytes.Contains(dict, []byte("/Subtype /Image")) {
+			continue
+		}
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			r, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			// Truncated streams still yield what was decoded
+			stream, _ = io.ReadAll(io.LimitReader(r, 16<<20))
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue
+		}
+		if !bytes.Contains(stream, []byte("BT")) {
+			continue
+		}
+		showText(stream, &text)
+		if text.Len() > maxPDFText {
+			break
+		}
+	}
+
+	out := strings.TrimSpace(text.String())
+	if out == "" {
+		return "", errors.New("no extractable text")
+	}
+	if len(out) > maxPDFText {
+		out = out[:maxPDFText]
+	}
+	return out, nil
+}
+
+// showText appends the text of a content stream's text operators
+func showText(stream []byte, text *strings.Builder) {
+	for _, op := range textOperator.FindAll(stream, -1) {
+		switch {
+		case bytes.Equal(op, []byte("T*")), bytes.HasSuffix(op, []byte("Td")), bytes.HasSuffix(op, []byte("TD")):
+			newline(text)
+			continue
+		case bytes.Equal(op, []byte("ET")):
+			newline(text)
+			continue
+		}
+		if bytes.HasSuffix(op, []byte("'")) || bytes.HasSuffix(op, []byte(`"`)) {
+			newline(text)
+		}
+		for _, s := range stringLiteral.FindAll(op, -1) {
+			switch s[0] {
+			case '(':
+				text.WriteString(decodeLiteral(s[1 : len(s)-1]))
+			case '<':
+				text.WriteString(decodeHex(s[1 : len(s)-1]))
+			default:
+				// A large negative adjustment in a TJ array is a word gap
+				if n, err := strconv.ParseFloat(string(s), 64); err == nil && n < -200 {
+					text.WriteByte(' ')
+				}
+			}
+		}
+	}
+}
+
+func newline(text *strings.Builder) {
+	if s := text.String(); len(s) > 0 && s[len(s)-1] != '\n' {
+		text.WriteByte('\n')
+	}
+}
+
+// decodeLiteral resolves the escapes of a PDF string literal
+func decodeLiteral(s []byte) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'b', 'f':
+		case '\n', '\r':
+			// Line continuation
+		default:
+			if s[i] >= '0' && s[i] <= '7' {
+				j := i
+				for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+					j++
+				}
+				n, _ := strconv.ParseUint(string(s[i:j]), 8, 8)
+				b.WriteByte(byte(n))
+				i = j - 1
+			} else {
+				b.WriteByte(s[i])
+			}
+		}
+	}
+	return latin1(b.String())
+}
+
+// decodeHex decodes a PDF hex string, as UTF-16 when it has a byte order mark
+func decodeHex(s []byte) string {
+	s = bytes.Join(bytes.Fields(s), nil)
+	if len(s)%2 == 1 {
+		s = append(s, '0')
+	}
+	raw := make([]byte, len(s)/2)
+	for i := range raw {
+		n, _ := strconv.ParseUint(string(s[2*i:2*i+2]), 16, 8)
+		raw[i] = byte(n)
+	}
+	if len(raw) >= 2 && raw[0] == 0xFE && raw[1] == 0xFF {
+		var b strings.Builder
+		for i := 2; i+1 < len(raw); i += 2 {
+			b.WriteRune(rune(raw[i])<<8 | rune(raw[i+1]))
+		}
+		return b.String()
+	}
+	return latin1(string(raw))
+}
+
+// latin1 converts single-byte text to UTF-8
+func latin1(s string) string {
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes)
+}
@@ -0,0 +1,296 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is anything that can write itself in the Prometheus text format
+type collector interface {
+	writeTo(w *bufio.Writer)
+}
+
+// Registry holds metrics in registration order
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Default is the registry served on /metrics
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// Write renders every registered metric in the Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.writeTo(bw)
+	}
+	return bw.Flush()
+}
+
+// desc is the name, help text and label names shared by all metric types
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// labelKey joins label values into a map key
+func (d *desc) labelKey(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels renders {name="value",...} for the given values plus any extra pair
+func (d *desc) formatLabels(values []string, extraName, extraValue string) string {
+	if len(d.labels) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range d.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		writeLabel(&b, name, values[i])
+	}
+	if extraName != "" {
+		if len(d.labels) > 0 {
+			b.WriteByte(',')
+		}
+		writeLabel(&b, extraName, extraValue)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func writeLabel(b *strings.Builder, name, value string) {
+	b.WriteString(name)
+	b.WriteString(`="`)
+	for _, r := range value {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sample is one labeled value
+type sample struct {
+	values []string
+	value  float64
+}
+
+// Vec is a counter or gauge with a value per label combination
+type Vec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*sample
+}
+
+func newVec(typ, name, help string, labels []string) *Vec {
+	v := &Vec{desc: desc{name: name, help: help, typ: typ, labels: labels}, series: make(map[string]*sample)}
+	Default.register(v)
+	return v
+}
+
+// NewCounter registers a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Vec {
+	return newVec("counter", name, help, labels)
+}
+
+// NewGauge registers a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Vec {
+	return newVec("gauge", name, help, labels)
+}
+
+// Add adds delta to the series for the label values
+func (v *Vec) Add(delta float64, values ...string) {
+	key := v.labelKey(values)
+	v.mu.Lock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &sample{values: append([]string(nil), values...)}
+		v.series[key] = s
+	}
+	s.value += delta
+	v.mu.Unlock()
+}
+
+// Inc adds one to the series for the label values
+func (v *Vec) Inc(values ...string) {
+	v.Add(1, values...)
+}
+
+// Dec subtracts one from the series for the label values
+func (v *Vec) Dec(values ...string) {
+	v.Add(-1, values...)
+}
+
+func (v *Vec) writeTo(w *bufio.Writer) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	samples := make([]sample, len(keys))
+	for i, k := range keys {
+		samples[i] = *v.series[k]
+	}
+	v.mu.Unlock()
+
+	v.writeHeader(w)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.formatLabels(s.values, "", ""), formatValue(s.value))
+	}
+}
+
+// Histogram counts observations into cumulative buckets per label combination
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with upper bucket bounds in ascending order
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	Default.register(h)
+	return h
+}
+
+// Observe records v in the series for the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: append([]string(nil), values...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) writeTo(w *bufio.Writer) {
+	h.mu.Lock()
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]histogramSeries, len(keys))
+	for i, k := range keys {
+		s := *h.series[k]
+		s.counts = append([]uint64(nil), s.counts...)
+		series[i] = s
+	}
+	h.mu.Unlock()
+
+	h.writeHeader(w)
+	for _, s := range series {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(s.values, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.formatLabels(s.values, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.formatLabels(s.values, "", ""), s.count)
+	}
+}
+
+// Func is a metric whose samples are read from a callback at scrape time,
+// for values other packages already track
+type Func struct {
+	desc
+	collect func(emit func(value float64, values ...string))
+}
+
+// NewGaugeFunc registers a gauge read from collect
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, values ...string))) *Func {
+	f := &Func{desc: desc{name: name, help: help, typ: "gauge", labels: labels}, collect: collect}
+	Default.register(f)
+	return f
+}
+
+// NewCounterFunc registers a counter read from collect
+func NewCounterFunc(name, help string, labels []string, collect func(emit func(value float64, values ...string))) *Func {
+	f := &Func{desc: desc{name: name, help: help, typ: "counter", labels: labels}, collect: collect}
+	Default.register(f)
+	return f
+}
+
+func (f *Func) writeTo(w *bufio.Writer) {
+	var samples []sample
+	f.collect(func(value float64, values ...string) {
+		f.labelKey(values)
+		samples = append(samples, sample{values: values, value: value})
+	})
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].values, "\xff") < strings.Join(samples[j].values, "\xff")
+	})
+
+	f.writeHeader(w)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, f.formatLabels(s.values, "", ""), formatValue(s.value))
+	}
+}
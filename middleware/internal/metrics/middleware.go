@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/models"
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+// Request metrics, recorded once per finished request
+var (
+	Requests = NewCounter("cliproxy_requests_total",
+		"Requests handled", "endpoint", "requested_model", "mapped_model", "status")
+	RequestDuration = NewHistogram("cliproxy_request_duration_seconds",
+		"Time from receiving a request to finishing its response",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		"endpoint", "requested_model", "mapped_model", "status")
+	TimeToFirstToken = NewHistogram("cliproxy_time_to_first_token_seconds",
+		"Time from receiving a request until the first generated content was sent",
+		[]float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60},
+		"endpoint", "mapped_model")
+	OutputTokensPerSecond = NewHistogram("cliproxy_output_tokens_per_second",
+		"Output tokens per second, measured from the first token for streams",
+		[]float64{5, 10, 20, 40, 60, 80, 100, 150, 200, 300},
+		"mapped_model")
+	Tokens = NewCounter("cliproxy_tokens_total",
+		"Tokens reported in responses, by type (input, output, cache_creation, cache_read)",
+		"mapped_model", "type")
+	InFlight = NewGauge("cliproxy_http_requests_in_flight",
+		"Client requests currently being served", "endpoint")
+)
+
+// UpstreamErrors counts failed upstream calls by kind: connection errors,
+// timeouts, breaker and queue rejections, error statuses and broken streams
+var UpstreamErrors = NewCounter("cliproxy_upstream_errors_total",
+	"Failed upstream calls by kind", "kind")
+
+// SchemaNormalizations counts tool schema rewrites by the JSON Schema keyword
+// that was removed or transformed
+var SchemaNormalizations = NewCounter("cliproxy_schema_normalizations_total",
+	"Tool schema rewrites by transformed JSON Schema keyword", "keyword")
+
+// ResponseCache counts response cache lookups by result (hit, miss, bypass)
+var ResponseCache = NewCounter("cliproxy_response_cache_requests_total",
+	"Cacheable requests by response cache result", "result")
+
+// modelLabel bounds the model label values to names the model mappings or
+// the model registry know; prefix matches are labeled by their prefix and
+// anything else, which clients can choose freely, is "other"
+func modelLabel(model string) string {
+	if model == "" {
+		return ""
+	}
+	if name := config.Recognize(model); name != "" {
+		return name
+	}
+	if _, ok := models.Lookup(model); ok {
+		return model
+	}
+	return "other"
+}
+
+// ObserveRequest records the metrics of a finished request
+func ObserveRequest(endpoint string, info *reqinfo.Info, status int) {
+	elapsed := time.Since(info.Start)
+	code := strconv.Itoa(status)
+	requested, mapped := modelLabel(info.RequestedModel), modelLabel(info.MappedModel)
+	Requests.Inc(endpoint, requested, mapped, code)
+	RequestDuration.Observe(elapsed.Seconds(), endpoint, requested, mapped, code)
+
+	if !info.FirstToken.IsZero() {
+		TimeToFirstToken.Observe(info.FirstToken.Sub(info.Start).Seconds(), endpoint, mapped)
+
+		// Streams are timed from the first token; a non-streaming body arrives
+		// all at once, so only the whole request time says anything
+		generating := time.Since(info.FirstToken)
+		if !info.Stream {
+			generating = elapsed
+		}
+		if info.OutputTokens > 0 && generating > 0 {
+			OutputTokensPerSecond.Observe(float64(info.OutputTokens)/generating.Seconds(), mapped)
+		}
+	}
+
+	for typ, n := range map[string]int{
+		"input":          info.InputTokens,
+		"output":         info.OutputTokens,
+		"cache_creation": info.CacheCreationInputTokens,
+		"cache_read":     info.CacheReadInputTokens,
+	} {
+		if n > 0 {
+			Tokens.Add(float64(n), mapped, typ)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// Capabilities describes what an upstream model accepts
+type Capabilities struct {
+	ContextWindow int       `json:"context_window"` // input plus output tokens
+	MaxOutput     int       `json:"max_output"`
+	Images        bool      `json:"images"`
+	Documents     bool      `json:"documents"`   // PDF document blocks
+	URLSources    bool      `json:"url_sources"` // fetches url image and document sources itself
+	Thinking      *Thinking `json:"thinking,omitempty"`
+
+	// Image formats accepted, and the size beyond which images are
+	// downscaled or recompressed (base64 bytes, longest edge in pixels)
+	ImageTypes        []string `json:"image_types,omitempty"`
+	MaxImageBytes     int      `json:"max_image_bytes,omitempty"`
+	MaxImageDimension int      `json:"max_image_dimension,omitempty"`
+}
+
+// Thinking styles
+const (
+	ThinkingNone   = "none"   // no extended thinking; thinking is dropped
+	ThinkingClaude = "claude" // Anthropic thinking {type, budget_tokens}
+	ThinkingGemini = "gemini" // Anthropic thinking that upstream converts to Gemini thinkingConfig
+)
+
+// Thinking describes the reasoning support of an upstream model. Models
+// without it, or with an empty style, get their thinking passed through.
+type Thinking struct {
+	Style     string `json:"style"`
+	MinBudget int    `json:"min_budget,omitempty"`
+	MaxBudget int    `json:"max_budget,omitempty"`
+	// Required models always think; a missing thinking block is added
+	Required bool `json:"required,omitempty"`
+	// CanDisable models accept a zero Gemini thinking budget
+	CanDisable bool `json:"can_disable,omitempty"`
+}
+
+// UnmarshalJSON also accepts the boolean of older models files, which leaves
+// thinking untouched
+func (t *Thinking) UnmarshalJSON(data []byte) error {
+	var flag bool
+	if json.Unmarshal(data, &flag) == nil {
+		*t = Thinking{}
+		return nil
+	}
+	type plain Thinking
+	return json.Unmarshal(data, (*plain)(t))
+}
+
+var (
+	claudeThinking = &Thinking{Style: ThinkingClaude, MinBudget: 1024, MaxBudget: 32000, Required: true}
+	geminiThinking = &Thinking{Style: ThinkingGemini, MinBudget: 128, MaxBudget: 32768}
+
+	claudeImageTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+	geminiImageTypes = []string{"image/jpeg", "image/png", "image/webp", "image/heic", "image/heif"}
+)
+
+// registry lists the known upstream models
+var registry = map[string]Capabilities{
+	"gemini-claude-opus-4-5-thinking": {ContextWindow: 200000, MaxOutput: 64000, Images: true, Documents: true, Thinking: claudeThinking,
+		ImageTypes: claudeImageTypes, MaxImageBytes: 5 << 20, MaxImageDimension: 1568},
+	"gemini-claude-sonnet-4-5-thinking": {ContextWindow: 200000, MaxOutput: 64000, Images: true, Documents: true, Thinking: claudeThinking,
+		ImageTypes: claudeImageTypes, MaxImageBytes: 5 << 20, MaxImageDimension: 1568},
+	"gemini-claude-sonnet-4-5": {ContextWindow: 200000, MaxOutput: 64000, Images: true, Documents: true, Thinking: &Thinking{Style: ThinkingNone},
+		ImageTypes: claudeImageTypes, MaxImageBytes: 5 << 20, MaxImageDimension: 1568},
+	"gemini-3-pro-high": {ContextWindow: 1048576, MaxOutput: 65536, Images: true, Documents: true, Thinking: geminiThinking,
+		ImageTypes: geminiImageTypes, MaxImageBytes: 7 << 20, MaxImageDimension: 3072},
+	"gemini-3-pro-low": {ContextWindow: 1048576, MaxOutput: 65536, Images: true, Documents: true, Thinking: geminiThinking,
+		ImageTypes: geminiImageTypes, MaxImageBytes: 7 << 20, MaxImageDimension: 3072},
+	"gemini-3-flash": {ContextWindow: 1048576, MaxOutput: 65536, Images: true, Documents: true,
+		Thinking:   &Thinking{Style: ThinkingGemini, MinBudget: 0, MaxBudget: 24576, CanDisable: true},
+		ImageTypes: geminiImageTypes, MaxImageBytes: 7 << 20, MaxImageDimension: 3072},
+	"gpt-oss-120b-medium": {ContextWindow: 131072, MaxOutput: 32768},
+}
+
+// Lookup returns the capabilities of an upstream model
+func Lookup(model string) (Capabilities, bool) {
+	c, ok := registry[model]
+	return c, ok
+}
+
+// LoadFile adds or replaces registry entries from a JSON object of model
+// name to capabilities
+func LoadFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var entries map[string]Capabilities
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for model, c := range entries {
+		if c.ContextWindow <= 0 || c.MaxOutput <= 0 {
+			return 0, fmt.Errorf("%s: context_window and max_output must be positive", model)
+		}
+		if t := c.Thinking; t != nil {
+			switch t.Style {
+			case "", ThinkingNone, ThinkingClaude, ThinkingGemini:
+			default:
+				return 0, fmt.Errorf("%s: thinking style must be none, claude or gemini", model)
+			}
+			if t.Style != "" && t.Style != ThinkingNone && (t.MinBudget < 0 || t.MaxBudget < t.MinBudget) {
+				return 0, fmt.Errorf("%s: thinking budgets must satisfy 0 <= min_budget <= max_budget", model)
+			}
+		}
+		registry[model] = c
+	}
+	return len(entries), nil
+}
+
+// mediaTokens is the estimated cost of one inline image or document. Their
+// base64 data is not counted as text.
+const mediaTokens = 1600
+
+// EstimateTokens estimates the prompt size of a Messages or Chat
+// Completions request from the length of its messages, system prompt and
+// tools, at tokenMultiplier characters per token
+func EstimateTokens(request map[string]json.RawMessage, tokenMultiplier float64) int {
+	chars := len(request["messages"]) + len(request["system"]) + len(request["tools"])
+	inline, count := inlineData(request["messages"])
+	return int(float64(chars-inline)/tokenMultiplier) + count*mediaTokens
+}
+
+// inlineKey matches the start of a string that may hold inline media:
+// Anthropic base64 "data" and Chat Completions data: URLs
+var inlineKey = regexp.MustCompile(`"(data|url)"\s*:\s*"`)
+
+// inlineData measures the base64 data and data: URL strings of image and
+// document sources. Base64 contains no quotes or escapes, so the string ends
+// at the next quote.
+func inlineData(raw []byte) (chars, count int) {
+	for {
+		loc := inlineKey.FindSubmatchIndex(raw)
+		if loc == nil {
+			return chars, count
+		}
+		key := string(raw[loc[2]:loc[3]])
+		raw = raw[loc[1]:]
+		end := bytes.IndexByte(raw, '"')
+		if end < 0 {
+			return chars, count
+		}
+		// Short values are ordinary fields, such as redacted thinking, and
+		// other URLs are fetched upstream
+		if end >= 1024 && (key == "data" || bytes.HasPrefix(raw, []byte("data:"))) {
+			chars += end
+			count++
+		}
+		raw = raw[end:]
+	}
+}
+
+// TooLongError reports a prompt that doesn't fit the model's context window.
+// The message follows Anthropic's wording, which clients such as Claude Code
+// recognize to compact the conversation.
+type TooLongError struct {
+	Tokens  int
+	Maximum int
+}
+
+func (e *TooLongError) Error() string {
+	return fmt.Sprintf("prompt is too long: %d tokens > %d maximum", e.Tokens, e.Maximum)
+}
+
+// Fit clamps the output token limit of a request for an upstream model to its
+// maximum output and to the room left in its context window after the
+// estimated input. field is max_tokens, or max_completion_tokens for Chat
+// Completions requests that use it. It returns the original limit if it was
+// lowered, 0 otherwise, and a *TooLongError if the input alone doesn't fit.
+func Fit(request map[string]json.RawMessage, c Capabilities, field string, inputTokens int) (int, error) {
+	if inputTokens >= c.ContextWindow {
+		return 0, &TooLongError{Tokens: inputTokens, Maximum: c.ContextWindow}
+	}
+
+	var requested int
+	if json.Unmarshal(request[field], &requested) != nil || requested <= 0 {
+		return 0, nil
+	}
+	limit := min(requested, c.MaxOutput, c.ContextWindow-inputTokens)
+	if limit == requested {
+		return 0, nil
+	}
+	request[field], _ = json.Marshal(limit)
+
+	// The thinking budget must stay below the output limit
+	var thinking struct {
+		Type         string `json:"type"`
+		BudgetTokens int    `json:"budget_tokens"`
+	}
+	if json.Unmarshal(request["thinking"], &thinking) == nil && thinking.Type == "enabled" && thinking.BudgetTokens >= limit {
+		// Split the limit between reasoning and answer, or go without thinking
+		// below the minimum budget
+		if budget := limit / 2; budget >= 1024 {
+			thinking.BudgetTokens = budget
+			request["thinking"], _ = json.Marshal(thinking)
+		} else {
+			delete(request, "thinking")
+		}
+	}
+	return requested, nil
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	image := strings.Repeat("A", 4000)
+	for _, tc := range []struct {
+		name    string
+		request map[string]json.RawMessage
+		want    int
+	}{
+		{
+			name: "text",
+			request: map[string]json.RawMessage{
+				"system":   json.RawMessage(strings.Repeat("s", 100)),
+				"messages": json.RawMessage(strings.Repeat("m", 200)),
+				"tools":    json.RawMessage(strings.Repeat("t", 100)),
+				"model":    json.RawMessage(strings.Repeat("x", 1000)),
+			},
+			want: 100,
+		},
+		{
+			name: "base64 image counted as media",
+			request: map[string]json.RawMessage{"messages": json.RawMessage(
+				`[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + image + `"}}]}]`)},
+			want: (len(`[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":""}}]}]`))/4 + mediaTokens,
+		},
+		{
+			name: "data URL counted as media",
+			request: map[string]json.RawMessage{"messages": json.RawMessage(
+				`[{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,` + image + `"}}]}]`)},
+			want: (len(`[{"role":"user","content":[{"type":"image_url","image_url":{"url":""}}]}]`))/4 + mediaTokens,
+		},
+		{
+			name: "short data and remote URLs counted as text",
+			request: map[string]json.RawMessage{"messages": json.RawMessage(
+				`[{"type":"redacted_thinking","data":"abc"},{"url":"https://example.com/` + image + `"}]`)},
+			want: len(`[{"type":"redacted_thinking","data":"abc"},{"url":"https://example.com/`+image+`"}]`) / 4,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := EstimateTokens(tc.request, 4); got != tc.want {
+				t.Fatalf("EstimateTokens = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFit(t *testing.T) {
+	c := Capabilities{ContextWindow: 10000, MaxOutput: 4000}
+	for _, tc := range []struct {
+		name         string
+		field        string
+		request      string
+		input        int
+		wantOriginal int
+		wantLimit    string
+		wantThinking string
+	}{
+		{"within limits", "max_tokens", `{"max_tokens":2000}`, 1000, 0, "2000", ""},
+		{"clamped to max output", "max_tokens", `{"max_tokens":8000}`, 1000, 8000, "4000", ""},
+		{"clamped to room left", "max_tokens", `{"max_tokens":4000}`, 7000, 4000, "3000", ""},
+		{"max_completion_tokens", "max_completion_tokens", `{"max_completion_tokens":8000}`, 0, 8000, "4000", ""},
+		{"no limit", "max_tokens", `{}`, 1000, 0, "", ""},
+		{
+			"thinking budget halved", "max_tokens", `{"max_tokens":8000,"thinking":{"type":"enabled","budget_tokens":6000}}`, 1000, 8000, "4000",
+			`{"type":"enabled","budget_tokens":2000}`,
+		},
+		{
+			"thinking budget below limit kept", "max_tokens", `{"max_tokens":8000,"thinking":{"type":"enabled","budget_tokens":3000}}`, 1000, 8000, "4000",
+			`{"type":"enabled","budget_tokens":3000}`,
+		},
+		{
+			"thinking dropped below minimum budget", "max_tokens", `{"max_tokens":8000,"thinking":{"type":"enabled","budget_tokens":4000}}`, 8000, 8000, "2000",
+			"",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var request map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tc.request), &request); err != nil {
+				t.Fatal(err)
+			}
+			original, err := Fit(request, c, tc.field, tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if original != tc.wantOriginal {
+				t.Fatalf("original = %d, want %d", original, tc.wantOriginal)
+			}
+			if got := string(request[tc.field]); got != tc.wantLimit {
+				t.Fatalf("%s = %s, want %s", tc.field, got, tc.wantLimit)
+			}
+			if got := string(request["thinking"]); got != tc.wantThinking {
+				t.Fatalf("thinking = %s, want %s", got, tc.wantThinking)
+			}
+		})
+	}
+}
+
+func TestFitTooLong(t *testing.T) {
+	request := map[string]json.RawMessage{"max_tokens": json.RawMessage("100")}
+	_, err := Fit(request, Capabilities{ContextWindow: 10000, MaxOutput: 4000}, "max_tokens", 10000)
+	var tooLong *TooLongError
+	if !errors.As(err, &tooLong) || tooLong.Tokens != 10000 || tooLong.Maximum != 10000 {
+		t.Fatalf("err = %v, want a TooLongError", err)
+	}
+	if want := "prompt is too long: 10000 tokens > 10000 maximum"; err.Error() != want {
+		t.Fatalf("message = %q, want %q", err.Error(), want)
+	}
+}
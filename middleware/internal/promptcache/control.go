@@ -0,0 +1,86 @@
+package promptcache
+
+import "encoding/json"
+
+// cache_control handling modes for backends that reject the field
+const (
+	ModeKeep      = "keep"      // forward cache_control as sent
+	ModeNormalize = "normalize" // reduce to {"type":"ephemeral"}, dropping ttl and other extensions
+	ModeStrip     = "strip"     // remove cache_control entirely
+)
+
+// ApplyMode rewrites the cache_control fields of a Messages request's
+// tools, system blocks and message content blocks. It reports whether the
+// request was changed.
+func ApplyMode(request map[string]json.RawMessage, mode string) bool {
+	if mode != ModeNormalize && mode != ModeStrip {
+		return false
+	}
+	modified := false
+
+	rewriteBlocks := func(raw json.RawMessage) (json.RawMessage, bool) {
+		var blocks []map[string]json.RawMessage
+		if json.Unmarshal(raw, &blocks) != nil {
+			return raw, false
+		}
+		changed := false
+		for _, block := range blocks {
+			if rewriteControl(block, mode) {
+				changed = true
+			}
+		}
+		if !changed {
+			return raw, false
+		}
+		out, err := json.Marshal(blocks)
+		if err != nil {
+			return raw, false
+		}
+		return out, true
+	}
+
+	for _, field := range []string{"tools", "system"} {
+		if raw, ok := request[field]; ok && len(raw) > 0 && raw[0] == '[' {
+			if out, changed := rewriteBlocks(raw); changed {
+				request[field] = out
+				modified = true
+			}
+		}
+	}
+
+	var messages []map[string]json.RawMessage
+	if json.Unmarshal(request["messages"], &messages) == nil {
+		changed := false
+		for _, message := range messages {
+			if content := message["content"]; len(content) > 0 && content[0] == '[' {
+				if out, ok := rewriteBlocks(content); ok {
+					message["content"] = out
+					changed = true
+				}
+			}
+		}
+		if changed {
+			request["messages"], _ = json.Marshal(messages)
+			modified = true
+		}
+	}
+	return modified
+}
+
+// rewriteControl applies mode to one block's cache_control
+func rewriteControl(block map[string]json.RawMessage, mode string) bool {
+	raw, ok := block["cache_control"]
+	if !ok {
+		return false
+	}
+	if mode == ModeStrip {
+		delete(block, "cache_control")
+		return true
+	}
+	normalized := json.RawMessage(`{"type":"ephemeral"}`)
+	if string(raw) == string(normalized) {
+		return false
+	}
+	block["cache_control"] = normalized
+	return true
+}
@@ -0,0 +1,232 @@
+package promptcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Anthropic only caches prefixes of at least this many tokens
+const minCacheableTokens = 1024
+
+// Cache lifetimes for cache_control {"type":"ephemeral"} and {"ttl":"1h"}
+const (
+	defaultTTL = 5 * time.Minute
+	longTTL    = time.Hour
+)
+
+// maxTracked bounds the number of remembered prefixes
+const maxTracked = 50000
+
+// breakpoint is a cache_control marker and the prompt prefix it ends
+type breakpoint struct {
+	fingerprint string
+	chars       int // length of the prefix, in the same units as Plan.totalChars
+	ttl         time.Duration
+}
+
+// Plan holds the cacheable prefixes of one request and how much of the
+// prompt this middleware considers read from or written to the cache
+type Plan struct {
+	breakpoints []breakpoint
+	totalChars  int
+	readChars   int
+	createChars int
+}
+
+// tracker remembers which prefixes were sent recently, standing in for the
+// upstream prompt cache
+type tracker struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+var seen = &tracker{expires: make(map[string]time.Time)}
+
+// live reports whether a prefix is still cached, refreshing its lifetime as
+// a cache read does
+func (t *tracker) live(fingerprint string, ttl time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	exp, ok := t.expires[fingerprint]
+	if !ok || time.Now().After(exp) {
+		return false
+	}
+	t.expires[fingerprint] = time.Now().Add(ttl)
+	return true
+}
+
+func (t *tracker) store(fingerprint string, ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if len(t.expires) >= maxTracked {
+		for fp, exp := range t.expires {
+			if now.After(exp) {
+				delete(t.expires, fp)
+			}
+		}
+		// Still full of live entries: forget an arbitrary half
+		for fp := range t.expires {
+			if len(t.expires) < maxTracked/2 {
+				break
+			}
+			delete(t.expires, fp)
+		}
+	}
+	if exp, ok := t.expires[fingerprint]; !ok || exp.Before(now.Add(ttl)) {
+		t.expires[fingerprint] = now.Add(ttl)
+	}
+}
+
+// Analyze fingerprints the prompt prefixes ending at each cache_control
+// breakpoint of a Messages request from client for model, in the order
+// Anthropic caches them: tools, then system, then messages. Prefixes are
+// tracked per client, as upstream caches are per account. Prefixes shorter
+// than the minimum cacheable length are ignored. It returns nil if nothing
+// is cacheable.
+func Analyze(request map[string]json.RawMessage, client, model string, tokenMultiplier float64) *Plan {
+	p := &Plan{}
+	hash := sha256.New()
+	hash.Write([]byte(client))
+	hash.Write([]byte{0})
+	hash.Write([]byte(model))
+
+	// add extends the prefix with one segment; marked segments end a prefix
+	add := func(segment []byte, control *cacheControl) {
+		hash.Write(segment)
+		hash.Write([]byte{0})
+		p.totalChars += len(segment)
+		if control == nil {
+			return
+		}
+		if float64(p.totalChars)/tokenMultiplier < minCacheableTokens {
+			return
+		}
+		ttl := defaultTTL
+		if control.TTL == "1h" {
+			ttl = longTTL
+		}
+		p.breakpoints = append(p.breakpoints, breakpoint{
+			fingerprint: hex.EncodeToString(hash.Sum(nil)),
+			chars:       p.totalChars,
+			ttl:         ttl,
+		})
+	}
+
+	var tools []json.RawMessage
+	json.Unmarshal(request["tools"], &tools)
+	for _, tool := range tools {
+		segment, control := withoutCacheControl(tool)
+		add(append([]byte("tool|"), segment...), control)
+	}
+
+	if system := request["system"]; len(system) > 0 && system[0] == '[' {
+		var blocks []json.RawMessage
+		json.Unmarshal(system, &blocks)
+		for _, block := range blocks {
+			segment, control := withoutCacheControl(block)
+			add(append([]byte("system|"), segment...), control)
+		}
+	} else if len(system) > 0 {
+		add(append([]byte("system|"), system...), nil)
+	}
+
+	var messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	json.Unmarshal(request["messages"], &messages)
+	for i, message := range messages {
+		prefix := fmt.Sprintf("%d|%s|", i, message.Role)
+		if len(message.Content) > 0 && message.Content[0] == '[' {
+			var blocks []json.RawMessage
+			json.Unmarshal(message.Content, &blocks)
+			for _, block := range blocks {
+				segment, control := withoutCacheControl(block)
+				add(append([]byte(prefix), segment...), control)
+			}
+		} else {
+			add(append([]byte(prefix), message.Content...), nil)
+		}
+	}
+
+	if len(p.breakpoints) == 0 {
+		return nil
+	}
+
+	// The longest prefix still cached is read; the rest up to the last
+	// breakpoint is written
+	for i := len(p.breakpoints) - 1; i >= 0; i-- {
+		if seen.live(p.breakpoints[i].fingerprint, p.breakpoints[i].ttl) {
+			p.readChars = p.breakpoints[i].chars
+			break
+		}
+	}
+	p.createChars = p.breakpoints[len(p.breakpoints)-1].chars - p.readChars
+	return p
+}
+
+// cacheControl is the value of a cache_control field
+type cacheControl struct {
+	Type string `json:"type"`
+	TTL  string `json:"ttl,omitempty"`
+}
+
+// withoutCacheControl returns a block in canonical form without its
+// cache_control field, so moving a breakpoint doesn't change fingerprints,
+// together with the removed cache_control
+func withoutCacheControl(block json.RawMessage) ([]byte, *cacheControl) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(block, &fields) != nil {
+		return block, nil
+	}
+	var control *cacheControl
+	if raw, ok := fields["cache_control"]; ok {
+		json.Unmarshal(raw, &control)
+		delete(fields, "cache_control")
+	}
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return block, control
+	}
+	return canonical, control
+}
+
+// Commit records the request's prefixes as cached, once upstream has
+// accepted the request
+func (p *Plan) Commit() {
+	for _, bp := range p.breakpoints {
+		seen.store(bp.fingerprint, bp.ttl)
+	}
+}
+
+// split divides an upstream input token count into uncached, cache write and
+// cache read tokens, in proportion to the prompt lengths
+func (p *Plan) split(input int) (uncached, creation, read int) {
+	if p.totalChars == 0 {
+		return input, 0, 0
+	}
+	read = int(math.Round(float64(input) * float64(p.readChars) / float64(p.totalChars)))
+	creation = int(math.Round(float64(input) * float64(p.createChars) / float64(p.totalChars)))
+	creation = min(creation, input-read)
+	return input - read - creation, creation, read
+}
+
+type contextKey struct{}
+
+// With returns a context carrying the plan
+func With(ctx context.Context, p *Plan) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// From returns the plan in ctx, or nil
+func From(ctx context.Context) *Plan {
+	p, _ := ctx.Value(contextKey{}).(*Plan)
+	return p
+}
@@ -0,0 +1,115 @@
+package promptcache
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+// request builds a Messages request with a system prompt of systemChars
+// characters, marked for caching, followed by the given user turns with the
+// last one marked too
+func request(t *testing.T, systemChars int, turns ...string) map[string]json.RawMessage {
+	t.Helper()
+	var messages []map[string]any
+	for i, turn := range turns {
+		block := map[string]any{"type": "text", "text": turn}
+		if i == len(turns)-1 {
+			block["cache_control"] = map[string]any{"type": "ephemeral"}
+		}
+		messages = append(messages, map[string]any{"role": "user", "content": []any{block}})
+	}
+	body, err := json.Marshal(map[string]any{
+		"system":   []any{map[string]any{"type": "text", "text": strings.Repeat("s", systemChars), "cache_control": map[string]any{"type": "ephemeral"}}},
+		"messages": messages,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req map[string]json.RawMessage
+	json.Unmarshal(body, &req)
+	return req
+}
+
+func TestAnalyze(t *testing.T) {
+	const model = "test-analyze"
+	if p := Analyze(request(t, 100, "hi"), "alice", model, 1); p != nil {
+		t.Fatalf("prefixes under %d tokens planned: %+v", minCacheableTokens, p)
+	}
+	if p := Analyze(map[string]json.RawMessage{"messages": json.RawMessage(`[{"role":"user","content":"hi"}]`)}, "alice", model, 1); p != nil {
+		t.Fatalf("request without cache_control planned: %+v", p)
+	}
+
+	first := Analyze(request(t, 2000, "first question"), "alice", model, 1)
+	if first == nil || first.readChars != 0 || first.createChars != first.totalChars {
+		t.Fatalf("first request = %+v, want everything written", first)
+	}
+
+	// Not committed yet: nothing is cached
+	if again := Analyze(request(t, 2000, "first question"), "alice", model, 1); again.readChars != 0 {
+		t.Fatalf("uncommitted prefix read: %+v", again)
+	}
+	first.Commit()
+
+	again := Analyze(request(t, 2000, "first question"), "alice", model, 1)
+	if again.readChars != again.totalChars || again.createChars != 0 {
+		t.Fatalf("repeated request = %+v, want everything read", again)
+	}
+
+	// A follow-up turn reads the system prompt and writes the rest
+	next := Analyze(request(t, 2000, "first question", "second question"), "alice", model, 1)
+	if next.readChars == 0 || next.readChars >= next.totalChars || next.readChars+next.createChars != next.totalChars {
+		t.Fatalf("follow-up request = %+v, want the system prefix read", next)
+	}
+
+	// Fingerprints are per client and per model
+	if other := Analyze(request(t, 2000, "first question"), "bob", model, 1); other.readChars != 0 {
+		t.Fatalf("prefix cached for another client: %+v", other)
+	}
+	if other := Analyze(request(t, 2000, "first question"), "alice", model+"-other", 1); other.readChars != 0 {
+		t.Fatalf("prefix cached for another model: %+v", other)
+	}
+}
+
+func TestRewriteJSON(t *testing.T) {
+	p := &Plan{totalChars: 1000, readChars: 600, createChars: 300}
+	for _, tc := range []struct {
+		name, body, want string
+	}{
+		{
+			"split",
+			`{"id":"m","usage":{"input_tokens":100,"output_tokens":5}}`,
+			`{"id":"m","usage":{"cache_creation_input_tokens":30,"cache_read_input_tokens":60,"input_tokens":10,"output_tokens":5}}`,
+		},
+		{
+			"upstream counts kept",
+			`{"usage":{"input_tokens":100,"cache_read_input_tokens":40}}`,
+			`{"usage":{"input_tokens":100,"cache_read_input_tokens":40}}`,
+		},
+		{
+			"no usage",
+			`{"id":"m"}`,
+			`{"id":"m"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(p.RewriteJSON([]byte(tc.body))); got != tc.want {
+				t.Fatalf("RewriteJSON = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWrapStreamRewritesMessageStart(t *testing.T) {
+	p := &Plan{totalChars: 1000, readChars: 500}
+	stream := "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":10}}}\n\n"
+	out, err := io.ReadAll(p.WrapStream(io.NopCloser(strings.NewReader(stream))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "event: message_start\ndata: {\"message\":{\"usage\":{\"cache_creation_input_tokens\":0,\"cache_read_input_tokens\":5,\"input_tokens\":5}},\"type\":\"message_start\"}\n\n"
+	if string(out) != want {
+		t.Fatalf("stream = %q\nwant %q", out, want)
+	}
+}
@@ -0,0 +1,76 @@
+package promptcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"cliproxy-middleware/internal/sse"
+)
+
+// rewriteUsage fills in cache token counts on a usage object that has none,
+// taking them out of input_tokens the way Anthropic reports them. It reports
+// whether the usage was changed.
+func (p *Plan) rewriteUsage(usage map[string]json.RawMessage) bool {
+	var input, creation, read int
+	json.Unmarshal(usage["input_tokens"], &input)
+	json.Unmarshal(usage["cache_creation_input_tokens"], &creation)
+	json.Unmarshal(usage["cache_read_input_tokens"], &read)
+	if input == 0 || creation > 0 || read > 0 {
+		return false
+	}
+
+	input, creation, read = p.split(input)
+	if creation == 0 && read == 0 {
+		return false
+	}
+	usage["input_tokens"], _ = json.Marshal(input)
+	usage["cache_creation_input_tokens"], _ = json.Marshal(creation)
+	usage["cache_read_input_tokens"], _ = json.Marshal(read)
+	return true
+}
+
+// rewriteObject applies rewriteUsage to the usage field of obj, or of the
+// message nested in a message_start event. It returns the new JSON, or nil
+// if nothing changed.
+func (p *Plan) rewriteObject(data []byte) []byte {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(data, &obj) != nil {
+		return nil
+	}
+
+	if raw, ok := obj["message"]; ok {
+		if nested := p.rewriteObject(raw); nested != nil {
+			obj["message"] = nested
+			out, _ := json.Marshal(obj)
+			return out
+		}
+	}
+
+	var usage map[string]json.RawMessage
+	if json.Unmarshal(obj["usage"], &usage) != nil || usage == nil || !p.rewriteUsage(usage) {
+		return nil
+	}
+	obj["usage"], _ = json.Marshal(usage)
+	out, _ := json.Marshal(obj)
+	return out
+}
+
+// RewriteJSON fills in cache token counts in a non-streaming response body
+func (p *Plan) RewriteJSON(body []byte) []byte {
+	if out := p.rewriteObject(body); out != nil {
+		return out
+	}
+	return body
+}
+
+// WrapStream fills in cache token counts in the usage of message_start and
+// message_delta events of an SSE body. Other lines pass through unchanged.
+func (p *Plan) WrapStream(body io.ReadCloser) io.ReadCloser {
+	return sse.RewriteData(body, func(data []byte) []byte {
+		if !bytes.Contains(data, []byte(`"input_tokens"`)) {
+			return nil
+		}
+		return p.rewriteObject(data)
+	})
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"cliproxy-middleware/internal/breaker"
+	"cliproxy-middleware/internal/limiter"
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+// HedgeStats counts hedged requests
+type HedgeStats struct {
+	Fired  atomic.Int64 // second requests sent
+	Won    atomic.Int64 // hedge answered first
+	Wasted atomic.Int64 // primary answered first, hedge canceled
+}
+
+// Global hedge counters
+var hedgeStats = &HedgeStats{}
+
+// GetHedgeStats returns the hedge counters
+func GetHedgeStats() (fired, won, wasted int64) {
+	return hedgeStats.Fired.Load(), hedgeStats.Won.Load(), hedgeStats.Wasted.Load()
+}
+
+// hedgingTransport fires a second copy of small non-streaming requests when
+// the first has not returned response headers within delay, and uses
+// whichever answers first. The hedge needs a limiter slot of its own and is
+// skipped when none is free, or while the breaker is not closed, since a
+// failing upstream is only made worse by doubling the load on it.
+type hedgingTransport struct {
+	transport http.RoundTripper
+	limiter   *limiter.Limiter
+	breaker   *breaker.Breaker
+	delay     time.Duration
+	maxBytes  int64
+	models    map[string]bool
+}
+
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedge  bool
+	cancel context.CancelFunc
+}
+
+// ok reports whether the result is usable as a final answer
+func (r hedgeResult) ok() bool {
+	return r.err == nil && r.resp.StatusCode < 500 && r.resp.StatusCode != http.StatusTooManyRequests
+}
+
+// discard releases a result that lost the race
+func (r hedgeResult) discard() {
+	r.cancel()
+	if r.resp != nil {
+		r.resp.Body.Close()
+	}
+}
+
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info := reqinfo.From(req.Context())
+	if info.Stream || !t.models[info.MappedModel] || req.Body == nil ||
+		req.ContentLength <= 0 || req.ContentLength > t.maxBytes {
+		return t.transport.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(chan hedgeResult, 2)
+	launch := func(hedge bool, release func()) {
+		ctx, cancel := context.WithCancel(req.Context())
+		attempt := req.Clone(ctx)
+		attempt.Body = io.NopCloser(bytes.NewReader(body))
+		resp, err := t.transport.RoundTrip(attempt)
+		if err != nil {
+			release()
+		} else {
+			resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+		}
+		results <- hedgeResult{resp: resp, err: err, hedge: hedge, cancel: cancel}
+	}
+
+	// The primary runs in the slot the limiting transport already holds
+	go launch(false, func() {})
+
+	timer := time.NewTimer(t.delay)
+	select {
+	case res := <-results:
+		timer.Stop()
+		return res.finish()
+	case <-timer.C:
+	case <-req.Context().Done():
+		timer.Stop()
+		res := <-results
+		return res.finish()
+	}
+
+	logger := reqinfo.Logger(req.Context())
+	if !t.breaker.IsClosed() {
+		logger.Info("hedge skipped, circuit breaker not closed", "model", info.MappedModel, "delay", t.delay)
+		return (<-results).finish()
+	}
+	release, ok := t.limiter.TryAcquire(info.ClientID(), info.MappedModel)
+	if !ok {
+		logger.Info("hedge skipped, no free slot", "model", info.MappedModel, "delay", t.delay)
+		return (<-results).finish()
+	}
+	hedgeStats.Fired.Add(1)
+	logger.Info("sending hedge request", "model", info.MappedModel, "delay", t.delay)
+	go launch(true, release)
+
+	first := <-results
+	if !first.ok() {
+		// Give the other attempt a chance before reporting the failure
+		second := <-results
+		if second.ok() {
+			first.discard()
+			first = second
+		} else {
+			second.discard()
+		}
+	} else {
+		go func() { (<-results).discard() }()
+	}
+
+	if first.hedge {
+		hedgeStats.Won.Add(1)
+	} else {
+		hedgeStats.Wasted.Add(1)
+	}
+	return first.finish()
+}
+
+// finish returns the result, tying its context to the lifetime of the body
+func (r hedgeResult) finish() (*http.Response, error) {
+	if r.err != nil {
+		r.cancel()
+		return nil, r.err
+	}
+	r.resp.Body = &cancelOnClose{ReadCloser: r.resp.Body, cancel: r.cancel}
+	return r.resp, nil
+}
+
+// cancelOnClose cancels an attempt's context once its body is done
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
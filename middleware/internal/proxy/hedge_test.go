@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cliproxy-middleware/internal/breaker"
+	"cliproxy-middleware/internal/limiter"
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+// slowTransport answers the first call after a delay and later ones at once
+type slowTransport struct {
+	calls atomic.Int32
+	delay time.Duration
+}
+
+func (t *slowTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.calls.Add(1) == 1 {
+		select {
+		case <-time.After(t.delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+}
+
+func hedgedRequest() *http.Request {
+	info := &reqinfo.Info{MappedModel: "m"}
+	req, _ := http.NewRequestWithContext(reqinfo.With(context.Background(), info), http.MethodPost, "http://upstream/v1/messages", strings.NewReader("{}"))
+	return req
+}
+
+func TestHedgeNeedsItsOwnSlot(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		maxTotal  int
+		wantCalls int32
+	}{
+		{"slot free", 2, 2},
+		{"no slot", 1, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lim := limiter.New(tc.maxTotal, nil, 0)
+			upstream := &slowTransport{delay: 100 * time.Millisecond}
+			rt := &limitingTransport{limiter: lim, transport: &hedgingTransport{
+				transport: upstream, limiter: lim, delay: 10 * time.Millisecond, maxBytes: 1 << 20, models: map[string]bool{"m": true},
+			}}
+
+			resp, err := rt.RoundTrip(hedgedRequest())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := upstream.calls.Load(); got != tc.wantCalls {
+				t.Fatalf("upstream calls = %d, want %d", got, tc.wantCalls)
+			}
+			if in := lim.Stats().InFlight; in > tc.maxTotal {
+				t.Fatalf("in flight = %d beyond the cap of %d", in, tc.maxTotal)
+			}
+			resp.Body.Close()
+
+			// The losing attempt gives its slot back once discarded
+			deadline := time.Now().Add(time.Second)
+			for lim.Stats().InFlight != 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("in flight = %d after the response was closed", lim.Stats().InFlight)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestHedgeSkippedUnlessBreakerClosed(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		trip      func(*breaker.Breaker)
+		wantCalls int32
+	}{
+		{"closed", func(*breaker.Breaker) {}, 2},
+		{"open", func(b *breaker.Breaker) { b.Failure() }, 1},
+		{"half open", func(b *breaker.Breaker) { b.Failure(); b.Probe(true) }, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			brk := breaker.New(1, 0)
+			tc.trip(brk)
+			upstream := &slowTransport{delay: 50 * time.Millisecond}
+			rt := &hedgingTransport{
+				transport: upstream, limiter: limiter.New(2, nil, 0), breaker: brk,
+				delay: 10 * time.Millisecond, maxBytes: 1 << 20, models: map[string]bool{"m": true},
+			}
+
+			resp, err := rt.RoundTrip(hedgedRequest())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := upstream.calls.Load(); got != tc.wantCalls {
+				t.Fatalf("upstream calls = %d, want %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"cliproxy-middleware/internal/apierror"
+)
+
+// errStalled is returned when upstream sends nothing for longer than the stall timeout
+var errStalled = &stallError{}
+
+type stallError struct{}
+
+func (*stallError) Error() string   { return "upstream stream stalled" }
+func (*stallError) Timeout() bool   { return true }
+func (*stallError) Temporary() bool { return true }
+
+var (
+	anthropicPing = []byte("event: ping\ndata: {\"type\": \"ping\"}\n\n")
+	openAIPing    = []byte(": ping\n\n")
+)
+
+type chunk struct {
+	data []byte
+	err  error
+}
+
+// keepaliveBody wraps an SSE response body. While upstream is silent it
+// injects ping events toward the client at event boundaries, and if the
+// silence lasts past the stall timeout it aborts the upstream call.
+type keepaliveBody struct {
+	body         io.ReadCloser
+	ping         []byte
+	pingInterval time.Duration
+	stallTimeout time.Duration
+
+	chunks  chan chunk
+	done    chan struct{}
+	pending []byte
+	err     error
+
+	lastData   time.Time
+	lastPing   time.Time
+	atBoundary bool
+	tail       [2]byte
+}
+
+func newKeepaliveBody(body io.ReadCloser, protocol apierror.Protocol, pingInterval, stallTimeout time.Duration) *keepaliveBody {
+	ping := anthropicPing
+	if protocol == apierror.OpenAI {
+		ping = openAIPing
+	}
+	now := time.Now()
+	kb := &keepaliveBody{
+		body:         body,
+		ping:         ping,
+		pingInterval: pingInterval,
+		stallTimeout: stallTimeout,
+		chunks:       make(chan chunk),
+		done:         make(chan struct{}),
+		lastData:     now,
+		lastPing:     now,
+		atBoundary:   true,
+	}
+	go kb.readLoop()
+	return kb
+}
+
+func (kb *keepaliveBody) readLoop() {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := kb.body.Read(buf)
+		select {
+		case kb.chunks <- chunk{buf[:n], err}:
+		case <-kb.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (kb *keepaliveBody) Read(p []byte) (int, error) {
+	if len(kb.pending) > 0 {
+		return kb.emit(p), nil
+	}
+	if kb.err != nil {
+		return 0, kb.err
+	}
+
+	for {
+		var timer <-chan time.Time
+		var t *time.Timer
+		if wait := kb.nextDeadline(); wait > 0 {
+			t = time.NewTimer(wait)
+			timer = t.C
+		}
+
+		select {
+		case c := <-kb.chunks:
+			if t != nil {
+				t.Stop()
+			}
+			kb.lastData = time.Now()
+			kb.pending = c.data
+			kb.err = c.err
+			if len(kb.pending) > 0 {
+				return kb.emit(p), nil
+			}
+			return 0, kb.err
+
+		case <-timer:
+			silence := time.Since(kb.lastData)
+			if kb.stallTimeout > 0 && silence >= kb.stallTimeout {
+				log.Printf("⚠️  Upstream stream silent for %s, aborting", silence.Round(time.Second))
+				kb.err = errStalled
+				kb.body.Close()
+				return 0, kb.err
+			}
+			if kb.pingInterval > 0 && kb.atBoundary && time.Since(kb.lastActivity()) >= kb.pingInterval {
+				kb.lastPing = time.Now()
+				kb.pending = kb.ping
+				return kb.emit(p), nil
+			}
+			// Mid-event: wait for the event to finish before pinging
+		}
+	}
+}
+
+// nextDeadline returns how long to wait before the next ping or stall check
+func (kb *keepaliveBody) nextDeadline() time.Duration {
+	var wait time.Duration
+	if kb.pingInterval > 0 {
+		wait = kb.pingInterval - time.Since(kb.lastActivity())
+		if !kb.atBoundary {
+			// Re-check shortly in case the event completes
+			wait = kb.pingInterval
+		}
+		if wait < 10*time.Millisecond {
+			wait = 10 * time.Millisecond
+		}
+	}
+	if kb.stallTimeout > 0 {
+		stall := kb.stallTimeout - time.Since(kb.lastData)
+		if stall < 10*time.Millisecond {
+			stall = 10 * time.Millisecond
+		}
+		if wait == 0 || stall < wait {
+			wait = stall
+		}
+	}
+	return wait
+}
+
+// lastActivity is the last time anything was sent toward the client
+func (kb *keepaliveBody) lastActivity() time.Time {
+	if kb.lastData.After(kb.lastPing) {
+		return kb.lastData
+	}
+	return kb.lastPing
+}
+
+// emit copies pending bytes to p and tracks whether output ends on an event boundary
+func (kb *keepaliveBody) emit(p []byte) int {
+	n := copy(p, kb.pending)
+	for _, b := range kb.pending[:n] {
+		if b == '\r' {
+			continue
+		}
+		kb.tail[0], kb.tail[1] = kb.tail[1], b
+	}
+	kb.atBoundary = kb.tail[0] == '\n' && kb.tail[1] == '\n'
+	kb.pending = kb.pending[n:]
+	return n
+}
+
+func (kb *keepaliveBody) Close() error {
+	select {
+	case <-kb.done:
+	default:
+		close(kb.done)
+	}
+	return kb.body.Close()
+}
+
+// isStall reports whether err came from stall detection
+func isStall(err error) bool {
+	return errors.Is(err, errStalled)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"cliproxy-middleware/internal/apierror"
+)
+
+func TestKeepalivePingsOnlyBetweenEvents(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	r, w := io.Pipe()
+	go func() {
+		// Stay silent for several ping intervals both inside an event and after it
+		w.Write([]byte("event: content_block_delta\ndata: {\"a\":"))
+		time.Sleep(5 * interval)
+		w.Write([]byte("1}\n\n"))
+		time.Sleep(5 * interval)
+		w.Close()
+	}()
+
+	out, err := io.ReadAll(newKeepaliveBody(r, apierror.Anthropic, interval, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, ok := strings.CutPrefix(string(out), "event: content_block_delta\ndata: {\"a\":1}\n\n")
+	if !ok {
+		t.Fatalf("stream = %q, want the event forwarded whole", out)
+	}
+	if rest == "" || strings.ReplaceAll(rest, string(anthropicPing), "") != "" {
+		t.Fatalf("after the event got %q, want only pings", rest)
+	}
+}
+
+func TestKeepaliveStallBecomesErrorFrame(t *testing.T) {
+	r, w := io.Pipe()
+	go w.Write([]byte(": ping\n\ndata: {\"choices\":[]}\n\n"))
+
+	body := newErrorFrameBody(newKeepaliveBody(r, apierror.OpenAI, 0, 50*time.Millisecond), apierror.OpenAI)
+	out, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, ok := strings.CutPrefix(string(out), ": ping\n\ndata: {\"choices\":[]}\n\n")
+	if !ok {
+		t.Fatalf("stream = %q, want the forwarded events first", out)
+	}
+	if !strings.HasPrefix(rest, "data: {\"error\":{\"message\":\"Upstream stream stalled") {
+		t.Fatalf("after the forwarded events got %q, want the stall error frame", rest)
+	}
+	// The upstream body was closed to abort the call
+	if _, err := w.Write([]byte("late")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("upstream write after stall = %v, want the body closed", err)
+	}
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"cliproxy-middleware/internal/limiter"
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+// limitingTransport holds a limiter slot for the whole upstream call,
+// including the streamed response body
+type limitingTransport struct {
+	limiter   *limiter.Limiter
+	transport http.RoundTripper
+}
+
+func (t *limitingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info := reqinfo.From(req.Context())
+	release, err := t.limiter.Acquire(req.Context(), info.ClientID(), info.MappedModel)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseOnClose frees the limiter slot once the response body is closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
@@ -2,25 +2,40 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"cliproxy-middleware/internal/apierror"
+	"cliproxy-middleware/internal/breaker"
+	"cliproxy-middleware/internal/capture"
 	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/limiter"
+	"cliproxy-middleware/internal/metrics"
+	"cliproxy-middleware/internal/promptcache"
+	"cliproxy-middleware/internal/reqinfo"
+	"cliproxy-middleware/internal/thinking"
+	"cliproxy-middleware/internal/toolnames"
+	"cliproxy-middleware/internal/toolprune"
+	"cliproxy-middleware/internal/tracing"
 )
 
 // New creates a basic reverse proxy (backwards compatibility)
 func New(cfg *config.Config) (*httputil.ReverseProxy, error) {
-	return NewWithPool(cfg)
+	return NewWithPool(cfg, nil, nil)
 }
 
-// NewWithPool creates a reverse proxy with connection pooling for better performance
-func NewWithPool(cfg *config.Config) (*httputil.ReverseProxy, error) {
+// NewWithPool creates a reverse proxy with connection pooling for better performance.
+// If brk is non-nil, upstream calls are guarded by the circuit breaker; if lim
+// is non-nil, concurrent upstream calls are capped and queued per client.
+func NewWithPool(cfg *config.Config, brk *breaker.Breaker, lim *limiter.Limiter) (*httputil.ReverseProxy, error) {
 	upstream, err := url.Parse(cfg.UpstreamURL)
 	if err != nil {
 		return nil, err
@@ -47,10 +62,36 @@ func NewWithPool(cfg *config.Config) (*httputil.ReverseProxy, error) {
 	proxy := httputil.NewSingleHostReverseProxy(upstream)
 
 	// Use pooled transport
+	var rt http.RoundTripper = transport
 	if cfg.Debug {
-		proxy.Transport = &loggingTransport{transport}
+		rt = &loggingTransport{rt}
+	}
+	if brk.Enabled() {
+		rt = &breaker.Transport{Breaker: brk, Transport: rt}
+	}
+	if cfg.HedgeDelay > 0 {
+		models := make(map[string]bool)
+		for _, model := range cfg.HedgeModels {
+			models[model] = true
+		}
+		rt = &hedgingTransport{transport: rt, limiter: lim, breaker: brk, delay: cfg.HedgeDelay, maxBytes: cfg.HedgeMaxBytes, models: models}
+	}
+	if lim.Enabled() {
+		proxy.Transport = &limitingTransport{limiter: lim, transport: rt}
 	} else {
-		proxy.Transport = transport
+		proxy.Transport = rt
+	}
+	if cfg.CaptureDir != "" {
+		proxy.Transport = &capture.Transport{Transport: proxy.Transport}
+	}
+	proxy.Transport = &tracing.Transport{Transport: proxy.Transport}
+
+	// Continuations queue for a fresh limiter slot and are traced and
+	// captured like any other call; the broken stream's slot is freed first
+	resume := &resumer{
+		transport:     proxy.Transport,
+		attempts:      cfg.StreamResumeAttempts,
+		fallbackModel: cfg.StreamResumeModel,
 	}
 
 	// Modify director for streaming
@@ -61,11 +102,82 @@ func NewWithPool(cfg *config.Config) (*httputil.ReverseProxy, error) {
 		req.Header.Del("Accept-Encoding")
 		// Set connection to keep-alive
 		req.Header.Set("Connection", "keep-alive")
+		// Let upstream logs be correlated with ours
+		if id := reqinfo.From(req.Context()).ID; id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
 	}
 
 	// Handle streaming responses
 	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			metrics.UpstreamErrors.Inc("http_" + strconv.Itoa(resp.StatusCode))
+		}
+
+		// The client already gets our request ID; don't send upstream's as a second value
+		if reqinfo.From(resp.Request.Context()).ID != "" {
+			resp.Header.Del("X-Request-ID")
+		}
+
 		contentType := resp.Header.Get("Content-Type")
+		// Rewriters for every upstream stream body, including the
+		// continuations of a resumed stream
+		var streamRewriters []func(io.ReadCloser) io.ReadCloser
+
+		// Give tool calls their original names back
+		if mapping := toolnames.From(resp.Request.Context()); mapping != nil && resp.Header.Get("Content-Encoding") == "" {
+			if strings.Contains(contentType, "text/event-stream") {
+				streamRewriters = append(streamRewriters, mapping.WrapStream)
+			} else if strings.Contains(contentType, "application/json") {
+				if err := rewriteBody(resp, mapping.RestoreJSON); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Refuse calls to tools that were pruned from the request; streams are
+		// checked below, after any resumption
+		if pruned := toolprune.From(resp.Request.Context()); pruned != nil && resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Encoding") == "" {
+			protocol := apierror.ProtocolFor(resp.Request)
+			if strings.Contains(contentType, "application/json") {
+				if err := rewriteBody(resp, func(body []byte) []byte {
+					name := pruned.Called(body)
+					if name == "" {
+						return body
+					}
+					reqinfo.Logger(resp.Request.Context()).Warn("pruned tool called", "tool", name)
+					e := apierror.Upstream(http.StatusBadGateway, pruned.Message(name))
+					resp.StatusCode = e.StatusFor(protocol)
+					return e.Body(protocol)
+				}); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Report emulated prompt cache usage when upstream doesn't
+		if plan := promptcache.From(resp.Request.Context()); plan != nil && resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Encoding") == "" {
+			plan.Commit()
+			if strings.Contains(contentType, "text/event-stream") {
+				streamRewriters = append(streamRewriters, plan.WrapStream)
+			} else if strings.Contains(contentType, "application/json") {
+				if err := rewriteBody(resp, plan.RewriteJSON); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Remember which model signed the thinking blocks of the response
+		if model := reqinfo.From(resp.Request.Context()).MappedModel; model != "" && resp.StatusCode == http.StatusOK && strings.HasSuffix(resp.Request.URL.Path, "/messages") {
+			if strings.Contains(contentType, "text/event-stream") {
+				streamRewriters = append(streamRewriters, func(body io.ReadCloser) io.ReadCloser {
+					return thinking.Watch(body, model, true)
+				})
+			} else {
+				resp.Body = thinking.Watch(resp.Body, model, false)
+			}
+		}
+
 		if strings.Contains(contentType, "text/event-stream") ||
 			strings.Contains(contentType, "application/x-ndjson") {
 			// Remove Content-Length for streaming
@@ -74,56 +186,127 @@ func NewWithPool(cfg *config.Config) (*httputil.ReverseProxy, error) {
 			resp.Header.Set("X-Accel-Buffering", "no")
 			resp.Header.Set("Cache-Control", "no-cache")
 		}
+		if strings.Contains(contentType, "text/event-stream") {
+			info := reqinfo.From(resp.Request.Context())
+			protocol := apierror.ProtocolFor(resp.Request)
+
+			// Keep idle streams alive and abort stalled ones
+			stallTimeout := cfg.StallTimeoutFor(info.MappedModel)
+			wrapUpstream := func(body io.ReadCloser) io.ReadCloser {
+				for _, rewrite := range streamRewriters {
+					body = rewrite(body)
+				}
+				if cfg.PingInterval <= 0 && stallTimeout <= 0 {
+					return body
+				}
+				return newKeepaliveBody(body, protocol, cfg.PingInterval, stallTimeout)
+			}
+
+			// Continue broken Anthropic streams where they left off
+			if resume.attempts > 0 && resp.StatusCode == http.StatusOK && info.Stream && info.UpstreamBody != nil {
+				resp.Body = resume.wrap(resp, info.UpstreamBody, wrapUpstream)
+			} else {
+				resp.Body = wrapUpstream(resp.Body)
+			}
+			// End the stream with an error when the model calls a pruned tool
+			if pruned := toolprune.From(resp.Request.Context()); pruned != nil && resp.StatusCode == http.StatusOK {
+				resp.Body = pruned.WrapStream(resp.Body, func(name string) []byte {
+					reqinfo.Logger(resp.Request.Context()).Warn("pruned tool called", "tool", name)
+					return apierror.Upstream(http.StatusBadGateway, pruned.Message(name)).SSE(protocol)
+				})
+			}
+			// Turn mid-stream failures into SSE error events
+			resp.Body = newErrorFrameBody(resp.Body, protocol)
+		}
 		return nil
 	}
 
 	// Handle proxy errors gracefully
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("⚠️  Proxy error: %v (path: %s)", err, r.URL.Path)
-
-		// Determine appropriate error response
-		statusCode := http.StatusBadGateway
-		errorType := "upstream_error"
-		message := "Failed to connect to upstream server"
-
-		if strings.Contains(err.Error(), "timeout") {
-			statusCode = http.StatusGatewayTimeout
-			message = "Upstream server timed out"
-		} else if strings.Contains(err.Error(), "connection refused") {
-			message = "Upstream server is not available"
+		// Fast-fail while the circuit breaker is open
+		if errors.Is(err, breaker.ErrOpen) {
+			metrics.UpstreamErrors.Inc("breaker_open")
+			apierror.Write(w, r, apierror.Overloaded("Upstream is unavailable, circuit breaker is open", brk.RetryAfter()))
+			return
+		}
+		if errors.Is(err, limiter.ErrQueueTimeout) {
+			metrics.UpstreamErrors.Inc("queue_timeout")
+			reqinfo.Logger(r.Context()).Warn("queue timeout", "client", reqinfo.From(r.Context()).ClientID(), "path", r.URL.Path)
+			apierror.Write(w, r, apierror.Overloaded("Too many concurrent requests, timed out waiting in queue", 5*time.Second))
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(statusCode)
-		w.Write([]byte(`{"error":{"message":"` + message + `","type":"` + errorType + `"}}`))
+		reqinfo.Logger(r.Context()).Warn("proxy error", "path", r.URL.Path, "error", err)
+		if !errors.Is(err, context.Canceled) {
+			metrics.UpstreamErrors.Inc(upstreamErrorKind(err))
+		}
+		apierror.Write(w, r, upstreamError(err))
 	}
 
 	return proxy, nil
 }
 
+// rewriteBody replaces a non-streaming response body with rewrite's result
+func rewriteBody(resp *http.Response, rewrite func([]byte) []byte) error {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	body = rewrite(body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// upstreamError classifies a failed upstream round trip
+func upstreamError(err error) *apierror.Error {
+	if isTimeout(err) || strings.Contains(err.Error(), "timeout") {
+		return apierror.Upstream(http.StatusGatewayTimeout, "Upstream server timed out")
+	}
+	if strings.Contains(err.Error(), "connection refused") {
+		return apierror.Upstream(http.StatusBadGateway, "Upstream server is not available")
+	}
+	return apierror.Upstream(http.StatusBadGateway, "Failed to connect to upstream server")
+}
+
+// upstreamErrorKind labels a failed upstream round trip for metrics
+func upstreamErrorKind(err error) string {
+	switch {
+	case isTimeout(err) || strings.Contains(err.Error(), "timeout"):
+		return "timeout"
+	case strings.Contains(err.Error(), "connection refused"):
+		return "connection_refused"
+	default:
+		return "connection"
+	}
+}
+
 type loggingTransport struct {
 	transport http.RoundTripper
 }
 
 func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now()
-	log.Printf("[DEBUG] → %s %s", req.Method, req.URL.String())
+	logger := reqinfo.Logger(req.Context())
+	logger.Debug("upstream request", "method", req.Method, "url", req.URL.String())
 
 	if req.Body != nil && req.ContentLength > 0 && req.ContentLength < 10000 {
 		body, _ := io.ReadAll(req.Body)
 		req.Body = io.NopCloser(bytes.NewReader(body))
-		log.Printf("[DEBUG] Request body: %s", truncate(string(body), 500))
+		logger.Debug("upstream request body", "body", truncate(string(body), 500))
 	}
 
 	resp, err := t.transport.RoundTrip(req)
-	duration := time.Since(start)
+	duration := time.Since(start).Round(time.Millisecond)
 
 	if err != nil {
-		log.Printf("[DEBUG] ← Error after %s: %v", duration.Round(time.Millisecond), err)
+		logger.Debug("upstream error", "duration", duration, "error", err)
 		return resp, err
 	}
 
-	log.Printf("[DEBUG] ← %d %s (%s)", resp.StatusCode, resp.Status, duration.Round(time.Millisecond))
+	logger.Debug("upstream response", "status", resp.StatusCode, "duration", duration)
 	return resp, err
 }
 
@@ -0,0 +1,464 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"cliproxy-middleware/internal/sse"
+)
+
+// resumer re-issues broken /v1/messages streams with the partial assistant
+// text prefilled and splices the continuation into the client stream
+type resumer struct {
+	transport     http.RoundTripper
+	attempts      int
+	fallbackModel string
+}
+
+// blockState tracks the content block currently open on the client side
+type blockState struct {
+	index int
+	typ   string
+	text  strings.Builder
+}
+
+// resumeStream holds the client-side view of one spliced stream
+type resumeStream struct {
+	*resumer
+	ctx      context.Context
+	template *http.Request
+	body     []byte
+	wrapBody func(io.ReadCloser) io.ReadCloser
+
+	started    bool // message_start sent to client
+	stopped    bool // message_stop sent to client
+	deltaSeen  bool // message_delta sent to client
+	nextIndex  int  // next client block index
+	open       *blockState
+	texts      []string
+	lastType   string
+	hasNonText bool
+
+	// Continuation index mapping
+	continuing bool
+	mapped     bool
+	offset     int
+
+	// resent is trailing whitespace the client already has but the prefill
+	// left out; the continuation's text drops it when it repeats it
+	resent string
+
+	// Input usage of the first message_start and of the continuations,
+	// which is reported on the final message_delta
+	startUsage   inputUsage
+	resumedUsage inputUsage
+}
+
+// inputUsage holds the input token counts of a message_start event
+type inputUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+func (u *inputUsage) add(other inputUsage) {
+	u.InputTokens += other.InputTokens
+	u.CacheCreationInputTokens += other.CacheCreationInputTokens
+	u.CacheReadInputTokens += other.CacheReadInputTokens
+}
+
+// wrap returns a body that transparently resumes the upstream stream on failure.
+// wrapBody is applied to every upstream body, including continuations.
+func (rs *resumer) wrap(resp *http.Response, body []byte, wrapBody func(io.ReadCloser) io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	s := &resumeStream{
+		resumer:  rs,
+		ctx:      resp.Request.Context(),
+		template: resp.Request,
+		body:     body,
+		wrapBody: wrapBody,
+	}
+	go s.run(wrapBody(resp.Body), pw)
+	return pr
+}
+
+func (s *resumeStream) run(upstream io.ReadCloser, pw *io.PipeWriter) {
+	for attempt := 1; ; attempt++ {
+		err := s.pump(upstream, pw)
+		upstream.Close()
+		if err == nil || s.stopped {
+			pw.Close()
+			return
+		}
+		if errors.Is(err, io.ErrClosedPipe) || s.ctx.Err() != nil {
+			// Client went away
+			pw.CloseWithError(err)
+			return
+		}
+
+		// A finished tool_use with no trailing text only lacks the closing events
+		if s.open == nil && !s.deltaSeen && s.lastType == "tool_use" {
+			log.Printf("🔁 Stream broke after final tool_use, closing it cleanly")
+			pw.Write(sse.Encode("message_delta", []byte(`{"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":0}}`)))
+			pw.Write(sse.Encode("message_stop", []byte(`{"type":"message_stop"}`)))
+			pw.Close()
+			return
+		}
+
+		if attempt > s.attempts {
+			pw.CloseWithError(fmt.Errorf("%v (resume attempts exhausted)", err))
+			return
+		}
+		if reason := s.unresumable(); reason != "" {
+			log.Printf("⚠️  Stream broke but cannot be resumed: %s", reason)
+			pw.CloseWithError(fmt.Errorf("%v (%s)", err, reason))
+			return
+		}
+
+		next, rerr := s.continuation(attempt, err)
+		if rerr != nil {
+			log.Printf("⚠️  Stream resume failed: %v", rerr)
+			pw.CloseWithError(err)
+			return
+		}
+		upstream = next
+	}
+}
+
+// unresumable explains why the stream cannot be continued, or returns ""
+func (s *resumeStream) unresumable() string {
+	if s.open != nil && s.open.typ != "text" {
+		return "broke inside a " + s.open.typ + " block"
+	}
+	if s.hasNonText {
+		return "response already contains tool_use blocks"
+	}
+	if s.deltaSeen {
+		return "message already finished"
+	}
+	return ""
+}
+
+// continuation issues the follow-up request with the generated text prefilled
+func (s *resumeStream) continuation(attempt int, cause error) (io.ReadCloser, error) {
+	texts := s.texts
+	if s.open != nil {
+		texts = append(texts[:len(texts):len(texts)], s.open.text.String())
+	}
+	// The API rejects assistant prefill ending in whitespace. The client
+	// already has it, so it is dropped again if the continuation repeats it.
+	prefill := strings.Join(texts, "\n\n")
+	trimmed := strings.TrimRight(prefill, " \t\r\n")
+	s.resent = prefill[len(trimmed):]
+	prefill = trimmed
+
+	body, model, err := s.continuationBody(prefill)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("🔁 Resuming broken stream on %s (attempt %d/%d, %d chars prefilled): %v",
+		model, attempt, s.attempts, len(prefill), cause)
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.template.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = s.template.Header.Clone()
+	req.ContentLength = int64(len(body))
+	req.Header.Del("Content-Length")
+
+	resp, err := s.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body.Close()
+		return nil, fmt.Errorf("continuation returned %d", resp.StatusCode)
+	}
+
+	s.continuing = true
+	s.mapped = false
+	return s.wrapBody(resp.Body), nil
+}
+
+// continuationBody rewrites the original request: prefill the partial
+// assistant turn, switch to the fallback model and drop extended thinking,
+// which cannot be combined with prefill
+func (s *resumeStream) continuationBody(prefill string) ([]byte, string, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(s.body, &req); err != nil {
+		return nil, "", err
+	}
+
+	var model string
+	json.Unmarshal(req["model"], &model)
+	if s.fallbackModel != "" {
+		model = s.fallbackModel
+		req["model"], _ = json.Marshal(model)
+	}
+	delete(req, "thinking")
+
+	if prefill != "" {
+		var messages []map[string]interface{}
+		if err := json.Unmarshal(req["messages"], &messages); err != nil {
+			return nil, "", err
+		}
+		block := map[string]interface{}{"type": "text", "text": prefill}
+
+		if n := len(messages); n > 0 && messages[n-1]["role"] == "assistant" {
+			// Client already prefilled; extend its turn
+			last := messages[n-1]
+			switch content := last["content"].(type) {
+			case string:
+				last["content"] = []interface{}{map[string]interface{}{"type": "text", "text": content}, block}
+			case []interface{}:
+				last["content"] = append(content, block)
+			}
+		} else {
+			messages = append(messages, map[string]interface{}{
+				"role":    "assistant",
+				"content": []interface{}{block},
+			})
+		}
+		req["messages"], _ = json.Marshal(messages)
+	}
+
+	body, err := json.Marshal(req)
+	return body, model, err
+}
+
+// streamEvent is the subset of an Anthropic stream event needed for splicing
+type streamEvent struct {
+	Type         string `json:"type"`
+	Index        *int   `json:"index"`
+	ContentBlock struct {
+		Type string `json:"type"`
+	} `json:"content_block"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+	Message struct {
+		Usage inputUsage `json:"usage"`
+	} `json:"message"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// pump forwards events until the stream ends. It returns nil once
+// message_stop was forwarded, or the error that ended the stream early.
+func (s *resumeStream) pump(upstream io.Reader, w io.Writer) error {
+	reader := sse.NewReader(upstream)
+	for {
+		ev, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		var se streamEvent
+		if err := json.Unmarshal(ev.Data, &se); err != nil {
+			if _, err := w.Write(ev.Raw); err != nil {
+				return err
+			}
+			continue
+		}
+
+		out, err := s.translate(ev, &se)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range out {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		}
+		if s.stopped {
+			return nil
+		}
+	}
+}
+
+// translate updates the client-side state for one upstream event and returns
+// the bytes to forward, renumbering content block indices for continuations
+func (s *resumeStream) translate(ev *sse.Event, se *streamEvent) ([][]byte, error) {
+	switch se.Type {
+	case "error":
+		return nil, fmt.Errorf("upstream error event: %s: %s", se.Error.Type, se.Error.Message)
+
+	case "message_start":
+		if s.started {
+			// The client already has a message_start; the continuation's
+			// usage is added to the final message_delta instead
+			s.resumedUsage.add(se.Message.Usage)
+			return nil, nil
+		}
+		s.started = true
+		s.startUsage = se.Message.Usage
+		return [][]byte{ev.Raw}, nil
+
+	case "content_block_start":
+		if se.Index == nil {
+			return [][]byte{ev.Raw}, nil
+		}
+		var out [][]byte
+		if s.continuing && !s.mapped {
+			s.mapped = true
+			s.offset = s.nextIndex
+			if s.open != nil {
+				if se.ContentBlock.Type == "text" && *se.Index == 0 {
+					// Continue the interrupted text block in place
+					s.offset = s.open.index
+					return nil, nil
+				}
+				out = append(out, s.closeOpen())
+				s.offset = s.nextIndex
+			}
+		}
+		index := s.clientIndex(*se.Index)
+		s.open = &blockState{index: index, typ: se.ContentBlock.Type}
+		s.nextIndex = index + 1
+		return append(out, s.reindex(ev, index)), nil
+
+	case "content_block_delta":
+		if se.Index == nil {
+			return [][]byte{ev.Raw}, nil
+		}
+		index := s.clientIndex(*se.Index)
+		if se.Delta.Type == "text_delta" && s.resent != "" {
+			text := s.dropResent(se.Delta.Text)
+			if text == "" {
+				return nil, nil
+			}
+			if text != se.Delta.Text {
+				se.Delta.Text = text
+				ev = withDeltaText(ev, text)
+			}
+		}
+		if s.open != nil && s.open.index == index && se.Delta.Type == "text_delta" {
+			s.open.text.WriteString(se.Delta.Text)
+		}
+		return [][]byte{s.reindex(ev, index)}, nil
+
+	case "content_block_stop":
+		if se.Index == nil {
+			return [][]byte{ev.Raw}, nil
+		}
+		index := s.clientIndex(*se.Index)
+		s.finishOpen()
+		return [][]byte{s.reindex(ev, index)}, nil
+
+	case "message_delta":
+		s.deltaSeen = true
+		if s.resumedUsage != (inputUsage{}) {
+			return [][]byte{s.withResumedUsage(ev)}, nil
+		}
+	case "message_stop":
+		s.stopped = true
+	}
+	return [][]byte{ev.Raw}, nil
+}
+
+// clientIndex maps an upstream block index to the client-side index
+func (s *resumeStream) clientIndex(index int) int {
+	if !s.continuing {
+		return index
+	}
+	return s.offset + index
+}
+
+// closeOpen finishes the open block and returns its content_block_stop event
+func (s *resumeStream) closeOpen() []byte {
+	index := s.open.index
+	s.finishOpen()
+	return sse.Encode("content_block_stop", []byte(fmt.Sprintf(`{"type":"content_block_stop","index":%d}`, index)))
+}
+
+// finishOpen records the open block as completed
+func (s *resumeStream) finishOpen() {
+	if s.open == nil {
+		return
+	}
+	switch s.open.typ {
+	case "text":
+		s.texts = append(s.texts, s.open.text.String())
+	case "thinking", "redacted_thinking":
+		// Not carried into the prefill
+	default:
+		s.hasNonText = true
+	}
+	s.lastType = s.open.typ
+	s.open = nil
+}
+
+// reindex rewrites the "index" field of an event if it changed
+func (s *resumeStream) reindex(ev *sse.Event, index int) []byte {
+	if !s.continuing {
+		return ev.Raw
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(ev.Data, &fields); err != nil {
+		return ev.Raw
+	}
+	fields["index"], _ = json.Marshal(index)
+	data, _ := json.Marshal(fields)
+	return sse.Encode(ev.Name, data)
+}
+
+// dropResent removes the start of a continuation's text that repeats the
+// whitespace trimmed from the prefill
+func (s *resumeStream) dropResent(text string) string {
+	n := 0
+	for n < len(text) && n < len(s.resent) && text[n] == s.resent[n] {
+		n++
+	}
+	if n == len(text) {
+		s.resent = s.resent[n:]
+		return ""
+	}
+	s.resent = ""
+	return text[n:]
+}
+
+// withDeltaText returns a content_block_delta event with its text replaced
+func withDeltaText(ev *sse.Event, text string) *sse.Event {
+	var fields map[string]json.RawMessage
+	var delta map[string]json.RawMessage
+	if json.Unmarshal(ev.Data, &fields) != nil || json.Unmarshal(fields["delta"], &delta) != nil {
+		return ev
+	}
+	delta["text"], _ = json.Marshal(text)
+	fields["delta"], _ = json.Marshal(delta)
+	data, _ := json.Marshal(fields)
+	return &sse.Event{Name: ev.Name, Data: data, Raw: sse.Encode(ev.Name, data)}
+}
+
+// withResumedUsage reports the input of the first request plus that of the
+// continuations on a message_delta event
+func (s *resumeStream) withResumedUsage(ev *sse.Event) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(ev.Data, &fields); err != nil {
+		return ev.Raw
+	}
+	usage := make(map[string]json.RawMessage)
+	json.Unmarshal(fields["usage"], &usage)
+	total := s.startUsage
+	total.add(s.resumedUsage)
+	usage["input_tokens"], _ = json.Marshal(total.InputTokens)
+	usage["cache_creation_input_tokens"], _ = json.Marshal(total.CacheCreationInputTokens)
+	usage["cache_read_input_tokens"], _ = json.Marshal(total.CacheReadInputTokens)
+	fields["usage"], _ = json.Marshal(usage)
+	data, _ := json.Marshal(fields)
+	return sse.Encode(ev.Name, data)
+}
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"cliproxy-middleware/internal/limiter"
+	"cliproxy-middleware/internal/reqinfo"
+	"cliproxy-middleware/internal/sse"
+)
+
+// resumingUpstream breaks the first stream after some text and completes
+// the continuation, noting how many limiter slots were taken meanwhile
+type resumingUpstream struct {
+	limiter  *limiter.Limiter
+	calls    atomic.Int32
+	inFlight atomic.Int32
+}
+
+func (u *resumingUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := http.Header{"Content-Type": {"text/event-stream"}}
+	if u.calls.Add(1) == 1 {
+		events := string(sse.Encode("message_start", []byte(`{"type":"message_start","message":{}}`))) +
+			string(sse.Encode("content_block_start", []byte(`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`))) +
+			string(sse.Encode("content_block_delta", []byte(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`)))
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: &brokenBody{data: strings.NewReader(events)}}, nil
+	}
+
+	u.inFlight.Store(int32(u.limiter.Stats().InFlight))
+	events := string(sse.Encode("message_start", []byte(`{"type":"message_start","message":{}}`))) +
+		string(sse.Encode("content_block_start", []byte(`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`))) +
+		string(sse.Encode("content_block_delta", []byte(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" world"}}`))) +
+		string(sse.Encode("content_block_stop", []byte(`{"type":"content_block_stop","index":0}`))) +
+		string(sse.Encode("message_delta", []byte(`{"type":"message_delta","delta":{"stop_reason":"end_turn"}}`))) +
+		string(sse.Encode("message_stop", []byte(`{"type":"message_stop"}`)))
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader(events))}, nil
+}
+
+func TestResumeTakesALimiterSlot(t *testing.T) {
+	lim := limiter.New(1, nil, 0)
+	upstream := &resumingUpstream{limiter: lim}
+	rt := &limitingTransport{limiter: lim, transport: upstream}
+	resume := &resumer{transport: rt, attempts: 1}
+
+	body := `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	ctx := reqinfo.With(context.Background(), &reqinfo.Info{MappedModel: "m"})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://upstream/v1/messages", strings.NewReader(body))
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Request = req
+
+	out := resume.wrap(resp, []byte(body), func(body io.ReadCloser) io.ReadCloser { return body })
+	data, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	if got := upstream.calls.Load(); got != 2 {
+		t.Fatalf("upstream calls = %d, want 2", got)
+	}
+	if !strings.Contains(string(data), "message_stop") {
+		t.Fatalf("resumed stream did not finish: %q", data)
+	}
+	// The broken stream's slot is freed and the continuation takes its own
+	if got := upstream.inFlight.Load(); got != 1 {
+		t.Fatalf("slots in use during the continuation = %d, want 1", got)
+	}
+	if in := lim.Stats().InFlight; in != 0 {
+		t.Fatalf("slots in use after the stream = %d, want 0", in)
+	}
+}
+
+// scriptedUpstream answers each call with the next stream; all but the last
+// break after their events. It records the request bodies.
+type scriptedUpstream struct {
+	streams  []string
+	requests []string
+}
+
+func (u *scriptedUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	u.requests = append(u.requests, string(body))
+	n := len(u.requests) - 1
+	var respBody io.ReadCloser = io.NopCloser(strings.NewReader(u.streams[n]))
+	if n < len(u.streams)-1 {
+		respBody = &brokenBody{data: strings.NewReader(u.streams[n])}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/event-stream"}}, Body: respBody}, nil
+}
+
+// events encodes Anthropic stream events, taking the event name from each
+// payload's type
+func events(payloads ...string) string {
+	var b strings.Builder
+	for _, payload := range payloads {
+		var ev struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal([]byte(payload), &ev)
+		b.Write(sse.Encode(ev.Type, []byte(payload)))
+	}
+	return b.String()
+}
+
+// resumed runs the scripted streams through a resumer and returns what the
+// client receives and the continuation requests
+func resumed(t *testing.T, streams ...string) (string, []string, error) {
+	t.Helper()
+	upstream := &scriptedUpstream{streams: streams}
+	body := `{"model":"m","stream":true,"thinking":{"type":"enabled","budget_tokens":2048},"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest(http.MethodPost, "http://upstream/v1/messages", strings.NewReader(body))
+	resp, _ := upstream.RoundTrip(req)
+	resp.Request = req
+
+	resume := &resumer{transport: upstream, attempts: 2, fallbackModel: "fallback"}
+	out := resume.wrap(resp, []byte(body), func(body io.ReadCloser) io.ReadCloser { return body })
+	data, err := io.ReadAll(out)
+	return string(data), upstream.requests[1:], err
+}
+
+// clientEvents decodes the payloads of a client stream
+func clientEvents(t *testing.T, stream string) []map[string]any {
+	t.Helper()
+	reader := sse.NewReader(strings.NewReader(stream))
+	var out []map[string]any
+	for {
+		ev, err := reader.Next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload map[string]any
+		if err := json.Unmarshal(ev.Data, &payload); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, payload)
+	}
+}
+
+// clientText joins the text deltas of a client stream by block index
+func clientText(events []map[string]any) map[int]string {
+	text := make(map[int]string)
+	for _, ev := range events {
+		if ev["type"] != "content_block_delta" {
+			continue
+		}
+		delta := ev["delta"].(map[string]any)
+		text[int(ev["index"].(float64))] += delta["text"].(string)
+	}
+	return text
+}
+
+const (
+	messageStart = `{"type":"message_start","message":{"usage":{"input_tokens":100,"cache_read_input_tokens":40}}}`
+	textStart    = `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`
+	textStop     = `{"type":"content_block_stop","index":0}`
+	messageDelta = `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7}}`
+	messageStop  = `{"type":"message_stop"}`
+)
+
+func textDelta(index int, text string) string {
+	return fmt.Sprintf(`{"type":"content_block_delta","index":%d,"delta":{"type":"text_delta","text":%q}}`, index, text)
+}
+
+func TestResumeMidText(t *testing.T) {
+	out, continuations, err := resumed(t,
+		events(messageStart, textStart, textDelta(0, "Hello, "), textDelta(0, "wide\n")),
+		events(`{"type":"message_start","message":{"usage":{"input_tokens":120,"cache_creation_input_tokens":5}}}`,
+			textStart, textDelta(0, "\n"), textDelta(0, "world"), textStop, messageDelta, messageStop),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := clientEvents(t, out)
+
+	// The continuation extends the open block; its own start is not sent
+	var starts, messageStarts int
+	for _, ev := range got {
+		switch ev["type"] {
+		case "content_block_start":
+			starts++
+		case "message_start":
+			messageStarts++
+		}
+	}
+	if starts != 1 || messageStarts != 1 {
+		t.Fatalf("%d content_block_start and %d message_start events, want 1 of each", starts, messageStarts)
+	}
+	// The newline the client already has is not repeated
+	if text := clientText(got); len(text) != 1 || text[0] != "Hello, wide\nworld" {
+		t.Fatalf("text = %q, want one block", text)
+	}
+
+	var req struct {
+		Model    string          `json:"model"`
+		Thinking json.RawMessage `json:"thinking"`
+		Messages []struct {
+			Role    string `json:"role"`
+			Content []struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"messages"`
+	}
+	json.Unmarshal([]byte(continuations[0]), &req)
+	if last := req.Messages[len(req.Messages)-1]; req.Model != "fallback" || req.Thinking != nil || last.Role != "assistant" || last.Content[0].Text != "Hello, wide" {
+		t.Fatalf("continuation = %s", continuations[0])
+	}
+
+	// The continuation's input is reported on the final message_delta
+	delta := got[len(got)-2]
+	usage := delta["usage"].(map[string]any)
+	if delta["type"] != "message_delta" || usage["input_tokens"] != 220.0 || usage["cache_read_input_tokens"] != 40.0 ||
+		usage["cache_creation_input_tokens"] != 5.0 || usage["output_tokens"] != 7.0 {
+		t.Fatalf("message_delta = %v", delta)
+	}
+}
+
+func TestResumeBetweenBlocks(t *testing.T) {
+	out, continuations, err := resumed(t,
+		events(messageStart, textStart, textDelta(0, "First."), textStop,
+			`{"type":"content_block_start","index":1,"content_block":{"type":"thinking","thinking":""}}`,
+			`{"type":"content_block_stop","index":1}`,
+			`{"type":"content_block_start","index":2,"content_block":{"type":"text","text":""}}`,
+			textDelta(2, "Second."),
+			`{"type":"content_block_stop","index":2}`),
+		events(messageStart, textStart, textDelta(0, " Third."), textStop, messageDelta, messageStop),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := clientEvents(t, out)
+
+	// The continuation's block follows the finished ones
+	if text := clientText(got); text[0] != "First." || text[2] != "Second." || text[3] != " Third." {
+		t.Fatalf("text = %q", text)
+	}
+	for _, ev := range got {
+		if ev["type"] == "content_block_stop" && ev["index"] == 3.0 {
+			break
+		}
+		if ev["type"] == "message_delta" {
+			t.Fatal("message_delta before the continued block ended")
+		}
+	}
+
+	// Separate text blocks stay apart in the prefill
+	if !strings.Contains(continuations[0], `"text":"First.\n\nSecond."`) {
+		t.Fatalf("continuation = %s", continuations[0])
+	}
+}
+
+func TestResumeRefused(t *testing.T) {
+	for _, tc := range []struct {
+		name, stream, want string
+	}{
+		{
+			"open tool_use",
+			events(messageStart, `{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"t","name":"f","input":{}}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"a\""}}`),
+			"broke inside a tool_use block",
+		},
+		{
+			"finished tool_use before text",
+			events(messageStart, `{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"t","name":"f","input":{}}}`,
+				`{"type":"content_block_stop","index":0}`, `{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`),
+			"response already contains tool_use blocks",
+		},
+		{
+			"message_delta seen",
+			events(messageStart, textStart, textDelta(0, "Done"), textStop, messageDelta),
+			"message already finished",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, continuations, err := resumed(t, tc.stream, events(messageStart, textStart, textDelta(0, "again"), textStop, messageDelta, messageStop))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want %q", err, tc.want)
+			}
+			if len(continuations) != 0 {
+				t.Fatalf("continued with %s", continuations)
+			}
+			if out != tc.stream {
+				t.Fatalf("client got %q, want the events before the break", out)
+			}
+		})
+	}
+}
+
+func TestResumeClosesFinishedToolUse(t *testing.T) {
+	stream := events(messageStart, `{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"t","name":"f","input":{}}}`,
+		`{"type":"content_block_stop","index":0}`)
+	out, continuations, err := resumed(t, stream, "")
+	if err != nil || len(continuations) != 0 {
+		t.Fatalf("err = %v after %d continuations", err, len(continuations))
+	}
+	got := clientEvents(t, out)
+	if last := got[len(got)-2]; last["type"] != "message_delta" || last["delta"].(map[string]any)["stop_reason"] != "tool_use" {
+		t.Fatalf("stream ends with %v", got[len(got)-2:])
+	}
+}
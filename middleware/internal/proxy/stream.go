@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+
+	"cliproxy-middleware/internal/apierror"
+	"cliproxy-middleware/internal/metrics"
+)
+
+// errorFrameBody wraps an SSE response body so that a broken upstream stream
+// ends with a well-formed error event instead of an aborted connection. Data
+// is forwarded one complete event at a time, so an event cut off by the
+// failure is dropped rather than delivered half-written.
+type errorFrameBody struct {
+	body     io.ReadCloser
+	protocol apierror.Protocol
+	pending  []byte // complete events, then the error frame, to forward
+	partial  []byte // start of an event still being received
+	done     bool
+	err      error // returned once pending is drained and done is set
+}
+
+func newErrorFrameBody(body io.ReadCloser, protocol apierror.Protocol) *errorFrameBody {
+	return &errorFrameBody{body: body, protocol: protocol}
+}
+
+func (b *errorFrameBody) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(b.pending) == 0 {
+		if b.done {
+			return 0, b.err
+		}
+		b.fill(p)
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+// fill reads from upstream, using buf as scratch space, and moves every
+// complete event to pending
+func (b *errorFrameBody) fill(buf []byte) {
+	n, err := b.body.Read(buf)
+	b.partial = append(b.partial, buf[:n]...)
+	if end := eventsEnd(b.partial); end > 0 {
+		b.pending = append(b.pending, b.partial[:end]...)
+		b.partial = append(b.partial[:0], b.partial[end:]...)
+	}
+
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		// A clean end may omit the final blank line
+		b.pending = append(b.pending, b.partial...)
+		b.partial = nil
+		b.done, b.err = true, io.EOF
+	case errors.Is(err, context.Canceled):
+		// Client went away; nobody is left to read an error frame
+		b.done, b.err = true, err
+	default:
+		log.Printf("⚠️  Upstream stream failed: %v", err)
+		metrics.UpstreamErrors.Inc(streamErrorKind(err))
+		if len(b.partial) > 0 {
+			log.Printf("⚠️  Dropped %d bytes of an unfinished event", len(b.partial))
+			b.partial = nil
+		}
+		b.pending = append(b.pending, streamError(err).SSE(b.protocol)...)
+		b.done, b.err = true, io.EOF
+	}
+}
+
+// eventsEnd returns the length of the complete events at the start of data
+func eventsEnd(data []byte) int {
+	end := 0
+	if i := bytes.LastIndex(data, []byte("\n\n")); i >= 0 {
+		end = i + 2
+	}
+	if i := bytes.LastIndex(data, []byte("\r\n\r\n")); i >= 0 {
+		end = max(end, i+4)
+	}
+	return end
+}
+
+func (b *errorFrameBody) Close() error {
+	return b.body.Close()
+}
+
+// streamError classifies a mid-stream upstream failure
+func streamError(err error) *apierror.Error {
+	if isStall(err) {
+		return apierror.Upstream(504, "Upstream stream stalled: no data received within the stall timeout")
+	}
+	if errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+		return apierror.Upstream(504, "Upstream stream timed out")
+	}
+	return apierror.Upstream(502, "Upstream stream ended unexpectedly: "+err.Error())
+}
+
+// streamErrorKind labels a mid-stream failure for metrics
+func streamErrorKind(err error) string {
+	if isStall(err) {
+		return "stream_stall"
+	}
+	if errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+		return "stream_timeout"
+	}
+	return "stream_broken"
+}
+
+func isTimeout(err error) bool {
+	var te interface{ Timeout() bool }
+	return errors.As(err, &te) && te.Timeout()
+}
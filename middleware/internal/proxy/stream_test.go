@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"cliproxy-middleware/internal/apierror"
+)
+
+// brokenBody returns data and then fails
+type brokenBody struct {
+	data io.Reader
+}
+
+func (b *brokenBody) Read(p []byte) (int, error) {
+	n, err := b.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func (b *brokenBody) Close() error { return nil }
+
+func TestErrorFrameDropsPartialEvent(t *testing.T) {
+	for _, tc := range []struct {
+		name, sent, wantForwarded string
+	}{
+		{"nothing sent", "", ""},
+		{"complete event", "event: ping\ndata: {}\n\n", "event: ping\ndata: {}\n\n"},
+		{"partial event", "event: ping\ndata: {}\n\nevent: content_block_delta\ndata: {\"a\":", "event: ping\ndata: {}\n\n"},
+		{"partial line ending", "event: ping\ndata: {}\n", ""},
+		{"crlf events", "data: {}\r\n\r\ndata: {\"a\"", "data: {}\r\n\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := newErrorFrameBody(&brokenBody{data: strings.NewReader(tc.sent)}, apierror.Anthropic)
+			out, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rest, ok := strings.CutPrefix(string(out), tc.wantForwarded)
+			if !ok {
+				t.Fatalf("forwarded %q, want %q first", out, tc.wantForwarded)
+			}
+			if !strings.HasPrefix(rest, "event: error\ndata: {") {
+				t.Fatalf("after the forwarded events got %q, want the error frame", rest)
+			}
+		})
+	}
+}
+
+func TestErrorFrameForOpenAI(t *testing.T) {
+	sent := "data: {\"choices\":[]}\n\ndata: {\"cho"
+	body := newErrorFrameBody(&brokenBody{data: strings.NewReader(sent)}, apierror.OpenAI)
+	out, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "data: {\"choices\":[]}\n\ndata: {\"error\":{\"message\":\"Upstream stream ended unexpectedly: connection reset\",\"type\":\"server_error\",\"param\":null,\"code\":null}}\n\n"
+	if string(out) != want {
+		t.Fatalf("stream = %q\nwant %q", out, want)
+	}
+}
+
+func TestErrorFramePassesCleanEnd(t *testing.T) {
+	sent := "event: ping\ndata: {}\n\ndata: [DONE]\n"
+	body := newErrorFrameBody(io.NopCloser(strings.NewReader(sent)), apierror.OpenAI)
+	out, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != sent {
+		t.Fatalf("stream = %q, want %q", out, sent)
+	}
+}
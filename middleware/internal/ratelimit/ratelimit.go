@@ -0,0 +1,186 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket that refills continuously up to its capacity.
+// Debits may drive it negative; the client is then blocked until it refills.
+type bucket struct {
+	capacity float64
+	rate     float64 // tokens per second
+	level    float64
+	updated  time.Time
+}
+
+func newBucket(capacity float64, per time.Duration, now time.Time) *bucket {
+	return &bucket{
+		capacity: capacity,
+		rate:     capacity / per.Seconds(),
+		level:    capacity,
+		updated:  now,
+	}
+}
+
+// full reports whether the bucket is back at capacity, which makes it no
+// different from a new one
+func (b *bucket) full() bool {
+	return b == nil || b.level >= b.capacity
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.level = math.Min(b.capacity, b.level+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+}
+
+// wait returns how long until the bucket holds at least n tokens
+func (b *bucket) wait(n float64) time.Duration {
+	if b.level >= n {
+		return 0
+	}
+	return time.Duration((n - b.level) / b.rate * float64(time.Second))
+}
+
+type clientBuckets struct {
+	requests *bucket
+	tokens   *bucket
+}
+
+func (cb *clientBuckets) refill(now time.Time) {
+	if cb.requests != nil {
+		cb.requests.refill(now)
+	}
+	if cb.tokens != nil {
+		cb.tokens.refill(now)
+	}
+}
+
+// sweepInterval is how often buckets of idle clients are dropped
+const sweepInterval = time.Minute
+
+// Limiter enforces per-client request and token quotas. Clients whose
+// buckets have refilled are forgotten, so keys seen once don't pile up.
+type Limiter struct {
+	requestsPerMinute int
+	tokensPerDay      int64
+	now               func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*clientBuckets
+	swept   time.Time
+}
+
+// New creates a limiter. A zero quota disables that limit.
+func New(requestsPerMinute int, tokensPerDay int64) *Limiter {
+	return &Limiter{
+		requestsPerMinute: requestsPerMinute,
+		tokensPerDay:      tokensPerDay,
+		now:               time.Now,
+		clients:           make(map[string]*clientBuckets),
+	}
+}
+
+// Enabled reports whether any quota is configured
+func (l *Limiter) Enabled() bool {
+	return l != nil && (l.requestsPerMinute > 0 || l.tokensPerDay > 0)
+}
+
+// buckets returns the client's buckets; callers must hold l.mu
+func (l *Limiter) buckets(client string, now time.Time) *clientBuckets {
+	if now.Sub(l.swept) >= sweepInterval {
+		l.sweep(now)
+	}
+	cb, ok := l.clients[client]
+	if !ok {
+		cb = &clientBuckets{}
+		if l.requestsPerMinute > 0 {
+			cb.requests = newBucket(float64(l.requestsPerMinute), time.Minute, now)
+		}
+		if l.tokensPerDay > 0 {
+			cb.tokens = newBucket(float64(l.tokensPerDay), 24*time.Hour, now)
+		}
+		l.clients[client] = cb
+	}
+	cb.refill(now)
+	return cb
+}
+
+// sweep drops the clients whose buckets are all full; callers must hold l.mu
+func (l *Limiter) sweep(now time.Time) {
+	l.swept = now
+	for client, cb := range l.clients {
+		cb.refill(now)
+		if cb.requests.full() && cb.tokens.full() {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// Allow takes one request from the client's quota. If the client is over a
+// limit it returns false, how long to wait and which limit was hit.
+func (l *Limiter) Allow(client string) (bool, time.Duration, string) {
+	if !l.Enabled() {
+		return true, 0, ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cb := l.buckets(client, l.now())
+	if cb.tokens != nil && cb.tokens.level <= 0 {
+		return false, cb.tokens.wait(1), fmt.Sprintf("daily token quota of %d exceeded", l.tokensPerDay)
+	}
+	if cb.requests != nil {
+		if wait := cb.requests.wait(1); wait > 0 {
+			return false, wait, fmt.Sprintf("request rate limit of %d per minute exceeded", l.requestsPerMinute)
+		}
+		cb.requests.level--
+	}
+	return true, 0, ""
+}
+
+// Debit charges tokens used by a finished request against the client's daily budget
+func (l *Limiter) Debit(client string, tokens int) {
+	if !l.Enabled() || l.tokensPerDay <= 0 || tokens <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cb := l.buckets(client, l.now())
+	cb.tokens.level -= float64(tokens)
+}
+
+// ClientQuota is the remaining quota for one client
+type ClientQuota struct {
+	RequestsRemaining *int   `json:"requests_remaining,omitempty"`
+	TokensRemaining   *int64 `json:"tokens_remaining,omitempty"`
+}
+
+// Stats returns the remaining quota per client
+func (l *Limiter) Stats() map[string]ClientQuota {
+	stats := make(map[string]ClientQuota)
+	if !l.Enabled() {
+		return stats
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for client, cb := range l.clients {
+		cb.refill(now)
+		var q ClientQuota
+		if cb.requests != nil {
+			n := int(math.Max(0, cb.requests.level))
+			q.RequestsRemaining = &n
+		}
+		if cb.tokens != nil {
+			n := int64(math.Max(0, cb.tokens.level))
+			q.TokensRemaining = &n
+		}
+		stats[client] = q
+	}
+	return stats
+}
@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cliproxy-middleware/internal/apierror"
+)
+
+// fakeClock is a settable time source for a limiter
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(rpm int, tokensPerDay int64) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(rpm, tokensPerDay)
+	l.now = clock.now
+	return l, clock
+}
+
+func TestAllow(t *testing.T) {
+	type step struct {
+		advance   time.Duration
+		debit     int
+		wantOK    bool
+		wantWait  time.Duration
+		wantLimit string
+	}
+	for _, tc := range []struct {
+		name         string
+		rpm          int
+		tokensPerDay int64
+		steps        []step
+	}{
+		{
+			name: "request burst then refill",
+			rpm:  2,
+			steps: []step{
+				{wantOK: true},
+				{wantOK: true},
+				{wantOK: false, wantWait: 30 * time.Second, wantLimit: "request rate limit of 2 per minute exceeded"},
+				{advance: 10 * time.Second, wantOK: false, wantWait: 20 * time.Second, wantLimit: "request rate limit of 2 per minute exceeded"},
+				{advance: 20 * time.Second, wantOK: true},
+				{wantOK: false, wantWait: 30 * time.Second, wantLimit: "request rate limit of 2 per minute exceeded"},
+			},
+		},
+		{
+			name:         "daily token quota",
+			tokensPerDay: 24000,
+			steps: []step{
+				{wantOK: true, debit: 30000},
+				// 6000 tokens overdrawn refill at 1000 an hour
+				{wantOK: false, wantWait: 6*time.Hour + 3600*time.Millisecond, wantLimit: "daily token quota of 24000 exceeded"},
+				{advance: 6 * time.Hour, wantOK: false, wantWait: 3600 * time.Millisecond, wantLimit: "daily token quota of 24000 exceeded"},
+				{advance: time.Hour, wantOK: true},
+			},
+		},
+		{
+			name:         "token quota checked before request rate",
+			rpm:          1,
+			tokensPerDay: 1000,
+			steps: []step{
+				{wantOK: true, debit: 2000},
+				{wantOK: false, wantWait: 24*time.Hour + 86400*time.Millisecond, wantLimit: "daily token quota of 1000 exceeded"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, clock := newTestLimiter(tc.rpm, tc.tokensPerDay)
+			for i, s := range tc.steps {
+				clock.advance(s.advance)
+				ok, wait, limit := l.Allow("a")
+				if ok != s.wantOK || wait.Round(time.Millisecond) != s.wantWait || limit != s.wantLimit {
+					t.Fatalf("step %d: Allow = %v, %v, %q; want %v, %v, %q", i, ok, wait, limit, s.wantOK, s.wantWait, s.wantLimit)
+				}
+				l.Debit("a", s.debit)
+			}
+		})
+	}
+}
+
+func TestClientsHaveSeparateBuckets(t *testing.T) {
+	l, _ := newTestLimiter(1, 0)
+	if ok, _, _ := l.Allow("a"); !ok {
+		t.Fatal("first request of a refused")
+	}
+	if ok, _, _ := l.Allow("a"); ok {
+		t.Fatal("second request of a allowed")
+	}
+	if ok, _, _ := l.Allow("b"); !ok {
+		t.Fatal("b limited by a's requests")
+	}
+}
+
+func TestIdleClientsAreForgotten(t *testing.T) {
+	l, clock := newTestLimiter(60, 1000)
+	for _, client := range []string{"junk-1", "junk-2", "junk-3"} {
+		l.Allow(client)
+	}
+	l.Allow("spender")
+	l.Debit("spender", 500)
+	if n := len(l.Stats()); n != 4 {
+		t.Fatalf("tracking %d clients, want 4", n)
+	}
+
+	// The request buckets are full again after a minute; the token bucket
+	// of the client that spent tokens is not
+	clock.advance(sweepInterval)
+	l.Allow("new")
+	stats := l.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("tracking %v, want spender and new", stats)
+	}
+	if remaining := *stats["spender"].TokensRemaining; remaining != 500 {
+		t.Fatalf("spender has %d tokens left, want 500", remaining)
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	l, _ := newTestLimiter(1, 0)
+	l.Allow("a")
+	ok, wait, reason := l.Allow("a")
+	if ok {
+		t.Fatal("over-limit request allowed")
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	apierror.Write(w, r, apierror.RateLimit("Rate limit exceeded: "+reason, wait))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Fatalf("Retry-After = %q, want 60", got)
+	}
+}
@@ -0,0 +1,98 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Diff compares two JSON documents and returns one line per difference,
+// addressed by path. Object keys in ignore are skipped at any depth.
+func Diff(recorded, replayed []byte, ignore map[string]bool) []string {
+	var a, b any
+	errA := json.Unmarshal(recorded, &a)
+	errB := json.Unmarshal(replayed, &b)
+	if errA != nil || errB != nil {
+		// Not JSON on both sides: compare as text
+		if string(recorded) == string(replayed) {
+			return nil
+		}
+		return []string{fmt.Sprintf("~ $: %s -> %s", abbreviate(string(recorded)), abbreviate(string(replayed)))}
+	}
+	var diffs []string
+	diffValues("$", a, b, ignore, &diffs)
+	return diffs
+}
+
+func diffValues(path string, a, b any, ignore map[string]bool, diffs *[]string) {
+	switch av := a.(type) {
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for k := range av {
+			keys[k] = true
+		}
+		for k := range bv {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			if !ignore[k] {
+				sorted = append(sorted, k)
+			}
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			child := path + "." + k
+			va, inA := av[k]
+			vb, inB := bv[k]
+			switch {
+			case !inA:
+				*diffs = append(*diffs, fmt.Sprintf("+ %s: %s", child, encode(vb)))
+			case !inB:
+				*diffs = append(*diffs, fmt.Sprintf("- %s: %s", child, encode(va)))
+			default:
+				diffValues(child, va, vb, ignore, diffs)
+			}
+		}
+		return
+	case []any:
+		bv, ok := b.([]any)
+		if !ok {
+			break
+		}
+		for i := 0; i < max(len(av), len(bv)); i++ {
+			child := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(av):
+				*diffs = append(*diffs, fmt.Sprintf("+ %s: %s", child, encode(bv[i])))
+			case i >= len(bv):
+				*diffs = append(*diffs, fmt.Sprintf("- %s: %s", child, encode(av[i])))
+			default:
+				diffValues(child, av[i], bv[i], ignore, diffs)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*diffs = append(*diffs, fmt.Sprintf("~ %s: %s -> %s", path, encode(a), encode(b)))
+	}
+}
+
+func encode(v any) string {
+	data, _ := json.Marshal(v)
+	return abbreviate(string(data))
+}
+
+func abbreviate(s string) string {
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if len(s) > 120 {
+		return s[:117] + "..."
+	}
+	return s
+}
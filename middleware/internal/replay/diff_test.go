@@ -0,0 +1,37 @@
+package replay
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	ignore := map[string]bool{"id": true, "created": true}
+	for _, tc := range []struct {
+		name, recorded, replayed string
+		want                     []string
+	}{
+		{"identical", `{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1}`, nil},
+		{"changed value", `{"a":{"b":"x"}}`, `{"a":{"b":"y"}}`, []string{`~ $.a.b: "x" -> "y"`}},
+		{"added and removed keys", `{"a":1,"c":3}`, `{"a":1,"b":2}`, []string{`+ $.b: 2`, `- $.c: 3`}},
+		{"array length", `{"a":[1,2]}`, `{"a":[1,2,3]}`, []string{`+ $.a[2]: 3`}},
+		{"array element", `[{"t":"a"},{"t":"b"}]`, `[{"t":"a"},{"t":"c"}]`, []string{`~ $[1].t: "b" -> "c"`}},
+		{"type change", `{"a":[1]}`, `{"a":{"0":1}}`, []string{`~ $.a: [1] -> {"0":1}`}},
+		{"ignored keys at any depth", `{"id":"1","message":{"id":"a","created":1,"text":"x"}}`, `{"id":"2","message":{"id":"b","created":2,"text":"x"}}`, nil},
+		{"ignored key added", `{"a":1}`, `{"a":1,"created":5}`, nil},
+		{"text bodies", "data: a\n", "data: b\n", []string{`~ $: data: a\n -> data: b\n`}},
+		{"same text", "plain", "plain", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Diff([]byte(tc.recorded), []byte(tc.replayed), ignore); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Diff = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiffWithoutIgnore(t *testing.T) {
+	if got := Diff([]byte(`{"id":"1"}`), []byte(`{"id":"2"}`), nil); len(got) != 1 {
+		t.Fatalf("Diff = %q, want the id difference", got)
+	}
+}
@@ -0,0 +1,196 @@
+package replay
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"cliproxy-middleware/internal/breaker"
+	"cliproxy-middleware/internal/capture"
+	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/handlers"
+	"cliproxy-middleware/internal/proxy"
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+// maxDiffLines caps the differences printed per section
+const maxDiffLines = 40
+
+// Main runs the replay subcommand: each capture file's client request is sent
+// through the middleware's request pipeline to an upstream, and both the
+// rewritten upstream request and the response are diffed against the
+// recording. It returns the process exit code: 0 if everything matched, 1 if
+// anything differed or failed, 2 for usage errors.
+func Main(args []string) int {
+	mock := flag.Bool("mock", false, "Answer with the recorded response instead of calling -upstream")
+	ignore := flag.String("ignore", "id,created,system_fingerprint", "Comma-separated JSON keys to ignore when diffing")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: cliproxy-middleware replay [flags] capture.json...\n\n")
+		flag.PrintDefaults()
+	}
+	cfg := config.LoadArgs(args)
+	files := flag.Args()
+	if len(files) == 0 {
+		flag.Usage()
+		return 2
+	}
+
+	ignored := make(map[string]bool)
+	for _, key := range strings.Split(*ignore, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			ignored[key] = true
+		}
+	}
+
+	// The mock upstream serves whichever recording is being replayed
+	var current atomic.Pointer[capture.Record]
+	if *mock {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveRecorded(w, current.Load())
+		}))
+		defer server.Close()
+		cfg.UpstreamURL = server.URL
+	}
+
+	handler, err := newHandler(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create proxy: %v\n", err)
+		return 1
+	}
+
+	failed := false
+	for _, path := range files {
+		rec, err := capture.Load(path)
+		if err != nil {
+			fmt.Printf("== %s\nerror: %v\n\n", path, err)
+			failed = true
+			continue
+		}
+		current.Store(rec)
+		if !replayOne(path, rec, cfg, handler, ignored) {
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// newHandler builds the request pipeline for replays. Upstream requests are
+// recorded into each replay's own record, so -capture-dir is ignored rather
+// than capturing every call a second time.
+func newHandler(cfg *config.Config) (http.Handler, error) {
+	cfg.CaptureDir = ""
+	brk := breaker.New(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	rp, err := proxy.NewWithPool(cfg, brk, nil)
+	if err != nil {
+		return nil, err
+	}
+	rp.Transport = &capture.Transport{Transport: rp.Transport}
+	return pipeline(cfg, rp, brk), nil
+}
+
+// pipeline routes a request the way the server does, minus authentication,
+// quotas and logging
+func pipeline(cfg *config.Config, rp *httputil.ReverseProxy, brk *breaker.Breaker) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/messages/count_tokens", handlers.TokenCount(cfg, rp, brk))
+	mux.HandleFunc("/v1/messages", handlers.Messages(cfg, rp))
+	mux.HandleFunc("/v1/chat/completions", handlers.ChatCompletions(cfg, rp))
+	mux.Handle("/", rp)
+	return mux
+}
+
+// replayOne replays a single recording and prints the comparison. It
+// reports whether the replay matched.
+func replayOne(path string, rec *capture.Record, cfg *config.Config, handler http.Handler, ignore map[string]bool) bool {
+	fmt.Printf("== %s (%s %s", path, rec.Request.Method, rec.Request.URL)
+	if rec.RequestedModel != "" {
+		fmt.Printf(", %s -> %s", rec.RequestedModel, rec.MappedModel)
+	}
+	fmt.Println(")")
+	if rec.Request.Truncated {
+		fmt.Printf("error: request body was cut at the capture size limit and can't be replayed\n\n")
+		return false
+	}
+
+	req := httptest.NewRequest(rec.Request.Method, rec.Request.URL, bytes.NewReader(rec.Request.BodyBytes()))
+	req.Header = rec.Request.Header.Clone()
+	req.Header.Del("Content-Length")
+	for name, values := range req.Header {
+		if len(values) > 0 && values[0] == "[REDACTED]" {
+			req.Header.Del(name)
+		}
+	}
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+
+	replayed := &capture.Record{}
+	info := &reqinfo.Info{ID: "replay-" + rec.ID}
+	req = req.WithContext(capture.WithRecord(reqinfo.With(req.Context(), info), replayed))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	matched := true
+	if rec.UpstreamRequest != nil {
+		if replayed.UpstreamRequest == nil {
+			fmt.Println("upstream request: not sent")
+			matched = false
+		} else {
+			diffs := Diff(rec.UpstreamRequest.BodyBytes(), replayed.UpstreamRequest.BodyBytes(), ignore)
+			matched = report("upstream request", diffs) && matched
+		}
+	}
+
+	if rr.Code != rec.Response.Status {
+		fmt.Printf("response status: %d -> %d\n", rec.Response.Status, rr.Code)
+		matched = false
+	}
+	recorded, got := rec.Response.BodyBytes(), rr.Body.Bytes()
+	if len(rec.Response.Assembled) > 0 {
+		recorded, got = rec.Response.Assembled, capture.Assemble(got)
+	}
+	matched = report("response", Diff(recorded, got, ignore)) && matched
+
+	fmt.Println()
+	return matched
+}
+
+// report prints a section's differences and reports whether there were none
+func report(section string, diffs []string) bool {
+	if len(diffs) == 0 {
+		fmt.Printf("%s: identical\n", section)
+		return true
+	}
+	fmt.Printf("%s: %d difference(s)\n", section, len(diffs))
+	for i, d := range diffs {
+		if i == maxDiffLines {
+			fmt.Printf("  ... %d more\n", len(diffs)-maxDiffLines)
+			break
+		}
+		fmt.Printf("  %s\n", d)
+	}
+	return false
+}
+
+// serveRecorded answers with a recorded response
+func serveRecorded(w http.ResponseWriter, rec *capture.Record) {
+	if rec == nil {
+		http.Error(w, "no recording", http.StatusBadGateway)
+		return
+	}
+	if ct := rec.Response.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(rec.Response.Status)
+	w.Write(rec.Response.BodyBytes())
+}
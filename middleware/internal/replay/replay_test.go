@@ -0,0 +1,47 @@
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"cliproxy-middleware/internal/capture"
+	"cliproxy-middleware/internal/config"
+)
+
+func TestReplayOne(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object":"list","created":2,"data":[{"id":"gemini-3-flash"}]}`))
+	}))
+	defer upstream.Close()
+
+	captureDir := t.TempDir()
+	cfg := config.LoadArgs([]string{"-upstream", upstream.URL, "-capture-dir", captureDir})
+	handler, err := newHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignore := map[string]bool{"created": true}
+
+	recording := func(response string) *capture.Record {
+		return &capture.Record{
+			ID:              "req_1",
+			Request:         capture.Message{Method: http.MethodGet, URL: "/v1/models"},
+			UpstreamRequest: &capture.Message{Method: http.MethodGet, URL: upstream.URL + "/v1/models"},
+			Response:        capture.Message{Status: http.StatusOK, Body: []byte(response)},
+		}
+	}
+	if !replayOne("same.json", recording(`{"object":"list","created":1,"data":[{"id":"gemini-3-flash"}]}`), cfg, handler, ignore) {
+		t.Fatal("matching replay reported a difference")
+	}
+	if replayOne("changed.json", recording(`{"object":"list","created":1,"data":[{"id":"gemini-3-pro-high"}]}`), cfg, handler, ignore) {
+		t.Fatal("changed response reported as identical")
+	}
+
+	// Replays don't write capture files
+	if entries, _ := os.ReadDir(captureDir); len(entries) != 0 {
+		t.Fatalf("replay wrote %d capture files", len(entries))
+	}
+}
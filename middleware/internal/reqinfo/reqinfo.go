@@ -0,0 +1,101 @@
+package reqinfo
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Info carries per-request state shared between the handlers, the proxy
+// transport chain and the request logger. It is created in the server's
+// request wrapper and filled in as the request is processed.
+type Info struct {
+	// ID correlates log lines and is sent upstream as X-Request-ID
+	ID    string
+	Start time.Time
+
+	// Client identifies the caller, derived from its API key
+	Client string
+
+	RequestedModel    string
+	MappedModel       string
+	Stream            bool
+	SchemasNormalized int  // tool schemas rewritten by the normalizer
+	CacheHit          bool // answered from the response cache
+
+	// UpstreamBody is the final request body sent upstream, kept so a broken
+	// stream can be resumed with a continuation request
+	UpstreamBody []byte
+
+	// Filled in from the response
+	ResponseID               string
+	ResponseModel            string
+	FinishReason             string
+	FirstToken               time.Time
+	InputTokens              int
+	OutputTokens             int
+	CacheCreationInputTokens int
+	CacheReadInputTokens     int
+}
+
+// ClientID returns the client identity, or "anonymous" if none is known
+func (i *Info) ClientID() string {
+	if i.Client == "" {
+		return "anonymous"
+	}
+	return i.Client
+}
+
+// RecordUsage merges token counts seen in the response. Streaming responses
+// report cumulative counts across several events, so the largest value wins.
+func (i *Info) RecordUsage(input, output, cacheCreation, cacheRead int) {
+	i.InputTokens = max(i.InputTokens, input)
+	i.OutputTokens = max(i.OutputTokens, output)
+	i.CacheCreationInputTokens = max(i.CacheCreationInputTokens, cacheCreation)
+	i.CacheReadInputTokens = max(i.CacheReadInputTokens, cacheRead)
+}
+
+// RecordResponse keeps the response identity and finish reason, ignoring
+// empty values so stream events can each contribute a part
+func (i *Info) RecordResponse(id, model, finishReason string) {
+	if id != "" {
+		i.ResponseID = id
+	}
+	if model != "" {
+		i.ResponseModel = model
+	}
+	if finishReason != "" {
+		i.FinishReason = finishReason
+	}
+}
+
+// MarkFirstToken records when the first generated content reached the client
+func (i *Info) MarkFirstToken() {
+	if i.FirstToken.IsZero() {
+		i.FirstToken = time.Now()
+	}
+}
+
+type contextKey struct{}
+
+// With returns a context carrying info
+func With(ctx context.Context, info *Info) context.Context {
+	return context.WithValue(ctx, contextKey{}, info)
+}
+
+// From returns the request info stored in ctx. If none was attached an empty
+// Info is returned, so callers never need a nil check.
+func From(ctx context.Context) *Info {
+	if info, ok := ctx.Value(contextKey{}).(*Info); ok {
+		return info
+	}
+	return &Info{}
+}
+
+// Logger returns the default logger tagged with the request ID from ctx
+func Logger(ctx context.Context) *slog.Logger {
+	if info := From(ctx); info.ID != "" {
+		return slog.Default().With("request_id", info.ID)
+	}
+	return slog.Default()
+}
@@ -0,0 +1,321 @@
+package respcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cliproxy-middleware/internal/capture"
+	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/handlers"
+	"cliproxy-middleware/internal/metrics"
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+// Entry is a cached response body. Streamed responses are stored as the
+// assembled final message so they can be served to streaming and
+// non-streaming requests alike.
+type Entry struct {
+	Created time.Time       `json:"created"`
+	Path    string          `json:"path"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// backend stores entries by key
+type backend interface {
+	get(key string) (*Entry, bool)
+	put(key string, e *Entry, size int64)
+	remove(key string)
+}
+
+// Cache serves repeated deterministic requests without calling upstream:
+// count_tokens calls and completions with temperature 0. A nil *Cache is
+// disabled.
+type Cache struct {
+	backend       backend
+	ttl           time.Duration
+	maxEntryBytes int64
+}
+
+// New creates a cache with the given backend ("memory" or "disk"), or returns
+// nil for "none". dir is only used by the disk backend.
+func New(kind, dir string, ttl time.Duration, maxBytes, maxEntryBytes int64) (*Cache, error) {
+	c := &Cache{ttl: ttl, maxEntryBytes: maxEntryBytes}
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		c.backend = newMemoryBackend(maxBytes)
+	case "disk":
+		b, err := newDiskBackend(dir, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		c.backend = b
+	default:
+		return nil, fmt.Errorf("unknown response cache backend %q: expected memory, disk or none", kind)
+	}
+	return c, nil
+}
+
+// Enabled reports whether responses are cached
+func (c *Cache) Enabled() bool {
+	return c != nil
+}
+
+// Wrap serves eligible requests from the cache and stores successful
+// responses to them. Clients skip the lookup with Cache-Control: no-cache
+// and skip the cache entirely with Cache-Control: no-store or
+// X-Cache-Bypass: 1. Responses carry X-Cache: HIT, MISS or BYPASS.
+func (c *Cache) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			h(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			h(w, r)
+			return
+		}
+
+		key, req, ok := requestKey(r.URL.Path, caller(r), body)
+		if !ok {
+			h(w, r)
+			return
+		}
+
+		lookup, store := bypass(r.Header)
+		if lookup {
+			if e, hit := c.backend.get(key); hit {
+				if time.Since(e.Created) < c.ttl {
+					metrics.ResponseCache.Inc("hit")
+					c.serve(w, r, e, req)
+					return
+				}
+				c.backend.remove(key)
+			}
+		}
+
+		if !store {
+			metrics.ResponseCache.Inc("bypass")
+			w.Header().Set("X-Cache", "BYPASS")
+			h(w, r)
+			return
+		}
+		if lookup {
+			metrics.ResponseCache.Inc("miss")
+			w.Header().Set("X-Cache", "MISS")
+		} else {
+			metrics.ResponseCache.Inc("bypass")
+			w.Header().Set("X-Cache", "BYPASS")
+		}
+
+		rec := &recorder{ResponseWriter: w, limit: c.maxEntryBytes}
+		h(rec, r)
+		c.store(key, r.URL.Path, rec)
+	}
+}
+
+// cachedRequest is what the key is derived from and what serving needs
+type cachedRequest struct {
+	Model       string `json:"model"`
+	MappedModel string `json:"-"`
+	Stream      bool   `json:"stream"`
+}
+
+// caller identifies the authenticated client: the key name from the keys
+// file, or a hash of the client's own upstream key without one. The presented
+// key can't be used, as it is already the shared upstream key under a keys
+// file.
+func caller(r *http.Request) string {
+	return reqinfo.From(r.Context()).ClientID()
+}
+
+// requestKey returns the cache key for an eligible request: a hash of the
+// caller, the path, the mapped model and the request body in canonical form,
+// without the fields that only choose the response format or identify the
+// session
+func requestKey(path, caller string, body []byte) (string, cachedRequest, bool) {
+	var req cachedRequest
+	countTokens := strings.HasSuffix(path, "/count_tokens")
+	if !countTokens && !strings.HasSuffix(path, "/messages") && !strings.HasSuffix(path, "/chat/completions") {
+		return "", req, false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var fields map[string]any
+	if decoder.Decode(&fields) != nil || json.Unmarshal(body, &req) != nil {
+		return "", req, false
+	}
+	if !countTokens {
+		// Only greedy sampling is repeatable
+		temperature, ok := fields["temperature"].(json.Number)
+		if !ok {
+			return "", req, false
+		}
+		if t, err := temperature.Float64(); err != nil || t != 0 {
+			return "", req, false
+		}
+	}
+
+	req.MappedModel = config.MapModel(req.Model)
+	fields["model"] = req.MappedModel
+	delete(fields, "stream")
+	delete(fields, "stream_options")
+	delete(fields, "metadata")
+
+	// Map keys are marshaled in sorted order, so equal requests hash equally
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return "", req, false
+	}
+	sum := sha256.New()
+	sum.Write([]byte(caller))
+	sum.Write([]byte{0})
+	sum.Write([]byte(path))
+	sum.Write([]byte{0})
+	sum.Write(canonical)
+	return hex.EncodeToString(sum.Sum(nil)), req, true
+}
+
+// bypass reads the client's cache directives
+func bypass(h http.Header) (lookup, store bool) {
+	if h.Get("X-Cache-Bypass") == "1" || h.Get("X-Cache-Bypass") == "true" {
+		return false, false
+	}
+	lookup, store = true, true
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache", "max-age=0":
+			lookup = false
+		case "no-store":
+			lookup, store = false, false
+		}
+	}
+	return lookup, store
+}
+
+// store keeps a successful response
+func (c *Cache) store(key, path string, rec *recorder) {
+	// Estimates made while upstream was unavailable are not worth keeping
+	if rec.status != http.StatusOK || rec.overflow || rec.Header().Get("X-Token-Estimate") != "" {
+		return
+	}
+	body := rec.body.Bytes()
+	if strings.Contains(rec.Header().Get("Content-Type"), "text/event-stream") {
+		body = capture.Assemble(body)
+		if body == nil || !complete(body) {
+			return
+		}
+	} else if !json.Valid(body) {
+		return
+	}
+	e := &Entry{Created: time.Now(), Path: path, Body: body}
+	c.backend.put(key, e, int64(len(body)))
+}
+
+// complete reports whether an assembled stream finished normally
+func complete(message []byte) bool {
+	var m struct {
+		StopReason *string `json:"stop_reason"`
+		Choices    []struct {
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+		StreamErrors json.RawMessage `json:"stream_errors"`
+	}
+	if json.Unmarshal(message, &m) != nil || m.StreamErrors != nil {
+		return false
+	}
+	if m.StopReason != nil {
+		return true
+	}
+	return len(m.Choices) > 0 && m.Choices[0].FinishReason != nil
+}
+
+// serve answers from a cache entry, as SSE if the client asked for a stream
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, e *Entry, req cachedRequest) {
+	info := reqinfo.From(r.Context())
+	info.RequestedModel = req.Model
+	info.MappedModel = req.MappedModel
+	info.Stream = req.Stream
+	info.CacheHit = true
+	info.MarkFirstToken()
+	reqinfo.Logger(r.Context()).Debug("response cache hit", "path", r.URL.Path, "age", time.Since(e.Created).Round(time.Second))
+
+	// Hits count toward the client's usage and token quota like the
+	// original response did
+	if usage := handlers.TrackUsageFromResponse(info.ClientID(), e.Body, false, false); usage != nil {
+		info.RecordUsage(usage.InputTokens, usage.OutputTokens, usage.CacheCreationInputTokens, usage.CacheReadInputTokens)
+	}
+
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Age", fmt.Sprint(int(time.Since(e.Created).Seconds())))
+	if !req.Stream || strings.HasSuffix(e.Path, "/count_tokens") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(e.Body)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if strings.HasSuffix(e.Path, "/chat/completions") {
+		w.Write(completionEvents(e.Body))
+	} else {
+		w.Write(messageEvents(e.Body))
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// recorder tees the response into a buffer, giving up once it exceeds limit
+type recorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if !r.overflow {
+		if r.limit > 0 && int64(r.body.Len()+len(p)) > r.limit {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *recorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,136 @@
+package respcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cliproxy-middleware/internal/handlers"
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+func TestRequestKey(t *testing.T) {
+	const base = `{"model":"claude-haiku-4-5-20251001","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+	key, req, ok := requestKey("/v1/messages", "a", []byte(base))
+	if !ok {
+		t.Fatal("temperature 0 request not cacheable")
+	}
+	if req.Model != "claude-haiku-4-5-20251001" || req.MappedModel != "gemini-3-flash" || req.Stream {
+		t.Fatalf("request = %+v", req)
+	}
+
+	for _, tc := range []struct {
+		name, path, caller, body string
+		wantOK, wantSame         bool
+	}{
+		{"same request", "/v1/messages", "a", base, true, true},
+		{"key order and spacing", "/v1/messages", "a", `{"messages":[{"content":"hi","role":"user"}], "temperature":0,"model":"claude-haiku-4-5-20251001"}`, true, true},
+		{"stream and metadata ignored", "/v1/messages", "a", `{"model":"claude-haiku-4-5-20251001","temperature":0,"stream":true,"metadata":{"user_id":"session-2"},"messages":[{"role":"user","content":"hi"}]}`, true, true},
+		{"same mapped model", "/v1/messages", "a", `{"model":"claude-haiku-4-5","temperature":0,"messages":[{"role":"user","content":"hi"}]}`, true, true},
+		{"other caller", "/v1/messages", "b", base, true, false},
+		{"other path", "/v1/chat/completions", "a", base, true, false},
+		{"other prompt", "/v1/messages", "a", `{"model":"claude-haiku-4-5-20251001","temperature":0,"messages":[{"role":"user","content":"bye"}]}`, true, false},
+		{"sampled", "/v1/messages", "a", `{"model":"claude-haiku-4-5-20251001","temperature":0.7,"messages":[]}`, false, false},
+		{"default temperature", "/v1/messages", "a", `{"model":"claude-haiku-4-5-20251001","messages":[]}`, false, false},
+		{"count_tokens needs no temperature", "/v1/messages/count_tokens", "a", `{"model":"claude-haiku-4-5-20251001","messages":[]}`, true, false},
+		{"other endpoint", "/v1/models", "a", base, false, false},
+		{"invalid JSON", "/v1/messages", "a", `{"model":`, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _, ok := requestKey(tc.path, tc.caller, []byte(tc.body))
+			if ok != tc.wantOK {
+				t.Fatalf("cacheable = %v, want %v", ok, tc.wantOK)
+			}
+			if ok && (got == key) != tc.wantSame {
+				t.Fatalf("same key = %v, want %v", got == key, tc.wantSame)
+			}
+		})
+	}
+}
+
+func TestBypass(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		header                http.Header
+		wantLookup, wantStore bool
+	}{
+		{"none", http.Header{}, true, true},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, false, true},
+		{"max-age=0", http.Header{"Cache-Control": {"max-age=0"}}, false, true},
+		{"no-store among others", http.Header{"Cache-Control": {"private, No-Store"}}, false, false},
+		{"bypass header", http.Header{"X-Cache-Bypass": {"1"}}, false, false},
+		{"bypass header true", http.Header{"X-Cache-Bypass": {"true"}}, false, false},
+		{"unrelated directive", http.Header{"Cache-Control": {"max-age=60"}}, true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lookup, store := bypass(tc.header)
+			if lookup != tc.wantLookup || store != tc.wantStore {
+				t.Fatalf("bypass = %v, %v; want %v, %v", lookup, store, tc.wantLookup, tc.wantStore)
+			}
+		})
+	}
+}
+
+func TestComplete(t *testing.T) {
+	for message, want := range map[string]bool{
+		`{"type":"message","stop_reason":"end_turn"}`: true,
+		`{"type":"message","stop_reason":null}`:       false,
+		`{"type":"message"}`:                          false,
+		`{"type":"message","stop_reason":"end_turn","stream_errors":[{"type":"error"}]}`: false,
+		`{"choices":[{"finish_reason":"stop"}]}`:                                         true,
+		`{"choices":[{"finish_reason":null}]}`:                                           false,
+		`{"choices":[]}`:                                                                 false,
+		`not json`:                                                                       false,
+	} {
+		if got := complete([]byte(message)); got != want {
+			t.Errorf("complete(%s) = %v, want %v", message, got, want)
+		}
+	}
+}
+
+func TestWrapScopesEntriesToClientsAndRecordsUsage(t *testing.T) {
+	c, err := New("memory", "", time.Minute, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upstreamCalls int
+	h := c.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"type":"message","stop_reason":"end_turn","usage":{"input_tokens":30,"output_tokens":12}}`))
+	})
+	charged := make(map[string]int)
+	handlers.OnUsage(func(client string, usage *handlers.AnthropicUsage) {
+		charged[client] += usage.Total()
+	})
+
+	send := func(client string) *httptest.ResponseRecorder {
+		body := `{"model":"claude-haiku-4-5-20251001","temperature":0,"messages":[{"role":"user","content":"title this"}]}`
+		r := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+		// Under a keys file every client presents the shared upstream key
+		r.Header.Set("Authorization", "Bearer sk-upstream")
+		r = r.WithContext(reqinfo.With(r.Context(), &reqinfo.Info{Client: client}))
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	if w := send("alice"); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first request X-Cache = %q", w.Header().Get("X-Cache"))
+	}
+	if w := send("alice"); w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("repeated request X-Cache = %q", w.Header().Get("X-Cache"))
+	}
+	if w := send("bob"); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("another client's request X-Cache = %q, want its own entry", w.Header().Get("X-Cache"))
+	}
+	if upstreamCalls != 2 {
+		t.Fatalf("handler called %d times, want 2", upstreamCalls)
+	}
+	// The handler records usage for misses; hits are charged by the cache
+	if charged["alice"] != 42 || charged["bob"] != 0 {
+		t.Fatalf("usage charged = %v, want 42 for alice's hit", charged)
+	}
+}
@@ -0,0 +1,165 @@
+package respcache
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryBackend keeps entries in memory, evicting the least recently used
+// once their bodies exceed maxBytes
+type memoryBackend struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List // front is most recently used
+	entries  map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+func newMemoryBackend(maxBytes int64) *memoryBackend {
+	return &memoryBackend{maxBytes: maxBytes, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (b *memoryBackend) get(key string) (*Entry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	el, ok := b.entries[key]
+	if !ok {
+		return nil, false
+	}
+	b.order.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, true
+}
+
+func (b *memoryBackend) put(key string, e *Entry, size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if el, ok := b.entries[key]; ok {
+		b.removeElement(el)
+	}
+	b.entries[key] = b.order.PushFront(&memoryItem{key: key, entry: e, size: size})
+	b.size += size
+	for b.maxBytes > 0 && b.size > b.maxBytes && b.order.Len() > 0 {
+		b.removeElement(b.order.Back())
+	}
+}
+
+func (b *memoryBackend) remove(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if el, ok := b.entries[key]; ok {
+		b.removeElement(el)
+	}
+}
+
+// removeElement drops an entry; callers must hold b.mu
+func (b *memoryBackend) removeElement(el *list.Element) {
+	item := b.order.Remove(el).(*memoryItem)
+	delete(b.entries, item.key)
+	b.size -= item.size
+}
+
+// diskBackend keeps one JSON file per entry, so the cache survives
+// restarts. The oldest files are removed once the directory exceeds maxBytes.
+type diskBackend struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+}
+
+func newDiskBackend(dir string, maxBytes int64) (*diskBackend, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &diskBackend{dir: dir, maxBytes: maxBytes}, nil
+}
+
+func (b *diskBackend) path(key string) string {
+	return filepath.Join(b.dir, key+".json")
+}
+
+func (b *diskBackend) get(key string) (*Entry, bool) {
+	data, err := os.ReadFile(b.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var e Entry
+	if json.Unmarshal(data, &e) != nil {
+		return nil, false
+	}
+	return &e, true
+}
+
+func (b *diskBackend) put(key string, e *Entry, size int64) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Write then rename, so readers never see a partial file
+	tmp := b.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("⚠️  Failed to write response cache entry: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, b.path(key)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	b.evict()
+}
+
+func (b *diskBackend) remove(key string) {
+	os.Remove(b.path(key))
+}
+
+// evict removes the oldest entries beyond maxBytes; callers must hold b.mu
+func (b *diskBackend) evict() {
+	if b.maxBytes <= 0 {
+		return
+	}
+	dirEntries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return
+	}
+	type file struct {
+		name string
+		info os.FileInfo
+	}
+	var files []file
+	var total int64
+	for _, de := range dirEntries {
+		if !strings.HasSuffix(de.Name(), ".json") {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{de.Name(), info})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].info.ModTime().Before(files[j].info.ModTime()) })
+	for _, f := range files {
+		if total <= b.maxBytes {
+			break
+		}
+		if os.Remove(filepath.Join(b.dir, f.name)) == nil {
+			total -= f.info.Size()
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package respcache
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"cliproxy-middleware/internal/sse"
+)
+
+// messageEvents replays an Anthropic message as the stream that would have
+// produced it: one delta per content block
+func messageEvents(body []byte) []byte {
+	var message map[string]any
+	if json.Unmarshal(body, &message) != nil {
+		return nil
+	}
+	content, _ := message["content"].([]any)
+	usage, _ := message["usage"].(map[string]any)
+
+	var buf bytes.Buffer
+	emit := func(name string, event map[string]any) {
+		event["type"] = name
+		data, _ := json.Marshal(event)
+		buf.Write(sse.Encode(name, data))
+	}
+
+	// message_start carries the message without content and output tokens
+	start := make(map[string]any, len(message))
+	for k, v := range message {
+		start[k] = v
+	}
+	start["content"] = []any{}
+	start["stop_reason"] = nil
+	start["stop_sequence"] = nil
+	if usage != nil {
+		startUsage := make(map[string]any, len(usage))
+		for k, v := range usage {
+			startUsage[k] = v
+		}
+		startUsage["output_tokens"] = 0
+		start["usage"] = startUsage
+	}
+	emit("message_start", map[string]any{"message": start})
+
+	for i, raw := range content {
+		block, _ := raw.(map[string]any)
+		if block == nil {
+			continue
+		}
+		empty := make(map[string]any, len(block))
+		for k, v := range block {
+			empty[k] = v
+		}
+		var deltas []map[string]any
+		switch block["type"] {
+		case "text":
+			empty["text"] = ""
+			deltas = append(deltas, map[string]any{"type": "text_delta", "text": block["text"]})
+		case "thinking":
+			empty["thinking"] = ""
+			delete(empty, "signature")
+			deltas = append(deltas, map[string]any{"type": "thinking_delta", "thinking": block["thinking"]})
+			if sig, ok := block["signature"]; ok {
+				deltas = append(deltas, map[string]any{"type": "signature_delta", "signature": sig})
+			}
+		case "tool_use", "server_tool_use":
+			empty["input"] = map[string]any{}
+			input, _ := json.Marshal(block["input"])
+			deltas = append(deltas, map[string]any{"type": "input_json_delta", "partial_json": string(input)})
+		}
+		emit("content_block_start", map[string]any{"index": i, "content_block": empty})
+		for _, delta := range deltas {
+			emit("content_block_delta", map[string]any{"index": i, "delta": delta})
+		}
+		emit("content_block_stop", map[string]any{"index": i})
+	}
+
+	delta := map[string]any{"stop_reason": message["stop_reason"], "stop_sequence": message["stop_sequence"]}
+	messageDelta := map[string]any{"delta": delta}
+	if usage != nil {
+		messageDelta["usage"] = map[string]any{"output_tokens": usage["output_tokens"]}
+	}
+	emit("message_delta", messageDelta)
+	emit("message_stop", map[string]any{})
+	return buf.Bytes()
+}
+
+// completionEvents replays an OpenAI chat completion as chunks: the content
+// and tool calls of each choice, its finish reason, then usage and [DONE]
+func completionEvents(body []byte) []byte {
+	var completion map[string]any
+	if json.Unmarshal(body, &completion) != nil {
+		return nil
+	}
+	choices, _ := completion["choices"].([]any)
+
+	var buf bytes.Buffer
+	emit := func(chunkChoices []any, usage any) {
+		chunk := map[string]any{
+			"id":      completion["id"],
+			"object":  "chat.completion.chunk",
+			"created": completion["created"],
+			"model":   completion["model"],
+			"choices": chunkChoices,
+		}
+		if usage != nil {
+			chunk["usage"] = usage
+		}
+		data, _ := json.Marshal(chunk)
+		buf.Write(sse.Encode("", data))
+	}
+
+	for _, raw := range choices {
+		choice, _ := raw.(map[string]any)
+		if choice == nil {
+			continue
+		}
+		message, _ := choice["message"].(map[string]any)
+		delta := map[string]any{"role": "assistant"}
+		for _, field := range []string{"content", "reasoning_content", "refusal"} {
+			if v, ok := message[field]; ok && v != nil {
+				delta[field] = v
+			}
+		}
+		if calls, ok := message["tool_calls"].([]any); ok {
+			indexed := make([]any, 0, len(calls))
+			for i, call := range calls {
+				if m, ok := call.(map[string]any); ok {
+					c := map[string]any{"index": i}
+					for k, v := range m {
+						c[k] = v
+					}
+					indexed = append(indexed, c)
+				}
+			}
+			delta["tool_calls"] = indexed
+		}
+		emit([]any{map[string]any{"index": choice["index"], "delta": delta, "finish_reason": nil}}, nil)
+		emit([]any{map[string]any{"index": choice["index"], "delta": map[string]any{}, "finish_reason": choice["finish_reason"]}}, nil)
+	}
+	if usage, ok := completion["usage"]; ok {
+		emit([]any{}, usage)
+	}
+	buf.Write(sse.Encode("", []byte("[DONE]")))
+	return buf.Bytes()
+}
@@ -0,0 +1,469 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxFallbackLength bounds the JSON quoted for constraints that have no
+// plain-language form
+const maxFallbackLength = 160
+
+// Hoist appends a short note to the description of each schema whose
+// constraints Normalize is about to drop (if/then/else, not,
+// dependentRequired, dependentSchemas, patternProperties, propertyNames,
+// unions and type arrays), so the model still learns them. Call it before
+// Normalize.
+func Hoist(schema map[string]interface{}) {
+	if schema == nil {
+		return
+	}
+	notes := constraintNotes(schema)
+
+	// allOf members are merged into this schema, so their conditions apply here
+	if members, ok := schema["allOf"].([]interface{}); ok {
+		for _, member := range members {
+			if m, ok := member.(map[string]interface{}); ok {
+				notes = append(notes, constraintNotes(m)...)
+				hoistChildren(m)
+			}
+		}
+	}
+
+	// Normalize keeps the first non-null union member; describe the others.
+	// The kept member's description replaces this one, so the note goes there.
+	target := schema
+	for _, key := range []string{"anyOf", "oneOf"} {
+		members, ok := schema[key].([]interface{})
+		if !ok || len(members) == 0 {
+			continue
+		}
+		for _, member := range members {
+			if m, ok := member.(map[string]interface{}); ok {
+				Hoist(m)
+			}
+		}
+		kept, note := unionNote(members)
+		if note == "" {
+			continue
+		}
+		if kept != nil {
+			if _, has := kept["description"]; has {
+				target = kept
+			}
+		}
+		addNotes(target, []string{note})
+	}
+
+	addNotes(schema, notes)
+	hoistChildren(schema)
+}
+
+// hoistChildren hoists the schemas nested in schema, other than allOf,
+// anyOf and oneOf members
+func hoistChildren(schema map[string]interface{}) {
+	for _, key := range []string{"properties", "patternProperties"} {
+		if props, ok := schema[key].(map[string]interface{}); ok {
+			for _, prop := range props {
+				if m, ok := prop.(map[string]interface{}); ok {
+					Hoist(m)
+				}
+			}
+		}
+	}
+	for _, key := range []string{"items", "additionalProperties", "contains"} {
+		if m, ok := schema[key].(map[string]interface{}); ok {
+			Hoist(m)
+		}
+	}
+	if items, ok := schema["prefixItems"].([]interface{}); ok {
+		for _, item := range items {
+			if m, ok := item.(map[string]interface{}); ok {
+				Hoist(m)
+			}
+		}
+	}
+}
+
+// constraintNotes describes the dropped constraints of one schema
+func constraintNotes(schema map[string]interface{}) []string {
+	var notes []string
+
+	if cond, ok := schema["if"].(map[string]interface{}); ok {
+		if then, ok := schema["then"].(map[string]interface{}); ok {
+			if r := requirement(then); r != "" {
+				notes = append(notes, fmt.Sprintf("If %s, %s.", condition(cond), r))
+			}
+		}
+		if otherwise, ok := schema["else"].(map[string]interface{}); ok {
+			if r := requirement(otherwise); r != "" {
+				notes = append(notes, fmt.Sprintf("Unless %s, %s.", condition(cond), r))
+			}
+		}
+	}
+
+	if not, ok := schema["not"].(map[string]interface{}); ok {
+		notes = append(notes, negation(not))
+	}
+
+	if deps, ok := schema["dependentRequired"].(map[string]interface{}); ok {
+		for _, prop := range sortedKeys(deps) {
+			if required := stringList(deps[prop]); len(required) > 0 {
+				notes = append(notes, fmt.Sprintf("If %s is given, %s %s required.", prop, join(required, "and"), plural(len(required), "is", "are")))
+			}
+		}
+	}
+	if deps, ok := schema["dependentSchemas"].(map[string]interface{}); ok {
+		for _, prop := range sortedKeys(deps) {
+			if m, ok := deps[prop].(map[string]interface{}); ok {
+				if r := requirement(m); r != "" {
+					notes = append(notes, fmt.Sprintf("If %s is given, %s.", prop, r))
+				}
+			}
+		}
+	}
+
+	if patterns, ok := schema["patternProperties"].(map[string]interface{}); ok {
+		for _, pattern := range sortedKeys(patterns) {
+			kind := "any value"
+			if m, ok := patterns[pattern].(map[string]interface{}); ok {
+				if s := summary(m); s != "" {
+					kind = s
+				}
+			}
+			notes = append(notes, fmt.Sprintf("Properties whose names match /%s/ may be added, each %s.", pattern, kind))
+		}
+	}
+
+	if names, ok := schema["propertyNames"].(map[string]interface{}); ok {
+		rule := valueRule(names)
+		_, isConst := names["const"]
+		_, isEnum := names["enum"]
+		if !isConst && !isEnum {
+			rule = "strings " + strings.TrimPrefix(strings.TrimPrefix(rule, "a value "), "a string ")
+		}
+		notes = append(notes, "Property names must be "+rule+".")
+	}
+
+	if types, ok := schema["type"].([]interface{}); ok {
+		if others := typeAlternatives(types); len(others) > 0 {
+			notes = append(notes, fmt.Sprintf("Can also be %s.", join(others, "or")))
+		}
+	}
+	return notes
+}
+
+// unionNote returns the member Normalize keeps and a note listing the others
+func unionNote(members []interface{}) (map[string]interface{}, string) {
+	var kept map[string]interface{}
+	var others []string
+	nullable := false
+	for _, member := range members {
+		m, ok := member.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if t, _ := m["type"].(string); t == "null" {
+			nullable = true
+			continue
+		}
+		if kept == nil && keepsType(m) {
+			kept = m
+			continue
+		}
+		others = append(others, summary(m))
+	}
+	if kept == nil || len(others) == 0 && !nullable {
+		return kept, ""
+	}
+	if len(others) == 0 {
+		return kept, "Can also be null."
+	}
+	if nullable {
+		others = append(others, "null")
+	}
+	return kept, fmt.Sprintf("Can also be %s.", join(others, "or"))
+}
+
+// keepsType mirrors Normalize's choice of union member: the first with a
+// non-null type
+func keepsType(m map[string]interface{}) bool {
+	switch t := m["type"].(type) {
+	case string:
+		return t != "null"
+	case []interface{}:
+		for _, v := range t {
+			if s, ok := v.(string); ok && s != "null" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// typeAlternatives names the non-null types after the first in a type array
+func typeAlternatives(types []interface{}) []string {
+	var names []string
+	first := true
+	for _, t := range types {
+		s, ok := t.(string)
+		if !ok {
+			continue
+		}
+		if s == "null" {
+			if len(types) > 1 {
+				names = append(names, "null")
+			}
+			continue
+		}
+		if first {
+			first = false
+			continue
+		}
+		names = append(names, article(s))
+	}
+	return names
+}
+
+// condition describes an if schema as a condition on an object's properties
+func condition(s map[string]interface{}) string {
+	var parts []string
+	if props, ok := s["properties"].(map[string]interface{}); ok {
+		for _, prop := range sortedKeys(props) {
+			if m, ok := props[prop].(map[string]interface{}); ok {
+				parts = append(parts, prop+" "+predicate(m))
+			}
+		}
+	}
+	if required := stringList(s["required"]); len(required) > 0 {
+		parts = append(parts, fmt.Sprintf("%s %s given", join(required, "and"), plural(len(required), "is", "are")))
+	}
+	if len(parts) == 0 {
+		return "the value matches " + compact(s)
+	}
+	return strings.Join(parts, " and ")
+}
+
+// requirement describes a then, else or dependent schema as what it demands
+func requirement(s map[string]interface{}) string {
+	var parts []string
+	if required := stringList(s["required"]); len(required) > 0 {
+		parts = append(parts, fmt.Sprintf("%s %s required", join(required, "and"), plural(len(required), "is", "are")))
+	}
+	if props, ok := s["properties"].(map[string]interface{}); ok {
+		for _, prop := range sortedKeys(props) {
+			if m, ok := props[prop].(map[string]interface{}); ok {
+				parts = append(parts, prop+" must be "+valueRule(m))
+			}
+		}
+	}
+	if not, ok := s["not"].(map[string]interface{}); ok {
+		parts = append(parts, strings.TrimSuffix(lowerFirst(negation(not)), "."))
+	}
+	if len(parts) == 0 {
+		if len(s) == 0 {
+			return ""
+		}
+		return "the value must match " + compact(s)
+	}
+	return strings.Join(parts, ", and ")
+}
+
+// negation describes a not schema
+func negation(s map[string]interface{}) string {
+	if required := stringList(s["required"]); len(required) > 0 && len(s) == 1 {
+		if len(required) == 1 {
+			return fmt.Sprintf("%s must not be given.", required[0])
+		}
+		return fmt.Sprintf("%s must not all be given together.", join(required, "and"))
+	}
+	if _, hasProps := s["properties"]; hasProps {
+		return fmt.Sprintf("Must not hold when %s.", condition(s))
+	}
+	return "Must not be " + valueRule(s) + "."
+}
+
+// predicate describes a property schema as a condition: "is 'crawl'"
+func predicate(s map[string]interface{}) string {
+	return "is " + valueRule(s)
+}
+
+// valueRule describes the values a schema allows: "'crawl'", "one of 'a' or
+// 'b'", "a string matching /^x/"
+func valueRule(s map[string]interface{}) string {
+	if v, ok := s["const"]; ok {
+		return literal(v)
+	}
+	if values, ok := s["enum"].([]interface{}); ok && len(values) > 0 {
+		if len(values) == 1 {
+			return literal(values[0])
+		}
+		literals := make([]string, len(values))
+		for i, v := range values {
+			literals[i] = literal(v)
+		}
+		return "one of " + join(literals, "or")
+	}
+	var parts []string
+	if pattern, ok := s["pattern"].(string); ok {
+		parts = append(parts, fmt.Sprintf("matching /%s/", pattern))
+	}
+	if n, ok := s["minLength"].(float64); ok {
+		parts = append(parts, fmt.Sprintf("at least %g characters long", n))
+	}
+	if n, ok := s["maxLength"].(float64); ok {
+		parts = append(parts, fmt.Sprintf("at most %g characters long", n))
+	}
+	if n, ok := s["minimum"].(float64); ok {
+		parts = append(parts, fmt.Sprintf("at least %g", n))
+	}
+	if n, ok := s["maximum"].(float64); ok {
+		parts = append(parts, fmt.Sprintf("at most %g", n))
+	}
+	if len(parts) > 0 {
+		subject := "a value"
+		if t, ok := s["type"].(string); ok {
+			subject = article(t)
+		}
+		return subject + " " + strings.Join(parts, " and ")
+	}
+	if t, ok := s["type"].(string); ok {
+		return article(t)
+	}
+	return "a value matching " + compact(s)
+}
+
+// summary describes a union member or pattern property schema
+func summary(s map[string]interface{}) string {
+	if _, ok := s["const"]; ok {
+		return valueRule(s)
+	}
+	if _, ok := s["enum"]; ok {
+		return valueRule(s)
+	}
+	t, _ := s["type"].(string)
+	switch t {
+	case "array":
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			if inner := summary(items); inner != "" {
+				return "an array of " + inner
+			}
+		}
+		return "an array"
+	case "object":
+		var parts []string
+		if props, ok := s["properties"].(map[string]interface{}); ok {
+			for _, prop := range sortedKeys(props) {
+				if m, ok := props[prop].(map[string]interface{}); ok {
+					if _, isConst := m["const"]; isConst {
+						parts = append(parts, prop+" "+predicate(m))
+					}
+				}
+			}
+		}
+		if required := stringList(s["required"]); len(required) > 0 {
+			parts = append(parts, "requiring "+join(required, "and"))
+		}
+		if len(parts) == 0 {
+			return "an object"
+		}
+		return "an object where " + strings.Join(parts, ", ")
+	case "":
+		return "a value matching " + compact(s)
+	}
+	return valueRule(s)
+}
+
+// addNotes appends notes to a schema's description
+func addNotes(schema map[string]interface{}, notes []string) {
+	if len(notes) == 0 {
+		return
+	}
+	text := strings.Join(notes, " ")
+	description, _ := schema["description"].(string)
+	description = strings.TrimSpace(description)
+	switch {
+	case description == "":
+		description = text
+	case strings.HasSuffix(description, ".") || strings.HasSuffix(description, "!") || strings.HasSuffix(description, "?"):
+		description += " " + text
+	default:
+		description += ". " + text
+	}
+	schema["description"] = description
+}
+
+// literal formats a JSON value for a note: strings in single quotes
+func literal(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return "'" + s + "'"
+	}
+	return compact(v)
+}
+
+// compact renders a value as JSON, shortened for a description
+func compact(v interface{}) string {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "a schema"
+	}
+	if len(out) > maxFallbackLength {
+		return string(out[:maxFallbackLength]) + "..."
+	}
+	return string(out)
+}
+
+// article prefixes a JSON Schema type name with "a" or "an"
+func article(t string) string {
+	switch t {
+	case "null":
+		return "null"
+	case "integer", "object", "array":
+		return "an " + t
+	}
+	return "a " + t
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// join lists items as "a, b and c"
+func join(items []string, conjunction string) string {
+	if len(items) <= 1 {
+		return strings.Join(items, "")
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " " + conjunction + " " + items[len(items)-1]
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func stringList(v interface{}) []string {
+	values, _ := v.([]interface{})
+	var out []string
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
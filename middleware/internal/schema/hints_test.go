@@ -0,0 +1,131 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHoist(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		schema string
+		path   []string // properties leading to the described schema
+		want   string
+	}{
+		{
+			name: "if then else",
+			schema: `{"type":"object","description":"Scrape options","properties":{"mode":{"type":"string"},"url":{"type":"string"},"query":{"type":"string"}},
+				"if":{"properties":{"mode":{"const":"crawl"}}},"then":{"required":["url"]},"else":{"required":["query"]}}`,
+			want: "Scrape options. If mode is 'crawl', url is required. Unless mode is 'crawl', query is required.",
+		},
+		{
+			name:   "if with required condition and property rule",
+			schema: `{"type":"object","if":{"required":["end"]},"then":{"properties":{"start":{"type":"integer","minimum":0}}}}`,
+			want:   "If end is given, start must be an integer at least 0.",
+		},
+		{
+			name:   "not required",
+			schema: `{"type":"object","description":"Either, not both","not":{"required":["path","content"]}}`,
+			want:   "Either, not both. path and content must not all be given together.",
+		},
+		{
+			name:   "not a value",
+			schema: `{"type":"string","not":{"enum":["root","admin"]}}`,
+			want:   "Must not be one of 'root' or 'admin'.",
+		},
+		{
+			name:   "dependentRequired",
+			schema: `{"type":"object","description":"Payment","dependentRequired":{"card":["billing_address","cvv"],"iban":["bic"]}}`,
+			want:   "Payment. If card is given, billing_address and cvv are required. If iban is given, bic is required.",
+		},
+		{
+			name:   "dependentSchemas",
+			schema: `{"type":"object","dependentSchemas":{"retry":{"required":["max_attempts"]}}}`,
+			want:   "If retry is given, max_attempts is required.",
+		},
+		{
+			name:   "patternProperties",
+			schema: `{"type":"object","description":"Headers","patternProperties":{"^x-":{"type":"string","maxLength":64},"^n-":{"type":"number"}}}`,
+			want:   "Headers. Properties whose names match /^n-/ may be added, each a number. Properties whose names match /^x-/ may be added, each a string at most 64 characters long.",
+		},
+		{
+			name:   "propertyNames pattern",
+			schema: `{"type":"object","propertyNames":{"pattern":"^[a-z_]+$"}}`,
+			want:   "Property names must be strings matching /^[a-z_]+$/.",
+		},
+		{
+			name:   "propertyNames enum",
+			schema: `{"type":"object","propertyNames":{"enum":["a","b"]}}`,
+			want:   "Property names must be one of 'a' or 'b'.",
+		},
+		{
+			name: "union note lands on the kept member's description",
+			schema: `{"type":"object","properties":{"target":{"description":"What to match","anyOf":[
+				{"type":"string","description":"A file path"},
+				{"type":"object","properties":{"kind":{"const":"glob"}},"required":["pattern"]},
+				{"type":"null"}]}}}`,
+			path: []string{"target"},
+			want: "A file path. Can also be an object where kind is 'glob', requiring pattern or null.",
+		},
+		{
+			name:   "nullable union",
+			schema: `{"type":"object","properties":{"limit":{"description":"Max results","oneOf":[{"type":"integer"},{"type":"null"}]}}}`,
+			path:   []string{"limit"},
+			want:   "Max results. Can also be null.",
+		},
+		{
+			name:   "type array",
+			schema: `{"type":"object","properties":{"id":{"type":["string","integer","null"],"description":"ID"}}}`,
+			path:   []string{"id"},
+			want:   "ID. Can also be an integer or null.",
+		},
+		{
+			name:   "allOf condition applies to the merged schema",
+			schema: `{"description":"Job","allOf":[{"type":"object","not":{"required":["cron"]}}]}`,
+			want:   "Job. cron must not be given.",
+		},
+		{
+			name:   "unnamed condition quoted",
+			schema: `{"type":"object","if":{"minProperties":2},"then":{"required":["mode"]}}`,
+			want:   `If the value matches {"minProperties":2}, mode is required.`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var s map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.schema), &s); err != nil {
+				t.Fatal(err)
+			}
+			Hoist(s)
+			s = Normalize(s, false)
+
+			target := s
+			for _, prop := range tc.path {
+				props, _ := target["properties"].(map[string]interface{})
+				target, _ = props[prop].(map[string]interface{})
+				if target == nil {
+					t.Fatalf("property %s missing after Normalize", prop)
+				}
+			}
+			if got, _ := target["description"].(string); got != tc.want {
+				t.Fatalf("description = %q\nwant %q", got, tc.want)
+			}
+			for _, key := range unsupportedKeys {
+				if _, ok := target[key]; ok {
+					t.Fatalf("%s survived Normalize", key)
+				}
+			}
+		})
+	}
+}
+
+func TestHoistWithoutDroppedConstraints(t *testing.T) {
+	var s map[string]interface{}
+	json.Unmarshal([]byte(`{"type":"object","description":"Plain","properties":{"a":{"type":"string"}}}`), &s)
+	Hoist(s)
+	if got := s["description"]; got != "Plain" {
+		t.Fatalf("description = %q, want it unchanged", got)
+	}
+	if _, ok := s["properties"].(map[string]interface{})["a"].(map[string]interface{})["description"]; ok {
+		t.Fatal("description added to a property without constraints")
+	}
+}
@@ -1,6 +1,10 @@
 package schema
 
-import "log"
+import (
+	"log"
+
+	"cliproxy-middleware/internal/metrics"
+)
 
 // unsupportedKeys are JSON Schema keys not supported by Gemini
 var unsupportedKeys = []string{
@@ -36,6 +40,7 @@ func Normalize(schema map[string]interface{}, debug bool) map[string]interface{}
 			if debug {
 				log.Printf("[schema] removing unsupported key: %s", key)
 			}
+			metrics.SchemaNormalizations.Inc(key)
 			delete(schema, key)
 		}
 	}
@@ -64,6 +69,7 @@ func Normalize(schema map[string]interface{}, debug bool) map[string]interface{}
 				}
 			}
 			delete(schema, unionKey)
+			metrics.SchemaNormalizations.Inc(unionKey)
 			if debug {
 				log.Printf("[schema] flattened %s to single type", unionKey)
 			}
@@ -85,6 +91,7 @@ func Normalize(schema map[string]interface{}, debug bool) map[string]interface{}
 			}
 		}
 		delete(schema, "allOf")
+		metrics.SchemaNormalizations.Inc("allOf")
 		if debug {
 			log.Printf("[schema] merged allOf schemas")
 		}
@@ -96,6 +103,7 @@ func Normalize(schema map[string]interface{}, debug bool) map[string]interface{}
 			for _, t := range typeArr {
 				if typeStr, isStr := t.(string); isStr && typeStr != "null" {
 					schema["type"] = typeStr
+					metrics.SchemaNormalizations.Inc("type")
 					if debug {
 						log.Printf("[schema] simplified type array to: %s", typeStr)
 					}
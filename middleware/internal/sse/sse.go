@@ -0,0 +1,134 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Event is a single server-sent event
+type Event struct {
+	Name string // value of the "event:" field, empty if absent
+	Data []byte // joined "data:" fields
+	Raw  []byte // the event exactly as received, including the blank line terminator
+}
+
+// Reader splits an SSE stream into complete events
+type Reader struct {
+	br *bufio.Reader
+}
+
+// NewReader creates an event reader over r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{br: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next complete event. A partial event cut off by the end of
+// the stream is discarded and the underlying error (io.EOF or otherwise) is returned.
+func (r *Reader) Next() (*Event, error) {
+	ev := &Event{}
+	var raw bytes.Buffer
+	var data [][]byte
+
+	for {
+		line, err := r.br.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF && raw.Len() == 0 && len(line) == 0 {
+				return nil, io.EOF
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		raw.Write(line)
+
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			if raw.Len() == len(line) {
+				// Stray blank line between events
+				raw.Reset()
+				continue
+			}
+			ev.Data = bytes.Join(data, []byte("\n"))
+			ev.Raw = raw.Bytes()
+			return ev, nil
+		}
+
+		field, value := trimmed, []byte(nil)
+		if i := bytes.IndexByte(trimmed, ':'); i >= 0 {
+			field, value = trimmed[:i], trimmed[i+1:]
+			value = bytes.TrimPrefix(value, []byte(" "))
+		}
+		switch string(field) {
+		case "event":
+			ev.Name = string(value)
+		case "data":
+			data = append(data, append([]byte(nil), value...))
+		}
+	}
+}
+
+// Encode formats an event for writing to a stream
+func Encode(name string, data []byte) []byte {
+	var buf bytes.Buffer
+	if name != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(name)
+		buf.WriteByte('\n')
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// RewriteData passes a stream through, replacing the payload of each
+// "data:" line with rewrite's result. rewrite returns nil to keep a line
+// unchanged. Lines are handled as they arrive, so events are not delayed.
+func RewriteData(body io.ReadCloser, rewrite func(data []byte) []byte) io.ReadCloser {
+	return &dataRewriter{body: body, reader: bufio.NewReader(body), rewrite: rewrite}
+}
+
+type dataRewriter struct {
+	body    io.ReadCloser
+	reader  *bufio.Reader
+	rewrite func([]byte) []byte
+	pending []byte
+	err     error
+}
+
+func (d *dataRewriter) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		line, err := d.reader.ReadBytes('\n')
+		d.err = err
+		d.pending = d.rewriteLine(line)
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *dataRewriter) rewriteLine(line []byte) []byte {
+	data, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		return line
+	}
+	out := d.rewrite(bytes.TrimSpace(data))
+	if out == nil {
+		return line
+	}
+	// Keep the original line ending
+	ending := line[len(bytes.TrimRight(line, "\r\n")):]
+	return append(append([]byte("data: "), out...), ending...)
+}
+
+func (d *dataRewriter) Close() error {
+	return d.body.Close()
+}
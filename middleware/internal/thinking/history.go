@@ -0,0 +1,123 @@
+package thinking
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// History modes for thinking blocks the target model can't validate
+const (
+	HistoryStrip = "strip" // remove the block
+	HistoryText  = "text"  // keep the reasoning as a plain text block
+)
+
+// validFor reports whether model can verify the signature of a prior
+// thinking block. Signatures are bound to the model that issued them;
+// unknown signatures, which didn't come through the middleware (or predate
+// the signatures file), are assumed to come from a Claude model.
+func validFor(b *block, model string, limits Limits) bool {
+	signature := b.signature()
+	if signature == "" {
+		return false
+	}
+	if from, ok := origin(signature); ok {
+		return from == model
+	}
+	return limits.Style == Claude
+}
+
+// SanitizeHistory strips or converts the thinking and redacted_thinking
+// blocks of earlier assistant turns that model would reject, such as those
+// signed by another model after a model switch. If the turn thinking
+// requires is lost, thinking is disabled for the request. It returns the
+// number of blocks changed.
+func SanitizeHistory(request map[string]json.RawMessage, model, mode string) int {
+	limits, known := For(model)
+	if !known {
+		return 0
+	}
+
+	var messages []map[string]json.RawMessage
+	if json.Unmarshal(request["messages"], &messages) != nil {
+		return 0
+	}
+
+	changed := 0
+	lastAssistant := -1
+	lostLeadingThinking := false
+	for i, message := range messages {
+		var role string
+		json.Unmarshal(message["role"], &role)
+		if role != "assistant" {
+			continue
+		}
+		lastAssistant = i
+		lostLeadingThinking = false
+
+		var content []json.RawMessage
+		if json.Unmarshal(message["content"], &content) != nil {
+			continue
+		}
+		before := changed
+		kept := content[:0:0]
+		for _, raw := range content {
+			var b block
+			json.Unmarshal(raw, &b)
+			if (b.Type != "thinking" && b.Type != "redacted_thinking") || validFor(&b, model, limits) {
+				kept = append(kept, raw)
+				continue
+			}
+			changed++
+			if mode == HistoryText && b.Type == "thinking" && b.Thinking != "" {
+				text, _ := json.Marshal(map[string]string{"type": "text", "text": fmt.Sprintf("<thinking>\n%s\n</thinking>", b.Thinking)})
+				kept = append(kept, text)
+			}
+		}
+		if changed == before {
+			continue
+		}
+		lostLeadingThinking = opensWithThinking(content) && !opensWithThinking(kept)
+		if len(kept) == 0 {
+			// Empty assistant turns are rejected; keep the turn order intact
+			kept = append(kept, json.RawMessage(`{"type":"text","text":"..."}`))
+		}
+		message["content"], _ = json.Marshal(kept)
+	}
+	if changed == 0 {
+		return 0
+	}
+	request["messages"], _ = json.Marshal(messages)
+
+	// A tool-use turn being continued must open with its thinking block when
+	// thinking is enabled; without it, the request can only go without thinking
+	if lostLeadingThinking && lastAssistant == len(messages)-2 {
+		var thinking config
+		json.Unmarshal(request["thinking"], &thinking)
+		if thinking.Type == "enabled" && usesTools(messages[lastAssistant]) {
+			delete(request, "thinking")
+		}
+	}
+	return changed
+}
+
+// opensWithThinking reports whether content starts with a thinking block
+func opensWithThinking(content []json.RawMessage) bool {
+	if len(content) == 0 {
+		return false
+	}
+	var b block
+	json.Unmarshal(content[0], &b)
+	return b.Type == "thinking" || b.Type == "redacted_thinking"
+}
+
+// usesTools reports whether an assistant message calls a tool
+func usesTools(message map[string]json.RawMessage) bool {
+	var content []block
+	json.Unmarshal(message["content"], &content)
+	for _, b := range content {
+		if b.Type == "tool_use" {
+			return true
+		}
+	}
+	return false
+}
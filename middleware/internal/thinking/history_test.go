@@ -0,0 +1,120 @@
+package thinking
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	opus   = "gemini-claude-opus-4-5-thinking"
+	sonnet = "gemini-claude-sonnet-4-5-thinking"
+	flash  = "gemini-3-flash"
+)
+
+// conversation builds a request whose assistant turn holds a thinking block
+// with signature, followed by text or a tool call
+func conversation(t *testing.T, signature string, toolUse bool) map[string]json.RawMessage {
+	t.Helper()
+	answer := `{"type":"text","text":"answer"}`
+	next := `{"role":"user","content":"next"}`
+	if toolUse {
+		answer = `{"type":"tool_use","id":"t","name":"f","input":{}}`
+		next = `{"role":"user","content":[{"type":"tool_result","tool_use_id":"t","content":"ok"}]}`
+	}
+	var request map[string]json.RawMessage
+	err := json.Unmarshal([]byte(`{"thinking":{"type":"enabled","budget_tokens":2048},"messages":[
+		{"role":"user","content":"hi"},
+		{"role":"assistant","content":[{"type":"thinking","thinking":"reasoning","signature":"`+signature+`"},`+answer+`]},
+		`+next+`]}`), &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func assistantContent(t *testing.T, request map[string]json.RawMessage) []map[string]any {
+	t.Helper()
+	var messages []struct {
+		Content json.RawMessage `json:"content"`
+	}
+	var content []map[string]any
+	if err := json.Unmarshal(request["messages"], &messages); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(messages[1].Content, &content); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestSanitizeHistory(t *testing.T) {
+	remember("sig-opus", opus)
+
+	for _, tc := range []struct {
+		name, signature, model, mode string
+		toolUse                      bool
+		wantChanged                  int
+		wantFirst                    string // type of the first assistant block afterwards
+		wantThinking                 bool
+	}{
+		{"same model keeps", "sig-opus", opus, HistoryStrip, false, 0, "thinking", true},
+		{"other Claude model strips", "sig-opus", sonnet, HistoryStrip, false, 1, "text", true},
+		{"other model as text", "sig-opus", sonnet, HistoryText, false, 1, "text", true},
+		{"Gemini target strips", "sig-opus", flash, HistoryStrip, false, 1, "text", true},
+		{"unknown signature kept for Claude", "sig-unknown", sonnet, HistoryStrip, false, 0, "thinking", true},
+		{"unknown signature stripped for Gemini", "sig-unknown", flash, HistoryStrip, false, 1, "text", true},
+		{"unsigned stripped", "", opus, HistoryStrip, false, 1, "text", true},
+		{"continued tool call loses thinking", "sig-opus", sonnet, HistoryStrip, true, 1, "tool_use", false},
+		{"unknown model untouched", "sig-opus", "other-model", HistoryStrip, false, 0, "thinking", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := conversation(t, tc.signature, tc.toolUse)
+			if got := SanitizeHistory(request, tc.model, tc.mode); got != tc.wantChanged {
+				t.Fatalf("changed = %d, want %d", got, tc.wantChanged)
+			}
+			content := assistantContent(t, request)
+			if content[0]["type"] != tc.wantFirst {
+				t.Fatalf("assistant turn = %v", content)
+			}
+			if _, ok := request["thinking"]; ok != tc.wantThinking {
+				t.Fatalf("thinking kept = %v, want %v", ok, tc.wantThinking)
+			}
+			if tc.mode == HistoryText && (len(content) != 2 || !strings.Contains(content[0]["text"].(string), "<thinking>\nreasoning\n</thinking>")) {
+				t.Fatalf("reasoning not kept as text: %v", content)
+			}
+		})
+	}
+}
+
+func TestSignaturesSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "signatures.json")
+	if n, err := LoadSignatures(path); n != 0 || err != nil {
+		t.Fatalf("LoadSignatures of a missing file = %d, %v", n, err)
+	}
+	remember("sig-saved", sonnet)
+	if err := SaveSignatures(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart starts with an empty map
+	origins.Lock()
+	origins.models = make(map[string]string)
+	origins.Unlock()
+	if _, ok := origin("sig-saved"); ok {
+		t.Fatal("origin known before loading")
+	}
+	if _, err := LoadSignatures(path); err != nil {
+		t.Fatal(err)
+	}
+	if model, ok := origin("sig-saved"); !ok || model != sonnet {
+		t.Fatalf("origin = %q, %v; want %s", model, ok, sonnet)
+	}
+
+	// A signature from before the restart is stripped for another model
+	request := conversation(t, "sig-saved", false)
+	if SanitizeHistory(request, opus, HistoryStrip) != 1 {
+		t.Fatal("restored signature not checked against its model")
+	}
+}
@@ -0,0 +1,219 @@
+package thinking
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxSignatures bounds the number of remembered signatures
+const maxSignatures = 20000
+
+// maxWatchedBody is the largest non-streaming response scanned for signatures
+const maxWatchedBody = 8 << 20
+
+// origins remembers which upstream model produced each thinking signature.
+// Signatures are only accepted by the model that issued them. With a
+// signatures file they survive restarts, so conversations carried over keep
+// their origins.
+var origins = struct {
+	sync.Mutex
+	models map[string]string
+	path   string
+	dirty  bool
+}{models: make(map[string]string)}
+
+// LoadSignatures restores the origins saved in the file at path, which
+// SaveSignatures writes from then on. A missing file is not an error. It
+// returns the number of signatures loaded.
+func LoadSignatures(path string) (int, error) {
+	origins.Lock()
+	defer origins.Unlock()
+	origins.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var saved map[string]string
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for key, model := range saved {
+		if len(origins.models) >= maxSignatures {
+			break
+		}
+		origins.models[key] = model
+	}
+	return len(saved), nil
+}
+
+// SaveSignatures writes the origins to the file given to LoadSignatures if
+// they changed since the last save
+func SaveSignatures() error {
+	origins.Lock()
+	if origins.path == "" || !origins.dirty {
+		origins.Unlock()
+		return nil
+	}
+	path := origins.path
+	data, err := json.Marshal(origins.models)
+	origins.dirty = false
+	origins.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func signatureKey(signature string) string {
+	sum := sha256.Sum256([]byte(signature))
+	return hex.EncodeToString(sum[:16])
+}
+
+// remember records that model produced signature
+func remember(signature, model string) {
+	if signature == "" || model == "" {
+		return
+	}
+	origins.Lock()
+	defer origins.Unlock()
+	if len(origins.models) >= maxSignatures {
+		// Forget an arbitrary half; old conversations rarely come back
+		for key := range origins.models {
+			if len(origins.models) < maxSignatures/2 {
+				break
+			}
+			delete(origins.models, key)
+		}
+	}
+	origins.models[signatureKey(signature)] = model
+	origins.dirty = true
+}
+
+// origin returns the model that produced signature, if known
+func origin(signature string) (string, bool) {
+	origins.Lock()
+	defer origins.Unlock()
+	model, ok := origins.models[signatureKey(signature)]
+	return model, ok
+}
+
+// block is the part of a content block that carries a signature
+type block struct {
+	Type      string `json:"type"`
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Data      string `json:"data,omitempty"` // redacted_thinking
+}
+
+// signature returns the opaque value upstream validates
+func (b *block) signature() string {
+	if b.Type == "redacted_thinking" {
+		return b.Data
+	}
+	return b.Signature
+}
+
+// Watch records the signatures of thinking blocks in a Messages response
+// from model as it is read, streaming or not
+func Watch(body io.ReadCloser, model string, stream bool) io.ReadCloser {
+	return &watcher{body: body, model: model, stream: stream}
+}
+
+type watcher struct {
+	body   io.ReadCloser
+	model  string
+	stream bool
+	buf    bytes.Buffer
+	done   bool
+}
+
+func (w *watcher) Read(p []byte) (int, error) {
+	n, err := w.body.Read(p)
+	if n > 0 && !w.done {
+		w.buf.Write(p[:n])
+		if w.stream {
+			w.scanLines()
+		} else if w.buf.Len() > maxWatchedBody {
+			w.done = true
+			w.buf = bytes.Buffer{}
+		}
+	}
+	if err == io.EOF && !w.stream && !w.done {
+		w.done = true
+		w.scanMessage(w.buf.Bytes())
+		w.buf = bytes.Buffer{}
+	}
+	return n, err
+}
+
+// scanLines handles the complete SSE lines buffered so far
+func (w *watcher) scanLines() {
+	data := w.buf.Bytes()
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data[:end]))
+	scanner.Buffer(nil, len(data))
+	for scanner.Scan() {
+		line, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok || !bytes.Contains(line, []byte(`"signature`)) && !bytes.Contains(line, []byte(`"redacted_thinking"`)) {
+			continue
+		}
+		var event struct {
+			ContentBlock *block `json:"content_block"`
+			Delta        *struct {
+				Type      string `json:"type"`
+				Signature string `json:"signature"`
+			} `json:"delta"`
+		}
+		if json.Unmarshal(bytes.TrimSpace(line), &event) != nil {
+			continue
+		}
+		if event.Delta != nil && event.Delta.Type == "signature_delta" {
+			remember(event.Delta.Signature, w.model)
+		}
+		if event.ContentBlock != nil {
+			remember(event.ContentBlock.signature(), w.model)
+		}
+	}
+	w.buf.Next(end + 1)
+}
+
+// scanMessage handles a complete non-streaming message
+func (w *watcher) scanMessage(body []byte) {
+	var message struct {
+		Content []block `json:"content"`
+	}
+	if json.Unmarshal(body, &message) != nil {
+		return
+	}
+	for _, b := range message.Content {
+		remember(b.signature(), w.model)
+	}
+}
+
+func (w *watcher) Close() error {
+	return w.body.Close()
+}
@@ -0,0 +1,158 @@
+package thinking
+
+import (
+	"encoding/json"
+	"strings"
+
+	"cliproxy-middleware/internal/models"
+)
+
+// Styles of reasoning configuration, from the model registry
+const (
+	None   = models.ThinkingNone
+	Claude = models.ThinkingClaude
+	Gemini = models.ThinkingGemini
+)
+
+// Limits describes the reasoning support of an upstream model
+type Limits = models.Thinking
+
+// For returns the reasoning support of model from the model registry.
+// Unknown models ending in -thinking are treated as Claude thinking models;
+// other unknown models are left alone.
+func For(model string) (Limits, bool) {
+	if c, ok := models.Lookup(model); ok && c.Thinking != nil && c.Thinking.Style != "" {
+		return *c.Thinking, true
+	}
+	if strings.HasSuffix(model, "-thinking") {
+		return Limits{Style: Claude, MinBudget: 1024, MaxBudget: 32000, Required: true}, true
+	}
+	return Limits{}, false
+}
+
+// config is the Anthropic thinking block
+type config struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// Translate rewrites the thinking block of a Messages request for model:
+// it is dropped for models without extended thinking, clamped to the model's
+// budget limits, and added with defaultBudget for Claude thinking models when
+// missing (0 disables adding). An explicit "disabled" is left for Claude
+// models to accept or reject. Gemini models get their budget in the same
+// block, which upstream converts to thinkingConfig. It returns a short
+// description of the change, or "" if the request was left as is.
+func Translate(request map[string]json.RawMessage, model string, defaultBudget int) string {
+	limits, known := For(model)
+	if !known {
+		return ""
+	}
+
+	var thinking *config
+	if raw, ok := request["thinking"]; ok && string(raw) != "null" {
+		if json.Unmarshal(raw, &thinking) != nil {
+			thinking = nil
+		}
+	}
+	var maxTokens int
+	json.Unmarshal(request["max_tokens"], &maxTokens)
+
+	switch limits.Style {
+	case None:
+		if _, ok := request["thinking"]; !ok {
+			return ""
+		}
+		delete(request, "thinking")
+		return "dropped"
+
+	case Gemini:
+		if thinking == nil {
+			return ""
+		}
+		budget := thinking.BudgetTokens
+		if thinking.Type != "enabled" {
+			if !limits.CanDisable {
+				// Thinking can't be turned off; spend as little as allowed
+				budget = limits.MinBudget
+			} else {
+				budget = 0
+			}
+		}
+		budget = clamp(budget, limits.MinBudget, limits.MaxBudget)
+		if thinking.Type == "enabled" && maxTokens > 0 {
+			budget = min(budget, max(maxTokens-1, limits.MinBudget))
+		}
+		translated := config{Type: "enabled", BudgetTokens: budget}
+		if budget == 0 {
+			translated = config{Type: "disabled"}
+		}
+		if translated == *thinking {
+			return ""
+		}
+		request["thinking"], _ = json.Marshal(translated)
+		return "clamped"
+
+	case Claude:
+		action := "clamped"
+		switch {
+		case thinking != nil && thinking.Type == "enabled":
+		case thinking == nil && limits.Required && defaultBudget > 0 && !forcesToolUse(request) && !continuesPlainToolUse(request):
+			thinking = &config{Type: "enabled", BudgetTokens: defaultBudget}
+			action = "added"
+		default:
+			return ""
+		}
+
+		budget := clamp(thinking.BudgetTokens, limits.MinBudget, limits.MaxBudget)
+		// budget_tokens must stay below max_tokens; make room for the
+		// answer the client asked for rather than starving the reasoning
+		if maxTokens > 0 && budget >= maxTokens {
+			request["max_tokens"], _ = json.Marshal(budget + maxTokens)
+		}
+		if action == "clamped" && budget == thinking.BudgetTokens && budget < maxTokens {
+			return ""
+		}
+		request["thinking"], _ = json.Marshal(config{Type: "enabled", BudgetTokens: budget})
+		// Sampling overrides are rejected alongside thinking
+		delete(request, "top_k")
+		if temperature, ok := request["temperature"]; ok && string(temperature) != "1" {
+			delete(request, "temperature")
+		}
+		return action
+	}
+	return ""
+}
+
+// forcesToolUse reports whether tool_choice requires a tool call, which
+// extended thinking doesn't support
+func forcesToolUse(request map[string]json.RawMessage) bool {
+	var choice struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(request["tool_choice"], &choice)
+	return choice.Type == "any" || choice.Type == "tool"
+}
+
+// continuesPlainToolUse reports whether the last assistant turn calls tools
+// without opening with thinking. Upstream rejects enabling thinking for the
+// continuation of such a turn.
+func continuesPlainToolUse(request map[string]json.RawMessage) bool {
+	var messages []map[string]json.RawMessage
+	json.Unmarshal(request["messages"], &messages)
+	for i := len(messages) - 1; i >= 0; i-- {
+		var role string
+		json.Unmarshal(messages[i]["role"], &role)
+		if role != "assistant" {
+			continue
+		}
+		var content []json.RawMessage
+		json.Unmarshal(messages[i]["content"], &content)
+		return usesTools(messages[i]) && !opensWithThinking(content)
+	}
+	return false
+}
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
@@ -0,0 +1,58 @@
+package thinking
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	const (
+		claude = "test-model-thinking"
+		pro    = "gemini-3-pro-high" // 128-32768, can't be disabled
+		flash  = "gemini-3-flash"    // 0-24576
+		none   = "gemini-claude-sonnet-4-5"
+	)
+	toolTurn := `"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":[{"type":"tool_use","id":"t","name":"f","input":{}}]},{"role":"user","content":[{"type":"tool_result","tool_use_id":"t","content":"ok"}]}]`
+	for _, tc := range []struct {
+		name, model, request, wantAction, wantThinking string
+		wantMaxTokens                                  string
+	}{
+		{"added when missing", claude, `{"max_tokens":64000}`, "added", `{"type":"enabled","budget_tokens":8000}`, "64000"},
+		{"explicit disable kept", claude, `{"max_tokens":64000,"thinking":{"type":"disabled"}}`, "", `{"type":"disabled"}`, "64000"},
+		{"budget clamped", claude, `{"max_tokens":64000,"thinking":{"type":"enabled","budget_tokens":100}}`, "clamped", `{"type":"enabled","budget_tokens":1024}`, "64000"},
+		{"max_tokens raised above budget", claude, `{"max_tokens":2000,"thinking":{"type":"enabled","budget_tokens":4000}}`, "clamped", `{"type":"enabled","budget_tokens":4000}`, "6000"},
+		{"not added when forcing a tool", claude, `{"max_tokens":64000,"tool_choice":{"type":"any"}}`, "", ``, "64000"},
+		{"not added when continuing a plain tool call", claude, `{"max_tokens":64000,` + toolTurn + `}`, "", ``, "64000"},
+
+		{"gemini within limits", pro, `{"max_tokens":64000,"thinking":{"type":"enabled","budget_tokens":4000}}`, "", `{"type":"enabled","budget_tokens":4000}`, "64000"},
+		{"gemini clamped to maximum", pro, `{"max_tokens":64000,"thinking":{"type":"enabled","budget_tokens":50000}}`, "clamped", `{"type":"enabled","budget_tokens":32768}`, "64000"},
+		{"gemini kept below max_tokens", pro, `{"max_tokens":1000,"thinking":{"type":"enabled","budget_tokens":4000}}`, "clamped", `{"type":"enabled","budget_tokens":999}`, "1000"},
+		{"gemini disable becomes minimum", pro, `{"max_tokens":1000,"thinking":{"type":"disabled"}}`, "clamped", `{"type":"enabled","budget_tokens":128}`, "1000"},
+		{"gemini disable kept", flash, `{"max_tokens":1000,"thinking":{"type":"disabled"}}`, "", `{"type":"disabled"}`, "1000"},
+		{"gemini zero budget disables", flash, `{"max_tokens":1000,"thinking":{"type":"enabled","budget_tokens":0}}`, "clamped", `{"type":"disabled"}`, "1000"},
+		{"gemini not added", pro, `{"max_tokens":1000}`, "", ``, "1000"},
+
+		{"dropped for none", none, `{"max_tokens":1000,"thinking":{"type":"enabled","budget_tokens":4000}}`, "dropped", ``, "1000"},
+		{"none without thinking", none, `{"max_tokens":1000}`, "", ``, "1000"},
+		{"unknown model untouched", "other-model", `{"max_tokens":1000,"thinking":{"type":"enabled","budget_tokens":4000}}`, "", `{"type":"enabled","budget_tokens":4000}`, "1000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var request map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tc.request), &request); err != nil {
+				t.Fatal(err)
+			}
+			if got := Translate(request, tc.model, 8000); got != tc.wantAction {
+				t.Fatalf("action = %q, want %q", got, tc.wantAction)
+			}
+			if got := string(request["thinking"]); got != tc.wantThinking {
+				t.Fatalf("thinking = %s, want %s", got, tc.wantThinking)
+			}
+			if got := string(request["max_tokens"]); got != tc.wantMaxTokens {
+				t.Fatalf("max_tokens = %s, want %s", got, tc.wantMaxTokens)
+			}
+			if _, ok := request["thinkingConfig"]; ok {
+				t.Fatal("thinkingConfig added to a Messages request")
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package toolnames
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"cliproxy-middleware/internal/sse"
+)
+
+// Gemini function names: a letter or underscore, then letters, digits and
+// underscores, at most 64 characters. Dots, colons and dashes are allowed by
+// some Gemini versions and rejected by others, so they are avoided too.
+const maxNameLength = 64
+
+var (
+	validName   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	invalidRune = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// Applies reports whether tool names are sanitized for an upstream model.
+// Antigravity serves every model through Gemini function declarations and
+// names them all gemini-*, Claude ones included (gemini-claude-sonnet-4-5),
+// so the prefix covers every Antigravity-mapped model. Other models are
+// passed through to an upstream that takes their names as they are.
+func Applies(model string) bool {
+	return strings.HasPrefix(model, "gemini-")
+}
+
+// Mapping holds the aliases given to the tools of one request
+type Mapping struct {
+	aliases   map[string]string // original name -> alias
+	originals map[string]string // alias -> original name
+}
+
+// Len returns the number of renamed tools
+func (m *Mapping) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.aliases)
+}
+
+// alias returns a valid name for name: invalid characters become
+// underscores, and names that were changed or are too long get a short hash
+// of the original so different tools never share an alias
+func alias(name string) string {
+	if validName.MatchString(name) && len(name) <= maxNameLength {
+		return name
+	}
+	safe := invalidRune.ReplaceAllString(name, "_")
+	if safe == "" || safe[0] >= '0' && safe[0] <= '9' {
+		safe = "_" + safe
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "_" + hex.EncodeToString(sum[:4])
+	if len(safe) > maxNameLength-len(suffix) {
+		safe = safe[:maxNameLength-len(suffix)]
+	}
+	return safe + suffix
+}
+
+// Format is the API format of a request
+type Format int
+
+const (
+	Anthropic Format = iota // tools[].name, tool_use blocks
+	OpenAI                  // tools[].function.name, tool_calls
+)
+
+// Sanitize renames the tools of a request whose names Gemini rejects if
+// rename is set, together with their calls earlier in the conversation and
+// tool_choice, and truncates descriptions longer than maxDescription
+// characters (0 keeps them). It returns the mapping for restoring names in
+// the response, nil if no tool was renamed, and the number of descriptions
+// truncated.
+func Sanitize(request map[string]json.RawMessage, format Format, rename bool, maxDescription int) (*Mapping, int) {
+	var tools []map[string]any
+	if json.Unmarshal(request["tools"], &tools) != nil || len(tools) == 0 {
+		return nil, 0
+	}
+
+	m := &Mapping{aliases: make(map[string]string), originals: make(map[string]string)}
+	truncated := 0
+	for _, tool := range tools {
+		fields := tool
+		if format == OpenAI {
+			fields, _ = tool["function"].(map[string]any)
+			if fields == nil {
+				continue
+			}
+		}
+		if name, ok := fields["name"].(string); ok && rename {
+			if a := alias(name); a != name {
+				m.aliases[name] = a
+				m.originals[a] = name
+				fields["name"] = a
+			}
+		}
+		if description, ok := fields["description"].(string); ok && maxDescription > 0 && utf8.RuneCountInString(description) > maxDescription {
+			fields["description"] = truncate(description, maxDescription)
+			truncated++
+		}
+	}
+	if len(m.aliases) == 0 && truncated == 0 {
+		return nil, 0
+	}
+	request["tools"], _ = json.Marshal(tools)
+	if len(m.aliases) == 0 {
+		return nil, truncated
+	}
+
+	// Earlier calls and tool_choice must use the names the model now sees
+	if raw, ok := request["messages"]; ok {
+		if out := renameAll(raw, m.aliases, renameMessages); out != nil {
+			request["messages"] = out
+		}
+	}
+	if raw, ok := request["tool_choice"]; ok {
+		if out := renameAll(raw, m.aliases, renameToolChoice); out != nil {
+			request["tool_choice"] = out
+		}
+	}
+	return m, truncated
+}
+
+// truncate shortens s to at most n characters, marking the cut
+func truncate(s string, n int) string {
+	const marker = " [...]"
+	keep := max(n-len(marker), 0)
+	for i := range s {
+		if keep == 0 {
+			return s[:i] + marker
+		}
+		keep--
+	}
+	return s
+}
+
+// renameAll decodes raw, renames the tool names that fn finds in it and
+// returns the new JSON, or nil if nothing changed
+func renameAll(raw []byte, names map[string]string, fn func(any, map[string]string) bool) []byte {
+	var v any
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if decoder.Decode(&v) != nil {
+		return nil
+	}
+	if !fn(v, names) {
+		return nil
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// renameMessages renames the calls in a messages array
+func renameMessages(v any, names map[string]string) bool {
+	messages, _ := v.([]any)
+	changed := false
+	for _, message := range messages {
+		if renameMessage(message, names) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// renameMessage renames the calls of one message: Anthropic tool_use
+// content blocks and OpenAI tool_calls. Tool inputs and results are left
+// alone, even if they contain a "name" that matches a tool.
+func renameMessage(v any, names map[string]string) bool {
+	message, _ := v.(map[string]any)
+	if message == nil {
+		return false
+	}
+	changed := false
+	blocks, _ := message["content"].([]any)
+	for _, block := range blocks {
+		if renameBlock(block, names) {
+			changed = true
+		}
+	}
+	calls, _ := message["tool_calls"].([]any)
+	for _, call := range calls {
+		call, _ := call.(map[string]any)
+		if call != nil && renameField(call["function"], names) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// renameBlock renames a tool_use content block
+func renameBlock(v any, names map[string]string) bool {
+	block, _ := v.(map[string]any)
+	if block == nil || block["type"] != "tool_use" {
+		return false
+	}
+	return renameField(block, names)
+}
+
+// renameToolChoice renames an Anthropic {"type":"tool","name":...} or
+// OpenAI {"type":"function","function":{"name":...}} tool_choice
+func renameToolChoice(v any, names map[string]string) bool {
+	choice, _ := v.(map[string]any)
+	if choice == nil {
+		return false
+	}
+	return renameField(choice, names) || renameField(choice["function"], names)
+}
+
+// renameResponse renames the calls in a response body or stream event:
+// an Anthropic message or content_block_start, or OpenAI choices
+func renameResponse(v any, names map[string]string) bool {
+	body, _ := v.(map[string]any)
+	if body == nil {
+		return false
+	}
+	changed := renameMessage(body, names)
+	if renameBlock(body["content_block"], names) {
+		changed = true
+	}
+	choices, _ := body["choices"].([]any)
+	for _, choice := range choices {
+		choice, _ := choice.(map[string]any)
+		if choice == nil {
+			continue
+		}
+		for _, key := range []string{"message", "delta"} {
+			if renameMessage(choice[key], names) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// renameField replaces the "name" of v if it is a key of names
+func renameField(v any, names map[string]string) bool {
+	fields, _ := v.(map[string]any)
+	if fields == nil {
+		return false
+	}
+	name, ok := fields["name"].(string)
+	if !ok {
+		return false
+	}
+	to, ok := names[name]
+	if !ok {
+		return false
+	}
+	fields["name"] = to
+	return true
+}
+
+// mentions reports whether data contains any alias, as a cheap check before
+// decoding it
+func (m *Mapping) mentions(data []byte) bool {
+	for a := range m.originals {
+		if bytes.Contains(data, []byte(a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RestoreJSON puts the original tool names back into a response body
+func (m *Mapping) RestoreJSON(body []byte) []byte {
+	if !m.mentions(body) {
+		return body
+	}
+	if out := renameAll(body, m.originals, renameResponse); out != nil {
+		return out
+	}
+	return body
+}
+
+// WrapStream puts the original tool names back into the events of an SSE
+// body: Anthropic content_block_start and OpenAI tool_calls deltas
+func (m *Mapping) WrapStream(body io.ReadCloser) io.ReadCloser {
+	return sse.RewriteData(body, func(data []byte) []byte {
+		if !m.mentions(data) {
+			return nil
+		}
+		return renameAll(data, m.originals, renameResponse)
+	})
+}
+
+type contextKey struct{}
+
+// With returns a context carrying the mapping
+func With(ctx context.Context, m *Mapping) context.Context {
+	return context.WithValue(ctx, contextKey{}, m)
+}
+
+// From returns the mapping in ctx, or nil
+func From(ctx context.Context) *Mapping {
+	m, _ := ctx.Value(contextKey{}).(*Mapping)
+	return m
+}
@@ -0,0 +1,156 @@
+package toolnames
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestApplies(t *testing.T) {
+	for model, want := range map[string]bool{
+		"gemini-3-flash":                  true,
+		"gemini-claude-sonnet-4-5":        true,
+		"gemini-claude-opus-4-5-thinking": true,
+		"claude-sonnet-4-5-20250929":      false,
+		"gpt-5":                           false,
+	} {
+		if got := Applies(model); got != want {
+			t.Errorf("Applies(%q) = %v, want %v", model, got, want)
+		}
+	}
+}
+
+func TestAlias(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"read_file", "read_file"},
+		{"mcp.fire-crawl:scrape", "mcp_fire_crawl_scrape_"},
+		{"9lives", "_9lives_"},
+		{strings.Repeat("a", 70), strings.Repeat("a", 55) + "_"},
+	} {
+		got := alias(tc.name)
+		if !strings.HasPrefix(got, tc.want) || !validName.MatchString(got) || len(got) > maxNameLength {
+			t.Errorf("alias(%q) = %q, want a valid name starting with %q", tc.name, got, tc.want)
+		}
+	}
+	if alias("a.b") == alias("a-b") {
+		t.Errorf("a.b and a-b share the alias %q", alias("a.b"))
+	}
+}
+
+func decode(t *testing.T, s string) map[string]json.RawMessage {
+	t.Helper()
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s), &request); err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func TestSanitizeRenamesOnlyToolNames(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		format   Format
+		request  string
+		messages string
+		choice   string
+	}{
+		{
+			name:   "anthropic",
+			format: Anthropic,
+			request: `{"tools":[{"name":"fs.read"}],"tool_choice":{"type":"tool","name":"fs.read"},"messages":[
+				{"role":"assistant","content":[{"type":"tool_use","id":"t1","name":"fs.read","input":{"name":"fs.read"}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":[{"type":"text","text":"x","name":"fs.read"}]}]}]}`,
+			messages: `[{"content":[{"id":"t1","input":{"name":"fs.read"},"name":"ALIAS","type":"tool_use"}],"role":"assistant"},` +
+				`{"content":[{"content":[{"name":"fs.read","text":"x","type":"text"}],"tool_use_id":"t1","type":"tool_result"}],"role":"user"}]`,
+			choice: `{"name":"ALIAS","type":"tool"}`,
+		},
+		{
+			name:   "openai",
+			format: OpenAI,
+			request: `{"tools":[{"type":"function","function":{"name":"fs.read"}}],"tool_choice":{"type":"function","function":{"name":"fs.read"}},"messages":[
+				{"role":"assistant","tool_calls":[{"id":"c1","type":"function","function":{"name":"fs.read","arguments":"{}"}}]},
+				{"role":"tool","tool_call_id":"c1","name":"fs.read","content":"x"}]}`,
+			messages: `[{"role":"assistant","tool_calls":[{"function":{"arguments":"{}","name":"ALIAS"},"id":"c1","type":"function"}]},` +
+				`{"content":"x","name":"fs.read","role":"tool","tool_call_id":"c1"}]`,
+			choice: `{"function":{"name":"ALIAS"},"type":"function"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := decode(t, tc.request)
+			m, _ := Sanitize(request, tc.format, true, 0)
+			if m.Len() != 1 {
+				t.Fatalf("renamed %d tools, want 1", m.Len())
+			}
+			a := alias("fs.read")
+			if got, want := string(request["messages"]), strings.ReplaceAll(tc.messages, "ALIAS", a); got != want {
+				t.Errorf("messages = %s\nwant %s", got, want)
+			}
+			if got, want := string(request["tool_choice"]), strings.ReplaceAll(tc.choice, "ALIAS", a); got != want {
+				t.Errorf("tool_choice = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestSanitizeTruncatesDescriptions(t *testing.T) {
+	request := decode(t, `{"tools":[{"name":"a","description":"0123456789abcdef"},{"name":"b","description":"short"}]}`)
+	m, truncated := Sanitize(request, Anthropic, true, 12)
+	if m != nil || truncated != 1 {
+		t.Fatalf("mapping = %v, truncated = %d; want nil, 1", m, truncated)
+	}
+	if got, want := string(request["tools"]), `[{"description":"012345 [...]","name":"a"},{"description":"short","name":"b"}]`; got != want {
+		t.Fatalf("tools = %s, want %s", got, want)
+	}
+
+	// The limit counts characters, not bytes
+	request = decode(t, `{"tools":[{"name":"a","description":"Größenänderung"},{"name":"b","description":"日本語の説明文"}]}`)
+	_, truncated = Sanitize(request, Anthropic, true, 12)
+	if truncated != 1 {
+		t.Fatalf("truncated = %d, want only the description over 12 characters", truncated)
+	}
+	if got, want := string(request["tools"]), `[{"description":"Größen [...]","name":"a"},{"description":"日本語の説明文","name":"b"}]`; got != want {
+		t.Fatalf("tools = %s, want %s", got, want)
+	}
+}
+
+func TestRestoreJSON(t *testing.T) {
+	request := decode(t, `{"tools":[{"name":"fs.read"}]}`)
+	m, _ := Sanitize(request, Anthropic, true, 0)
+	a := alias("fs.read")
+
+	body := `{"content":[{"type":"text","text":"calling ` + a + `"},{"type":"tool_use","id":"t1","name":"` + a + `","input":{"name":"` + a + `"}}]}`
+	want := `{"content":[{"text":"calling ` + a + `","type":"text"},{"id":"t1","input":{"name":"` + a + `"},"name":"fs.read","type":"tool_use"}]}`
+	if got := string(m.RestoreJSON([]byte(body))); got != want {
+		t.Fatalf("restored = %s\nwant %s", got, want)
+	}
+
+	chat := `{"choices":[{"message":{"tool_calls":[{"function":{"name":"` + a + `","arguments":"{}"}}]}}]}`
+	if got := string(m.RestoreJSON([]byte(chat))); !strings.Contains(got, `"name":"fs.read"`) {
+		t.Fatalf("chat completion not restored: %s", got)
+	}
+}
+
+func TestWrapStream(t *testing.T) {
+	request := decode(t, `{"tools":[{"name":"fs.read"}]}`)
+	m, _ := Sanitize(request, Anthropic, true, 0)
+	a := alias("fs.read")
+
+	stream := "event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"tool_use\",\"id\":\"t1\",\"name\":\"" + a + "\",\"input\":{}}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{\\\"name\\\":\\\"" + a + "\\\"}\"}}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"name\":\"" + a + "\"}}]}}]}\n\n"
+	out, err := io.ReadAll(m.WrapStream(io.NopCloser(strings.NewReader(stream))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(out)
+	if strings.Count(got, `"name":"fs.read"`) != 2 {
+		t.Fatalf("tool names not restored: %s", got)
+	}
+	// Arguments are the model's own output and keep what it wrote
+	if !strings.Contains(got, `\"name\":\"`+a+`\"`) {
+		t.Fatalf("input delta rewritten: %s", got)
+	}
+}
@@ -0,0 +1,96 @@
+package toolprune
+
+import (
+	"math"
+	"unicode"
+)
+
+// BM25 parameters: term frequency saturation and length normalization
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// stopwords are too common in tool descriptions and prompts to rank by
+var stopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "this": true, "that": true,
+	"from": true, "into": true, "are": true, "is": true, "to": true, "of": true,
+	"in": true, "on": true, "or": true, "an": true, "be": true, "it": true,
+	"as": true, "by": true, "if": true, "use": true, "can": true, "you": true,
+	"your": true, "will": true, "when": true, "please": true,
+}
+
+// tokenize splits text into lowercase terms, breaking on punctuation and
+// camelCase boundaries so "readFile" and "read_file" both give "read", "file"
+func tokenize(text string) []string {
+	var terms []string
+	var current []rune
+	flush := func() {
+		if len(current) > 1 {
+			if term := string(current); !stopwords[term] {
+				terms = append(terms, term)
+			}
+		}
+		current = current[:0]
+	}
+	var prev rune
+	for _, r := range text {
+		switch {
+		case unicode.IsUpper(r):
+			if unicode.IsLower(prev) {
+				flush()
+			}
+			current = append(current, unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			current = append(current, r)
+		default:
+			flush()
+		}
+		prev = r
+	}
+	flush()
+	return terms
+}
+
+// rank scores each document against query with BM25
+func rank(documents [][]string, query []string) []float64 {
+	scores := make([]float64, len(documents))
+	if len(documents) == 0 || len(query) == 0 {
+		return scores
+	}
+
+	frequencies := make([]map[string]int, len(documents))
+	documentFrequency := make(map[string]int)
+	total := 0
+	for i, terms := range documents {
+		frequencies[i] = make(map[string]int)
+		for _, term := range terms {
+			if frequencies[i][term] == 0 {
+				documentFrequency[term]++
+			}
+			frequencies[i][term]++
+		}
+		total += len(terms)
+	}
+	averageLength := math.Max(float64(total)/float64(len(documents)), 1)
+
+	n := float64(len(documents))
+	seen := make(map[string]bool)
+	for _, term := range query {
+		if seen[term] || documentFrequency[term] == 0 {
+			continue
+		}
+		seen[term] = true
+		df := float64(documentFrequency[term])
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for i, terms := range documents {
+			tf := float64(frequencies[i][term])
+			if tf == 0 {
+				continue
+			}
+			norm := k1 * (1 - b + b*float64(len(terms))/averageLength)
+			scores[i] += idf * tf * (k1 + 1) / (tf + norm)
+		}
+	}
+	return scores
+}
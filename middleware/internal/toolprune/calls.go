@@ -0,0 +1,94 @@
+package toolprune
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"cliproxy-middleware/internal/sse"
+)
+
+// Called returns the name of a pruned tool called in a Messages response or
+// a content_block_start event, or "" if there is none
+func (p *Pruned) Called(data []byte) string {
+	if !p.mentions(data) {
+		return ""
+	}
+	var response struct {
+		Type         string          `json:"type"`
+		Content      []toolUse       `json:"content"`
+		ContentBlock json.RawMessage `json:"content_block"`
+	}
+	if json.Unmarshal(data, &response) != nil {
+		return ""
+	}
+	blocks := response.Content
+	var block toolUse
+	if json.Unmarshal(response.ContentBlock, &block) == nil {
+		blocks = append(blocks, block)
+	}
+	for _, block := range blocks {
+		if block.Type == "tool_use" && p.names[block.Name] {
+			return block.Name
+		}
+	}
+	return ""
+}
+
+type toolUse struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// mentions reports whether data contains any pruned name, as a cheap check
+// before decoding it
+func (p *Pruned) mentions(data []byte) bool {
+	for name := range p.names {
+		if bytes.Contains(data, []byte(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// WrapStream ends an SSE body with the frame returned by errorFrame when the
+// model starts a call to a pruned tool
+func (p *Pruned) WrapStream(body io.ReadCloser, errorFrame func(name string) []byte) io.ReadCloser {
+	return &callGuard{pruned: p, body: body, events: sse.NewReader(body), errorFrame: errorFrame}
+}
+
+type callGuard struct {
+	pruned     *Pruned
+	body       io.ReadCloser
+	events     *sse.Reader
+	errorFrame func(name string) []byte
+	pending    []byte
+	done       bool
+}
+
+func (g *callGuard) Read(p []byte) (int, error) {
+	for len(g.pending) == 0 {
+		if g.done {
+			return 0, io.EOF
+		}
+		ev, err := g.events.Next()
+		if err != nil {
+			return 0, err
+		}
+		if ev.Name == "content_block_start" {
+			if name := g.pruned.Called(ev.Data); name != "" {
+				g.pending = g.errorFrame(name)
+				g.done = true
+				break
+			}
+		}
+		g.pending = ev.Raw
+	}
+	n := copy(p, g.pending)
+	g.pending = g.pending[n:]
+	return n, nil
+}
+
+func (g *callGuard) Close() error {
+	return g.body.Close()
+}
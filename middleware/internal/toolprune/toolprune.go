@@ -0,0 +1,197 @@
+package toolprune
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Pruned records the tools left out of a request
+type Pruned struct {
+	Total int // tools in the request
+	Kept  int // tools sent upstream
+	names map[string]bool
+}
+
+// Len returns the number of tools left out
+func (p *Pruned) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.names)
+}
+
+// Prune cuts the tools of a Messages request down to limit. Tools called
+// earlier in the conversation or named by tool_choice are always kept; the
+// rest of the room goes to the tools ranked most relevant to the latest user
+// message. Kept tools stay in their original order, and there are more than
+// limit of them only if that many are required. It returns nil if the
+// request has no more than limit tools.
+func Prune(request map[string]json.RawMessage, limit int) *Pruned {
+	var tools []map[string]json.RawMessage
+	if limit <= 0 || json.Unmarshal(request["tools"], &tools) != nil || len(tools) <= limit {
+		return nil
+	}
+
+	names := make([]string, len(tools))
+	for i, tool := range tools {
+		json.Unmarshal(tool["name"], &names[i])
+	}
+	required := usedTools(request)
+
+	keep := make([]bool, len(tools))
+	kept := 0
+	for i, name := range names {
+		if required[name] {
+			keep[i] = true
+			kept++
+		}
+	}
+
+	// Fill the remaining room by relevance; ties keep the original order
+	if kept < limit {
+		documents := make([][]string, len(tools))
+		for i, tool := range tools {
+			documents[i] = toolTerms(names[i], tool)
+		}
+		scores := rank(documents, tokenize(latestUserText(request["messages"])))
+		order := make([]int, len(tools))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return scores[order[a]] > scores[order[b]]
+		})
+		for _, i := range order {
+			if kept >= limit {
+				break
+			}
+			if !keep[i] {
+				keep[i] = true
+				kept++
+			}
+		}
+	}
+
+	p := &Pruned{Total: len(tools), Kept: kept, names: make(map[string]bool)}
+	selected := make([]map[string]json.RawMessage, 0, kept)
+	for i, tool := range tools {
+		if keep[i] {
+			selected = append(selected, tool)
+		} else {
+			p.names[names[i]] = true
+		}
+	}
+	request["tools"], _ = json.Marshal(selected)
+	return p
+}
+
+// usedTools returns the tools called earlier in the conversation or forced
+// by tool_choice
+func usedTools(request map[string]json.RawMessage) map[string]bool {
+	used := make(map[string]bool)
+	var messages []struct {
+		Content json.RawMessage `json:"content"`
+	}
+	json.Unmarshal(request["messages"], &messages)
+	for _, message := range messages {
+		var blocks []struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+		}
+		if json.Unmarshal(message.Content, &blocks) != nil {
+			continue
+		}
+		for _, block := range blocks {
+			if block.Type == "tool_use" {
+				used[block.Name] = true
+			}
+		}
+	}
+
+	var choice struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	if json.Unmarshal(request["tool_choice"], &choice) == nil && choice.Type == "tool" {
+		used[choice.Name] = true
+	}
+	return used
+}
+
+// latestUserText returns the text of the last user turn that has any,
+// skipping turns that only carry tool results
+func latestUserText(raw json.RawMessage) string {
+	var messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	json.Unmarshal(raw, &messages)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role != "user" {
+			continue
+		}
+		var text string
+		if json.Unmarshal(messages[i].Content, &text) == nil && text != "" {
+			return text
+		}
+		var blocks []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}
+		json.Unmarshal(messages[i].Content, &blocks)
+		var parts []string
+		for _, block := range blocks {
+			if block.Type == "text" && block.Text != "" {
+				parts = append(parts, block.Text)
+			}
+		}
+		if len(parts) > 0 {
+			return strings.Join(parts, "\n")
+		}
+	}
+	return ""
+}
+
+// toolTerms describes a tool for ranking: its name, counted twice, its
+// description, and the names and descriptions of its parameters
+func toolTerms(name string, tool map[string]json.RawMessage) []string {
+	nameTerms := tokenize(name)
+	terms := append(append([]string{}, nameTerms...), nameTerms...)
+
+	var description string
+	json.Unmarshal(tool["description"], &description)
+	terms = append(terms, tokenize(description)...)
+
+	var schema struct {
+		Properties map[string]struct {
+			Description string `json:"description"`
+		} `json:"properties"`
+	}
+	json.Unmarshal(tool["input_schema"], &schema)
+	for property, value := range schema.Properties {
+		terms = append(terms, tokenize(property)...)
+		terms = append(terms, tokenize(value.Description)...)
+	}
+	return terms
+}
+
+// Message explains a call to a pruned tool
+func (p *Pruned) Message(name string) string {
+	return fmt.Sprintf("The model called tool %q, which was not sent upstream: the request had %d tools and only %d were kept (-max-tools). Mention the tool in your message or raise the limit.", name, p.Total, p.Kept)
+}
+
+type contextKey struct{}
+
+// With returns a context carrying the pruned tools
+func With(ctx context.Context, p *Pruned) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// From returns the pruned tools in ctx, or nil
+func From(ctx context.Context) *Pruned {
+	p, _ := ctx.Value(contextKey{}).(*Pruned)
+	return p
+}
@@ -0,0 +1,179 @@
+package toolprune
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var tools = `[
+	{"name":"read_file","description":"Read the contents of a file from disk"},
+	{"name":"run_command","description":"Run a shell command in the terminal"},
+	{"name":"web_search","description":"Search the web for pages matching a query"},
+	{"name":"send_email","description":"Send an email message to a recipient"},
+	{"name":"create_issue","description":"Open an issue in the bug tracker","input_schema":{"properties":{"title":{"description":"Issue title"}}}}
+]`
+
+func toolNames(t *testing.T, request map[string]json.RawMessage) []string {
+	t.Helper()
+	var kept []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(request["tools"], &kept); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(kept))
+	for i, tool := range kept {
+		names[i] = tool.Name
+	}
+	return names
+}
+
+func TestPrune(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		messages string
+		choice   string
+		limit    int
+		want     []string
+		wantKept int
+	}{
+		{
+			name:     "most relevant kept in original order",
+			messages: `[{"role":"user","content":"search the web, then email me what you find"}]`,
+			limit:    2,
+			want:     []string{"web_search", "send_email"},
+		},
+		{
+			name:     "latest text turn ranks, tool results skipped",
+			messages: `[{"role":"user","content":"send an email"},{"role":"user","content":[{"type":"text","text":"file a bug issue"}]},{"role":"user","content":[{"type":"tool_result","tool_use_id":"t","content":"email"}]}]`,
+			limit:    1,
+			want:     []string{"create_issue"},
+		},
+		{
+			name: "earlier calls and tool_choice are kept",
+			messages: `[{"role":"user","content":"search the web"},
+				{"role":"assistant","content":[{"type":"tool_use","id":"t","name":"run_command","input":{}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"t","content":"ok"}]}]`,
+			choice: `{"type":"tool","name":"read_file"}`,
+			limit:  3,
+			want:   []string{"read_file", "run_command", "web_search"},
+		},
+		{
+			name: "required tools may exceed the limit",
+			messages: `[{"role":"assistant","content":[{"type":"tool_use","id":"a","name":"run_command","input":{}},{"type":"tool_use","id":"b","name":"send_email","input":{}}]},
+				{"role":"user","content":"search the web"}]`,
+			choice:   `{"type":"tool","name":"read_file"}`,
+			limit:    2,
+			want:     []string{"read_file", "run_command", "send_email"},
+			wantKept: 3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := map[string]json.RawMessage{"tools": json.RawMessage(tools), "messages": json.RawMessage(tc.messages)}
+			if tc.choice != "" {
+				request["tool_choice"] = json.RawMessage(tc.choice)
+			}
+			p := Prune(request, tc.limit)
+			if p == nil {
+				t.Fatal("nothing pruned")
+			}
+			if got := toolNames(t, request); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("kept %v, want %v", got, tc.want)
+			}
+			wantKept := tc.wantKept
+			if wantKept == 0 {
+				wantKept = tc.limit
+			}
+			if p.Total != 5 || p.Kept != wantKept || p.Len() != 5-wantKept {
+				t.Fatalf("pruned = %d of %d kept, %d left out", p.Kept, p.Total, p.Len())
+			}
+		})
+	}
+}
+
+func TestPruneUnderLimit(t *testing.T) {
+	request := map[string]json.RawMessage{"tools": json.RawMessage(tools)}
+	if p := Prune(request, 5); p != nil {
+		t.Fatalf("pruned %+v at the limit", p)
+	}
+	if p := Prune(request, 0); p != nil {
+		t.Fatalf("pruned %+v without a limit", p)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	for text, want := range map[string][]string{
+		"readFile":              {"read", "file"},
+		"read_file":             {"read", "file"},
+		"Use the HTTP client":   {"http", "client"},
+		"mcp.fire-crawl:scrape": {"mcp", "fire", "crawl", "scrape"},
+	} {
+		if got := tokenize(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("tokenize(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestRankPrefersRareTerms(t *testing.T) {
+	documents := [][]string{
+		{"file", "read"},
+		{"file", "write"},
+		{"file", "delete"},
+	}
+	scores := rank(documents, []string{"file", "write"})
+	if !(scores[1] > scores[0] && scores[0] == scores[2]) {
+		t.Fatalf("scores = %v, want the write document first and a tie behind it", scores)
+	}
+	if scores := rank(documents, nil); scores[0] != 0 {
+		t.Fatalf("empty query scored %v", scores)
+	}
+}
+
+func pruned(names ...string) *Pruned {
+	p := &Pruned{Total: 10, Kept: 10 - len(names), names: make(map[string]bool)}
+	for _, name := range names {
+		p.names[name] = true
+	}
+	return p
+}
+
+func TestCalled(t *testing.T) {
+	p := pruned("send_email")
+	for body, want := range map[string]string{
+		`{"type":"message","content":[{"type":"text","text":"ok"},{"type":"tool_use","name":"send_email"}]}`:         "send_email",
+		`{"type":"message","content":[{"type":"tool_use","name":"read_file"}]}`:                                      "",
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","name":"send_email"}}`:           "send_email",
+		`{"type":"message","content":[{"type":"text","text":"I can't call send_email"}]}`:                            "",
+		`{"type":"content_block_delta","delta":{"type":"input_json_delta","partial_json":"{\"tool\":\"send_email"}}`: "",
+	} {
+		if got := p.Called([]byte(body)); got != want {
+			t.Errorf("Called(%s) = %q, want %q", body, got, want)
+		}
+	}
+}
+
+func TestWrapStreamStopsAtPrunedCall(t *testing.T) {
+	stream := "event: message_start\ndata: {\"type\":\"message_start\"}\n\n" +
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"tool_use\",\"name\":\"send_email\"}}\n\n" +
+		"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n"
+	body := pruned("send_email").WrapStream(io.NopCloser(strings.NewReader(stream)), func(name string) []byte {
+		return []byte("event: error\ndata: " + name + "\n\n")
+	})
+	out, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "event: message_start\ndata: {\"type\":\"message_start\"}\n\nevent: error\ndata: send_email\n\n"
+	if string(out) != want {
+		t.Fatalf("stream = %q\nwant %q", out, want)
+	}
+
+	// Calls to kept tools pass through
+	body = pruned("read_file").WrapStream(io.NopCloser(strings.NewReader(stream)), nil)
+	if out, _ := io.ReadAll(body); string(out) != stream {
+		t.Fatalf("stream = %q, want it unchanged", out)
+	}
+}
@@ -0,0 +1,254 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type exporter interface {
+	export(s *Span)
+	shutdown(ctx context.Context)
+}
+
+// OTLP/JSON encoding of spans
+type otlpValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"` // int64 is a string in OTLP/JSON
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpValue `json:"values"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+func encodeValue(v any) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	case []string:
+		arr := &otlpArrayValue{Values: make([]otlpValue, len(v))}
+		for i, item := range v {
+			arr.Values[i] = encodeValue(item)
+		}
+		return otlpValue{ArrayValue: arr}
+	}
+	s := ""
+	return otlpValue{StringValue: &s}
+}
+
+func encodeSpan(s *Span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, a := range s.attrs {
+		out.Attributes = append(out.Attributes, otlpAttr{Key: a.Key, Value: encodeValue(a.Value)})
+	}
+	if s.failed {
+		out.Status = otlpStatus{Code: 2, Message: s.errorMsg}
+	}
+	return out
+}
+
+func resourceAttrs(service string) []otlpAttr {
+	return []otlpAttr{{Key: "service.name", Value: encodeValue(service)}}
+}
+
+// otlpExporter batches spans and posts them to an OTLP/HTTP collector
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	spans   chan *Span
+	flushed chan chan struct{}
+	once    sync.Once
+}
+
+const (
+	otlpBatchSize     = 256
+	otlpFlushInterval = 2 * time.Second
+)
+
+func newOTLPExporter(endpoint, service string) *otlpExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	e := &otlpExporter{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		spans:   make(chan *Span, 4096),
+		flushed: make(chan chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) export(s *Span) {
+	select {
+	case e.spans <- s:
+	default:
+		// Collector is too slow; drop rather than block requests
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= otlpBatchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.send(batch)
+				batch = nil
+			}
+		case done := <-e.flushed:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+				if len(batch) >= otlpBatchSize {
+					e.send(batch)
+					batch = nil
+				}
+			}
+			if len(batch) > 0 {
+				e.send(batch)
+				batch = nil
+			}
+			close(done)
+		}
+	}
+}
+
+func (e *otlpExporter) send(batch []*Span) {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = encodeSpan(s)
+	}
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": resourceAttrs(e.service)},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "cliproxy-middleware"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		e.warn(err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		e.warn(resp.Status)
+	}
+}
+
+// warn logs the first export failure only, so a missing collector doesn't flood the log
+func (e *otlpExporter) warn(reason string) {
+	e.once.Do(func() {
+		log.Printf("⚠️  Failed to export traces to %s: %s", e.url, reason)
+	})
+}
+
+func (e *otlpExporter) shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case e.flushed <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// stdoutExporter writes one JSON span per line
+type stdoutExporter struct {
+	service string
+	mu      sync.Mutex
+	enc     *json.Encoder
+}
+
+func newStdoutExporter(service string) *stdoutExporter {
+	return &stdoutExporter{service: service, enc: json.NewEncoder(os.Stdout)}
+}
+
+func (e *stdoutExporter) export(s *Span) {
+	line := struct {
+		Service string `json:"service"`
+		otlpSpan
+	}{e.service, encodeSpan(s)}
+	e.mu.Lock()
+	e.enc.Encode(line)
+	e.mu.Unlock()
+}
+
+func (e *stdoutExporter) shutdown(context.Context) {}
@@ -0,0 +1,192 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEncodeSpan(t *testing.T) {
+	child := &Span{
+		traceID:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		spanID:   [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		parentID: [8]byte{8, 7, 6, 5, 4, 3, 2, 1},
+		name:     "chat gemini-3-flash",
+		kind:     KindClient,
+		start:    time.Unix(1700000000, 5),
+		end:      time.Unix(1700000001, 0),
+		attrs: []Attr{
+			String("gen_ai.system", "anthropic"),
+			Int("gen_ai.request.max_tokens", 1024),
+			Bool("gen_ai.request.stream", true),
+			Float("gen_ai.request.temperature", 0.5),
+			Strings("gen_ai.response.finish_reasons", []string{"end_turn"}),
+			{"http.response.body.size", int64(7)},
+			{"unsupported", struct{}{}},
+		},
+		failed:   true,
+		errorMsg: "502 Bad Gateway",
+	}
+	root := &Span{
+		traceID: child.traceID,
+		spanID:  child.parentID,
+		name:    "POST /v1/messages",
+		kind:    KindServer,
+		start:   time.Unix(1700000000, 0),
+		end:     time.Unix(1700000002, 0),
+	}
+
+	for _, tc := range []struct {
+		name string
+		span *Span
+		want string
+	}{
+		{"child", child, `{"traceId":"0102030405060708090a0b0c0d0e0f10","spanId":"0102030405060708","parentSpanId":"0807060504030201",` +
+			`"name":"chat gemini-3-flash","kind":3,"startTimeUnixNano":"1700000000000000005","endTimeUnixNano":"1700000001000000000",` +
+			`"attributes":[{"key":"gen_ai.system","value":{"stringValue":"anthropic"}},` +
+			`{"key":"gen_ai.request.max_tokens","value":{"intValue":"1024"}},` +
+			`{"key":"gen_ai.request.stream","value":{"boolValue":true}},` +
+			`{"key":"gen_ai.request.temperature","value":{"doubleValue":0.5}},` +
+			`{"key":"gen_ai.response.finish_reasons","value":{"arrayValue":{"values":[{"stringValue":"end_turn"}]}}},` +
+			`{"key":"http.response.body.size","value":{"intValue":"7"}},` +
+			`{"key":"unsupported","value":{"stringValue":""}}],` +
+			`"status":{"code":2,"message":"502 Bad Gateway"}}`},
+		{"root", root, `{"traceId":"0102030405060708090a0b0c0d0e0f10","spanId":"0807060504030201",` +
+			`"name":"POST /v1/messages","kind":2,"startTimeUnixNano":"1700000000000000000","endTimeUnixNano":"1700000002000000000",` +
+			`"status":{"code":0}}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := json.Marshal(encodeSpan(tc.span))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("encoded span\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+// collector is an OTLP/HTTP endpoint that records the batches it receives
+type collector struct {
+	mu      sync.Mutex
+	paths   []string
+	batches [][]otlpSpan
+	service string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttr `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, r.URL.Path)
+	for _, rs := range payload.ResourceSpans {
+		c.service = *rs.Resource.Attributes[0].Value.StringValue
+		for _, ss := range rs.ScopeSpans {
+			c.batches = append(c.batches, ss.Spans)
+		}
+	}
+}
+
+func testSpan(name string) *Span {
+	return &Span{name: name, kind: KindInternal, start: time.Now(), end: time.Now()}
+}
+
+func TestOTLPExporterBatches(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	e := newOTLPExporter(srv.URL+"/", "cliproxy-middleware")
+	for range otlpBatchSize + 1 {
+		e.export(testSpan("work"))
+	}
+	e.shutdown(context.Background())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A full batch goes out at once and shutdown flushes the rest
+	if len(c.batches) != 2 || len(c.batches[0]) != otlpBatchSize || len(c.batches[1]) != 1 {
+		sizes := make([]int, len(c.batches))
+		for i, b := range c.batches {
+			sizes[i] = len(b)
+		}
+		t.Fatalf("batch sizes = %v, want [%d 1]", sizes, otlpBatchSize)
+	}
+	if c.paths[0] != "/v1/traces" || c.service != "cliproxy-middleware" {
+		t.Fatalf("posted to %s for service %q", c.paths[0], c.service)
+	}
+	if span := c.batches[1][0]; span.Name != "work" || span.Kind != KindInternal {
+		t.Fatalf("exported span = %+v", span)
+	}
+}
+
+func TestOTLPExporterURL(t *testing.T) {
+	for endpoint, want := range map[string]string{
+		"http://127.0.0.1:4318":            "http://127.0.0.1:4318/v1/traces",
+		"http://127.0.0.1:4318/":           "http://127.0.0.1:4318/v1/traces",
+		"http://collector/v1/traces":       "http://collector/v1/traces",
+		"http://collector/otlp/v1/traces/": "http://collector/otlp/v1/traces",
+	} {
+		if got := newOTLPExporter(endpoint, "svc").url; got != want {
+			t.Errorf("url for %s = %s, want %s", endpoint, got, want)
+		}
+	}
+}
+
+func TestOTLPExporterWarnsOnce(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "collector down", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	e := newOTLPExporter(srv.URL, "svc")
+	for range 2 {
+		e.export(testSpan("work"))
+		e.shutdown(context.Background())
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("collector called %d times, want every batch sent", calls.Load())
+	}
+	if n := strings.Count(logged.String(), "Failed to export traces"); n != 1 || !strings.Contains(logged.String(), "500 Internal Server Error") {
+		t.Fatalf("log = %q, want one warning with the status", logged.String())
+	}
+
+	// An unreachable collector drops the batch without blocking shutdown
+	srv.Close()
+	e.export(testSpan("work"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e.shutdown(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("shutdown blocked on an unreachable collector")
+	}
+}
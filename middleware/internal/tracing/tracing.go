@@ -0,0 +1,219 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, numbered as in OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Attr is a span attribute. Value is a string, bool, int, int64, float64 or []string.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// String, Int, Bool, Float and Strings build attributes
+func String(key, value string) Attr       { return Attr{key, value} }
+func Int(key string, value int) Attr      { return Attr{key, value} }
+func Bool(key string, value bool) Attr    { return Attr{key, value} }
+func Float(key string, v float64) Attr    { return Attr{key, v} }
+func Strings(key string, v []string) Attr { return Attr{key, v} }
+
+// Span is one timed operation. A nil *Span is valid and records nothing, so
+// callers never need to check whether tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu       sync.Mutex
+	end      time.Time
+	attrs    []Attr
+	errorMsg string
+	failed   bool
+	ended    bool
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed = true
+	s.errorMsg = message
+	s.mu.Unlock()
+}
+
+// End finishes the span and hands it to the exporter. Later calls are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.exporter.export(s)
+}
+
+// Traceparent returns the W3C traceparent header value identifying this span
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// TraceID returns the hex trace ID, for correlating logs with traces
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// Tracer creates spans and exports them when they end
+type Tracer struct {
+	service  string
+	exporter exporter
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultTracer *Tracer
+)
+
+// Setup installs the tracer used by Start. exporterName is "otlp" (OTLP/HTTP
+// JSON to endpoint), "stdout" (one JSON span per line) or "none".
+func Setup(exporterName, endpoint, service string) error {
+	var exp exporter
+	switch exporterName {
+	case "", "none":
+		return nil
+	case "otlp":
+		exp = newOTLPExporter(endpoint, service)
+	case "stdout":
+		exp = newStdoutExporter(service)
+	default:
+		return fmt.Errorf("unknown trace exporter %q: expected otlp, stdout or none", exporterName)
+	}
+	defaultMu.Lock()
+	defaultTracer = &Tracer{service: service, exporter: exp}
+	defaultMu.Unlock()
+	return nil
+}
+
+// Shutdown flushes spans that have not been exported yet
+func Shutdown(ctx context.Context) {
+	defaultMu.RLock()
+	t := defaultTracer
+	defaultMu.RUnlock()
+	if t != nil {
+		t.exporter.shutdown(ctx)
+	}
+}
+
+// Enabled reports whether spans are recorded
+func Enabled() bool {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultTracer != nil
+}
+
+type spanKey struct{}
+
+// remoteParent is a span context received from a caller
+type remoteParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+type remoteKey struct{}
+
+// SpanFrom returns the current span in ctx, or nil
+func SpanFrom(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start begins a span as a child of the span in ctx (or of a remote parent
+// extracted from the incoming request) and returns a context carrying it
+func Start(ctx context.Context, name string, kind int, attrs ...Attr) (context.Context, *Span) {
+	defaultMu.RLock()
+	t := defaultTracer
+	defaultMu.RUnlock()
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	rand.Read(s.spanID[:])
+	if parent := SpanFrom(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(remoteParent); ok {
+		s.traceID = remote.traceID
+		s.parentID = remote.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Extract returns ctx with the caller's trace context from a traceparent
+// header, so the server span joins the caller's trace
+func Extract(ctx context.Context, h http.Header) context.Context {
+	parts := strings.Split(h.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	var remote remoteParent
+	if _, err := hex.Decode(remote.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(remote.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	if remote.traceID == [16]byte{} || remote.spanID == [8]byte{} {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, remote)
+}
+
+// Inject sets the traceparent header for the span in ctx
+func Inject(ctx context.Context, h http.Header) {
+	if s := SpanFrom(ctx); s != nil {
+		h.Set("traceparent", s.Traceparent())
+	}
+}
@@ -0,0 +1,172 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+// recorder is an exporter that keeps ended spans in memory
+type recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) export(s *Span) {
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+}
+
+func (r *recorder) shutdown(context.Context) {}
+
+func (r *recorder) named(name string) *Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.spans {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// record installs a tracer that exports to a recorder for the test
+func record(t *testing.T) *recorder {
+	rec := &recorder{}
+	defaultMu.Lock()
+	defaultTracer = &Tracer{service: "test", exporter: rec}
+	defaultMu.Unlock()
+	t.Cleanup(func() {
+		defaultMu.Lock()
+		defaultTracer = nil
+		defaultMu.Unlock()
+	})
+	return rec
+}
+
+func TestExtract(t *testing.T) {
+	record(t)
+	const traceID, spanID = "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+	for _, tc := range []struct {
+		name, traceparent string
+		wantJoined        bool
+	}{
+		{"valid", "00-" + traceID + "-" + spanID + "-01", true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true},
+		{"missing", "", false},
+		{"too few parts", "00-" + traceID + "-" + spanID, false},
+		{"short trace ID", "00-" + traceID[2:] + "-" + spanID + "-01", false},
+		{"short span ID", "00-" + traceID + "-" + spanID[2:] + "-01", false},
+		{"not hex", "00-" + strings.Repeat("z", 32) + "-" + spanID + "-01", false},
+		{"zero trace ID", "00-" + strings.Repeat("0", 32) + "-" + spanID + "-01", false},
+		{"zero span ID", "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			if tc.traceparent != "" {
+				h.Set("traceparent", tc.traceparent)
+			}
+			_, span := Start(Extract(context.Background(), h), "server", KindServer)
+			joined := span.TraceID() == traceID && hex.EncodeToString(span.parentID[:]) == spanID
+			if joined != tc.wantJoined {
+				t.Fatalf("span trace %s parent %x, joined = %v, want %v", span.TraceID(), span.parentID, joined, tc.wantJoined)
+			}
+			if !tc.wantJoined && span.parentID != [8]byte{} {
+				t.Fatalf("root span has parent %x", span.parentID)
+			}
+		})
+	}
+}
+
+func TestStartAndInject(t *testing.T) {
+	record(t)
+	ctx, parent := Start(context.Background(), "server", KindServer)
+	ctx, child := Start(ctx, "client", KindClient)
+	if child.traceID != parent.traceID || child.parentID != parent.spanID || child.spanID == parent.spanID {
+		t.Fatalf("child trace %x parent %x, want trace %x parent %x", child.traceID, child.parentID, parent.traceID, parent.spanID)
+	}
+
+	h := http.Header{}
+	Inject(ctx, h)
+	want := "00-" + parent.TraceID() + "-" + hex.EncodeToString(child.spanID[:]) + "-01"
+	if got := h.Get("traceparent"); got != want {
+		t.Fatalf("traceparent = %q, want %q", got, want)
+	}
+	// A traceparent round-trips to the same span context
+	_, next := Start(Extract(context.Background(), h), "next hop", KindServer)
+	if next.traceID != child.traceID || next.parentID != child.spanID {
+		t.Fatalf("next hop trace %x parent %x, want %x %x", next.traceID, next.parentID, child.traceID, child.spanID)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, span := Start(context.Background(), "server", KindServer)
+	if span != nil || SpanFrom(ctx) != nil {
+		t.Fatal("span started without a tracer")
+	}
+	// A nil span is safe to use
+	span.SetAttributes(String("k", "v"))
+	span.SetError("boom")
+	span.End()
+	h := http.Header{}
+	Inject(ctx, h)
+	if span.Traceparent() != "" || span.TraceID() != "" || h.Get("traceparent") != "" {
+		t.Fatal("nil span produced a trace context")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestTransportPropagates(t *testing.T) {
+	rec := record(t)
+	ctx, server := Start(context.Background(), "server", KindServer)
+	info := &reqinfo.Info{ResponseModel: "gemini-3-flash", FinishReason: "end_turn", InputTokens: 12}
+	ctx = reqinfo.With(ctx, info)
+
+	var sent string
+	rt := &Transport{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req.Header.Get("traceparent")
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+	})}
+	body := `{"model":"gemini-3-flash","max_tokens":1024,"temperature":0.5}`
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://upstream:8317/v1/messages", strings.NewReader(body))
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	client := rec.named("chat gemini-3-flash")
+	if client == nil || client.kind != KindClient || client.parentID != server.spanID {
+		t.Fatalf("client span = %+v, want a child of the server span", client)
+	}
+	if want := client.Traceparent(); sent != want {
+		t.Fatalf("upstream traceparent = %q, want the client span %q", sent, want)
+	}
+	if req.Header.Get("traceparent") != "" {
+		t.Fatal("traceparent set on the caller's request headers")
+	}
+	for _, name := range []string{"first byte", "stream completion"} {
+		if s := rec.named(name); s == nil || s.parentID != client.spanID {
+			t.Fatalf("%s span = %+v, want a child of the client span", name, s)
+		}
+	}
+	got := make(map[string]any)
+	for _, a := range client.attrs {
+		got[a.Key] = a.Value
+	}
+	if got["gen_ai.request.max_tokens"] != 1024 || got["gen_ai.request.temperature"] != 0.5 ||
+		got["http.response.status_code"] != 200 || got["gen_ai.usage.input_tokens"] != 12 {
+		t.Fatalf("client span attributes = %v", got)
+	}
+}
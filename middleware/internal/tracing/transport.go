@@ -0,0 +1,210 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"cliproxy-middleware/internal/reqinfo"
+)
+
+// maxPeekBytes bounds how much of a request body is parsed for attributes
+const maxPeekBytes = 4 << 20
+
+// Transport records each upstream call as a client span following the
+// OpenTelemetry GenAI conventions and passes the trace on via traceparent.
+// The span lasts until the response body is closed, with child spans for the
+// time to the first body byte and for the rest of the stream.
+type Transport struct {
+	Transport http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !Enabled() {
+		return t.Transport.RoundTrip(req)
+	}
+
+	info := reqinfo.From(req.Context())
+	operation, attrs := requestAttrs(req)
+	name := req.Method + " " + req.URL.Path
+	if operation != "" {
+		name = operation
+		if model := requestModel(attrs); model != "" {
+			name += " " + model
+		}
+	}
+
+	ctx, span := Start(req.Context(), name, KindClient, attrs...)
+	_, firstByte := Start(ctx, "first byte", KindInternal)
+	req = req.WithContext(ctx)
+	req.Header = req.Header.Clone()
+	Inject(ctx, req.Header)
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		firstByte.SetError(err.Error())
+		firstByte.End()
+		span.SetError(err.Error())
+		span.End()
+		return nil, err
+	}
+
+	span.SetAttributes(Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetError(resp.Status)
+	}
+	resp.Body = &tracedBody{body: resp.Body, ctx: ctx, span: span, firstByte: firstByte, info: info}
+	return resp, nil
+}
+
+// tracedBody ends the upstream spans as the response is read and closed
+type tracedBody struct {
+	body      io.ReadCloser
+	ctx       context.Context
+	span      *Span
+	firstByte *Span
+	stream    *Span
+	info      *reqinfo.Info
+	bytes     int
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 && b.stream == nil {
+		b.firstByte.End()
+		_, b.stream = Start(b.ctx, "stream completion", KindInternal)
+	}
+	b.bytes += n
+	if err != nil && err != io.EOF {
+		b.stream.SetError(err.Error())
+		b.span.SetError(err.Error())
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	err := b.body.Close()
+	b.firstByte.End()
+	b.stream.SetAttributes(Int("http.response.body.size", b.bytes))
+	b.stream.End()
+	b.span.SetAttributes(responseAttrs(b.info)...)
+	b.span.End()
+	return err
+}
+
+// requestAttrs derives the GenAI operation and request attributes from an
+// upstream request. operation is empty for calls that aren't model calls.
+func requestAttrs(req *http.Request) (string, []Attr) {
+	attrs := []Attr{
+		String("http.request.method", req.Method),
+		String("server.address", req.URL.Hostname()),
+		String("url.path", req.URL.Path),
+	}
+
+	var operation, system string
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/messages/count_tokens"):
+		operation, system = "count_tokens", "anthropic"
+	case strings.HasSuffix(req.URL.Path, "/messages"):
+		operation, system = "chat", "anthropic"
+	case strings.HasSuffix(req.URL.Path, "/chat/completions"):
+		operation, system = "chat", "openai"
+	default:
+		return "", attrs
+	}
+	attrs = append(attrs, String("gen_ai.operation.name", operation), String("gen_ai.system", system))
+
+	var params struct {
+		Model               string   `json:"model"`
+		MaxTokens           *int     `json:"max_tokens"`
+		MaxCompletionTokens *int     `json:"max_completion_tokens"`
+		Temperature         *float64 `json:"temperature"`
+		TopP                *float64 `json:"top_p"`
+		TopK                *int     `json:"top_k"`
+		Stream              bool     `json:"stream"`
+	}
+	if body := peekBody(req); body != nil {
+		json.Unmarshal(body, &params)
+	}
+	if params.Model != "" {
+		attrs = append(attrs, String("gen_ai.request.model", params.Model))
+	}
+	if params.MaxTokens == nil {
+		params.MaxTokens = params.MaxCompletionTokens
+	}
+	if params.MaxTokens != nil {
+		attrs = append(attrs, Int("gen_ai.request.max_tokens", *params.MaxTokens))
+	}
+	if params.Temperature != nil {
+		attrs = append(attrs, Float("gen_ai.request.temperature", *params.Temperature))
+	}
+	if params.TopP != nil {
+		attrs = append(attrs, Float("gen_ai.request.top_p", *params.TopP))
+	}
+	if params.TopK != nil {
+		attrs = append(attrs, Int("gen_ai.request.top_k", *params.TopK))
+	}
+	if operation == "chat" {
+		attrs = append(attrs, Bool("gen_ai.request.stream", params.Stream))
+	}
+	return operation, attrs
+}
+
+func requestModel(attrs []Attr) string {
+	for _, a := range attrs {
+		if a.Key == "gen_ai.request.model" {
+			return a.Value.(string)
+		}
+	}
+	return ""
+}
+
+// peekBody returns the request body without consuming it
+func peekBody(req *http.Request) []byte {
+	if req.Body == nil || req.ContentLength > maxPeekBytes {
+		return nil
+	}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil
+		}
+		defer rc.Close()
+		body, _ := io.ReadAll(rc)
+		return body
+	}
+	body, _ := io.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+// responseAttrs reports what the handlers learned from the response
+func responseAttrs(info *reqinfo.Info) []Attr {
+	var attrs []Attr
+	if info.ResponseID != "" {
+		attrs = append(attrs, String("gen_ai.response.id", info.ResponseID))
+	}
+	if info.ResponseModel != "" {
+		attrs = append(attrs, String("gen_ai.response.model", info.ResponseModel))
+	}
+	if info.FinishReason != "" {
+		attrs = append(attrs, Strings("gen_ai.response.finish_reasons", []string{info.FinishReason}))
+	}
+	if info.InputTokens > 0 {
+		attrs = append(attrs, Int("gen_ai.usage.input_tokens", info.InputTokens))
+	}
+	if info.OutputTokens > 0 {
+		attrs = append(attrs, Int("gen_ai.usage.output_tokens", info.OutputTokens))
+	}
+	if info.CacheReadInputTokens > 0 {
+		attrs = append(attrs, Int("gen_ai.usage.cache_read_input_tokens", info.CacheReadInputTokens))
+	}
+	if info.CacheCreationInputTokens > 0 {
+		attrs = append(attrs, Int("gen_ai.usage.cache_creation_input_tokens", info.CacheCreationInputTokens))
+	}
+	return attrs
+}
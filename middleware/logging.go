@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/reqinfo"
+	"cliproxy-middleware/internal/tracing"
+)
+
+// setupLogging installs the default slog logger. Plain log.Printf calls are
+// routed through it too, so every line comes out in the configured format.
+func setupLogging(cfg *config.Config) {
+	level := slog.LevelInfo
+	if cfg.Debug {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	log.SetFlags(0)
+}
+
+// requestID returns the client's X-Request-ID if it is safe to reuse, or a
+// new random ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); validRequestID(id) {
+		return id
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// beginRequest attaches fresh request info with an ID to r and echoes the ID
+// in the response headers
+func beginRequest(w http.ResponseWriter, r *http.Request) (*http.Request, *reqinfo.Info) {
+	info := &reqinfo.Info{ID: requestID(r), Start: time.Now()}
+	w.Header().Set("X-Request-ID", info.ID)
+	return r.WithContext(reqinfo.With(r.Context(), info)), info
+}
+
+// maxErrorBody bounds how much of an error response is kept for the dashboard
+const maxErrorBody = 8 << 10
+
+// statusRecorder remembers the response status for the request log, and the
+// start of the body of error responses for the dashboard
+type statusRecorder struct {
+	http.ResponseWriter
+	status    int
+	errorBody []byte
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	if sr.status >= http.StatusBadRequest && len(sr.errorBody) < maxErrorBody {
+		sr.errorBody = append(sr.errorBody, p[:min(len(p), maxErrorBody-len(sr.errorBody))]...)
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logRequest writes the one-line summary of a finished request
+func logRequest(r *http.Request, info *reqinfo.Info, status int) {
+	attrs := []slog.Attr{
+		slog.String("request_id", info.ID),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("client", info.ClientID()),
+		slog.Int("status", status),
+		slog.Int64("latency_ms", time.Since(info.Start).Milliseconds()),
+	}
+	if info.RequestedModel != "" {
+		attrs = append(attrs,
+			slog.String("requested_model", info.RequestedModel),
+			slog.String("mapped_model", info.MappedModel),
+			slog.Bool("stream", info.Stream))
+	}
+	if !info.FirstToken.IsZero() {
+		attrs = append(attrs, slog.Int64("ttft_ms", info.FirstToken.Sub(info.Start).Milliseconds()))
+	}
+	if info.InputTokens > 0 || info.OutputTokens > 0 {
+		attrs = append(attrs,
+			slog.Int("input_tokens", info.InputTokens),
+			slog.Int("output_tokens", info.OutputTokens))
+	}
+	if info.CacheCreationInputTokens > 0 || info.CacheReadInputTokens > 0 {
+		attrs = append(attrs,
+			slog.Int("cache_creation_input_tokens", info.CacheCreationInputTokens),
+			slog.Int("cache_read_input_tokens", info.CacheReadInputTokens))
+	}
+	if info.CacheHit {
+		attrs = append(attrs, slog.Bool("cache_hit", true))
+	}
+	if info.SchemasNormalized > 0 {
+		attrs = append(attrs, slog.Int("schemas_normalized", info.SchemasNormalized))
+	}
+	if span := tracing.SpanFrom(r.Context()); span != nil {
+		attrs = append(attrs, slog.String("trace_id", span.TraceID()))
+	}
+
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelWarn
+	}
+	slog.LogAttrs(r.Context(), level, "request", attrs...)
+}
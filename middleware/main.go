@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
@@ -13,9 +16,24 @@ import (
 	"syscall"
 	"time"
 
+	"cliproxy-middleware/internal/apierror"
+	"cliproxy-middleware/internal/auth"
+	"cliproxy-middleware/internal/breaker"
+	"cliproxy-middleware/internal/capture"
 	"cliproxy-middleware/internal/config"
+	"cliproxy-middleware/internal/dashboard"
 	"cliproxy-middleware/internal/handlers"
+	"cliproxy-middleware/internal/limiter"
+	"cliproxy-middleware/internal/listener"
+	"cliproxy-middleware/internal/metrics"
+	"cliproxy-middleware/internal/models"
 	"cliproxy-middleware/internal/proxy"
+	"cliproxy-middleware/internal/ratelimit"
+	"cliproxy-middleware/internal/replay"
+	"cliproxy-middleware/internal/reqinfo"
+	"cliproxy-middleware/internal/respcache"
+	"cliproxy-middleware/internal/thinking"
+	"cliproxy-middleware/internal/tracing"
 )
 
 // Server wraps the HTTP server with health tracking
@@ -23,6 +41,12 @@ type Server struct {
 	httpServer     *http.Server
 	proxy          *httputil.ReverseProxy
 	cfg            *config.Config
+	breaker        *breaker.Breaker
+	limiter        *limiter.Limiter
+	capturer       *capture.Capturer
+	dashboard      *dashboard.Dashboard
+	rateLimiter    *ratelimit.Limiter
+	keys           *auth.Store
 	healthy        atomic.Bool
 	upstreamHealth atomic.Bool
 	startTime      time.Time
@@ -30,31 +54,102 @@ type Server struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replay.Main(os.Args[2:]))
+	}
+
 	cfg := config.Load()
+	setupLogging(cfg)
+
+	// OpenTelemetry spans for each request and upstream call
+	if err := tracing.Setup(cfg.TraceExporter, cfg.TraceEndpoint, cfg.TraceService); err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	// Circuit breaker shared by the proxy, token counting and health checker
+	brk := breaker.New(cfg.BreakerThreshold, cfg.BreakerCooldown)
+
+	// Concurrency cap with fair per-client queuing
+	lim := limiter.New(cfg.MaxConcurrency, cfg.ModelMaxConcurrency, cfg.QueueTimeout)
+
+	// Client keys accepted by the middleware itself
+	keys, err := auth.Load(cfg.KeysFile)
+	if err != nil {
+		log.Fatalf("Failed to load keys file: %v", err)
+	}
+
+	// Context windows and output limits of upstream models
+	modelCount := 0
+	if cfg.ModelsFile != "" {
+		if modelCount, err = models.LoadFile(cfg.ModelsFile); err != nil {
+			log.Fatalf("Failed to load models file: %v", err)
+		}
+	}
+
+	// Which model signed each thinking block, kept across restarts
+	if cfg.ThinkingSignaturesFile != "" {
+		if _, err := thinking.LoadSignatures(cfg.ThinkingSignaturesFile); err != nil {
+			log.Printf("⚠️  Failed to load thinking signatures, starting empty: %v", err)
+		}
+		go saveSignatures()
+	}
+
+	// Per-client quotas, with token budgets debited from tracked usage
+	rl := ratelimit.New(cfg.RateLimitRPM, cfg.RateLimitTokensDay)
+	handlers.OnUsage(func(client string, usage *handlers.AnthropicUsage) {
+		rl.Debit(client, usage.Total())
+	})
+
+	// Opt-in request/response capture
+	capturer, err := capture.New(cfg.CaptureDir, cfg.CaptureMaxFiles, cfg.CaptureMaxBody, cfg.CapturePaths, cfg.CaptureModels)
+	if err != nil {
+		log.Fatalf("Failed to create capture directory: %v", err)
+	}
+
+	// Opt-in cache for count_tokens and temperature 0 completions
+	respCache, err := respcache.New(cfg.ResponseCache, cfg.ResponseCacheDir, cfg.ResponseCacheTTL,
+		cfg.ResponseCacheMaxBytes, cfg.ResponseCacheMaxEntryBytes)
+	if err != nil {
+		log.Fatalf("Failed to create response cache: %v", err)
+	}
 
 	// Create reverse proxy with connection pooling
-	reverseProxy, err := proxy.NewWithPool(cfg)
+	reverseProxy, err := proxy.NewWithPool(cfg, brk, lim)
 	if err != nil {
 		log.Fatalf("Failed to create proxy: %v", err)
 	}
 
+	// Captures hold full prompts and tool output; the dashboard only serves
+	// them when admin keys protect it
+	dashboardCaptures := capturer
+	if !keys.Enabled() {
+		dashboardCaptures = nil
+	}
+
 	srv := &Server{
-		proxy:     reverseProxy,
-		cfg:       cfg,
-		startTime: time.Now(),
+		proxy:       reverseProxy,
+		cfg:         cfg,
+		breaker:     brk,
+		limiter:     lim,
+		capturer:    capturer,
+		dashboard:   dashboard.New(dashboardCaptures),
+		rateLimiter: rl,
+		keys:        keys,
+		startTime:   time.Now(),
 	}
 	srv.healthy.Store(true)
 	srv.upstreamHealth.Store(false)
+	srv.registerMetrics()
 
 	// Setup routes
 	mux := http.NewServeMux()
 
 	// Anthropic-style endpoints
-	mux.HandleFunc("/v1/messages/count_tokens", srv.wrapHandler(handlers.TokenCount(cfg, reverseProxy)))
-	mux.HandleFunc("/v1/messages", srv.wrapHandler(handlers.Messages(cfg, reverseProxy)))
+	mux.HandleFunc("/v1/messages/count_tokens", srv.wrapHandler(auth.ScopeCountTokens, respCache.Wrap(handlers.TokenCount(cfg, reverseProxy, brk))))
+	mux.HandleFunc("/v1/messages", srv.wrapHandler(auth.ScopeMessages, respCache.Wrap(handlers.Messages(cfg, reverseProxy))))
 
 	// OpenAI-style endpoints
-	mux.HandleFunc("/v1/chat/completions", srv.wrapHandler(handlers.ChatCompletions(cfg, reverseProxy)))
+	mux.HandleFunc("/v1/chat/completions", srv.wrapHandler(auth.ScopeChat, respCache.Wrap(handlers.ChatCompletions(cfg, reverseProxy))))
 
 	// Health and metrics
 	mux.HandleFunc("/health", srv.healthHandler())
@@ -63,13 +158,22 @@ func main() {
 	mux.HandleFunc("/metrics", srv.metricsHandler())
 	mux.HandleFunc("/usage", srv.usageHandler())
 
+	// Dashboard
+	ui := srv.dashboard.Handler(srv.authorizeAdmin, srv.dashboardStatus)
+	mux.Handle("/ui", ui)
+	mux.Handle("/ui/", ui)
+
 	// Default handler
 	mux.HandleFunc("/", srv.defaultHandler())
 
+	// Bind TCP (optionally TLS) and Unix socket listeners
+	listeners, err := listener.Open(cfg)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
 	// Configure server with optimized timeouts
-	addr := fmt.Sprintf(":%d", cfg.Port)
 	srv.httpServer = &http.Server{
-		Addr:              addr,
 		Handler:           mux,
 		ReadTimeout:       30 * time.Second,
 		ReadHeaderTimeout: 10 * time.Second,
@@ -83,17 +187,46 @@ func main() {
 
 	// Start server in goroutine
 	go func() {
-		log.Printf("🚀 CLIProxy Middleware starting on http://127.0.0.1%s", addr)
+		for _, ln := range listeners {
+			log.Printf("🚀 CLIProxy Middleware starting on %s", ln.URL)
+		}
 		log.Printf("   Upstream: %s", cfg.UpstreamURL)
 		log.Printf("   Endpoints: /v1/messages (Anthropic), /v1/chat/completions (OpenAI)")
 		log.Printf("   Features: token counting, schema normalization, usage tracking")
-		log.Printf("   Health: /health, /metrics, /usage")
+		log.Printf("   Health: /health, /metrics, /usage, /ui (dashboard)")
+		if keys.Enabled() {
+			log.Printf("   Auth: %d client keys from %s", keys.Len(), cfg.KeysFile)
+		} else if rl.Enabled() {
+			log.Printf("⚠️  Rate limits apply per presented API key; without -keys-file clients can evade them by changing keys")
+		}
+		if modelCount > 0 {
+			log.Printf("   Models: %d capability entries from %s", modelCount, cfg.ModelsFile)
+		}
+		if capturer.Enabled() {
+			log.Printf("   Capture: writing requests to %s", capturer.Dir())
+		}
+		switch cfg.ResponseCache {
+		case "memory":
+			log.Printf("   Response cache: in memory, TTL %s", cfg.ResponseCacheTTL)
+		case "disk":
+			log.Printf("   Response cache: %s, TTL %s", cfg.ResponseCacheDir, cfg.ResponseCacheTTL)
+		}
+		switch cfg.TraceExporter {
+		case "otlp":
+			log.Printf("   Tracing: exporting to %s", cfg.TraceEndpoint)
+		case "stdout":
+			log.Printf("   Tracing: writing spans to stdout")
+		}
 		if cfg.Debug {
 			log.Printf("   Debug mode: enabled")
 		}
 
-		if err := srv.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+		for _, ln := range listeners {
+			go func(ln *listener.Listener) {
+				if err := srv.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+					log.Fatalf("Server error on %s: %v", ln.URL, err)
+				}
+			}(ln)
 		}
 	}()
 
@@ -101,17 +234,118 @@ func main() {
 	srv.waitForShutdown()
 }
 
-// wrapHandler adds request counting and logging
-func (s *Server) wrapHandler(h http.HandlerFunc) http.HandlerFunc {
+// track sets up per-request state, logging, metrics, tracing and the dashboard
+// feed. The returned writer and request replace w and r; done must be called
+// when the request is finished.
+func (s *Server) track(endpoint string, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	r, info := beginRequest(w, r)
+	r, span := startServerSpan(endpoint, r)
+	rec := &statusRecorder{ResponseWriter: w}
+	metrics.InFlight.Inc(endpoint)
+	s.dashboard.Begin(info, r.Method, r.URL.Path)
+	return rec, r, func() {
+		metrics.InFlight.Dec(endpoint)
+		metrics.ObserveRequest(endpoint, info, rec.status)
+		logRequest(r, info, rec.status)
+		endServerSpan(span, info, rec.status)
+		s.dashboard.Finish(info, r.Method, r.URL.Path, rec.status, rec.errorBody)
+	}
+}
+
+// capture starts capturing an authenticated request. Call the returned
+// function when the response is complete.
+func (s *Server) capture(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	w, r, captured := s.capturer.Begin(w, r)
+	return w, r, func() {
+		s.capturer.Finish(captured, reqinfo.From(r.Context()))
+	}
+}
+
+// wrapHandler adds request IDs, counting, logging, authentication, per-client
+// quotas and per-request state. scope is the key scope the route requires.
+func (s *Server) wrapHandler(scope string, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		w, r, done := s.track(r.URL.Path, w, r)
+		defer done()
+
 		s.requestCount.Add(1)
 		if s.cfg.LogRequests {
-			log.Printf("[%s] %s %s", r.Method, r.URL.Path, r.RemoteAddr)
+			reqinfo.Logger(r.Context()).Info("received", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+		}
+
+		if !s.authenticate(w, r, scope) {
+			return
+		}
+		w, r, finish := s.capture(w, r)
+		defer finish()
+
+		info := reqinfo.From(r.Context())
+		if ok, retryAfter, reason := s.rateLimiter.Allow(info.ClientID()); !ok {
+			reqinfo.Logger(r.Context()).Warn("rate limited", "client", info.ClientID(), "reason", reason)
+			apierror.Write(w, r, apierror.RateLimit("Rate limit exceeded: "+reason, retryAfter))
+			return
 		}
+
 		h(w, r)
 	}
 }
 
+// authenticate checks the client key for scope and swaps in the upstream key.
+// It records the client identity in the request info and writes an error
+// response if the request must not proceed.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, scope string) bool {
+	info := reqinfo.From(r.Context())
+	if !s.keys.Enabled() {
+		// Without a keys file, requests pass through with their own credentials.
+		// Admin endpoints have nothing to check, so they are only served on
+		// loopback and Unix socket listeners.
+		if scope == auth.ScopeAdmin && !localListener(r) {
+			reqinfo.Logger(r.Context()).Warn("rejected", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "reason", "admin endpoint on a public listener")
+			apierror.Write(w, r, apierror.Permission("Admin endpoints are only served on loopback and Unix socket listeners unless -keys-file is set"))
+			return false
+		}
+		info.Client = clientID(r)
+		return true
+	}
+
+	key, message, forbidden := s.keys.Authenticate(r, scope)
+	if key == nil {
+		reqinfo.Logger(r.Context()).Warn("rejected", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "reason", message)
+		if forbidden {
+			apierror.Write(w, r, apierror.Permission(message))
+		} else {
+			apierror.Write(w, r, apierror.Authentication(message))
+		}
+		return false
+	}
+
+	info.Client = key.Name
+	auth.SetUpstreamKey(r, s.cfg.APIKey)
+	return true
+}
+
+// localListener reports whether the request arrived on a loopback or Unix
+// socket listener
+func localListener(r *http.Request) bool {
+	switch addr := r.Context().Value(http.LocalAddrContextKey).(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	}
+	return false
+}
+
+// clientID derives a stable, non-secret client identity from the request's API key
+func clientID(r *http.Request) string {
+	key := auth.PresentedKey(r)
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
 // healthHandler returns basic health status
 func (s *Server) healthHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -127,8 +361,13 @@ func (s *Server) healthHandler() http.HandlerFunc {
 		}
 
 		w.WriteHeader(httpStatus)
-		fmt.Fprintf(w, `{"status":"%s","uptime":"%s","requests":%d,"upstream_healthy":%t}`,
-			status, uptime, s.requestCount.Load(), s.upstreamHealth.Load())
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":           status,
+			"uptime":           uptime.String(),
+			"requests":         s.requestCount.Load(),
+			"upstream_healthy": s.upstreamHealth.Load(),
+			"circuit_breaker":  s.breaker.Snapshot(),
+		})
 	}
 }
 
@@ -157,32 +396,108 @@ func (s *Server) readinessHandler() http.HandlerFunc {
 	}
 }
 
-// metricsHandler returns prometheus-style metrics
+// metricsHandler serves Prometheus metrics
 func (s *Server) metricsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.Default.Write(w)
+	}
+}
 
-		uptime := time.Since(s.startTime).Seconds()
-		upstreamUp := 0
+// registerMetrics exposes state tracked elsewhere (uptime, upstream health,
+// breaker, limiter, hedging) as metrics read at scrape time
+func (s *Server) registerMetrics() {
+	gauge := func(name, help string, value func() float64) {
+		metrics.NewGaugeFunc(name, help, nil, func(emit func(float64, ...string)) { emit(value()) })
+	}
+	counter := func(name, help string, value func() float64) {
+		metrics.NewCounterFunc(name, help, nil, func(emit func(float64, ...string)) { emit(value()) })
+	}
+
+	gauge("cliproxy_uptime_seconds", "Time since middleware started", func() float64 {
+		return time.Since(s.startTime).Seconds()
+	})
+	gauge("cliproxy_upstream_up", "Whether upstream is reachable", func() float64 {
 		if s.upstreamHealth.Load() {
-			upstreamUp = 1
+			return 1
 		}
+		return 0
+	})
+
+	gauge("cliproxy_circuit_breaker_state", "Circuit breaker state (0=closed, 1=open, 2=half_open, -1=disabled)", func() float64 {
+		return float64(breakerStateValue(s.breaker.Snapshot().State))
+	})
+	counter("cliproxy_circuit_breaker_trips_total", "Times the circuit breaker has opened", func() float64 {
+		return float64(s.breaker.Snapshot().Trips)
+	})
+	counter("cliproxy_circuit_breaker_rejected_total", "Requests fast-failed by the circuit breaker", func() float64 {
+		return float64(s.breaker.Snapshot().Rejected)
+	})
+
+	metrics.NewGaugeFunc("cliproxy_inflight_requests", "Upstream requests currently holding a concurrency slot, by upstream model",
+		[]string{"model"}, func(emit func(float64, ...string)) {
+			for model, n := range s.limiter.Stats().ModelInFlight {
+				emit(float64(n), model)
+			}
+		})
+	metrics.NewGaugeFunc("cliproxy_queue_depth", "Requests waiting for a free upstream slot, by client",
+		[]string{"client"}, func(emit func(float64, ...string)) {
+			for client, n := range s.limiter.Stats().ClientQueued {
+				emit(float64(n), client)
+			}
+		})
+
+	counter("cliproxy_hedges_fired_total", "Hedge requests sent after the hedge delay", func() float64 {
+		fired, _, _ := proxy.GetHedgeStats()
+		return float64(fired)
+	})
+	counter("cliproxy_hedges_won_total", "Hedge requests that answered before the original", func() float64 {
+		_, won, _ := proxy.GetHedgeStats()
+		return float64(won)
+	})
+	counter("cliproxy_hedges_wasted_total", "Hedge requests canceled because the original answered first", func() float64 {
+		_, _, wasted := proxy.GetHedgeStats()
+		return float64(wasted)
+	})
+}
 
-		fmt.Fprintf(w, "# HELP cliproxy_uptime_seconds Time since middleware started\n")
-		fmt.Fprintf(w, "# TYPE cliproxy_uptime_seconds gauge\n")
-		fmt.Fprintf(w, "cliproxy_uptime_seconds %.2f\n", uptime)
-		fmt.Fprintf(w, "# HELP cliproxy_requests_total Total requests handled\n")
-		fmt.Fprintf(w, "# TYPE cliproxy_requests_total counter\n")
-		fmt.Fprintf(w, "cliproxy_requests_total %d\n", s.requestCount.Load())
-		fmt.Fprintf(w, "# HELP cliproxy_upstream_up Whether upstream is reachable\n")
-		fmt.Fprintf(w, "# TYPE cliproxy_upstream_up gauge\n")
-		fmt.Fprintf(w, "cliproxy_upstream_up %d\n", upstreamUp)
+// breakerStateValue maps a breaker state name to its metric value
+func breakerStateValue(state string) int {
+	switch state {
+	case "closed":
+		return 0
+	case "open":
+		return 1
+	case "half_open":
+		return 2
+	default:
+		return -1
+	}
+}
+
+// authorizeAdmin checks for an admin key when client keys are configured
+func (s *Server) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	r = r.WithContext(reqinfo.With(r.Context(), &reqinfo.Info{}))
+	return s.authenticate(w, r, auth.ScopeAdmin)
+}
+
+// dashboardStatus returns the server-wide values shown in the dashboard header
+func (s *Server) dashboardStatus() map[string]any {
+	return map[string]any{
+		"uptime":           time.Since(s.startTime).Round(time.Second).String(),
+		"requests":         s.requestCount.Load(),
+		"upstream_healthy": s.upstreamHealth.Load(),
+		"circuit_breaker":  s.breaker.Snapshot().State,
 	}
 }
 
 // usageHandler returns token usage statistics
 func (s *Server) usageHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(reqinfo.With(r.Context(), &reqinfo.Info{}))
+		if !s.authenticate(w, r, auth.ScopeAdmin) {
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 
 		// Handle reset request
@@ -193,6 +508,9 @@ func (s *Server) usageHandler() http.HandlerFunc {
 		}
 
 		stats := handlers.GetUsageStats()
+		if s.rateLimiter.Enabled() {
+			stats["quotas"] = s.rateLimiter.Stats()
+		}
 		json.NewEncoder(w).Encode(stats)
 	}
 }
@@ -200,10 +518,19 @@ func (s *Server) usageHandler() http.HandlerFunc {
 // defaultHandler proxies unhandled routes
 func (s *Server) defaultHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		w, r, done := s.track("other", w, r)
+		defer done()
+
 		s.requestCount.Add(1)
 		if s.cfg.LogRequests {
-			log.Printf("[%s] %s %s", r.Method, r.URL.Path, r.RemoteAddr)
+			reqinfo.Logger(r.Context()).Info("received", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
 		}
+		if !s.authenticate(w, r, auth.ScopeProxy) {
+			return
+		}
+		w, r, finish := s.capture(w, r)
+		defer finish()
+
 		if flusher, ok := w.(http.Flusher); ok {
 			s.proxy.ServeHTTP(&flushWriter{w, flusher}, r)
 		} else {
@@ -212,6 +539,15 @@ func (s *Server) defaultHandler() http.HandlerFunc {
 	}
 }
 
+// saveSignatures periodically writes new thinking signature origins
+func saveSignatures() {
+	for range time.Tick(time.Minute) {
+		if err := thinking.SaveSignatures(); err != nil {
+			log.Printf("⚠️  Failed to save thinking signatures: %v", err)
+		}
+	}
+}
+
 // healthChecker periodically checks upstream health
 func (s *Server) healthChecker() {
 	client := &http.Client{Timeout: 5 * time.Second}
@@ -233,8 +569,10 @@ func (s *Server) checkUpstream(client *http.Client) {
 		req.Header.Set("Authorization", "Bearer "+s.cfg.APIKey)
 	}
 
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
+		s.dashboard.RecordHealth(false, time.Since(start), err.Error())
 		if s.upstreamHealth.Load() {
 			log.Printf("⚠️  Upstream became unavailable: %v", err)
 		}
@@ -243,11 +581,15 @@ func (s *Server) checkUpstream(client *http.Client) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+	up := resp.StatusCode >= 200 && resp.StatusCode < 300
+	s.dashboard.RecordHealth(up, time.Since(start), resp.Status)
+	if up {
 		if !s.upstreamHealth.Load() {
 			log.Printf("✅ Upstream is now available")
 		}
 		s.upstreamHealth.Store(true)
+		// Let an open breaker admit a trial request
+		s.breaker.Probe(true)
 	} else {
 		if s.upstreamHealth.Load() {
 			log.Printf("⚠️  Upstream returned status %d", resp.StatusCode)
@@ -278,6 +620,10 @@ func (s *Server) waitForShutdown() {
 	} else {
 		log.Printf("✅ Server shutdown complete")
 	}
+	tracing.Shutdown(ctx)
+	if err := thinking.SaveSignatures(); err != nil {
+		log.Printf("⚠️  Failed to save thinking signatures: %v", err)
+	}
 
 	log.Printf("📊 Final stats: %d requests served, uptime: %s",
 		s.requestCount.Load(), time.Since(s.startTime).Round(time.Second))
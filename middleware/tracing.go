@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+
+	"cliproxy-middleware/internal/reqinfo"
+	"cliproxy-middleware/internal/tracing"
+)
+
+// startServerSpan begins the span covering a whole client request, joining
+// the caller's trace if it sent a traceparent header
+func startServerSpan(endpoint string, r *http.Request) (*http.Request, *tracing.Span) {
+	name := r.Method
+	if endpoint != "other" {
+		name += " " + endpoint
+	}
+	ctx := tracing.Extract(r.Context(), r.Header)
+	ctx, span := tracing.Start(ctx, name, tracing.KindServer,
+		tracing.String("http.request.method", r.Method),
+		tracing.String("url.path", r.URL.Path),
+		tracing.String("client.address", r.RemoteAddr),
+		tracing.String("cliproxy.request_id", reqinfo.From(ctx).ID))
+	return r.WithContext(ctx), span
+}
+
+// endServerSpan records the outcome of the request on its span
+func endServerSpan(span *tracing.Span, info *reqinfo.Info, status int) {
+	span.SetAttributes(
+		tracing.Int("http.response.status_code", status),
+		tracing.String("cliproxy.client", info.ClientID()))
+	if info.RequestedModel != "" {
+		span.SetAttributes(
+			tracing.String("gen_ai.request.model", info.MappedModel),
+			tracing.String("cliproxy.requested_model", info.RequestedModel))
+	}
+	if info.InputTokens > 0 || info.OutputTokens > 0 {
+		span.SetAttributes(
+			tracing.Int("gen_ai.usage.input_tokens", info.InputTokens),
+			tracing.Int("gen_ai.usage.output_tokens", info.OutputTokens))
+	}
+	if status >= http.StatusInternalServerError {
+		span.SetError(http.StatusText(status))
+	}
+	span.End()
+}